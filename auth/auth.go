@@ -17,14 +17,53 @@
 package auth
 
 import (
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Elbandi/ghostunnel/logging"
 	"github.com/Elbandi/ghostunnel/wildcard"
+	"github.com/rcrowley/go-metrics"
 )
 
+var (
+	certAgeHistogram = metrics.GetOrRegisterHistogram("auth.cert.age", metrics.DefaultRegistry, metrics.NewExpDecaySample(1028, 0.015))
+	certAgeCounter   = metrics.GetOrRegisterCounter("auth.cert.age.exceeded", metrics.DefaultRegistry)
+	ekuCounter       = metrics.GetOrRegisterCounter("auth.cert.eku.missing", metrics.DefaultRegistry)
+	sigAlgCounter    = metrics.GetOrRegisterCounter("auth.cert.signature.rejected", metrics.DefaultRegistry)
+)
+
+var (
+	// OID of the extended key usage extension, and of the client auth usage.
+	oidExtKeyUsage        = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtKeyUsageClient  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+	errMissingKeyUsage    = errors.New("unauthorized: certificate lacks required extended key usage")
+	errInvalidKeyUsageExt = errors.New("unauthorized: invalid extended key usage extension")
+	errSignatureAlgorithm = errors.New("unauthorized: certificate signed with disallowed signature algorithm")
+)
+
+// DefaultSignatureAlgorithms are the certificate signature algorithms allowed
+// by default (everything but MD5, SHA-1 and DSA).
+var DefaultSignatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.SHA256WithRSA,
+	x509.SHA384WithRSA,
+	x509.SHA512WithRSA,
+	x509.SHA256WithRSAPSS,
+	x509.SHA384WithRSAPSS,
+	x509.SHA512WithRSAPSS,
+	x509.ECDSAWithSHA256,
+	x509.ECDSAWithSHA384,
+	x509.ECDSAWithSHA512,
+	x509.PureEd25519,
+}
+
 // Logger is used by this package to log messages
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -56,6 +95,24 @@ type ACL struct {
 	// has a valid certificate with at least one of these URI SANs, we grant
 	// access.
 	AllowedURIs []wildcard.Matcher
+	// MaxCertAge limits how old (measured from NotBefore) the leaf certificate
+	// of a principal may be at connection time. Zero means no limit.
+	MaxCertAge time.Duration
+	// MaxCertAgeAuditOnly will only log principals with certificates older
+	// than MaxCertAge instead of denying them access.
+	MaxCertAgeAuditOnly bool
+	// RequireClientEKU requires the leaf certificate of a principal to
+	// explicitly list the client auth extended key usage (or one of
+	// RequiredEKUs, if set). Certificates without the extension, or that only
+	// list the "any" usage, are rejected.
+	RequireClientEKU bool
+	// RequiredEKUs lists extended key usage OIDs to require instead of client
+	// auth with RequireClientEKU. At least one of them must be present.
+	RequiredEKUs []asn1.ObjectIdentifier
+	// AllowedSignatureAlgorithms, if set, lists the signature algorithms
+	// certificates in the verified chain of a principal may be signed with.
+	// The signature on the trust anchor at the end of the chain isn't checked.
+	AllowedSignatureAlgorithms []x509.SignatureAlgorithm
 	// Logger is used to log authorization decisions.
 	Logger Logger
 }
@@ -69,39 +126,216 @@ func (a ACL) VerifyPeerCertificateServer(rawCerts [][]byte, verifiedChains [][]*
 		return errors.New("unauthorized: invalid principal, or principal not allowed")
 	}
 
+	cert := verifiedChains[0][0]
+
+	// Check certificate age against --max-peer-cert-age flag.
+	if err := a.verifyCertAge(cert); err != nil {
+		return err
+	}
+
+	// Check extended key usage against --require-client-eku flag.
+	if err := a.verifyEKU(cert); err != nil {
+		return err
+	}
+
+	// Check signatures against --allowed-signature-algorithms flag.
+	if err := a.verifySignatureAlgorithms(verifiedChains); err != nil {
+		return err
+	}
+
+	if !a.allowedServer(cert) {
+		return errors.New("unauthorized: invalid principal, or principal not allowed")
+	}
+
+	certAgeHistogram.Update(int64(time.Since(cert.NotBefore) / time.Second))
+	return nil
+}
+
+// Allows checks a verified leaf certificate against the principals in the ACL,
+// e.g. to authorize requests on a connection that was already verified with a
+// different ACL. Other checks (certificate age, EKU) are not applied.
+func (a ACL) Allows(cert *x509.Certificate) bool {
+	return a.allowedServer(cert)
+}
+
+// allowedServer checks the given (verified) leaf certificate against the ACL.
+func (a ACL) allowedServer(cert *x509.Certificate) bool {
 	// If --allow-all has been set, a valid cert is sufficient to connect.
 	if a.AllowAll {
-		return nil
+		return true
 	}
 
-	cert := verifiedChains[0][0]
-
 	// Check CN against --allow-cn flag(s).
 	if contains(a.AllowedCNs, cert.Subject.CommonName) {
-		return nil
+		return true
 	}
 
 	// Check OUs against --allow-ou flag(s).
 	if intersects(a.AllowedOUs, cert.Subject.OrganizationalUnit) {
-		return nil
+		return true
 	}
 
 	// Check DNS SANs against --allow-dns-san flag(s).
 	if intersects(a.AllowedDNSs, cert.DNSNames) {
-		return nil
+		return true
 	}
 
 	// Check IP SANs against --allow-dns-san flag(s).
 	if intersectsIP(a.AllowedIPs, cert.IPAddresses) {
-		return nil
+		return true
 	}
 
 	// Check URI SANs against --allow-uri-san flag(s).
 	if intersectsURI(a.AllowedURIs, cert.URIs) {
+		return true
+	}
+
+	return false
+}
+
+// verifyCertAge checks that the leaf certificate is not older than MaxCertAge.
+// In audit-only mode, violations are logged but access is not denied.
+func (a ACL) verifyCertAge(cert *x509.Certificate) error {
+	if a.MaxCertAge == 0 {
 		return nil
 	}
 
-	return errors.New("unauthorized: invalid principal, or principal not allowed")
+	age := time.Since(cert.NotBefore)
+	if age <= a.MaxCertAge {
+		return nil
+	}
+
+	certAgeCounter.Inc(1)
+	if a.MaxCertAgeAuditOnly {
+		a.logf("audit: certificate for '%s' is %s old, exceeds max age of %s", cert.Subject, age, a.MaxCertAge)
+		return nil
+	}
+
+	a.logf("denied: certificate for '%s' is %s old, exceeds max age of %s", cert.Subject, age, a.MaxCertAge)
+	return errors.New("unauthorized: certificate exceeds maximum allowed age")
+}
+
+// verifyEKU checks that the leaf certificate explicitly lists the required
+// extended key usage. We look at the raw extension, as crypto/x509 treats
+// certificates without it as valid for any usage.
+func (a ACL) verifyEKU(cert *x509.Certificate) error {
+	if !a.RequireClientEKU {
+		return nil
+	}
+
+	required := a.RequiredEKUs
+	if len(required) == 0 {
+		required = []asn1.ObjectIdentifier{oidExtKeyUsageClient}
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtKeyUsage) {
+			continue
+		}
+		var usages []asn1.ObjectIdentifier
+		if rest, err := asn1.Unmarshal(ext.Value, &usages); err != nil || len(rest) > 0 {
+			return errInvalidKeyUsageExt
+		}
+		for _, usage := range usages {
+			for _, oid := range required {
+				if usage.Equal(oid) {
+					return nil
+				}
+			}
+		}
+	}
+
+	ekuCounter.Inc(1)
+	a.logf("denied: certificate for '%s' lacks required extended key usage", cert.Subject)
+	return errMissingKeyUsage
+}
+
+// verifySignatureAlgorithms checks that at least one of the verified chains
+// only has signatures made with allowed algorithms. Trust anchors are skipped,
+// as we trust them because of configuration, not because of a signature.
+func (a ACL) verifySignatureAlgorithms(verifiedChains [][]*x509.Certificate) error {
+	if len(a.AllowedSignatureAlgorithms) == 0 {
+		return nil
+	}
+
+	var rejected *x509.Certificate
+	for _, chain := range verifiedChains {
+		signed := chain
+		if len(chain) > 1 {
+			signed = chain[:len(chain)-1]
+		}
+		rejected = nil
+		for _, cert := range signed {
+			if !a.allowedSignatureAlgorithm(cert.SignatureAlgorithm) {
+				rejected = cert
+				break
+			}
+		}
+		if rejected == nil {
+			return nil
+		}
+	}
+
+	sigAlgCounter.Inc(1)
+	a.logf("denied: certificate '%s' in chain for '%s' is signed with disallowed algorithm %s", rejected.Subject, verifiedChains[0][0].Subject, rejected.SignatureAlgorithm)
+	return errSignatureAlgorithm
+}
+
+func (a ACL) allowedSignatureAlgorithm(algorithm x509.SignatureAlgorithm) bool {
+	for _, allowed := range a.AllowedSignatureAlgorithms {
+		if algorithm == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSignatureAlgorithms parses a comma-separated list of signature
+// algorithm names, as printed by x509.SignatureAlgorithm (e.g. SHA256-RSA,
+// ECDSA-SHA384, Ed25519). Names are case-insensitive.
+func ParseSignatureAlgorithms(list string) ([]x509.SignatureAlgorithm, error) {
+	algorithms := []x509.SignatureAlgorithm{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		algorithm, ok := signatureAlgorithmByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown signature algorithm '%s'", name)
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+func signatureAlgorithmByName(name string) (x509.SignatureAlgorithm, bool) {
+	for algorithm := x509.MD2WithRSA; algorithm <= x509.PureEd25519; algorithm++ {
+		if strings.EqualFold(algorithm.String(), name) {
+			return algorithm, true
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, false
+}
+
+// ParseOID parses an object identifier in dotted form (e.g. 1.3.6.1.5.5.7.3.2).
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID '%s'", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID '%s'", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+func (a ACL) logf(format string, v ...interface{}) {
+	if a.Logger != nil {
+		logging.Warnf(a.Logger, format, v...)
+	}
 }
 
 // VerifyPeerCertificateClient is an implementation of VerifyPeerCertificate
@@ -150,6 +384,24 @@ func (a ACL) VerifyPeerCertificateClient(rawCerts [][]byte, verifiedChains [][]*
 	return errors.New("unauthorized: invalid principal, or principal not allowed")
 }
 
+// IsUnauthorized returns true if err (e.g. from a failed TLS handshake) comes
+// from rejecting a peer certificate: because its chain couldn't be verified,
+// or because it isn't allowed (errors from this package start with
+// "unauthorized:").
+func IsUnauthorized(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuthority), errors.As(err, &invalid), errors.As(err, &hostname):
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "unauthorized:")
+}
+
 // Returns true if item is contained in set.
 func contains(set []string, item string) bool {
 	for _, c := range set {
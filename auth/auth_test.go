@@ -19,9 +19,13 @@ package auth
 import (
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/Elbandi/ghostunnel/wildcard"
 	"github.com/stretchr/testify/assert"
@@ -70,6 +74,109 @@ func TestAuthorizeAllowAll(t *testing.T) {
 	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "allow-all should always allow authed clients")
 }
 
+func TestAuthorizeMaxCertAge(t *testing.T) {
+	recentChains := [][]*x509.Certificate{
+		{
+			{
+				Subject:   pkix.Name{CommonName: "gopher"},
+				NotBefore: time.Now().Add(-1 * time.Hour),
+			},
+		},
+	}
+
+	testACL := ACL{
+		AllowAll:   true,
+		MaxCertAge: 24 * time.Hour,
+	}
+
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, recentChains), "should allow cert younger than max age")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "should reject cert older than max age")
+
+	testACL.MaxCertAgeAuditOnly = true
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, fakeChains), "audit-only mode should allow cert older than max age")
+}
+
+func ekuChains(usages ...asn1.ObjectIdentifier) [][]*x509.Certificate {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "gopher"}}
+	if usages != nil {
+		value, _ := asn1.Marshal(usages)
+		cert.Extensions = []pkix.Extension{{Id: oidExtKeyUsage, Value: value}}
+	}
+	return [][]*x509.Certificate{{cert}}
+}
+
+func TestAuthorizeRequireEKU(t *testing.T) {
+	oidServerAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	oidAny := asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	oidCustom := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+
+	testACL := ACL{
+		AllowAll:         true,
+		RequireClientEKU: true,
+	}
+
+	missing := ekuCounter.Count()
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains(oidServerAuth, oidExtKeyUsageClient)), "should allow cert with client auth EKU")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains()), "should reject cert w/o EKU extension")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains(oidServerAuth)), "should reject cert w/o client auth EKU")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains(oidAny)), "should reject cert with only any EKU")
+	assert.Equal(t, missing+3, ekuCounter.Count(), "should count rejected certs")
+
+	testACL.RequiredEKUs = []asn1.ObjectIdentifier{oidCustom}
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains(oidExtKeyUsageClient, oidCustom)), "should allow cert with custom EKU")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains(oidExtKeyUsageClient)), "should reject cert w/o custom EKU")
+
+	testACL.RequireClientEKU = false
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, ekuChains()), "should not check EKU unless required")
+}
+
+func TestAuthorizeSignatureAlgorithms(t *testing.T) {
+	chain := func(algorithms ...x509.SignatureAlgorithm) []*x509.Certificate {
+		certs := []*x509.Certificate{}
+		for _, algorithm := range algorithms {
+			certs = append(certs, &x509.Certificate{Subject: pkix.Name{CommonName: "gopher"}, SignatureAlgorithm: algorithm})
+		}
+		return certs
+	}
+
+	testACL := ACL{
+		AllowAll:                   true,
+		AllowedSignatureAlgorithms: DefaultSignatureAlgorithms,
+	}
+
+	rejected := sigAlgCounter.Count()
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{chain(x509.ECDSAWithSHA256, x509.SHA384WithRSA, x509.SHA1WithRSA)}), "should ignore signature on trust anchor")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{chain(x509.SHA1WithRSA, x509.SHA256WithRSA)}), "should reject SHA-1 leaf")
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{chain(x509.SHA256WithRSA, x509.MD5WithRSA, x509.SHA256WithRSA)}), "should reject MD5 intermediate")
+	assert.Nil(t, testACL.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{chain(x509.SHA1WithRSA, x509.SHA256WithRSA), chain(x509.SHA256WithRSA, x509.SHA256WithRSA)}), "should allow if any chain is acceptable")
+	assert.Equal(t, rejected+2, sigAlgCounter.Count(), "should count rejected certs")
+
+	testACL.AllowedSignatureAlgorithms = []x509.SignatureAlgorithm{x509.PureEd25519}
+	assert.NotNil(t, testACL.VerifyPeerCertificateServer(nil, [][]*x509.Certificate{chain(x509.ECDSAWithSHA256, x509.PureEd25519)}), "should reject algorithm not in list")
+}
+
+func TestParseSignatureAlgorithms(t *testing.T) {
+	algorithms, err := ParseSignatureAlgorithms("SHA256-RSA, ecdsa-sha384,Ed25519")
+	assert.Nil(t, err, "should parse valid algorithms")
+	assert.Equal(t, []x509.SignatureAlgorithm{x509.SHA256WithRSA, x509.ECDSAWithSHA384, x509.PureEd25519}, algorithms)
+
+	for _, invalid := range []string{"", "SHA256", "SHA256-RSA,,ECDSA-SHA256"} {
+		_, err = ParseSignatureAlgorithms(invalid)
+		assert.NotNil(t, err, "should reject invalid list '%s'", invalid)
+	}
+}
+
+func TestParseOID(t *testing.T) {
+	oid, err := ParseOID("1.3.6.1.5.5.7.3.2")
+	assert.Nil(t, err, "should parse valid OID")
+	assert.True(t, oid.Equal(oidExtKeyUsageClient), "should parse OID correctly")
+
+	for _, invalid := range []string{"", "1", "1..2", "1.-2", "1.a"} {
+		_, err = ParseOID(invalid)
+		assert.NotNil(t, err, "should reject invalid OID '%s'", invalid)
+	}
+}
+
 func TestAuthorizeAllowCN(t *testing.T) {
 	testACL := ACL{
 		AllowedCNs: []string{"gopher"},
@@ -212,3 +319,12 @@ func TestVerifyNoVerifiedChains(t *testing.T) {
 
 	assert.NotNil(t, testACL.VerifyPeerCertificateClient(nil, nil), "should reject if no verified chains")
 }
+
+func TestIsUnauthorized(t *testing.T) {
+	testACL := ACL{AllowedCNs: []string{"nobody"}}
+	err := testACL.VerifyPeerCertificateServer(nil, fakeChains)
+	assert.True(t, IsUnauthorized(err), "ACL rejections are authorization failures")
+	assert.True(t, IsUnauthorized(fmt.Errorf("wrapped: %w", x509.UnknownAuthorityError{})), "unverified chains are authorization failures")
+	assert.False(t, IsUnauthorized(errors.New("i/o timeout")), "other errors aren't authorization failures")
+	assert.False(t, IsUnauthorized(nil))
+}
@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// ChainOptions control how VerifyChain verifies peer certificate chains.
+type ChainOptions struct {
+	// Roots are the trust anchors that verified chains must end in.
+	Roots *x509.CertPool
+	// Intermediates are CA certificates that may be used to build chains, in
+	// addition to the ones sent by the peer, but aren't trusted as anchors.
+	Intermediates []*x509.Certificate
+	// KeyUsage is the extended key usage the leaf must be valid for.
+	KeyUsage x509.ExtKeyUsage
+	// DNSName, if set, is checked against the leaf (hostname verification).
+	DNSName string
+	// ExpiryGrace accepts leaf certificates that expired at most this long ago.
+	ExpiryGrace time.Duration
+	// IgnoreNameConstraints skips name constraints on intermediates. Roots
+	// must be stripped by the caller, see WithoutNameConstraints.
+	IgnoreNameConstraints bool
+	// Logger is used to log warnings (optional).
+	Logger Logger
+}
+
+// VerifyChain returns a VerifyPeerCertificate callback that verifies the
+// peer certificate chain with the given options, instead of relying on the
+// verification in crypto/tls. Verified chains are then passed on to next
+// (usually an ACL) for authorization.
+//
+// On servers, the callback must be used with ClientAuth set to
+// tls.RequireAnyClientCert, and on clients with InsecureSkipVerify set, so
+// that crypto/tls doesn't verify (and possibly reject) chains itself.
+func VerifyChain(opts ChainOptions, next VerifyFunc) VerifyFunc {
+	intermediates := opts.Intermediates
+	if opts.IgnoreNameConstraints {
+		intermediates = WithoutNameConstraints(intermediates)
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("unauthorized: no peer certificate presented")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		verifyOpts := x509.VerifyOptions{
+			Roots:         opts.Roots,
+			Intermediates: x509.NewCertPool(),
+			DNSName:       opts.DNSName,
+			KeyUsages:     []x509.ExtKeyUsage{opts.KeyUsage},
+		}
+		presented := certs[1:]
+		if opts.IgnoreNameConstraints {
+			presented = WithoutNameConstraints(presented)
+		}
+		for _, cert := range presented {
+			verifyOpts.Intermediates.AddCert(cert)
+		}
+		for _, cert := range intermediates {
+			verifyOpts.Intermediates.AddCert(cert)
+		}
+
+		chains, err := verifyWithGrace(certs[0], verifyOpts, opts.ExpiryGrace, opts.Logger)
+		if err != nil {
+			return err
+		}
+
+		return next(rawCerts, chains)
+	}
+}
+
+// SplitBundle splits the certificates from a CA bundle into trust anchors
+// and intermediates: only self-signed certificates are anchors, unless
+// allowPartial is set, in which case every certificate is (so that chains
+// may end in an intermediate CA, without going up to a root).
+func SplitBundle(certs []*x509.Certificate, allowPartial bool) (anchors, intermediates []*x509.Certificate) {
+	if allowPartial {
+		return certs, nil
+	}
+	for _, cert := range certs {
+		if isSelfSigned(cert) {
+			anchors = append(anchors, cert)
+		} else {
+			intermediates = append(intermediates, cert)
+		}
+	}
+	return anchors, intermediates
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// WithoutNameConstraints returns copies of the given certificates with all
+// name constraints removed, so that they're not enforced during verification.
+func WithoutNameConstraints(certs []*x509.Certificate) []*x509.Certificate {
+	stripped := make([]*x509.Certificate, len(certs))
+	for i, cert := range certs {
+		c := *cert
+		c.PermittedDNSDomainsCritical = false
+		c.PermittedDNSDomains = nil
+		c.ExcludedDNSDomains = nil
+		c.PermittedIPRanges = nil
+		c.ExcludedIPRanges = nil
+		c.PermittedEmailAddresses = nil
+		c.ExcludedEmailAddresses = nil
+		c.PermittedURIDomains = nil
+		c.ExcludedURIDomains = nil
+		stripped[i] = &c
+	}
+	return stripped
+}
@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testChain struct {
+	root, intermediate, leaf *x509.Certificate
+}
+
+// Creates a root CA, an intermediate CA (restricted to example.com by name
+// constraints), and a leaf certificate with the given DNS name signed by the
+// intermediate.
+func makeIntermediateChain(t *testing.T, dnsName string) testChain {
+	create := func(template, parent *x509.Certificate, key *ecdsa.PrivateKey, parentKey crypto.Signer) *x509.Certificate {
+		if parent == nil {
+			parent = template
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		assert.Nil(t, err)
+		cert, err := x509.ParseCertificate(raw)
+		assert.Nil(t, err)
+		return cert
+	}
+
+	var keys [3]*ecdsa.PrivateKey
+	for i := range keys {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Nil(t, err)
+		keys[i] = key
+	}
+
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(time.Hour)
+	root := create(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, keys[0], keys[0])
+	intermediate := create(&x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		PermittedDNSDomains:   []string{"example.com"},
+	}, root, keys[1], keys[0])
+	leaf := create(&x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "gopher"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		DNSNames:     []string{dnsName},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}, intermediate, keys[2], keys[1])
+
+	return testChain{root, intermediate, leaf}
+}
+
+func poolOf(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func allowAll(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return ACL{AllowAll: true}.VerifyPeerCertificateServer(rawCerts, verifiedChains)
+}
+
+func TestSplitBundle(t *testing.T) {
+	chain := makeIntermediateChain(t, "gopher.example.com")
+	bundle := []*x509.Certificate{chain.intermediate, chain.root}
+
+	anchors, intermediates := SplitBundle(bundle, false)
+	assert.Equal(t, []*x509.Certificate{chain.root}, anchors, "only self-signed certs should be anchors")
+	assert.Equal(t, []*x509.Certificate{chain.intermediate}, intermediates, "other certs should be intermediates")
+
+	anchors, intermediates = SplitBundle(bundle, true)
+	assert.Equal(t, bundle, anchors, "all certs should be anchors with partial chains")
+	assert.Empty(t, intermediates)
+}
+
+func TestVerifyChainFull(t *testing.T) {
+	chain := makeIntermediateChain(t, "gopher.example.com")
+
+	// Intermediate sent by peer
+	verify := VerifyChain(ChainOptions{Roots: poolOf(chain.root), KeyUsage: x509.ExtKeyUsageClientAuth}, allowAll)
+	assert.Nil(t, verify([][]byte{chain.leaf.Raw, chain.intermediate.Raw}, nil), "should accept full chain")
+	assert.NotNil(t, verify([][]byte{chain.leaf.Raw}, nil), "should reject chain without intermediate")
+	assert.NotNil(t, verify(nil, nil), "should reject missing cert")
+
+	// Intermediate from the bundle, not trusted as an anchor
+	verify = VerifyChain(ChainOptions{
+		Roots:         poolOf(chain.root),
+		Intermediates: []*x509.Certificate{chain.intermediate},
+		KeyUsage:      x509.ExtKeyUsageClientAuth,
+	}, allowAll)
+	assert.Nil(t, verify([][]byte{chain.leaf.Raw}, nil), "should build chain with intermediate from bundle")
+
+	verify = VerifyChain(ChainOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: []*x509.Certificate{chain.intermediate},
+		KeyUsage:      x509.ExtKeyUsageClientAuth,
+	}, allowAll)
+	assert.NotNil(t, verify([][]byte{chain.leaf.Raw}, nil), "should not trust bundle intermediate as anchor")
+}
+
+func TestVerifyChainPartial(t *testing.T) {
+	chain := makeIntermediateChain(t, "gopher.example.com")
+
+	verify := VerifyChain(ChainOptions{Roots: poolOf(chain.intermediate), KeyUsage: x509.ExtKeyUsageClientAuth}, allowAll)
+	assert.Nil(t, verify([][]byte{chain.leaf.Raw}, nil), "should accept chain ending in trusted intermediate")
+}
+
+func TestVerifyChainNameConstraints(t *testing.T) {
+	chain := makeIntermediateChain(t, "gopher.example.org")
+
+	verify := VerifyChain(ChainOptions{Roots: poolOf(chain.root), KeyUsage: x509.ExtKeyUsageClientAuth}, allowAll)
+	assert.NotNil(t, verify([][]byte{chain.leaf.Raw, chain.intermediate.Raw}, nil), "should enforce name constraints")
+
+	verify = VerifyChain(ChainOptions{
+		Roots:                 poolOf(chain.root),
+		KeyUsage:              x509.ExtKeyUsageClientAuth,
+		IgnoreNameConstraints: true,
+	}, allowAll)
+	assert.Nil(t, verify([][]byte{chain.leaf.Raw, chain.intermediate.Raw}, nil), "should ignore name constraints on presented intermediate")
+
+	// Constraints on anchors must be stripped by the caller
+	verify = VerifyChain(ChainOptions{
+		Roots:                 poolOf(WithoutNameConstraints([]*x509.Certificate{chain.intermediate})...),
+		KeyUsage:              x509.ExtKeyUsageClientAuth,
+		IgnoreNameConstraints: true,
+	}, allowAll)
+	assert.Nil(t, verify([][]byte{chain.leaf.Raw}, nil), "should ignore name constraints on stripped anchor")
+	assert.NotEmpty(t, chain.intermediate.PermittedDNSDomains, "should not modify original certificate")
+}
+
+func TestVerifyChainHostnameAndUsage(t *testing.T) {
+	chain := makeIntermediateChain(t, "gopher.example.com")
+	opts := ChainOptions{Roots: poolOf(chain.root), KeyUsage: x509.ExtKeyUsageServerAuth}
+	raw := [][]byte{chain.leaf.Raw, chain.intermediate.Raw}
+
+	opts.DNSName = "gopher.example.com"
+	assert.Nil(t, VerifyChain(opts, allowAll)(raw, nil), "should accept matching hostname")
+
+	opts.DNSName = "other.example.com"
+	assert.NotNil(t, VerifyChain(opts, allowAll)(raw, nil), "should reject mismatched hostname")
+
+	opts.DNSName = ""
+	opts.KeyUsage = x509.ExtKeyUsageCodeSigning
+	assert.NotNil(t, VerifyChain(opts, allowAll)(raw, nil), "should reject wrong key usage")
+}
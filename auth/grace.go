@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var expiredGraceCounter = metrics.GetOrRegisterCounter("auth.cert.expired.grace", metrics.DefaultRegistry)
+
+// VerifyFunc is the signature of the VerifyPeerCertificate callback on tls.Config.
+type VerifyFunc func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// VerifyWithExpiryGrace returns a VerifyPeerCertificate callback that verifies
+// the peer certificate chain against the given roots, but accepts leaf
+// certificates that expired at most grace ago. All other parts of chain
+// verification must still pass. Verified chains are then passed on to next
+// (usually an ACL) for authorization.
+//
+// The returned callback must be used with ClientAuth set to tls.RequireAnyClientCert,
+// as crypto/tls would otherwise reject expired certificates before calling it.
+func VerifyWithExpiryGrace(roots *x509.CertPool, grace time.Duration, logger Logger, next VerifyFunc) VerifyFunc {
+	return VerifyChain(ChainOptions{
+		Roots:       roots,
+		KeyUsage:    x509.ExtKeyUsageClientAuth,
+		ExpiryGrace: grace,
+		Logger:      logger,
+	}, next)
+}
+
+// verifyWithGrace verifies the leaf certificate with the given options, but
+// accepts it if it expired at most grace ago.
+func verifyWithGrace(leaf *x509.Certificate, opts x509.VerifyOptions, grace time.Duration, logger Logger) ([][]*x509.Certificate, error) {
+	chains, err := leaf.Verify(opts)
+	if invalid, ok := err.(x509.CertificateInvalidError); ok && invalid.Reason == x509.Expired {
+		expiredAgo := time.Since(leaf.NotAfter)
+		if expiredAgo > 0 && expiredAgo <= grace {
+			// Verify again as of the last moment the leaf was still valid,
+			// so that everything except the expiry check must still pass.
+			opts.CurrentTime = leaf.NotAfter
+			chains, err = leaf.Verify(opts)
+			if err == nil {
+				expiredGraceCounter.Inc(1)
+				if logger != nil {
+					logging.Warnf(logger, "warning: accepting certificate for '%s' that expired %s ago (within grace period of %s)", leaf.Subject, expiredAgo, grace)
+				}
+			}
+		}
+	}
+	return chains, err
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Creates a root CA and a client certificate signed by it, valid from
+// notBefore until notAfter.
+func makeTestChain(t *testing.T, notBefore, notAfter time.Time) (*x509.CertPool, [][]byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caRaw, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	ca, err := x509.ParseCertificate(caRaw)
+	assert.Nil(t, err)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gopher"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	leafRaw, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return roots, [][]byte{leafRaw}
+}
+
+func TestExpiryGraceAcceptsRecentlyExpired(t *testing.T) {
+	roots, raw := makeTestChain(t, time.Now().Add(-10*time.Hour), time.Now().Add(-1*time.Hour))
+	acl := ACL{AllowedCNs: []string{"gopher"}}
+
+	verify := VerifyWithExpiryGrace(roots, 2*time.Hour, nil, acl.VerifyPeerCertificateServer)
+	assert.Nil(t, verify(raw, nil), "should accept cert expired within grace period")
+
+	verify = VerifyWithExpiryGrace(roots, 30*time.Minute, nil, acl.VerifyPeerCertificateServer)
+	assert.NotNil(t, verify(raw, nil), "should reject cert expired before grace period")
+}
+
+func TestExpiryGraceStillVerifiesChain(t *testing.T) {
+	_, raw := makeTestChain(t, time.Now().Add(-10*time.Hour), time.Now().Add(-1*time.Hour))
+	otherRoots, _ := makeTestChain(t, time.Now().Add(-1*time.Hour), time.Now().Add(time.Hour))
+	acl := ACL{AllowAll: true}
+
+	verify := VerifyWithExpiryGrace(otherRoots, 2*time.Hour, nil, acl.VerifyPeerCertificateServer)
+	assert.NotNil(t, verify(raw, nil), "should reject cert from untrusted CA even within grace period")
+	assert.NotNil(t, verify(nil, nil), "should reject missing cert")
+}
+
+func TestExpiryGraceAppliesACL(t *testing.T) {
+	roots, raw := makeTestChain(t, time.Now().Add(-1*time.Hour), time.Now().Add(time.Hour))
+
+	verify := VerifyWithExpiryGrace(roots, time.Hour, nil, ACL{AllowedCNs: []string{"gopher"}}.VerifyPeerCertificateServer)
+	assert.Nil(t, verify(raw, nil), "should accept valid cert matching ACL")
+
+	verify = VerifyWithExpiryGrace(roots, time.Hour, nil, ACL{AllowedCNs: []string{"other"}}.VerifyPeerCertificateServer)
+	assert.NotNil(t, verify(raw, nil), "should reject valid cert not matching ACL")
+}
@@ -0,0 +1,338 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var sctRejectedCounter = metrics.GetOrRegisterCounter("auth.cert.sct.rejected", metrics.DefaultRegistry)
+
+// OID of the X.509 extension with embedded SCTs (RFC 6962, section 3.3).
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// SCT is a signed certificate timestamp (RFC 6962, section 3.2), a promise
+// by a certificate transparency log to include a certificate.
+type SCT struct {
+	LogID     [32]byte
+	Timestamp time.Time
+	// Fields needed to verify the signature.
+	timestamp  uint64
+	extensions []byte
+	hash       uint8
+	algorithm  uint8
+	signature  []byte
+}
+
+// SCTOptions control how RequireSCTs checks SCTs.
+type SCTOptions struct {
+	// MinSCTs is the number of valid SCTs, from distinct logs, the leaf must have.
+	MinSCTs int
+	// Logs maps log IDs to the logs' public keys (see LoadCTLogList). If set,
+	// only SCTs from these logs with a valid signature are counted. If empty,
+	// SCTs are counted without verifying them.
+	Logs map[[32]byte]crypto.PublicKey
+}
+
+// RequireSCTs returns a VerifyPeerCertificate callback that rejects peers
+// whose certificate doesn't have enough SCTs embedded, and otherwise calls
+// next. It needs verified chains, so it must be called after chain
+// verification (by crypto/tls, or as the next function of VerifyChain).
+func RequireSCTs(opts SCTOptions, next VerifyFunc) VerifyFunc {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return errors.New("unauthorized: no verified chain to check SCTs on")
+		}
+		chain := verifiedChains[0]
+		var issuer *x509.Certificate
+		if len(chain) > 1 {
+			issuer = chain[1]
+		}
+
+		valid, err := countValidSCTs(chain[0], issuer, opts.Logs)
+		if err != nil {
+			sctRejectedCounter.Inc(1)
+			return fmt.Errorf("unauthorized: invalid SCTs in certificate: %s", err)
+		}
+		if valid < opts.MinSCTs {
+			sctRejectedCounter.Inc(1)
+			return fmt.Errorf("unauthorized: certificate has %d valid SCTs, but %d are required", valid, opts.MinSCTs)
+		}
+		return next(rawCerts, verifiedChains)
+	}
+}
+
+// countValidSCTs returns the number of distinct logs with a valid SCT in the
+// leaf. Without logs, all SCTs are considered valid.
+func countValidSCTs(leaf, issuer *x509.Certificate, logs map[[32]byte]crypto.PublicKey) (int, error) {
+	scts, err := ParseSCTs(leaf)
+	if err != nil {
+		return 0, err
+	}
+
+	var tbs []byte
+	if len(logs) > 0 && issuer != nil {
+		tbs, err = precertTBS(leaf.RawTBSCertificate)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	seen := map[[32]byte]bool{}
+	for _, sct := range scts {
+		if seen[sct.LogID] {
+			continue
+		}
+		if len(logs) > 0 {
+			key, ok := logs[sct.LogID]
+			if !ok || issuer == nil || sct.verify(key, issuer, tbs) != nil {
+				continue
+			}
+			if sct.Timestamp.After(time.Now()) {
+				continue
+			}
+		}
+		seen[sct.LogID] = true
+	}
+	return len(seen), nil
+}
+
+// ParseSCTs returns the SCTs embedded in the given certificate (if any).
+func ParseSCTs(cert *x509.Certificate) ([]SCT, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+		var list []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(rest) > 0 {
+			return nil, errors.New("malformed SCT list extension")
+		}
+		return parseSCTList(list)
+	}
+	return nil, nil
+}
+
+// parseSCTList parses a TLS-encoded SignedCertificateTimestampList.
+func parseSCTList(data []byte) ([]SCT, error) {
+	list, rest, ok := readVector(data, 2)
+	if !ok || len(rest) > 0 {
+		return nil, errors.New("malformed SCT list")
+	}
+
+	scts := []SCT{}
+	for len(list) > 0 {
+		var raw []byte
+		raw, list, ok = readVector(list, 2)
+		if !ok {
+			return nil, errors.New("malformed SCT list")
+		}
+		sct, err := parseSCT(raw)
+		if err != nil {
+			return nil, err
+		}
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+func parseSCT(data []byte) (SCT, error) {
+	var sct SCT
+	if len(data) < 1+32+8 || data[0] != 0 {
+		return sct, errors.New("malformed or unsupported SCT version")
+	}
+	copy(sct.LogID[:], data[1:33])
+	sct.timestamp = binary.BigEndian.Uint64(data[33:41])
+	sct.Timestamp = time.Unix(0, int64(sct.timestamp)*int64(time.Millisecond))
+
+	var ok bool
+	sct.extensions, data, ok = readVector(data[41:], 2)
+	if !ok || len(data) < 2 {
+		return sct, errors.New("malformed SCT")
+	}
+	sct.hash, sct.algorithm = data[0], data[1]
+	sct.signature, data, ok = readVector(data[2:], 2)
+	if !ok || len(data) > 0 {
+		return sct, errors.New("malformed SCT")
+	}
+	return sct, nil
+}
+
+// readVector reads a TLS-encoded variable-length vector with a length prefix
+// of the given size (in bytes), and returns it along with the remaining data.
+func readVector(data []byte, size int) (vector, rest []byte, ok bool) {
+	if len(data) < size {
+		return nil, nil, false
+	}
+	length := 0
+	for _, b := range data[:size] {
+		length = length<<8 | int(b)
+	}
+	if len(data) < size+length {
+		return nil, nil, false
+	}
+	return data[size : size+length], data[size+length:], true
+}
+
+// signedData returns the data covered by the signature on an SCT embedded in
+// a certificate: the precertificate (the TBS certificate without the SCT list)
+// and the issuer's public key, among others (RFC 6962, section 3.2).
+func (sct SCT) signedData(issuer *x509.Certificate, tbs []byte) []byte {
+	var signed bytes.Buffer
+	// Version (v1), signature type (certificate_timestamp), timestamp
+	signed.Write([]byte{0, 0})
+	binary.Write(&signed, binary.BigEndian, sct.timestamp)
+	// Entry type (precert_entry), issuer key hash, TBS certificate
+	signed.Write([]byte{0, 1})
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	signed.Write(issuerKeyHash[:])
+	signed.Write([]byte{byte(len(tbs) >> 16), byte(len(tbs) >> 8), byte(len(tbs))})
+	signed.Write(tbs)
+	// Extensions
+	binary.Write(&signed, binary.BigEndian, uint16(len(sct.extensions)))
+	signed.Write(sct.extensions)
+	return signed.Bytes()
+}
+
+// verify checks the signature on an SCT embedded in a certificate with the
+// given issuer and precertificate TBS (see precertTBS).
+func (sct SCT) verify(key crypto.PublicKey, issuer *x509.Certificate, tbs []byte) error {
+	if sct.hash != 4 {
+		return errors.New("unsupported SCT hash algorithm")
+	}
+
+	digest := sha256.Sum256(sct.signedData(issuer, tbs))
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if sct.algorithm != 3 || !ecdsa.VerifyASN1(key, digest[:], sct.signature) {
+			return errors.New("invalid SCT signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if sct.algorithm != 1 {
+			return errors.New("invalid SCT signature")
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sct.signature)
+	}
+	return errors.New("unsupported log key type")
+}
+
+// precertTBS reconstructs the TBS certificate of the precertificate that the
+// logs signed, by removing the SCT list extension from the TBS certificate.
+func precertTBS(rawTBS []byte) ([]byte, error) {
+	var tbs asn1.RawValue
+	if rest, err := asn1.Unmarshal(rawTBS, &tbs); err != nil || len(rest) > 0 {
+		return nil, errors.New("malformed TBS certificate")
+	}
+
+	var fields []byte
+	for rest := tbs.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, errors.New("malformed TBS certificate")
+		}
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+
+		// Extensions are an explicitly tagged SEQUENCE OF Extension.
+		var extensions asn1.RawValue
+		if _, err := asn1.Unmarshal(field.Bytes, &extensions); err != nil {
+			return nil, errors.New("malformed extensions in TBS certificate")
+		}
+		var kept []byte
+		for exts := extensions.Bytes; len(exts) > 0; {
+			var ext asn1.RawValue
+			exts, err = asn1.Unmarshal(exts, &ext)
+			if err != nil {
+				return nil, errors.New("malformed extension in TBS certificate")
+			}
+			var id asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(ext.Bytes, &id); err == nil && id.Equal(oidSCTList) {
+				continue
+			}
+			kept = append(kept, ext.FullBytes...)
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		sequence, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: kept})
+		if err != nil {
+			return nil, err
+		}
+		tagged, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: sequence})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, tagged...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+}
+
+// LoadCTLogList reads the public keys of trusted certificate transparency logs
+// from a log list in JSON format (as published by Google, version 3), and
+// returns them by log ID.
+func LoadCTLogList(path string) (map[[32]byte]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Operators []struct {
+			Logs []struct {
+				Description string `json:"description"`
+				Key         []byte `json:"key"`
+			} `json:"logs"`
+		} `json:"operators"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unable to parse CT log list: %s", err)
+	}
+
+	logs := map[[32]byte]crypto.PublicKey{}
+	for _, operator := range list.Operators {
+		for _, log := range operator.Logs {
+			key, err := x509.ParsePKIXPublicKey(log.Key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key for log '%s' in CT log list: %s", log.Description, err)
+			}
+			logs[sha256.Sum256(log.Key)] = key
+		}
+	}
+	if len(logs) == 0 {
+		return nil, errors.New("CT log list has no logs")
+	}
+	return logs, nil
+}
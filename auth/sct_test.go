@@ -0,0 +1,227 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLogKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	return key
+}
+
+func logID(t *testing.T, key *ecdsa.PrivateKey) [32]byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+	return sha256.Sum256(der)
+}
+
+// Creates a CA and a leaf certificate signed by it, with embedded SCTs signed
+// by the given logs as of the given time.
+func makeSCTCert(t *testing.T, logs []*ecdsa.PrivateKey, timestamp time.Time) (leaf, issuer *x509.Certificate) {
+	caKey, leafKey := newLogKey(t), newLogKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	issuer, err = x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "backend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"backend.example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	raw, err = x509.CreateCertificate(rand.Reader, template, issuer, &leafKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	precert, err := x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+
+	var list []byte
+	for _, log := range logs {
+		sct := SCT{LogID: logID(t, log), timestamp: uint64(timestamp.UnixNano() / int64(time.Millisecond))}
+		digest := sha256.Sum256(sct.signedData(issuer, precert.RawTBSCertificate))
+		signature, err := ecdsa.SignASN1(rand.Reader, log, digest[:])
+		assert.Nil(t, err)
+
+		serialized := []byte{0}
+		serialized = append(serialized, sct.LogID[:]...)
+		serialized = binary.BigEndian.AppendUint64(serialized, sct.timestamp)
+		serialized = append(serialized, 0, 0, 4, 3)
+		serialized = binary.BigEndian.AppendUint16(serialized, uint16(len(signature)))
+		serialized = append(serialized, signature...)
+
+		list = binary.BigEndian.AppendUint16(list, uint16(len(serialized)))
+		list = append(list, serialized...)
+	}
+	value, err := asn1.Marshal(append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...))
+	assert.Nil(t, err)
+
+	template.ExtraExtensions = []pkix.Extension{{Id: oidSCTList, Value: value}}
+	raw, err = x509.CreateCertificate(rand.Reader, template, issuer, &leafKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	leaf, err = x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+
+	tbs, err := precertTBS(leaf.RawTBSCertificate)
+	assert.Nil(t, err)
+	assert.Equal(t, precert.RawTBSCertificate, tbs, "should reconstruct precertificate")
+	return leaf, issuer
+}
+
+func logKeys(t *testing.T, keys ...*ecdsa.PrivateKey) map[[32]byte]crypto.PublicKey {
+	logs := map[[32]byte]crypto.PublicKey{}
+	for _, key := range keys {
+		logs[logID(t, key)] = &key.PublicKey
+	}
+	return logs
+}
+
+func TestParseSCTs(t *testing.T) {
+	log1, log2 := newLogKey(t), newLogKey(t)
+	now := time.Now().Truncate(time.Millisecond)
+	leaf, issuer := makeSCTCert(t, []*ecdsa.PrivateKey{log1, log2}, now)
+
+	scts, err := ParseSCTs(leaf)
+	assert.Nil(t, err, "should parse SCTs")
+	assert.Len(t, scts, 2)
+	assert.Equal(t, logID(t, log1), scts[0].LogID)
+	assert.True(t, scts[0].Timestamp.Equal(now), "should parse timestamp")
+
+	scts, err = ParseSCTs(issuer)
+	assert.Nil(t, err, "should not fail without SCTs")
+	assert.Empty(t, scts)
+
+	_, err = parseSCTList([]byte{0, 5, 0, 3, 0})
+	assert.NotNil(t, err, "should reject truncated SCT list")
+}
+
+func TestRequireSCTs(t *testing.T) {
+	log1, log2, unknown := newLogKey(t), newLogKey(t), newLogKey(t)
+	leaf, issuer := makeSCTCert(t, []*ecdsa.PrivateKey{log1, log2, unknown}, time.Now())
+	chains := [][]*x509.Certificate{{leaf, issuer}}
+
+	called := false
+	next := func([][]byte, [][]*x509.Certificate) error {
+		called = true
+		return nil
+	}
+
+	err := RequireSCTs(SCTOptions{MinSCTs: 3}, next)(nil, chains)
+	assert.Nil(t, err, "should count SCTs without log list")
+	assert.True(t, called, "should call next")
+
+	err = RequireSCTs(SCTOptions{MinSCTs: 2, Logs: logKeys(t, log1, log2)}, next)(nil, chains)
+	assert.Nil(t, err, "should accept SCTs from known logs")
+
+	rejected := sctRejectedCounter.Count()
+	called = false
+	err = RequireSCTs(SCTOptions{MinSCTs: 3, Logs: logKeys(t, log1, log2)}, next)(nil, chains)
+	assert.NotNil(t, err, "should not count SCTs from unknown logs")
+	assert.False(t, called, "should not call next")
+	assert.Equal(t, rejected+1, sctRejectedCounter.Count(), "should count rejection")
+
+	err = RequireSCTs(SCTOptions{MinSCTs: 1, Logs: logKeys(t, log1)}, next)(nil, [][]*x509.Certificate{{leaf, leaf}})
+	assert.NotNil(t, err, "should reject SCTs signed for a different issuer")
+
+	err = RequireSCTs(SCTOptions{MinSCTs: 1, Logs: logKeys(t, log1)}, next)(nil, [][]*x509.Certificate{{leaf}})
+	assert.NotNil(t, err, "should not verify SCTs without issuer")
+
+	err = RequireSCTs(SCTOptions{MinSCTs: 1}, next)(nil, [][]*x509.Certificate{{issuer}})
+	assert.NotNil(t, err, "should reject certificate without SCTs")
+
+	err = RequireSCTs(SCTOptions{MinSCTs: 1}, next)(nil, nil)
+	assert.NotNil(t, err, "should reject without verified chain")
+
+	future, futureIssuer := makeSCTCert(t, []*ecdsa.PrivateKey{log1}, time.Now().Add(time.Hour))
+	err = RequireSCTs(SCTOptions{MinSCTs: 1, Logs: logKeys(t, log1)}, next)(nil, [][]*x509.Certificate{{future, futureIssuer}})
+	assert.NotNil(t, err, "should reject SCTs from the future")
+
+	err = RequireSCTs(SCTOptions{MinSCTs: 1}, func([][]byte, [][]*x509.Certificate) error {
+		return errors.New("denied")
+	})(nil, chains)
+	assert.NotNil(t, err, "should pass on errors from next")
+}
+
+func TestLoadCTLogList(t *testing.T) {
+	key := newLogKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+
+	list, err := json.Marshal(map[string]interface{}{
+		"operators": []interface{}{
+			map[string]interface{}{
+				"name": "test",
+				"logs": []interface{}{
+					map[string]interface{}{"description": "test log", "key": base64.StdEncoding.EncodeToString(der)},
+				},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	file, err := ioutil.TempFile("", "ghostunnel-test")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	file.Write(list)
+	file.Close()
+
+	logs, err := LoadCTLogList(file.Name())
+	assert.Nil(t, err, "should load log list")
+	assert.Equal(t, logKeys(t, key), logs)
+
+	ioutil.WriteFile(file.Name(), []byte(`{"operators": []}`), 0600)
+	_, err = LoadCTLogList(file.Name())
+	assert.NotNil(t, err, "should reject empty log list")
+
+	ioutil.WriteFile(file.Name(), []byte(`{"operators": [{"logs": [{"key": "AAAA"}]}]}`), 0600)
+	_, err = LoadCTLogList(file.Name())
+	assert.NotNil(t, err, "should reject invalid key")
+
+	_, err = LoadCTLogList("does-not-exist")
+	assert.NotNil(t, err, "should fail on missing file")
+}
@@ -0,0 +1,149 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	affinityHitCounter  = metrics.GetOrRegisterCounter("backend.affinity.hit", metrics.DefaultRegistry)
+	affinityMissCounter = metrics.GetOrRegisterCounter("backend.affinity.miss", metrics.DefaultRegistry)
+)
+
+// Number of points per target on the hash ring. More points spread keys more
+// evenly across targets.
+const affinityReplicas = 128
+
+// Affinity sends connections with the same key (e.g. the client IP) to the
+// same target of a pool, using consistent hashing: adding or removing a
+// target only moves the keys of that target. If the target for a key is
+// down, the next target on the hash ring is used instead.
+type Affinity struct {
+	pool *Pool
+	ring []ringPoint
+	// Number of targets on the ring (i.e. with non-zero weight).
+	size int
+}
+
+type ringPoint struct {
+	hash   uint32
+	target int
+}
+
+// NewAffinity builds a hash ring over the targets of a pool, with a share of
+// keys proportional to the weight of each target. Targets that fail to dial
+// are marked down for the cool-off period of the pool.
+func NewAffinity(pool *Pool) *Affinity {
+	a := &Affinity{pool: pool}
+	for i, target := range pool.targets {
+		if target.Weight > 0 {
+			a.size++
+		}
+		for replica := 0; replica < affinityReplicas*target.Weight; replica++ {
+			a.ring = append(a.ring, ringPoint{hashKey(fmt.Sprintf("%s#%d", target.Address, replica)), i})
+		}
+	}
+	sort.Slice(a.ring, func(i, j int) bool { return a.ring[i].hash < a.ring[j].hash })
+	return a
+}
+
+// Hash a key onto the ring. FNV-1a alone clusters similar keys (such as
+// addresses in the same subnet), so the result is mixed with the finalizer
+// from MurmurHash3.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Targets returns the targets for key in order of preference, i.e. in the
+// order they appear on the hash ring starting at the key.
+func (a *Affinity) Targets(key string) []*Target {
+	if len(a.ring) == 0 {
+		return nil
+	}
+	hash := hashKey(key)
+	start := sort.Search(len(a.ring), func(i int) bool { return a.ring[i].hash >= hash })
+
+	seen := make([]bool, len(a.pool.targets))
+	targets := make([]*Target, 0, a.size)
+	for i := 0; i < len(a.ring) && len(targets) < a.size; i++ {
+		point := a.ring[(start+i)%len(a.ring)]
+		if !seen[point.target] {
+			seen[point.target] = true
+			targets = append(targets, a.pool.targets[point.target])
+		}
+	}
+	return targets
+}
+
+// Dial connects to the target for key, or to the next target on the hash
+// ring that is up if it's down. If all targets are marked down, they are all
+// tried anyway (in order).
+func (a *Affinity) Dial(key string) (net.Conn, error) {
+	preferred := a.Targets(key)
+	if len(preferred) == 0 {
+		return nil, errors.New("no backend targets available")
+	}
+
+	var candidates, down []*Target
+	for _, target := range preferred {
+		if target.Up() {
+			candidates = append(candidates, target)
+		} else {
+			down = append(down, target)
+		}
+	}
+	candidates = append(candidates, down...)
+
+	var errs []string
+	for _, target := range candidates {
+		conn, err := target.Dial()
+		if err == nil {
+			target.counter.Inc(1)
+			if target == preferred[0] {
+				affinityHitCounter.Inc(1)
+			} else {
+				affinityMissCounter.Inc(1)
+				logging.Warnf(a.pool.logger, "warning: affinity target %s for %s is unavailable, using %s instead", preferred[0].Address, key, target.Address)
+			}
+			return conn, nil
+		}
+
+		dialErrorCounter.Inc(1)
+		target.markDown(a.pool.cooloff)
+		logging.Warnf(a.pool.logger, "error dialing backend %s, marking down for %s: %s", target.Address, a.pool.cooloff, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", target.Address, err))
+	}
+
+	return nil, fmt.Errorf("unable to connect to any backend (%s)", strings.Join(errs, "; "))
+}
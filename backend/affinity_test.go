@@ -0,0 +1,133 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func affinityTargets(addresses []string, dialed *[]string, fail map[string]*bool) []*Target {
+	targets := []*Target{}
+	for _, address := range addresses {
+		targets = append(targets, recordingTarget(address, dialed, fail[address]))
+	}
+	return targets
+}
+
+func TestAffinityStable(t *testing.T) {
+	var dialed []string
+	affinity := NewAffinity(NewPool(affinityTargets([]string{"a:1", "b:1", "c:1"}, &dialed, nil), time.Minute, &testLogger{}))
+
+	for i := 0; i < 3; i++ {
+		conn, err := affinity.Dial("10.0.0.1")
+		assert.Nil(t, err, "should be able to dial")
+		conn.Close()
+	}
+	assert.Len(t, dialed, 3)
+	assert.Equal(t, dialed[0], dialed[1], "same key should go to same target")
+	assert.Equal(t, dialed[0], dialed[2], "same key should go to same target")
+
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		used[affinity.Targets(fmt.Sprintf("10.0.0.%d", i))[0].Address] = true
+	}
+	assert.Len(t, used, 3, "keys should be spread across all targets")
+}
+
+func TestAffinityMinimalReshuffle(t *testing.T) {
+	before := NewAffinity(NewPool(affinityTargets([]string{"a:1", "b:1", "c:1"}, nil, nil), time.Minute, &testLogger{}))
+	after := NewAffinity(NewPool(affinityTargets([]string{"a:1", "b:1", "c:1", "d:1"}, nil, nil), time.Minute, &testLogger{}))
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		old, new := before.Targets(key)[0].Address, after.Targets(key)[0].Address
+		if old != new {
+			assert.Equal(t, "d:1", new, "keys should only move to the new target")
+			moved++
+		}
+	}
+	assert.True(t, moved > 100 && moved < 400, "about a quarter of keys should move (moved %d)", moved)
+}
+
+func TestAffinityFallback(t *testing.T) {
+	var dialed []string
+	fail := map[string]*bool{"a:1": new(bool), "b:1": new(bool), "c:1": new(bool)}
+	affinity := NewAffinity(NewPool(affinityTargets([]string{"a:1", "b:1", "c:1"}, &dialed, fail), time.Minute, &testLogger{}))
+
+	order := affinity.Targets("10.0.0.1")
+	assert.Len(t, order, 3, "should list each target once")
+	*fail[order[0].Address] = true
+
+	hits, misses := affinityHitCounter.Count(), affinityMissCounter.Count()
+	conn, err := affinity.Dial("10.0.0.1")
+	assert.Nil(t, err, "should fall back to next target")
+	conn.Close()
+	assert.Equal(t, []string{order[0].Address, order[1].Address}, dialed, "should try next target on ring")
+	assert.False(t, order[0].Up(), "failed target should be marked down")
+	assert.Equal(t, hits, affinityHitCounter.Count())
+	assert.Equal(t, misses+1, affinityMissCounter.Count(), "should count miss")
+
+	// Target is marked down, so it's skipped without dialing.
+	dialed = nil
+	conn, err = affinity.Dial("10.0.0.1")
+	assert.Nil(t, err)
+	conn.Close()
+	assert.Equal(t, []string{order[1].Address}, dialed, "should skip target marked down")
+
+	for _, target := range order[1:] {
+		*fail[target.Address] = true
+	}
+	dialed = nil
+	_, err = affinity.Dial("10.0.0.1")
+	assert.NotNil(t, err, "should fail if all targets fail")
+	assert.Len(t, dialed, 3, "should try all targets, even if marked down")
+}
+
+func TestAffinityHit(t *testing.T) {
+	affinity := NewAffinity(NewPool(affinityTargets([]string{"a:1", "b:1"}, new([]string), nil), time.Minute, &testLogger{}))
+
+	hits, misses := affinityHitCounter.Count(), affinityMissCounter.Count()
+	conn, err := affinity.Dial("10.0.0.1")
+	assert.Nil(t, err)
+	conn.Close()
+	assert.Equal(t, hits+1, affinityHitCounter.Count(), "should count hit")
+	assert.Equal(t, misses, affinityMissCounter.Count())
+
+	_, err = NewAffinity(NewPool(nil, time.Minute, &testLogger{})).Dial("10.0.0.1")
+	assert.NotNil(t, err, "should fail without targets")
+}
+
+func TestAffinityWeighted(t *testing.T) {
+	targets := affinityTargets([]string{"a:1", "b:1", "c:1"}, nil, nil)
+	targets[0].Weight = 3
+	targets[2].Weight = 0
+	affinity := NewAffinity(NewPool(targets, time.Minute, &testLogger{}))
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		assert.Len(t, affinity.Targets(key), 2, "should skip target with zero weight")
+		counts[affinity.Targets(key)[0].Address]++
+	}
+	assert.Equal(t, 0, counts["c:1"], "should not send keys to target with zero weight")
+	assert.True(t, counts["a:1"] > 2*counts["b:1"], "should send more keys to target with higher weight (got %v)", counts)
+}
@@ -0,0 +1,242 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var consulErrorCounter = metrics.GetOrRegisterCounter("backend.consul.error", metrics.DefaultRegistry)
+
+var (
+	// How long Consul may hold a blocking query before answering.
+	consulWait = 5 * time.Minute
+	// How long to wait before querying again after an error.
+	consulRetry = 5 * time.Second
+)
+
+// ConsulConfig configures consul:SERVICE targets.
+type ConsulConfig struct {
+	// Address of the Consul HTTP API, e.g. 127.0.0.1:8500 or
+	// https://consul.example.com:8501.
+	Address string
+	// ACL token sent with queries (optional).
+	Token string
+	// Poll the health API at this interval, instead of using blocking
+	// queries (optional).
+	PollInterval time.Duration
+	// HTTP client for queries (optional).
+	Client *http.Client
+	Logger Logger
+}
+
+// NewConsulResolverFactory returns a factory for resolvers that look up
+// passing instances of a service in Consul, to be registered with
+// RegisterTargetResolver. Names are of the form SERVICE, optionally followed
+// by query parameters for the health API (e.g. SERVICE?tag=TAG&dc=DC).
+// Resolvers for the same name share a single watch on Consul.
+func NewConsulResolverFactory(config ConsulConfig) TargetResolverFactory {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: consulWait + time.Minute}
+	}
+	if !strings.Contains(config.Address, "://") {
+		config.Address = "http://" + config.Address
+	}
+
+	var mu sync.Mutex
+	watches := map[string]*ConsulResolver{}
+	return func(name string) (TargetResolver, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r, ok := watches[name]; ok {
+			return r, nil
+		}
+		r, err := newConsulResolver(config, name)
+		if err != nil {
+			return nil, err
+		}
+		go r.watch()
+		watches[name] = r
+		return r, nil
+	}
+}
+
+// ConsulResolver resolves a service to the addresses of its passing instances
+// in Consul, spreading connections across them in turn. The instance set is
+// kept up to date in the background. If Consul is unavailable, the last known
+// instances are used.
+type ConsulResolver struct {
+	config  ConsulConfig
+	service string
+	query   url.Values
+	addressSet
+}
+
+func newConsulResolver(config ConsulConfig, name string) (*ConsulResolver, error) {
+	parts := strings.SplitN(name, "?", 2)
+	if parts[0] == "" || strings.ContainsAny(parts[0], "/ ") {
+		return nil, fmt.Errorf("invalid Consul service name '%s'", parts[0])
+	}
+	query := url.Values{}
+	if len(parts) == 2 {
+		var err error
+		query, err = url.ParseQuery(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid query for Consul service %s: %s", parts[0], err)
+		}
+	}
+	query.Set("passing", "true")
+
+	return &ConsulResolver{
+		config:     config,
+		service:    parts[0],
+		query:      query,
+		addressSet: newAddressSet(),
+	}, nil
+}
+
+// Resolve returns the address of the next passing instance. It blocks until
+// the first query to Consul completed.
+func (r *ConsulResolver) Resolve() (string, error) {
+	return r.resolve(fmt.Errorf("no passing instances of service %s in Consul", r.service))
+}
+
+// Keep instances up to date, with blocking queries or by polling.
+func (r *ConsulResolver) watch() {
+	index := uint64(0)
+	for {
+		addrs, newIndex, err := r.fetch(index)
+		r.update(addrs, err)
+		r.markReady()
+
+		switch {
+		case err != nil:
+			time.Sleep(consulRetry)
+			index = 0
+		case r.config.PollInterval > 0:
+			time.Sleep(r.config.PollInterval)
+		case newIndex == 0:
+			// Blocking queries need an index, don't hammer Consul without one.
+			time.Sleep(consulRetry)
+		case newIndex < index:
+			// Index went backwards (e.g. Consul was restored), start over.
+			index = 0
+		default:
+			index = newIndex
+		}
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Query passing instances of the service. With a non-zero index, this is a
+// blocking query that returns once the result changed (or Consul timed out).
+func (r *ConsulResolver) fetch(index uint64) ([]string, uint64, error) {
+	query := url.Values{}
+	for k, v := range r.query {
+		query[k] = v
+	}
+	if index > 0 && r.config.PollInterval <= 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(r.config.Address, "/"), url.PathEscape(r.service), query.Encode()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.config.Token != "" {
+		req.Header.Set("X-Consul-Token", r.config.Token)
+	}
+
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected response from Consul: %s", resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("invalid response from Consul: %s", err)
+	}
+
+	addrs := []string{}
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		if host == "" || entry.Service.Port <= 0 {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	sort.Strings(addrs)
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return addrs, newIndex, nil
+}
+
+// Record the result of a query. On errors, the last known instances are kept.
+func (r *ConsulResolver) update(addrs []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		consulErrorCounter.Inc(1)
+		if len(r.addrs) > 0 {
+			logging.Warnf(r.config.Logger, "warning: unable to query Consul for service %s, using last known instances (%s): %s", r.service, strings.Join(r.addrs, ", "), err)
+			return
+		}
+		logging.Warnf(r.config.Logger, "warning: unable to query Consul for service %s: %s", r.service, err)
+		r.err = fmt.Errorf("unable to query Consul for service %s: %s", r.service, err)
+		return
+	}
+
+	if !equalStrings(addrs, r.addrs) {
+		if len(addrs) == 0 {
+			logging.Warnf(r.config.Logger, "warning: no passing instances of service %s in Consul", r.service)
+		} else {
+			r.config.Logger.Printf("instances of service %s: %s", r.service, strings.Join(addrs, ", "))
+		}
+	}
+	r.addrs = addrs
+	r.err = nil
+}
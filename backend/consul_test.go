@@ -0,0 +1,129 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a fake Consul server answering health queries for service "web",
+// with the given JSON entries and index. Requests are recorded in requests.
+func testConsulServer(entries *string, requests *[]*http.Request) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		if r.URL.Path != "/v1/health/service/web" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "42")
+		fmt.Fprint(w, *entries)
+	}))
+}
+
+func TestConsulResolverFetch(t *testing.T) {
+	entries := `[
+		{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8080}},
+		{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.0.1.2", "Port": 8081}}
+	]`
+	var requests []*http.Request
+	server := testConsulServer(&entries, &requests)
+	defer server.Close()
+
+	r, err := newConsulResolver(ConsulConfig{Address: server.URL, Token: "secret", Client: server.Client(), Logger: &testLogger{}}, "web?tag=primary")
+	assert.Nil(t, err, "should create resolver")
+
+	addrs, index, err := r.fetch(0)
+	assert.Nil(t, err, "should query Consul")
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.1.2:8081"}, addrs, "should use service address, falling back to node address")
+	assert.Equal(t, uint64(42), index)
+
+	query := requests[0].URL.Query()
+	assert.Equal(t, "true", query.Get("passing"), "should only ask for passing instances")
+	assert.Equal(t, "primary", query.Get("tag"), "should pass on query parameters")
+	assert.Equal(t, "", query.Get("index"), "first query should not block")
+	assert.Equal(t, "secret", requests[0].Header.Get("X-Consul-Token"))
+
+	_, _, err = r.fetch(42)
+	assert.Nil(t, err, "should query Consul")
+	query = requests[1].URL.Query()
+	assert.Equal(t, "42", query.Get("index"), "should make blocking query with last index")
+	assert.NotEqual(t, "", query.Get("wait"))
+}
+
+func TestConsulResolverRoundRobin(t *testing.T) {
+	r, err := newConsulResolver(ConsulConfig{Logger: &testLogger{}}, "web")
+	assert.Nil(t, err, "should create resolver")
+	r.update([]string{"10.0.0.1:8080", "10.0.0.2:8080"}, nil)
+	close(r.ready)
+
+	var resolved []string
+	for i := 0; i < 4; i++ {
+		addr, err := r.Resolve()
+		assert.Nil(t, err, "should resolve")
+		resolved = append(resolved, addr)
+	}
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.1:8080", "10.0.0.2:8080"}, resolved, "should rotate through instances")
+
+	r.update(nil, errors.New("connection refused"))
+	addr, err := r.Resolve()
+	assert.Nil(t, err, "should keep last known instances if Consul is unavailable")
+	assert.Contains(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, addr)
+
+	r.update([]string{}, nil)
+	_, err = r.Resolve()
+	assert.NotNil(t, err, "should fail without passing instances")
+}
+
+func TestConsulResolverUnavailable(t *testing.T) {
+	r, err := newConsulResolver(ConsulConfig{Logger: &testLogger{}}, "web")
+	assert.Nil(t, err, "should create resolver")
+	r.update(nil, errors.New("connection refused"))
+	close(r.ready)
+
+	_, err = r.Resolve()
+	assert.NotNil(t, err, "should fail if Consul was never reachable")
+}
+
+func TestConsulResolverFactory(t *testing.T) {
+	entries := `[{"Node": {"Address": "10.0.0.1"}, "Service": {"Port": 8080}}]`
+	var requests []*http.Request
+	server := testConsulServer(&entries, &requests)
+	defer server.Close()
+
+	factory := NewConsulResolverFactory(ConsulConfig{Address: server.URL, PollInterval: time.Hour, Logger: &testLogger{}})
+	r1, err := factory("web")
+	assert.Nil(t, err, "should create resolver")
+	r2, err := factory("web")
+	assert.Nil(t, err, "should create resolver")
+	assert.True(t, r1 == r2, "should share watch for same service")
+
+	addr, err := r1.Resolve()
+	assert.Nil(t, err, "should resolve after first query")
+	assert.Equal(t, "10.0.0.1:8080", addr)
+
+	_, err = factory("")
+	assert.NotNil(t, err, "should reject empty service name")
+	_, err = factory("web?%zz")
+	assert.NotNil(t, err, "should reject invalid query")
+}
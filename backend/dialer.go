@@ -0,0 +1,310 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var familyFallbackCounter = metrics.GetOrRegisterCounter("backend.dial.fallback", metrics.DefaultRegistry)
+
+// ResolvingDialer dials TCP addresses by resolving hostnames itself (see
+// Resolver), and racing connection attempts to the resolved addresses in the
+// style of RFC 8305 ("Happy Eyeballs"): IPv6 and IPv4 addresses are
+// interleaved, and if an attempt hasn't succeeded after a short delay, an
+// attempt to the next address is started in parallel. The first successful
+// connection wins, and the other attempts are canceled.
+type ResolvingDialer struct {
+	// Dialer used to establish connections to resolved addresses.
+	Dialer *net.Dialer
+	// Network to restrict addresses to ("tcp4" or "tcp6"), or "tcp" for both.
+	Network string
+	// Delay before starting the next connection attempt. If zero, addresses
+	// are dialed sequentially.
+	Delay time.Duration
+	// Interval for caching resolved addresses (see Resolver).
+	RefreshInterval time.Duration
+	// Logger is used to log information messages about connections.
+	Logger Logger
+	// Quiet disables logging of routine per-connection messages.
+	Quiet bool
+	// LocalIP, if set, is the source address for TCP connections. Targets
+	// must be of the same address family.
+	LocalIP net.IP
+	// LocalPorts, if set, is the range of source ports (inclusive) for TCP
+	// connections from LocalIP. A random free port in the range is used.
+	LocalPorts [2]int
+
+	// Mutex for resolvers below.
+	mu sync.Mutex
+	// Resolvers per host name.
+	resolvers map[string]*Resolver
+}
+
+// Dial connects to the address on the named network. Addresses with a
+// hostname are resolved and dialed as described above, IP addresses and
+// non-TCP networks are dialed as-is.
+func (d *ResolvingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.dialFrom(d.LocalIP, d.LocalPorts, network, address)
+}
+
+// DialFrom is like Dial, but connects from the given source address instead
+// of LocalIP and LocalPorts (with a random port), e.g. from the address of a
+// client for transparent proxying. The source address doesn't need to be
+// local if the Dialer sets IP_TRANSPARENT (see sockopt.Transparent).
+func (d *ResolvingDialer) DialFrom(local net.IP, network, address string) (net.Conn, error) {
+	return d.dialFrom(local, [2]int{}, network, address)
+}
+
+func (d *ResolvingDialer) dialFrom(local net.IP, ports [2]int, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if !strings.HasPrefix(network, "tcp") || err != nil || net.ParseIP(host) != nil {
+		if network == "tcp" && d.Network != "" {
+			network = d.Network
+		}
+		if strings.HasPrefix(network, "tcp") {
+			return d.dial(context.Background(), local, ports, network, address)
+		}
+		return d.Dialer.Dial(network, address)
+	}
+
+	addrs, err := d.resolver(host, port).Addresses()
+	if err != nil {
+		return nil, err
+	}
+	addrs = sortAddresses(filterAddresses(addrs, d.Network))
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no %s addresses found for %s", familyName(d.Network), host)
+	}
+
+	conn, addr, err := dialParallel(addrs, d.Delay, func(ctx context.Context, address string) (net.Conn, error) {
+		return d.dial(ctx, local, ports, "tcp", address)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s (%s)", host, err)
+	}
+
+	family := addressFamily(addr)
+	fallback := family != addressFamily(addrs[0])
+	if fallback {
+		familyFallbackCounter.Inc(1)
+	}
+	if !d.Quiet {
+		if fallback {
+			d.Logger.Printf("connected to backend %s via %s (fallback from %s)", addr, familyName(family), familyName(addressFamily(addrs[0])))
+		} else {
+			d.Logger.Printf("connected to backend %s via %s", addr, familyName(family))
+		}
+	}
+	return conn, nil
+}
+
+// Dial a single TCP address, from the local IP (and a port in the range of
+// ports) if set.
+func (d *ResolvingDialer) dial(ctx context.Context, localIP net.IP, ports [2]int, network, address string) (net.Conn, error) {
+	if localIP == nil {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+
+	local := addressFamily(net.JoinHostPort(localIP.String(), "0"))
+	if family := addressFamily(address); family != local {
+		return nil, fmt.Errorf("can't connect to %s address %s from %s local address %s", familyName(family), address, familyName(local), localIP)
+	}
+
+	dialer := *d.Dialer
+	low, high := ports[0], ports[1]
+	if high == 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect from local address %s (%s)", localIP, err)
+		}
+		return conn, nil
+	}
+
+	// Start at a random port, and move on to the next one while ports are in use.
+	size := high - low + 1
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		dialer.LocalAddr = &net.TCPAddr{IP: localIP, Port: low + (start+i)%size}
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("unable to connect from local address %s (%s)", dialer.LocalAddr, err)
+		}
+	}
+	return nil, fmt.Errorf("no free port in local port range %d-%d on %s", low, high, localIP)
+}
+
+// Get (or create) resolver for host name.
+func (d *ResolvingDialer) resolver(host, port string) *Resolver {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := net.JoinHostPort(host, port)
+	if d.resolvers == nil {
+		d.resolvers = map[string]*Resolver{}
+	}
+	r, ok := d.resolvers[key]
+	if !ok {
+		r = NewResolver(host, port, d.RefreshInterval, d.Logger)
+		d.resolvers[key] = r
+	}
+	return r
+}
+
+type dialResult struct {
+	conn    net.Conn
+	address string
+	err     error
+}
+
+// Dial addresses in order, starting the next attempt if the previous one didn't
+// succeed after delay (or immediately if it failed). Returns the first
+// successful connection, and cancels/closes all others.
+func dialParallel(addrs []string, delay time.Duration, dial func(ctx context.Context, address string) (net.Conn, error)) (net.Conn, string, error) {
+	if len(addrs) == 0 {
+		return nil, "", errors.New("no addresses to dial")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		address := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, address)
+			results <- dialResult{conn, address, err}
+		}()
+	}
+
+	// Channel that fires when it's time to start the next attempt (nil if
+	// dialing sequentially, or if there are no more addresses).
+	var timeout <-chan time.Time
+	startNext := func() {
+		start()
+		timeout = nil
+		if delay > 0 && next < len(addrs) {
+			timeout = time.After(delay)
+		}
+	}
+
+	var errs []string
+	startNext()
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close connections from attempts that still succeed after
+				// we've picked a winner.
+				go func(remaining int) {
+					for i := 0; i < remaining; i++ {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, result.address, nil
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", result.address, result.err))
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-timeout:
+			startNext()
+		}
+	}
+
+	return nil, "", errors.New(strings.Join(errs, "; "))
+}
+
+// Filter addresses (HOST:PORT) by network ("tcp4", "tcp6", or anything else for all).
+func filterAddresses(addrs []string, network string) []string {
+	if network != "tcp4" && network != "tcp6" {
+		return addrs
+	}
+	out := []string{}
+	for _, addr := range addrs {
+		if addressFamily(addr) == network {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// Sort addresses for dialing as per RFC 8305 (section 4): interleave IPv6
+// and IPv4 addresses, starting with IPv6, but otherwise keep original order.
+func sortAddresses(addrs []string) []string {
+	var v6, v4 []string
+	for _, addr := range addrs {
+		if addressFamily(addr) == "tcp6" {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+
+	out := make([]string, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// Returns "tcp4" or "tcp6" depending on the IP in the address (HOST:PORT).
+func addressFamily(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+func familyName(network string) string {
+	switch network {
+	case "tcp4":
+		return "IPv4"
+	case "tcp6":
+		return "IPv6"
+	}
+	return "IP"
+}
@@ -0,0 +1,213 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortAddresses(t *testing.T) {
+	addrs := []string{"10.0.0.1:80", "10.0.0.2:80", "[2001:db8::1]:80", "10.0.0.3:80", "[2001:db8::2]:80"}
+	assert.Equal(t,
+		[]string{"[2001:db8::1]:80", "10.0.0.1:80", "[2001:db8::2]:80", "10.0.0.2:80", "10.0.0.3:80"},
+		sortAddresses(addrs), "should interleave address families, starting with IPv6")
+
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}, filterAddresses(addrs, "tcp4"))
+	assert.Equal(t, []string{"[2001:db8::1]:80", "[2001:db8::2]:80"}, filterAddresses(addrs, "tcp6"))
+	assert.Equal(t, addrs, filterAddresses(addrs, "tcp"))
+}
+
+func TestDialParallelFallback(t *testing.T) {
+	// First address hangs until canceled, second one succeeds.
+	canceled := make(chan struct{})
+	conn, addr, err := dialParallel([]string{"[2001:db8::1]:80", "10.0.0.1:80"}, 10*time.Millisecond, func(ctx context.Context, address string) (net.Conn, error) {
+		if address == "[2001:db8::1]:80" {
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	})
+	assert.Nil(t, err, "should connect to second address")
+	assert.Equal(t, "10.0.0.1:80", addr)
+	conn.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("losing connection attempt should be canceled")
+	}
+}
+
+func TestDialParallelSequential(t *testing.T) {
+	var mu sync.Mutex
+	var dialed []string
+	_, _, err := dialParallel([]string{"10.0.0.1:80", "10.0.0.2:80"}, 0, func(ctx context.Context, address string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, address)
+		mu.Unlock()
+		return nil, errors.New("failure for test")
+	})
+	assert.NotNil(t, err, "should fail if all addresses fail")
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, dialed, "should try all addresses in order")
+
+	_, _, err = dialParallel(nil, 0, nil)
+	assert.NotNil(t, err, "should fail without addresses")
+}
+
+func TestResolvingDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	d := &ResolvingDialer{
+		Dialer:  &net.Dialer{Timeout: time.Second},
+		Network: "tcp4",
+		Delay:   10 * time.Millisecond,
+		Logger:  &testLogger{},
+	}
+
+	// Pre-populate resolver with fake lookup results
+	r := d.resolver("backend.example.com", port)
+	r.lookup = func(host string) ([]string, error) {
+		return []string{"::1", "127.0.0.1"}, nil
+	}
+
+	fallbacks := familyFallbackCounter.Count()
+	conn, err := d.Dial("tcp", "backend.example.com:"+port)
+	assert.Nil(t, err, "should be able to dial resolved address")
+	assert.Equal(t, ln.Addr().String(), conn.RemoteAddr().String(), "should only dial IPv4 addresses")
+	conn.Close()
+	assert.Equal(t, fallbacks, familyFallbackCounter.Count(), "should not count fallback if only one family allowed")
+
+	conn, err = d.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial IP address directly")
+	conn.Close()
+
+	d.Network = "tcp6"
+	_, err = d.Dial("tcp", "backend.example.com:"+port)
+	assert.NotNil(t, err, "should fail if no addresses in allowed family")
+}
+
+func TestResolvingDialerLocalAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &ResolvingDialer{
+		Dialer:  &net.Dialer{Timeout: time.Second},
+		Network: "tcp4",
+		Logger:  &testLogger{},
+		LocalIP: net.ParseIP("127.0.0.1"),
+	}
+
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial from local address")
+	assert.True(t, conn.LocalAddr().(*net.TCPAddr).IP.Equal(d.LocalIP), "should use local address")
+	conn.Close()
+
+	// Find a free port to use as the local port range
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	d.LocalPorts = [2]int{port, port}
+	conn, err = d.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial from local port range")
+	assert.Equal(t, port, conn.LocalAddr().(*net.TCPAddr).Port, "should use port from range")
+	conn.Close()
+
+	busy, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err == nil {
+		_, err = d.Dial("tcp", ln.Addr().String())
+		assert.NotNil(t, err, "should fail if all ports in range are in use")
+		assert.Contains(t, err.Error(), "local port range")
+		busy.Close()
+	}
+	d.LocalPorts = [2]int{}
+
+	d.LocalIP = net.ParseIP("::1")
+	_, err = d.Dial("tcp", ln.Addr().String())
+	assert.NotNil(t, err, "should fail if address families don't match")
+	assert.Contains(t, err.Error(), "::1")
+
+	d.LocalIP = net.ParseIP("192.0.2.1")
+	_, err = d.Dial("tcp", ln.Addr().String())
+	assert.NotNil(t, err, "should fail with unusable local address")
+	assert.Contains(t, err.Error(), "192.0.2.1", "should name local address in error")
+
+	_, err = d.Dial("unix", "/tmp/ghostunnel-test-does-not-exist.sock")
+	assert.NotContains(t, err.Error(), "local address", "should not use local address for UNIX sockets")
+}
+
+func TestResolvingDialerDialFrom(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &ResolvingDialer{
+		Dialer: &net.Dialer{Timeout: time.Second},
+		Logger: &testLogger{},
+	}
+
+	conn, err := d.DialFrom(net.ParseIP("127.0.0.1"), "tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial from given address")
+	assert.True(t, conn.LocalAddr().(*net.TCPAddr).IP.Equal(net.ParseIP("127.0.0.1")), "should use given address")
+	conn.Close()
+
+	_, err = d.DialFrom(net.ParseIP("::1"), "tcp", ln.Addr().String())
+	assert.NotNil(t, err, "should reject source address from other family")
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TargetResolver looks up the address of a target that can change over time,
+// e.g. from the environment or from service discovery. It's called for every
+// connection, so implementations that are expensive to query should cache
+// results. Addresses are in the same form as plain targets (HOST:PORT or
+// unix:PATH).
+type TargetResolver interface {
+	Resolve() (string, error)
+}
+
+// TargetResolverFunc adapts a function to the TargetResolver interface.
+type TargetResolverFunc func() (string, error)
+
+// Resolve calls f.
+func (f TargetResolverFunc) Resolve() (string, error) {
+	return f()
+}
+
+// TargetResolverFactory creates a resolver for a target address with a
+// registered scheme, given the part after the "SCHEME:" prefix.
+type TargetResolverFactory func(name string) (TargetResolver, error)
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]TargetResolverFactory{
+		"env": NewEnvResolver,
+	}
+)
+
+// RegisterTargetResolver makes targets of the form "SCHEME:NAME" use the
+// resolver created by factory, e.g. for lookups in Consul or etcd. The "env"
+// scheme is always registered.
+func RegisterTargetResolver(scheme string, factory TargetResolverFactory) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	resolvers[scheme] = factory
+}
+
+// IsResolvedTarget checks if address uses the scheme of a registered resolver.
+func IsResolvedTarget(address string) bool {
+	_, _, ok := resolverFactory(address)
+	return ok
+}
+
+// NewTargetResolver creates the resolver for a target address with a
+// registered scheme (see IsResolvedTarget).
+func NewTargetResolver(address string) (TargetResolver, error) {
+	factory, name, ok := resolverFactory(address)
+	if !ok {
+		return nil, fmt.Errorf("no resolver for target %s", address)
+	}
+	return factory(name)
+}
+
+func resolverFactory(address string) (TargetResolverFactory, string, bool) {
+	parts := strings.SplitN(address, ":", 2)
+	if len(parts) != 2 {
+		return nil, "", false
+	}
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	factory, ok := resolvers[parts[0]]
+	return factory, parts[1], ok
+}
+
+// NewEnvResolver creates a resolver that reads the target address from the
+// given environment variable, every time it's resolved.
+func NewEnvResolver(variable string) (TargetResolver, error) {
+	if variable == "" || strings.ContainsAny(variable, "=\x00") {
+		return nil, fmt.Errorf("invalid environment variable name '%s'", variable)
+	}
+	return TargetResolverFunc(func() (string, error) {
+		address := strings.TrimSpace(os.Getenv(variable))
+		if address == "" {
+			return "", fmt.Errorf("environment variable %s is not set", variable)
+		}
+		return address, nil
+	}), nil
+}
+
+// addressSet holds the addresses of a target that are kept up to date in the
+// background (e.g. instances of a service), and spreads connections across
+// them in turn.
+type addressSet struct {
+	// Closed once the first lookup completed (successfully or not)
+	ready     chan struct{}
+	readyOnce sync.Once
+	// Mutex for current addresses
+	mu    sync.Mutex
+	addrs []string
+	// Error from the last lookup, only kept if there are no addresses
+	err error
+	// Counter for rotating through addresses
+	next uint32
+}
+
+func newAddressSet() addressSet {
+	return addressSet{ready: make(chan struct{})}
+}
+
+// markReady unblocks resolve, once the first lookup completed.
+func (s *addressSet) markReady() {
+	s.readyOnce.Do(func() { close(s.ready) })
+}
+
+// resolve returns the next address, or empty if there are none (and no
+// error). It blocks until the first lookup completed.
+func (s *addressSet) resolve(empty error) (string, error) {
+	<-s.ready
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.addrs) == 0 {
+		if s.err != nil {
+			return "", s.err
+		}
+		return "", empty
+	}
+	next := atomic.AddUint32(&s.next, 1) - 1
+	return s.addrs[int(next)%len(s.addrs)], nil
+}
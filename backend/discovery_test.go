@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvResolver(t *testing.T) {
+	defer os.Unsetenv("GHOSTUNNEL_TEST_TARGET")
+
+	r, err := NewTargetResolver("env:GHOSTUNNEL_TEST_TARGET")
+	assert.Nil(t, err, "should create env resolver")
+
+	_, err = r.Resolve()
+	assert.NotNil(t, err, "should fail if variable is not set")
+
+	os.Setenv("GHOSTUNNEL_TEST_TARGET", "localhost:8080")
+	addr, err := r.Resolve()
+	assert.Nil(t, err, "should resolve variable")
+	assert.Equal(t, "localhost:8080", addr)
+
+	os.Setenv("GHOSTUNNEL_TEST_TARGET", " unix:/tmp/backend.sock\n")
+	addr, err = r.Resolve()
+	assert.Nil(t, err, "should re-read variable")
+	assert.Equal(t, "unix:/tmp/backend.sock", addr)
+}
+
+func TestEnvResolverInvalidName(t *testing.T) {
+	_, err := NewTargetResolver("env:")
+	assert.NotNil(t, err, "should reject empty variable name")
+
+	_, err = NewTargetResolver("env:A=B")
+	assert.NotNil(t, err, "should reject invalid variable name")
+}
+
+func TestRegisterTargetResolver(t *testing.T) {
+	assert.False(t, IsResolvedTarget("test:backend"), "scheme should not be registered yet")
+	assert.False(t, IsResolvedTarget("localhost:8080"), "plain target should not be resolved")
+	assert.False(t, IsResolvedTarget("unix:/tmp/backend.sock"), "unix target should not be resolved")
+	assert.True(t, IsResolvedTarget("env:BACKEND_ADDR"), "env scheme should be registered")
+
+	_, err := NewTargetResolver("test:backend")
+	assert.NotNil(t, err, "should fail for unknown scheme")
+
+	RegisterTargetResolver("test", func(name string) (TargetResolver, error) {
+		if name != "backend" {
+			return nil, errors.New("unknown service")
+		}
+		return TargetResolverFunc(func() (string, error) {
+			return "localhost:9000", nil
+		}), nil
+	})
+	assert.True(t, IsResolvedTarget("test:backend"), "scheme should be registered")
+
+	r, err := NewTargetResolver("test:backend")
+	assert.Nil(t, err, "should create registered resolver")
+	addr, err := r.Resolve()
+	assert.Nil(t, err, "should resolve")
+	assert.Equal(t, "localhost:9000", addr)
+
+	_, err = NewTargetResolver("test:other")
+	assert.NotNil(t, err, "should pass on factory errors")
+}
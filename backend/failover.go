@@ -0,0 +1,141 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	failoverCounter = metrics.GetOrRegisterCounter("backend.failover", metrics.DefaultRegistry)
+	failbackCounter = metrics.GetOrRegisterCounter("backend.failback", metrics.DefaultRegistry)
+)
+
+// Failover dials targets in priority order: the first target is the primary,
+// and subsequent targets are only used if all targets before it are unreachable.
+type Failover struct {
+	targets []*Target
+	logger  Logger
+	// Mutex for updating the active target
+	mu sync.Mutex
+	// Index of target currently considered healthy
+	active int32
+	// Set to 1 while a health check is running
+	probing int32
+}
+
+// NewFailover creates a new failover dialer, with targets in priority order.
+func NewFailover(targets []*Target, logger Logger) *Failover {
+	return &Failover{
+		targets: targets,
+		logger:  logger,
+	}
+}
+
+// Targets returns the targets in priority order.
+func (f *Failover) Targets() []*Target {
+	return f.targets
+}
+
+// Active returns the target currently considered healthy, i.e. the target
+// that was most recently dialed (or probed) successfully.
+func (f *Failover) Active() *Target {
+	return f.targets[atomic.LoadInt32(&f.active)]
+}
+
+// Dial connects to the highest priority target that is reachable. If a health
+// check is running, dialing starts at the currently active target instead, so
+// that an outage of the primary doesn't add latency to every connection. The
+// health check is then responsible for detecting recovery of the primary.
+func (f *Failover) Dial() (net.Conn, error) {
+	if len(f.targets) == 0 {
+		return nil, errors.New("no backend targets available")
+	}
+
+	start := 0
+	if atomic.LoadInt32(&f.probing) == 1 {
+		start = int(atomic.LoadInt32(&f.active))
+	}
+
+	var errs []string
+	for i := 0; i < len(f.targets); i++ {
+		index := (start + i) % len(f.targets)
+		target := f.targets[index]
+
+		conn, err := target.Dial()
+		if err == nil {
+			target.counter.Inc(1)
+			f.setActive(index)
+			return conn, nil
+		}
+
+		dialErrorCounter.Inc(1)
+		logging.Warnf(f.logger, "error dialing backend %s: %s", target.Address, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", target.Address, err))
+	}
+
+	return nil, fmt.Errorf("unable to connect to any backend (%s)", strings.Join(errs, "; "))
+}
+
+// StartHealthCheck starts probing all targets in the background at the given
+// interval, to keep track of the highest priority healthy target. Returns a
+// function that stops the health check.
+func (f *Failover) StartHealthCheck(interval time.Duration) (stop func()) {
+	atomic.StoreInt32(&f.probing, 1)
+	stopHealth := f.healthCheck().Start(interval)
+	return func() {
+		atomic.StoreInt32(&f.probing, 0)
+		stopHealth()
+	}
+}
+
+// Health check that marks the first reachable target as active. If no target
+// is reachable, the active target is left as-is.
+func (f *Failover) healthCheck() *HealthCheck {
+	health := newHealthCheck(f.targets, nil, "failover health check", 1, f.logger)
+	health.passed = f.setActive
+	return health
+}
+
+// Update the active target, logging and counting failover/fail-back events.
+func (f *Failover) setActive(index int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous := int(atomic.LoadInt32(&f.active))
+	if previous == index {
+		return
+	}
+	atomic.StoreInt32(&f.active, int32(index))
+
+	if index > previous {
+		failoverCounter.Inc(1)
+		logging.Warnf(f.logger, "failing over from backend %s to %s", f.targets[previous].Address, f.targets[index].Address)
+	} else {
+		failbackCounter.Inc(1)
+		logging.Warnf(f.logger, "failing back from backend %s to %s", f.targets[previous].Address, f.targets[index].Address)
+	}
+}
@@ -0,0 +1,127 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverPrefersPrimary(t *testing.T) {
+	var dialed []string
+	failover := NewFailover([]*Target{
+		recordingTarget("primary:1", &dialed, nil),
+		recordingTarget("standby:1", &dialed, nil),
+	}, &testLogger{})
+
+	for i := 0; i < 3; i++ {
+		conn, err := failover.Dial()
+		assert.Nil(t, err, "should be able to dial")
+		conn.Close()
+	}
+
+	assert.Equal(t, []string{"primary:1", "primary:1", "primary:1"}, dialed, "should always dial primary")
+	assert.Equal(t, "primary:1", failover.Active().Address)
+}
+
+func TestFailoverAndFailback(t *testing.T) {
+	var dialed []string
+	fail := true
+	failover := NewFailover([]*Target{
+		recordingTarget("primary:1", &dialed, &fail),
+		recordingTarget("standby:1", &dialed, nil),
+	}, &testLogger{})
+
+	failovers := failoverCounter.Count()
+	failbacks := failbackCounter.Count()
+
+	for i := 0; i < 2; i++ {
+		conn, err := failover.Dial()
+		assert.Nil(t, err, "should fail over to standby")
+		conn.Close()
+	}
+	assert.Equal(t, []string{"primary:1", "standby:1", "primary:1", "standby:1"}, dialed, "should try primary first on every dial")
+	assert.Equal(t, "standby:1", failover.Active().Address)
+	assert.Equal(t, failovers+1, failoverCounter.Count(), "should count failover once")
+
+	fail = false
+	conn, err := failover.Dial()
+	assert.Nil(t, err, "should be able to dial primary")
+	conn.Close()
+	assert.Equal(t, "primary:1", failover.Active().Address)
+	assert.Equal(t, failbacks+1, failbackCounter.Count(), "should count fail-back")
+}
+
+func TestFailoverAllDown(t *testing.T) {
+	var dialed []string
+	fail := true
+	failover := NewFailover([]*Target{
+		recordingTarget("primary:1", &dialed, &fail),
+		recordingTarget("standby:1", &dialed, &fail),
+	}, &testLogger{})
+
+	_, err := failover.Dial()
+	assert.NotNil(t, err, "should fail if all targets are down")
+	assert.Equal(t, "primary:1", failover.Active().Address)
+
+	_, err = NewFailover(nil, &testLogger{}).Dial()
+	assert.NotNil(t, err, "should fail without targets")
+}
+
+func TestFailoverHealthCheck(t *testing.T) {
+	var dialed []string
+	fail := true
+	failover := NewFailover([]*Target{
+		recordingTarget("primary:1", &dialed, &fail),
+		recordingTarget("standby:1", &dialed, nil),
+	}, &testLogger{})
+
+	// Run probes synchronously (and mark health check as running) to avoid
+	// racing with the background goroutine.
+	failover.probing = 1
+	health := failover.healthCheck()
+	health.check()
+	assert.Equal(t, "standby:1", failover.Active().Address, "probe should detect primary being down")
+
+	dialed = nil
+	conn, err := failover.Dial()
+	assert.Nil(t, err, "should be able to dial standby")
+	conn.Close()
+	assert.Equal(t, []string{"standby:1"}, dialed, "should not dial primary while it's known to be down")
+
+	fail = false
+	health.check()
+	assert.Equal(t, "primary:1", failover.Active().Address, "probe should detect primary recovery")
+}
+
+func TestFailoverStopHealthCheck(t *testing.T) {
+	failover := NewFailover([]*Target{
+		NewTarget("primary:1", func() (net.Conn, error) {
+			return nil, errors.New("failure for test")
+		}),
+	}, &testLogger{})
+
+	stop := failover.StartHealthCheck(time.Hour)
+	stop()
+	stop()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&failover.probing), "health check should be stopped")
+}
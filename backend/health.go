@@ -0,0 +1,299 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var healthGauge = metrics.GetOrRegisterGauge("backend.healthy", metrics.DefaultRegistry)
+
+// Probe checks that a target is healthy, given a new connection to it.
+type Probe func(conn net.Conn) error
+
+// ExchangeProbe returns a probe that sends the given data (if any) to the
+// target, and checks that the response starts with expect (if set). The whole
+// exchange must complete within timeout.
+func ExchangeProbe(send, expect []byte, timeout time.Duration) Probe {
+	return func(conn net.Conn) error {
+		if timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+		if len(send) > 0 {
+			if _, err := conn.Write(send); err != nil {
+				return fmt.Errorf("error sending probe: %s", err)
+			}
+		}
+		if len(expect) == 0 {
+			return nil
+		}
+		response := make([]byte, len(expect))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return fmt.Errorf("error reading probe response: %s", err)
+		}
+		if !bytes.Equal(response, expect) {
+			return fmt.Errorf("unexpected probe response %q", response)
+		}
+		return nil
+	}
+}
+
+// How often a failing health check logs at most, so that a long outage
+// doesn't flood the logs.
+const healthCheckLogInterval = time.Minute
+
+// HealthCheckResult is the state of a HealthCheck after its last probe.
+type HealthCheckResult struct {
+	// When the last probe ran (zero before the first one)
+	Checked time.Time
+	// Error from the last probe, nil if it succeeded
+	Err error
+	// How long the last probe took
+	Latency time.Duration
+	// When a probe last succeeded (zero if none did yet)
+	LastSuccess time.Time
+	// Number of probes in a row that failed
+	Failures int
+}
+
+// HealthCheck probes a set of targets at an interval, and considers the
+// backend healthy as long as at least one of them passes the probe. The
+// backend is assumed to be healthy until the first probe, and is considered
+// down once a number of probes in a row failed.
+type HealthCheck struct {
+	targets []*Target
+	probe   Probe
+	logger  Logger
+	// Prefix for log messages
+	name string
+	// Whether to export the result in the backend.healthy gauge
+	gauge bool
+	// Probes fail if dialing takes longer than this (zero for no limit)
+	timeout time.Duration
+	// Number of failed probes in a row before the backend is down
+	threshold int
+	// Called with the index of the first target that passed, after each
+	// successful probe (optional)
+	passed func(index int)
+	// Minimum time between logged probe failures
+	logInterval time.Duration
+	// Mutex for the fields below
+	mu     sync.Mutex
+	result HealthCheckResult
+	// When a probe failure was last logged, and how many weren't since
+	lastLog    time.Time
+	suppressed int
+}
+
+// NewHealthCheck creates a health check for the given targets. With a nil
+// probe, targets are healthy if they accept connections. The backend is
+// considered down once threshold probes in a row failed.
+func NewHealthCheck(targets []*Target, probe Probe, threshold int, logger Logger) *HealthCheck {
+	healthGauge.Update(1)
+	h := newHealthCheck(targets, probe, "health check", threshold, logger)
+	h.gauge = true
+	return h
+}
+
+func newHealthCheck(targets []*Target, probe Probe, name string, threshold int, logger Logger) *HealthCheck {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &HealthCheck{
+		targets:     targets,
+		probe:       probe,
+		logger:      logger,
+		name:        name,
+		threshold:   threshold,
+		logInterval: healthCheckLogInterval,
+	}
+}
+
+// Healthy returns false if the backend is considered down.
+func (h *HealthCheck) Healthy() bool {
+	return h.Err() == nil
+}
+
+// Err returns the reason the backend is considered down, or nil if healthy.
+func (h *HealthCheck) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.result.Failures < h.threshold {
+		return nil
+	}
+	if h.threshold > 1 {
+		return fmt.Errorf("%d probes in a row failed, last: %s", h.result.Failures, h.result.Err)
+	}
+	return h.result.Err
+}
+
+// Result returns the state after the last probe.
+func (h *HealthCheck) Result() HealthCheckResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.result
+}
+
+// Start probes targets right away, and then in the background at the given
+// interval. Returns a function that stops the health check.
+func (h *HealthCheck) Start(interval time.Duration) (stop func()) {
+	h.check()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				h.check()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Probe targets in order until one of them passes, and record the result.
+func (h *HealthCheck) check() {
+	start := time.Now()
+	var errs []string
+	for i, target := range h.targets {
+		err := h.probeTarget(target)
+		if err == nil {
+			h.update(start, nil)
+			if h.passed != nil {
+				h.passed(i)
+			}
+			return
+		}
+		if len(h.targets) == 1 {
+			h.update(start, err)
+			return
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", target.Address, err))
+	}
+	h.update(start, fmt.Errorf("no backend reachable (%s)", strings.Join(errs, "; ")))
+}
+
+func (h *HealthCheck) probeTarget(target *Target) error {
+	conn, err := h.dial(target)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if h.probe == nil {
+		return nil
+	}
+	return h.probe(conn)
+}
+
+// Dial a target, giving up after the timeout (if set). A connection made
+// after that is closed once it's there.
+func (h *HealthCheck) dial(target *Target) (net.Conn, error) {
+	if h.timeout <= 0 {
+		return target.Dial()
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := target.Dial()
+		done <- dialResult{conn, err}
+	}()
+
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+	select {
+	case result := <-done:
+		return result.conn, result.err
+	case <-timer.C:
+		go func() {
+			if result := <-done; result.err == nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %s", h.timeout)
+	}
+}
+
+// Record the result of a probe that started at the given time. Logs the
+// first failure, the backend going down and recovering right away, and other
+// failures at most once per log interval.
+func (h *HealthCheck) update(start time.Time, err error) {
+	latency := time.Since(start)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.result.Checked = start
+	h.result.Err = err
+	h.result.Latency = latency
+	if err == nil {
+		if h.result.Failures >= h.threshold {
+			h.setGauge(1)
+			h.logger.Printf("%s: backend is up again, after %d failed probe(s)", h.name, h.result.Failures)
+		} else if h.result.Failures > 0 {
+			h.logger.Printf("%s: probe passed again, after %d failed probe(s)", h.name, h.result.Failures)
+		}
+		h.result.LastSuccess = start
+		h.result.Failures = 0
+		h.lastLog = time.Time{}
+		h.suppressed = 0
+		return
+	}
+
+	h.result.Failures++
+	state := "probe failed"
+	if h.result.Failures == h.threshold {
+		h.setGauge(0)
+		state = "backend is down"
+	} else if !h.lastLog.IsZero() && start.Sub(h.lastLog) < h.logInterval {
+		h.suppressed++
+		return
+	}
+	if h.suppressed > 0 {
+		logging.Errorf(h.logger, "%s: %s: %s (%d failed probe(s) in a row, %d not logged)", h.name, state, err, h.result.Failures, h.suppressed)
+	} else {
+		logging.Errorf(h.logger, "%s: %s: %s (%d failed probe(s) in a row)", h.name, state, err, h.result.Failures)
+	}
+	h.lastLog = start
+	h.suppressed = 0
+}
+
+func (h *HealthCheck) setGauge(value int64) {
+	if h.gauge {
+		healthGauge.Update(value)
+	}
+}
@@ -0,0 +1,107 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckTransitions(t *testing.T) {
+	var dialed []string
+	failPrimary, failStandby := true, false
+	health := NewHealthCheck([]*Target{
+		recordingTarget("primary:1", &dialed, &failPrimary),
+		recordingTarget("standby:1", &dialed, &failStandby),
+	}, nil, 1, &testLogger{})
+	assert.True(t, health.Healthy(), "should be healthy before first probe")
+
+	health.check()
+	assert.True(t, health.Healthy(), "should be healthy if any target is reachable")
+	assert.Equal(t, []string{"primary:1", "standby:1"}, dialed, "should probe targets in order")
+	assert.Equal(t, int64(1), healthGauge.Value())
+
+	failStandby = true
+	health.check()
+	assert.False(t, health.Healthy(), "should be down if no target is reachable")
+	assert.NotNil(t, health.Err())
+	assert.Equal(t, int64(0), healthGauge.Value())
+
+	failPrimary = false
+	health.check()
+	assert.True(t, health.Healthy(), "should be healthy again once a target recovers")
+	assert.Equal(t, int64(1), healthGauge.Value())
+}
+
+func TestHealthCheckThreshold(t *testing.T) {
+	var dialed []string
+	fail := true
+	health := NewHealthCheck([]*Target{recordingTarget("primary:1", &dialed, &fail)}, nil, 2, &testLogger{})
+
+	health.check()
+	assert.True(t, health.Healthy(), "should still be healthy below threshold")
+	assert.Equal(t, int64(1), healthGauge.Value())
+	assert.True(t, health.Result().LastSuccess.IsZero(), "should have no last success yet")
+
+	health.check()
+	assert.False(t, health.Healthy(), "should be down once threshold is reached")
+	assert.Equal(t, int64(0), healthGauge.Value())
+
+	fail = false
+	health.check()
+	assert.True(t, health.Healthy(), "should be healthy again after a successful probe")
+	assert.Equal(t, int64(1), healthGauge.Value())
+	assert.Equal(t, health.Result().Checked, health.Result().LastSuccess)
+}
+
+func TestHealthCheckExchangeProbe(t *testing.T) {
+	response := "PONG\r\n"
+	health := NewHealthCheck([]*Target{
+		NewTarget("backend:1", func() (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				request := make([]byte, 6)
+				if _, err := c2.Read(request); err == nil && string(request) == "PING\r\n" {
+					c2.Write([]byte(response))
+				}
+			}()
+			return c1, nil
+		}),
+	}, ExchangeProbe([]byte("PING\r\n"), []byte("PONG"), time.Second), 1, &testLogger{})
+
+	health.check()
+	assert.True(t, health.Healthy(), "should pass probe with expected response")
+
+	response = "ERR\r\n"
+	health.check()
+	assert.False(t, health.Healthy(), "should fail probe with unexpected response")
+}
+
+func TestHealthCheckStop(t *testing.T) {
+	fail := true
+	var dialed []string
+	health := NewHealthCheck([]*Target{recordingTarget("primary:1", &dialed, &fail)}, nil, 1, &testLogger{})
+
+	stop := health.Start(time.Hour)
+	assert.False(t, health.Healthy(), "should probe right away on start")
+	stop()
+	stop()
+}
@@ -0,0 +1,145 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPProxyDialer establishes TCP connections to targets through an HTTP or
+// HTTPS proxy, using CONNECT requests. Connections are returned once the proxy
+// has connected to the target, any TLS handshake with the target happens
+// end-to-end over the returned connection.
+type HTTPProxyDialer struct {
+	// Proxy is the URL of the proxy (http or https scheme). Credentials in
+	// the URL are sent to the proxy with basic authentication.
+	Proxy *url.URL
+	// Dialer used to connect to the proxy. Its timeout also bounds the CONNECT
+	// request.
+	Dialer *net.Dialer
+	// TLSConfig for connecting to https proxies.
+	TLSConfig *tls.Config
+}
+
+// Dial connects to the address through the proxy. Errors talking to the proxy
+// mention the proxy, to tell them apart from errors with the target.
+func (d *HTTPProxyDialer) Dial(network, address string) (net.Conn, error) {
+	proxy := d.Proxy.Redacted()
+
+	conn, err := d.dialProxy()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to HTTP proxy %s: %s", proxy, err)
+	}
+	if d.Dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Dialer.Timeout))
+	}
+	conn, err = d.connect(conn, address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s through HTTP proxy %s: %s", address, proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *HTTPProxyDialer) dialProxy() (net.Conn, error) {
+	address := d.Proxy.Host
+	if d.Proxy.Port() == "" {
+		if d.Proxy.Scheme == "https" {
+			address = net.JoinHostPort(d.Proxy.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(d.Proxy.Hostname(), "8080")
+		}
+	}
+	if d.Proxy.Scheme != "https" {
+		return d.Dialer.Dial("tcp", address)
+	}
+	config := d.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = d.Proxy.Hostname()
+	}
+	return tls.DialWithDialer(d.Dialer, "tcp", address, config)
+}
+
+// connect sends a CONNECT request for the address, and checks the response.
+// Closes the connection on failure.
+func (d *HTTPProxyDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.Proxy.User != nil {
+		password, _ := d.Proxy.User.Password()
+		request.SetBasicAuth(d.Proxy.User.Username(), password)
+		// SetBasicAuth sets the header for origin servers, move it.
+		request.Header["Proxy-Authorization"] = request.Header["Authorization"]
+		delete(request.Header, "Authorization")
+	}
+	err := request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Note that we can't close the response body, as the tunnel looks like a
+	// body of unknown length to net/http.
+	switch {
+	case response.StatusCode == http.StatusOK:
+	case response.StatusCode == http.StatusProxyAuthRequired && d.Proxy.User == nil:
+		conn.Close()
+		return nil, fmt.Errorf("proxy requires authentication (%s)", response.Status)
+	case response.StatusCode == http.StatusProxyAuthRequired:
+		conn.Close()
+		return nil, fmt.Errorf("proxy authentication failed for user '%s' (%s)", d.Proxy.User.Username(), response.Status)
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT request (%s)", response.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		// Target already sent data, which we've read into the buffer.
+		return &bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection with some data already read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,141 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHTTPProxy accepts a single CONNECT request, and answers with the given
+// status (or 407 if the request doesn't have the expected credentials). On
+// success, it sends a greeting right away, and then echoes data back. The
+// request is sent on the returned channel.
+func fakeHTTPProxy(t *testing.T, username, password string, status int) (net.Listener, chan *http.Request) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+
+		if username != "" {
+			auth := &http.Request{Header: http.Header{"Authorization": request.Header["Proxy-Authorization"]}}
+			user, pass, ok := auth.BasicAuth()
+			if !ok || user != username || pass != password {
+				status = http.StatusProxyAuthRequired
+			}
+		}
+		if status != http.StatusOK {
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+		io.Copy(conn, reader)
+	}()
+	return listener, requests
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	proxy, requests := fakeHTTPProxy(t, "", "", http.StatusOK)
+	defer proxy.Close()
+
+	d := &HTTPProxyDialer{Proxy: &url.URL{Scheme: "http", Host: proxy.Addr().String()}, Dialer: &net.Dialer{Timeout: time.Second}}
+	conn, err := d.Dial("tcp", "target.example.com:443")
+	assert.Nil(t, err, "should connect through proxy")
+	defer conn.Close()
+
+	request := <-requests
+	assert.Equal(t, http.MethodConnect, request.Method)
+	assert.Equal(t, "target.example.com:443", request.Host)
+	assert.Empty(t, request.Header.Get("Proxy-Authorization"), "should not send credentials")
+
+	// Greeting was sent along with the response.
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read through proxy")
+	assert.Equal(t, "hello", string(buf))
+
+	_, err = conn.Write([]byte("world"))
+	assert.Nil(t, err, "should be able to write through proxy")
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read through proxy")
+	assert.Equal(t, "world", string(buf))
+}
+
+func TestHTTPProxyDialerAuthentication(t *testing.T) {
+	proxy, _ := fakeHTTPProxy(t, "user", "secret", http.StatusOK)
+	defer proxy.Close()
+
+	d := &HTTPProxyDialer{Proxy: &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: proxy.Addr().String()}, Dialer: &net.Dialer{Timeout: time.Second}}
+	conn, err := d.Dial("tcp", "target.example.com:443")
+	assert.Nil(t, err, "should authenticate to proxy")
+	conn.Close()
+
+	proxy, _ = fakeHTTPProxy(t, "user", "secret", http.StatusOK)
+	defer proxy.Close()
+
+	d.Proxy = &url.URL{Scheme: "http", User: url.UserPassword("user", "wrong"), Host: proxy.Addr().String()}
+	_, err = d.Dial("tcp", "target.example.com:443")
+	assert.NotNil(t, err, "should fail with wrong password")
+	assert.Contains(t, err.Error(), "proxy authentication failed for user 'user'")
+	assert.NotContains(t, err.Error(), "wrong", "should not log password")
+
+	proxy, _ = fakeHTTPProxy(t, "user", "secret", http.StatusOK)
+	defer proxy.Close()
+
+	d.Proxy = &url.URL{Scheme: "http", Host: proxy.Addr().String()}
+	_, err = d.Dial("tcp", "target.example.com:443")
+	assert.NotNil(t, err, "should fail without credentials")
+	assert.Contains(t, err.Error(), "proxy requires authentication")
+}
+
+func TestHTTPProxyDialerErrors(t *testing.T) {
+	proxy, _ := fakeHTTPProxy(t, "", "", http.StatusForbidden)
+	defer proxy.Close()
+
+	d := &HTTPProxyDialer{Proxy: &url.URL{Scheme: "http", Host: proxy.Addr().String()}, Dialer: &net.Dialer{Timeout: time.Second}}
+	_, err := d.Dial("tcp", "target.example.com:443")
+	assert.NotNil(t, err, "should fail if proxy refuses request")
+	assert.Contains(t, err.Error(), "through HTTP proxy http://"+proxy.Addr().String())
+	assert.Contains(t, err.Error(), "403 Forbidden")
+
+	// Proxy that isn't listening
+	proxy.Close()
+	_, err = d.Dial("tcp", "target.example.com:443")
+	assert.NotNil(t, err, "should fail if proxy is down")
+	assert.Contains(t, err.Error(), "unable to connect to HTTP proxy")
+}
@@ -0,0 +1,400 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var kubernetesErrorCounter = metrics.GetOrRegisterCounter("backend.kubernetes.error", metrics.DefaultRegistry)
+
+var (
+	// Where the service account of a pod is mounted.
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// How long the API server may keep a watch open.
+	kubernetesWatchTimeout = 5 * time.Minute
+	// How long to wait before listing again after an error.
+	kubernetesRetry = 5 * time.Second
+)
+
+// KubernetesConfig configures k8s: targets. Zero values are filled in from
+// the in-cluster configuration of the pod we're running in.
+type KubernetesConfig struct {
+	// URL of the API server (default: from $KUBERNETES_SERVICE_HOST and
+	// $KUBERNETES_SERVICE_PORT).
+	APIServer string
+	// File with the bearer token for the API server, re-read for every
+	// request (default: service account token).
+	TokenFile string
+	// Namespace for services given without one (default: namespace of the
+	// service account).
+	Namespace string
+	// HTTP client for requests (default: client trusting the service
+	// account CA certificate).
+	Client *http.Client
+	Logger Logger
+}
+
+// NewKubernetesResolverFactory returns a factory for resolvers that watch
+// the EndpointSlices of a Kubernetes service, to be registered with
+// RegisterTargetResolver. Names are of the form [NAMESPACE/]SERVICE[:PORT],
+// where the port is a port name or number of the service (optional if it only
+// has one). Resolvers for the same name share a single watch.
+func NewKubernetesResolverFactory(config KubernetesConfig) TargetResolverFactory {
+	var mu sync.Mutex
+	var configured bool
+	var configErr error
+	watches := map[string]*KubernetesResolver{}
+	return func(name string) (TargetResolver, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r, ok := watches[name]; ok {
+			return r, nil
+		}
+
+		// Only look for the in-cluster configuration once k8s: targets
+		// are actually used.
+		if !configured {
+			configErr = inClusterKubernetesConfig(&config)
+			configured = true
+		}
+		if configErr != nil {
+			return nil, configErr
+		}
+
+		r, err := newKubernetesResolver(config, name)
+		if err != nil {
+			return nil, err
+		}
+		go r.watch()
+		watches[name] = r
+		return r, nil
+	}
+}
+
+// Fill in missing settings from the in-cluster configuration.
+func inClusterKubernetesConfig(config *KubernetesConfig) error {
+	if config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return errors.New("not running in a Kubernetes cluster ($KUBERNETES_SERVICE_HOST and $KUBERNETES_SERVICE_PORT are not set)")
+		}
+		config.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = kubernetesServiceAccountDir + "/token"
+	}
+	if config.Namespace == "" {
+		namespace, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/namespace")
+		if err == nil {
+			config.Namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+	if config.Client == nil {
+		caCert, err := ioutil.ReadFile(kubernetesServiceAccountDir + "/ca.crt")
+		if err != nil {
+			return fmt.Errorf("unable to read Kubernetes CA certificate: %s", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caCert) {
+			return errors.New("unable to parse Kubernetes CA certificate")
+		}
+		config.Client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:       &tls.Config{RootCAs: roots},
+				ResponseHeaderTimeout: 30 * time.Second,
+			},
+		}
+	}
+	return nil
+}
+
+// KubernetesResolver resolves a Kubernetes service to the addresses of its
+// ready endpoints, spreading connections across them in turn. Endpoints are
+// kept up to date by watching the service's EndpointSlices. If the API
+// server is unavailable, the last known endpoints are used.
+type KubernetesResolver struct {
+	config    KubernetesConfig
+	namespace string
+	service   string
+	port      string
+	addressSet
+}
+
+func newKubernetesResolver(config KubernetesConfig, name string) (*KubernetesResolver, error) {
+	r := &KubernetesResolver{
+		config:     config,
+		namespace:  config.Namespace,
+		addressSet: newAddressSet(),
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, r.port = name[:i], name[i+1:]
+		if r.port == "" {
+			return nil, fmt.Errorf("invalid Kubernetes service '%s', empty port", name)
+		}
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		r.namespace, name = name[:i], name[i+1:]
+	}
+	r.service = name
+	if r.namespace == "" || r.service == "" || strings.ContainsAny(r.namespace+r.service, "/?&= ") {
+		return nil, fmt.Errorf("invalid Kubernetes service '%s/%s', must be [NAMESPACE/]SERVICE[:PORT]", r.namespace, r.service)
+	}
+	return r, nil
+}
+
+// Resolve returns the address of the next ready endpoint. It blocks until
+// the endpoints were first listed.
+func (r *KubernetesResolver) Resolve() (string, error) {
+	return r.resolve(fmt.Errorf("no ready endpoints for service %s/%s", r.namespace, r.service))
+}
+
+// Keep endpoints up to date, by listing and then watching EndpointSlices.
+// Watches time out regularly, after which we start over with a new list.
+func (r *KubernetesResolver) watch() {
+	for {
+		slices, version, err := r.list()
+		if err != nil {
+			r.update(nil, err)
+			r.markReady()
+			time.Sleep(kubernetesRetry)
+			continue
+		}
+		r.update(r.addresses(slices), nil)
+		r.markReady()
+
+		if err := r.watchFrom(slices, version); err != nil {
+			kubernetesErrorCounter.Inc(1)
+			logging.Warnf(r.config.Logger, "warning: watch for endpoints of service %s/%s failed, listing again: %s", r.namespace, r.service, err)
+			time.Sleep(kubernetesRetry)
+		}
+	}
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int    `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSliceEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Send a request for the service's EndpointSlices, with extra query
+// parameters.
+func (r *KubernetesResolver) request(extra url.Values) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("labelSelector", "kubernetes.io/service-name="+r.service)
+	for k, v := range extra {
+		query[k] = v
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", strings.TrimSuffix(r.config.APIServer, "/"), url.PathEscape(r.namespace), query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.config.TokenFile != "" {
+		token, err := ioutil.ReadFile(r.config.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read Kubernetes token: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response from Kubernetes API: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// List the service's EndpointSlices, by name.
+func (r *KubernetesResolver) list() (map[string]endpointSlice, string, error) {
+	resp, err := r.request(nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", fmt.Errorf("invalid response from Kubernetes API: %s", err)
+	}
+	slices := map[string]endpointSlice{}
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// Watch for changes to the service's EndpointSlices, starting at the given
+// version of slices, until the watch ends.
+func (r *KubernetesResolver) watchFrom(slices map[string]endpointSlice, version string) error {
+	resp, err := r.request(url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {version},
+		"timeoutSeconds":  {strconv.Itoa(int(kubernetesWatchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event endpointSliceEvent
+		if err := decoder.Decode(&event); err != nil {
+			// The API server ends watches with EOF once they time out.
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var slice endpointSlice
+			if err := json.Unmarshal(event.Object, &slice); err != nil {
+				return fmt.Errorf("invalid event from Kubernetes API: %s", err)
+			}
+			if event.Type == "DELETED" {
+				delete(slices, slice.Metadata.Name)
+			} else {
+				slices[slice.Metadata.Name] = slice
+			}
+			r.update(r.addresses(slices), nil)
+		case "ERROR":
+			// E.g. our version is too old, start over with a new list.
+			return fmt.Errorf("error from Kubernetes API: %s", event.Object)
+		}
+	}
+}
+
+// Get addresses of ready endpoints in slices, on the selected port.
+func (r *KubernetesResolver) addresses(slices map[string]endpointSlice) []string {
+	seen := map[string]bool{}
+	addrs := []string{}
+	for _, slice := range slices {
+		port, ok := r.slicePort(slice)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// Endpoints without a ready condition are considered ready.
+			if len(endpoint.Addresses) == 0 || (endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready) {
+				continue
+			}
+			// Only the first address is meant to be used.
+			addr := net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(port))
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Find the port to use in a slice: by name or number if set, or the only port.
+func (r *KubernetesResolver) slicePort(slice endpointSlice) (int, bool) {
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+		if r.port == "" && len(slice.Ports) == 1 {
+			return *port.Port, true
+		}
+		if r.port != "" && (r.port == name || r.port == strconv.Itoa(*port.Port)) {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// Record the result of a lookup. On errors, the last known endpoints are
+// kept.
+func (r *KubernetesResolver) update(addrs []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		kubernetesErrorCounter.Inc(1)
+		if len(r.addrs) > 0 {
+			logging.Warnf(r.config.Logger, "warning: unable to list endpoints of service %s/%s, using last known endpoints (%s): %s", r.namespace, r.service, strings.Join(r.addrs, ", "), err)
+			return
+		}
+		logging.Warnf(r.config.Logger, "warning: unable to list endpoints of service %s/%s: %s", r.namespace, r.service, err)
+		r.err = fmt.Errorf("unable to list endpoints of service %s/%s: %s", r.namespace, r.service, err)
+		return
+	}
+
+	if !equalStrings(addrs, r.addrs) {
+		if len(addrs) == 0 {
+			logging.Warnf(r.config.Logger, "warning: no ready endpoints for service %s/%s", r.namespace, r.service)
+		} else {
+			r.config.Logger.Printf("endpoints of service %s/%s: %s", r.namespace, r.service, strings.Join(addrs, ", "))
+		}
+	}
+	r.addrs = addrs
+	r.err = nil
+}
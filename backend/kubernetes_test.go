@@ -0,0 +1,167 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testEndpointSlice = `{
+	"metadata": {"name": "web-abc", "resourceVersion": "10"},
+	"endpoints": [
+		{"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+		{"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+		{"addresses": ["10.0.0.3"], "conditions": {}}
+	],
+	"ports": [{"name": "http", "port": 8080}, {"name": "metrics", "port": 9090}]
+}`
+
+// Returns a fake API server with EndpointSlices for service "web" in
+// namespace "default", that sends the given events on watches.
+func testKubernetesServer(t *testing.T, events []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+			http.NotFound(w, r)
+			return
+		}
+		assert.Equal(t, "kubernetes.io/service-name=web", r.URL.Query().Get("labelSelector"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("watch") == "true" {
+			assert.Equal(t, "10", r.URL.Query().Get("resourceVersion"), "should watch from listed version")
+			for _, event := range events {
+				fmt.Fprintln(w, event)
+			}
+			return
+		}
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [%s]}`, testEndpointSlice)
+	}))
+}
+
+func testKubernetesResolver(t *testing.T, server *httptest.Server, name string) *KubernetesResolver {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	r, err := newKubernetesResolver(KubernetesConfig{
+		APIServer: server.URL,
+		TokenFile: tokenFile,
+		Namespace: "default",
+		Client:    server.Client(),
+		Logger:    &testLogger{},
+	}, name)
+	assert.Nil(t, err, "should create resolver")
+	return r
+}
+
+func TestKubernetesResolverList(t *testing.T) {
+	server := testKubernetesServer(t, nil)
+	defer server.Close()
+
+	r := testKubernetesResolver(t, server, "web:http")
+	slices, version, err := r.list()
+	assert.Nil(t, err, "should list EndpointSlices")
+	assert.Equal(t, "10", version)
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.3:8080"}, r.addresses(slices), "should only use ready endpoints")
+
+	r.port = "9090"
+	assert.Equal(t, []string{"10.0.0.1:9090", "10.0.0.3:9090"}, r.addresses(slices), "should select port by number")
+
+	r.port = ""
+	assert.Equal(t, []string{}, r.addresses(slices), "should not guess between multiple ports")
+}
+
+func TestKubernetesResolverWatch(t *testing.T) {
+	server := testKubernetesServer(t, []string{
+		// Scale up: new slice with another endpoint
+		`{"type": "ADDED", "object": {"metadata": {"name": "web-def"}, "endpoints": [{"addresses": ["10.0.1.1"]}], "ports": [{"name": "http", "port": 8080}]}}`,
+		`{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "12"}}}`,
+		// Scale down: first slice is gone
+		`{"type": "DELETED", "object": {"metadata": {"name": "web-abc"}}}`,
+	})
+	defer server.Close()
+
+	r := testKubernetesResolver(t, server, "default/web:http")
+	slices, version, err := r.list()
+	assert.Nil(t, err, "should list EndpointSlices")
+	r.update(r.addresses(slices), nil)
+	r.markReady()
+
+	err = r.watchFrom(slices, version)
+	assert.Nil(t, err, "watch should end cleanly")
+
+	addr, err := r.Resolve()
+	assert.Nil(t, err, "should resolve")
+	assert.Equal(t, "10.0.1.1:8080", addr, "should follow scale events")
+}
+
+func TestKubernetesResolverWatchError(t *testing.T) {
+	server := testKubernetesServer(t, []string{
+		`{"type": "ERROR", "object": {"kind": "Status", "code": 410}}`,
+	})
+	defer server.Close()
+
+	r := testKubernetesResolver(t, server, "web:http")
+	slices, version, err := r.list()
+	assert.Nil(t, err, "should list EndpointSlices")
+	r.update(r.addresses(slices), nil)
+
+	err = r.watchFrom(slices, version)
+	assert.NotNil(t, err, "should stop watching on error events")
+
+	r.update(nil, err)
+	r.markReady()
+	_, err = r.Resolve()
+	assert.Nil(t, err, "should keep last known endpoints")
+}
+
+func TestKubernetesResolverNames(t *testing.T) {
+	config := KubernetesConfig{Namespace: "default"}
+
+	r, err := newKubernetesResolver(config, "other/web:8080")
+	assert.Nil(t, err, "should parse namespace and port")
+	assert.Equal(t, "other", r.namespace)
+	assert.Equal(t, "web", r.service)
+	assert.Equal(t, "8080", r.port)
+
+	r, err = newKubernetesResolver(config, "web")
+	assert.Nil(t, err, "should use default namespace")
+	assert.Equal(t, "default", r.namespace)
+	assert.Equal(t, "", r.port)
+
+	_, err = newKubernetesResolver(config, "web:")
+	assert.NotNil(t, err, "should reject empty port")
+	_, err = newKubernetesResolver(config, "a/b/c")
+	assert.NotNil(t, err, "should reject invalid name")
+	_, err = newKubernetesResolver(KubernetesConfig{}, "web")
+	assert.NotNil(t, err, "should require namespace")
+}
+
+func TestKubernetesResolverOutsideCluster(t *testing.T) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	defer os.Setenv("KUBERNETES_SERVICE_HOST", host)
+
+	_, err := NewKubernetesResolverFactory(KubernetesConfig{Logger: &testLogger{}})("default/web")
+	assert.NotNil(t, err, "should fail outside of a cluster")
+}
@@ -0,0 +1,196 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	dialErrorCounter = metrics.GetOrRegisterCounter("backend.dial.error", metrics.DefaultRegistry)
+	invalidMetricRe  = regexp.MustCompile("[^a-zA-Z0-9_]+")
+)
+
+// Logger is used by this package to log messages
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Dialer represents a function that can dial a backend target.
+type Dialer func() (net.Conn, error)
+
+// Target is a single backend target in a pool.
+type Target struct {
+	// Address of the target, for logging purposes.
+	Address string
+	// Dial function to connect to the target.
+	Dial Dialer
+	// Weight of the target in a pool, relative to the other targets. Zero
+	// means no new connections are sent to the target.
+	Weight int
+
+	// Time (as unix nanos) until which the target is considered down.
+	downUntil int64
+	// Number of connections made to this target.
+	counter metrics.Counter
+	// Current weight for smooth weighted round-robin, guarded by the pool.
+	current int
+}
+
+// NewTarget creates a new target with the given address and dialer.
+func NewTarget(address string, dial Dialer) *Target {
+	return &Target{
+		Address: address,
+		Dial:    dial,
+		Weight:  1,
+		counter: metrics.GetOrRegisterCounter(fmt.Sprintf("backend.%s.conn", metricName(address)), metrics.DefaultRegistry),
+	}
+}
+
+// Up returns true if the target is not currently marked down.
+func (t *Target) Up() bool {
+	return time.Now().UnixNano() >= atomic.LoadInt64(&t.downUntil)
+}
+
+// markDown marks the target as down for the given cool-off period.
+func (t *Target) markDown(cooloff time.Duration) {
+	atomic.StoreInt64(&t.downUntil, time.Now().Add(cooloff).UnixNano())
+}
+
+// Pool distributes connections round-robin across a set of targets. Targets
+// that fail to dial are skipped and marked down for a cool-off period. If
+// targets have different weights, smooth weighted round-robin (as in nginx)
+// is used instead, which spreads out connections to the same target.
+type Pool struct {
+	targets []*Target
+	cooloff time.Duration
+	logger  Logger
+	next    uint32
+
+	// Set if targets have different weights.
+	weighted bool
+	// Mutex for current weights of targets.
+	mu sync.Mutex
+}
+
+// NewPool creates a new pool with the given targets.
+func NewPool(targets []*Target, cooloff time.Duration, logger Logger) *Pool {
+	p := &Pool{
+		targets: targets,
+		cooloff: cooloff,
+		logger:  logger,
+	}
+	for _, target := range targets {
+		if target.Weight != 1 {
+			p.weighted = true
+		}
+	}
+	return p
+}
+
+// Targets returns the targets in the pool.
+func (p *Pool) Targets() []*Target {
+	return p.targets
+}
+
+// Dial connects to the next available target, skipping targets that are
+// marked down. If all targets are marked down, they are all tried anyway
+// (in order) since failing outright would be worse.
+func (p *Pool) Dial() (net.Conn, error) {
+	if len(p.targets) == 0 {
+		return nil, errors.New("no backend targets available")
+	}
+
+	start := p.start()
+
+	var candidates, down []*Target
+	for i := 0; i < len(p.targets); i++ {
+		target := p.targets[(start+i)%len(p.targets)]
+		if target.Weight <= 0 {
+			continue
+		}
+		if target.Up() {
+			candidates = append(candidates, target)
+		} else {
+			down = append(down, target)
+		}
+	}
+	candidates = append(candidates, down...)
+	if len(candidates) == 0 {
+		return nil, errors.New("no backend targets available")
+	}
+
+	var errs []string
+	for _, target := range candidates {
+		conn, err := target.Dial()
+		if err == nil {
+			target.counter.Inc(1)
+			return conn, nil
+		}
+
+		dialErrorCounter.Inc(1)
+		target.markDown(p.cooloff)
+		logging.Warnf(p.logger, "error dialing backend %s, marking down for %s: %s", target.Address, p.cooloff, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", target.Address, err))
+	}
+
+	return nil, fmt.Errorf("unable to connect to any backend (%s)", strings.Join(errs, "; "))
+}
+
+// Index of the target to try first for a new connection.
+func (p *Pool) start() int {
+	if !p.weighted {
+		return int(atomic.AddUint32(&p.next, 1)-1) % len(p.targets)
+	}
+
+	// Smooth weighted round-robin across targets that are up: every target
+	// gains its weight, and the one with the highest current weight is
+	// chosen and loses the total weight.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best, total := -1, 0
+	for i, target := range p.targets {
+		if target.Weight <= 0 || !target.Up() {
+			continue
+		}
+		target.current += target.Weight
+		total += target.Weight
+		if best < 0 || target.current > p.targets[best].current {
+			best = i
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	p.targets[best].current -= total
+	return best
+}
+
+// Sanitize an address for use in a metric name.
+func metricName(address string) string {
+	return strings.Trim(invalidMetricRe.ReplaceAllString(address, "_"), "_")
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLogger struct{}
+
+func (t *testLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+// Returns a target whose dialer records the target address in dialed.
+func recordingTarget(address string, dialed *[]string, fail *bool) *Target {
+	return NewTarget(address, func() (net.Conn, error) {
+		*dialed = append(*dialed, address)
+		if fail != nil && *fail {
+			return nil, errors.New("failure for test")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	})
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	var dialed []string
+	pool := NewPool([]*Target{
+		recordingTarget("a:1", &dialed, nil),
+		recordingTarget("b:1", &dialed, nil),
+		recordingTarget("c:1", &dialed, nil),
+	}, time.Minute, &testLogger{})
+
+	for i := 0; i < 6; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should be able to dial")
+		conn.Close()
+	}
+
+	assert.Equal(t, []string{"a:1", "b:1", "c:1", "a:1", "b:1", "c:1"}, dialed, "should distribute round-robin")
+}
+
+func TestPoolSkipsDownTargets(t *testing.T) {
+	var dialed []string
+	fail := true
+	pool := NewPool([]*Target{
+		recordingTarget("a:1", &dialed, &fail),
+		recordingTarget("b:1", &dialed, nil),
+	}, time.Minute, &testLogger{})
+
+	conn, err := pool.Dial()
+	assert.Nil(t, err, "should fall back to next target")
+	conn.Close()
+	assert.Equal(t, []string{"a:1", "b:1"}, dialed)
+	assert.False(t, pool.Targets()[0].Up(), "failed target should be marked down")
+
+	dialed = nil
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should be able to dial")
+		conn.Close()
+	}
+	assert.Equal(t, []string{"b:1", "b:1"}, dialed, "down target should be skipped")
+}
+
+func TestPoolAllTargetsDown(t *testing.T) {
+	var dialed []string
+	fail := true
+	pool := NewPool([]*Target{
+		recordingTarget("a:1", &dialed, &fail),
+		recordingTarget("b:1", &dialed, &fail),
+	}, time.Minute, &testLogger{})
+
+	_, err := pool.Dial()
+	assert.NotNil(t, err, "should fail if all targets fail")
+
+	// Targets marked down are still tried as a last resort
+	fail = false
+	conn, err := pool.Dial()
+	assert.Nil(t, err, "should be able to dial once targets recover")
+	conn.Close()
+
+	_, err = NewPool(nil, time.Minute, &testLogger{}).Dial()
+	assert.NotNil(t, err, "empty pool should fail")
+}
+
+func weightedTarget(address string, weight int, dialed *[]string, fail *bool) *Target {
+	target := recordingTarget(address, dialed, fail)
+	target.Weight = weight
+	return target
+}
+
+func TestPoolWeighted(t *testing.T) {
+	var dialed []string
+	pool := NewPool([]*Target{
+		weightedTarget("a:1", 3, &dialed, nil),
+		weightedTarget("b:1", 1, &dialed, nil),
+		weightedTarget("c:1", 0, &dialed, nil),
+	}, time.Minute, &testLogger{})
+
+	for i := 0; i < 8; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should be able to dial")
+		conn.Close()
+	}
+
+	assert.Equal(t, []string{"a:1", "a:1", "b:1", "a:1", "a:1", "a:1", "b:1", "a:1"}, dialed, "should distribute by weight, without sending bursts to one target")
+}
+
+func TestPoolWeightedSkipsDownTargets(t *testing.T) {
+	var dialed []string
+	fail := true
+	pool := NewPool([]*Target{
+		weightedTarget("a:1", 2, &dialed, &fail),
+		weightedTarget("b:1", 1, &dialed, nil),
+		weightedTarget("c:1", 0, &dialed, nil),
+	}, time.Minute, &testLogger{})
+
+	conn, err := pool.Dial()
+	assert.Nil(t, err, "should fall back to next target")
+	conn.Close()
+	assert.Equal(t, []string{"a:1", "b:1"}, dialed, "should not fall back to target with zero weight")
+
+	dialed = nil
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Dial()
+		assert.Nil(t, err, "should be able to dial")
+		conn.Close()
+	}
+	assert.Equal(t, []string{"b:1", "b:1"}, dialed, "down target should be skipped")
+
+	_, err = NewPool([]*Target{weightedTarget("c:1", 0, &dialed, nil)}, time.Minute, &testLogger{}).Dial()
+	assert.NotNil(t, err, "pool without weighted targets should fail")
+}
+
+func TestMetricName(t *testing.T) {
+	assert.Equal(t, "127_0_0_1_8080", metricName("127.0.0.1:8080"))
+	assert.Equal(t, "unix_tmp_sock", metricName("unix:/tmp/sock"))
+}
@@ -0,0 +1,340 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	prewarmHitCounter  = metrics.GetOrRegisterCounter("backend.prewarm.hit", metrics.DefaultRegistry)
+	prewarmMissCounter = metrics.GetOrRegisterCounter("backend.prewarm.miss", metrics.DefaultRegistry)
+	prewarmGauge       = metrics.GetOrRegisterGauge("backend.prewarm.ready", metrics.DefaultRegistry)
+)
+
+// Delay before dialing again after a prewarm dial failed.
+var prewarmRetryDelay = time.Second
+
+// Prewarm keeps a number of connections to the backend established ahead of
+// time (including the TLS handshake, if dial does one), so that new clients
+// don't have to wait for a connection. Pooled connections are replenished in
+// the background, closed once they are older than a TTL, and dropped as soon
+// as the backend closes them.
+type Prewarm struct {
+	dial   Dialer
+	size   int
+	ttl    time.Duration
+	logger Logger
+
+	// Wakes up the background loop to replenish the pool.
+	wake chan struct{}
+	done chan struct{}
+
+	// Mutex for pooled connections and state below.
+	mu    sync.Mutex
+	ready []*prewarmed
+	// Incremented on every flush, so that dials which were in progress
+	// during a flush are discarded.
+	generation int
+	closed     bool
+}
+
+// A pooled connection. While in the pool, a goroutine blocks reading from the
+// connection, so that we notice right away if the backend closes it.
+type prewarmed struct {
+	conn    net.Conn
+	created time.Time
+	// Closed once the reading goroutine returned.
+	watched chan struct{}
+	// Data or error returned by the read, if any (set before watched is
+	// closed). A timeout error means we interrupted the read.
+	data []byte
+	err  error
+}
+
+// NewPrewarm creates a pool of size prewarmed connections made with dial,
+// which are closed if not used within ttl. Call Start to fill the pool.
+func NewPrewarm(dial Dialer, size int, ttl time.Duration, logger Logger) *Prewarm {
+	return &Prewarm{
+		dial:   dial,
+		size:   size,
+		ttl:    ttl,
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start fills the pool, and keeps replenishing it in the background until
+// Close is called.
+func (p *Prewarm) Start() {
+	go p.run()
+}
+
+// Dial returns a connection from the pool, or dials a new one if none is
+// ready.
+func (p *Prewarm) Dial() (net.Conn, error) {
+	for {
+		pc := p.take()
+		if pc == nil {
+			break
+		}
+		if conn := pc.adopt(p.ttl); conn != nil {
+			prewarmHitCounter.Inc(1)
+			return conn, nil
+		}
+	}
+	prewarmMissCounter.Inc(1)
+	return p.dial()
+}
+
+// Flush closes all pooled connections, e.g. after reloading certificates so
+// that new connections present the new certificate. The pool is replenished
+// in the background.
+func (p *Prewarm) Flush() {
+	p.mu.Lock()
+	ready := p.ready
+	p.ready = nil
+	p.generation++
+	prewarmGauge.Update(0)
+	p.mu.Unlock()
+
+	for _, pc := range ready {
+		pc.conn.Close()
+	}
+	p.signal()
+}
+
+// Close closes all pooled connections, and stops replenishing the pool.
+func (p *Prewarm) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+	p.Flush()
+}
+
+// Take the oldest connection out of the pool, or nil if the pool is empty.
+func (p *Prewarm) take() *prewarmed {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ready) == 0 {
+		return nil
+	}
+	pc := p.ready[0]
+	p.ready = p.ready[1:]
+	prewarmGauge.Update(int64(len(p.ready)))
+	p.signal()
+	return pc
+}
+
+// Remove a connection from the pool, returns false if it was already taken.
+func (p *Prewarm) remove(pc *prewarmed) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.ready {
+		if other == pc {
+			p.ready = append(p.ready[:i], p.ready[i+1:]...)
+			prewarmGauge.Update(int64(len(p.ready)))
+			p.signal()
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Prewarm) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Background loop: top up the pool whenever a connection was taken or
+// dropped, and expire connections older than the TTL.
+func (p *Prewarm) run() {
+	ticker := time.NewTicker(p.expireInterval())
+	defer ticker.Stop()
+
+	for {
+		for p.fill() {
+		}
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-ticker.C:
+			p.expire()
+		}
+	}
+}
+
+// Check for expired connections a few times per TTL, but not too often.
+func (p *Prewarm) expireInterval() time.Duration {
+	interval := p.ttl / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	return interval
+}
+
+// Dial one new connection if the pool isn't full. Returns true if the pool
+// might need more connections.
+func (p *Prewarm) fill() bool {
+	p.mu.Lock()
+	if p.closed || len(p.ready) >= p.size {
+		p.mu.Unlock()
+		return false
+	}
+	generation := p.generation
+	p.mu.Unlock()
+
+	conn, err := p.dial()
+	if err != nil {
+		logging.Warnf(p.logger, "warning: unable to prewarm connection to backend: %s", err)
+		select {
+		case <-p.done:
+		case <-time.After(prewarmRetryDelay):
+		}
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.generation != generation || len(p.ready) >= p.size {
+		conn.Close()
+		return !p.closed
+	}
+	pc := &prewarmed{
+		conn:    conn,
+		created: time.Now(),
+		watched: make(chan struct{}),
+	}
+	p.ready = append(p.ready, pc)
+	prewarmGauge.Update(int64(len(p.ready)))
+	go p.watch(pc)
+	return true
+}
+
+// Block reading from a pooled connection until it's adopted, or the backend
+// closes it (or sends data, which is kept for the client).
+func (p *Prewarm) watch(pc *prewarmed) {
+	buf := make([]byte, 1)
+	n, err := pc.conn.Read(buf)
+	pc.data = buf[:n]
+	pc.err = err
+	close(pc.watched)
+
+	if err != nil && !isTimeout(err) && p.remove(pc) {
+		logging.Debugf(p.logger, "prewarmed connection to backend closed: %s", err)
+		pc.conn.Close()
+	}
+}
+
+// Close connections that have been in the pool for longer than the TTL.
+func (p *Prewarm) expire() {
+	var expired []*prewarmed
+	p.mu.Lock()
+	ready := p.ready[:0]
+	for _, pc := range p.ready {
+		if time.Since(pc.created) > p.ttl {
+			expired = append(expired, pc)
+		} else {
+			ready = append(ready, pc)
+		}
+	}
+	p.ready = ready
+	prewarmGauge.Update(int64(len(p.ready)))
+	p.mu.Unlock()
+
+	for _, pc := range expired {
+		pc.conn.Close()
+	}
+	if len(expired) > 0 {
+		p.signal()
+	}
+}
+
+// Stop watching a connection taken from the pool, and return it if it's
+// still usable. Returns nil (and closes the connection) otherwise.
+func (p *prewarmed) adopt(ttl time.Duration) net.Conn {
+	// Interrupt the pending read. Timeouts aren't fatal for TLS connections,
+	// the connection can still be used afterwards.
+	p.conn.SetReadDeadline(time.Now())
+	<-p.watched
+	p.conn.SetReadDeadline(time.Time{})
+
+	if (p.err != nil && !isTimeout(p.err)) || time.Since(p.created) > ttl {
+		p.conn.Close()
+		return nil
+	}
+	if len(p.data) > 0 {
+		return &prereadConn{Conn: p.conn, data: p.data}
+	}
+	return p.conn
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// A connection with data that was already read from it (e.g. a greeting
+// sent by the backend while the connection was in the pool).
+type prereadConn struct {
+	net.Conn
+	data []byte
+}
+
+func (c *prereadConn) Read(b []byte) (int, error) {
+	if len(c.data) > 0 {
+		n := copy(b, c.data)
+		c.data = c.data[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the wrapped connection.
+func (c *prereadConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite closes the write side of the connection, both for TLS and the
+// underlying connection (like the proxy does for TLS connections).
+func (c *prereadConn) CloseWrite() error {
+	conn := c.Conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.CloseWrite()
+		conn = tlsConn.NetConn()
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Close()
+}
@@ -0,0 +1,180 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Dials in-memory connections, and keeps the backend side of each of them.
+type pipeBackend struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (b *pipeBackend) dial() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	b.mu.Lock()
+	b.conns = append(b.conns, c2)
+	b.mu.Unlock()
+	return c1, nil
+}
+
+func (b *pipeBackend) dialed() []net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]net.Conn{}, b.conns...)
+}
+
+// Wait until cond is true, or fail the test after a few seconds.
+func eventually(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Wait until the pool has the given number of connections ready.
+func waitForReady(t *testing.T, p *Prewarm, n int) {
+	eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.ready) == n
+	}, "pool should have connections ready")
+}
+
+func TestPrewarmAdopt(t *testing.T) {
+	backend := &pipeBackend{}
+	p := NewPrewarm(backend.dial, 2, time.Minute, &testLogger{})
+	p.Start()
+	defer p.Close()
+	waitForReady(t, p, 2)
+
+	hits := prewarmHitCounter.Count()
+	conn, err := p.Dial()
+	assert.Nil(t, err, "should get a connection")
+	defer conn.Close()
+	assert.Equal(t, hits+1, prewarmHitCounter.Count(), "should adopt pooled connection")
+
+	// Adopted connection should still work after interrupting the read
+	go backend.dialed()[0].Write([]byte("x"))
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read from adopted connection")
+	assert.Equal(t, "x", string(buf))
+
+	waitForReady(t, p, 2)
+	assert.Len(t, backend.dialed(), 3, "should replenish pool")
+}
+
+func TestPrewarmBackendClosed(t *testing.T) {
+	backend := &pipeBackend{}
+	p := NewPrewarm(backend.dial, 1, time.Minute, &testLogger{})
+	p.Start()
+	defer p.Close()
+	waitForReady(t, p, 1)
+
+	backend.dialed()[0].Close()
+	eventually(t, func() bool {
+		return len(backend.dialed()) == 2
+	}, "should replace closed connection")
+	waitForReady(t, p, 1)
+
+	conn, err := p.Dial()
+	assert.Nil(t, err, "should get a connection")
+	defer conn.Close()
+	go backend.dialed()[1].Write([]byte("x"))
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should get the new connection")
+}
+
+func TestPrewarmPendingData(t *testing.T) {
+	backend := &pipeBackend{}
+	p := NewPrewarm(backend.dial, 1, time.Minute, &testLogger{})
+	p.Start()
+	defer p.Close()
+	waitForReady(t, p, 1)
+
+	// Backend sends a greeting while the connection is in the pool
+	go backend.dialed()[0].Write([]byte("HELLO"))
+	p.mu.Lock()
+	pc := p.ready[0]
+	p.mu.Unlock()
+	<-pc.watched
+
+	conn, err := p.Dial()
+	assert.Nil(t, err, "should get a connection")
+	defer conn.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read greeting")
+	assert.Equal(t, "HELLO", string(buf), "should not lose data read while pooled")
+	assert.Equal(t, backend.dialed()[0].RemoteAddr(), conn.(interface{ NetConn() net.Conn }).NetConn().RemoteAddr(), "should expose wrapped connection")
+}
+
+func TestPrewarmExpire(t *testing.T) {
+	backend := &pipeBackend{}
+	p := NewPrewarm(backend.dial, 1, 200*time.Millisecond, &testLogger{})
+	p.Start()
+	defer p.Close()
+	waitForReady(t, p, 1)
+
+	eventually(t, func() bool {
+		return len(backend.dialed()) >= 2
+	}, "should replace expired connection")
+
+	_, err := backend.dialed()[0].Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "expired connection should be closed")
+}
+
+func TestPrewarmFlush(t *testing.T) {
+	backend := &pipeBackend{}
+	p := NewPrewarm(backend.dial, 2, time.Minute, &testLogger{})
+	p.Start()
+	defer p.Close()
+	waitForReady(t, p, 2)
+
+	p.Flush()
+	for _, conn := range backend.dialed()[:2] {
+		_, err := conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "flushed connection should be closed")
+	}
+	waitForReady(t, p, 2)
+	assert.Len(t, backend.dialed(), 4, "should refill pool after flush")
+}
+
+func TestPrewarmMiss(t *testing.T) {
+	backend := &pipeBackend{}
+	p := NewPrewarm(backend.dial, 1, time.Minute, &testLogger{})
+	p.Close()
+
+	misses := prewarmMissCounter.Count()
+	conn, err := p.Dial()
+	assert.Nil(t, err, "should dial directly if pool is empty")
+	conn.Close()
+	assert.Equal(t, misses+1, prewarmMissCounter.Count())
+}
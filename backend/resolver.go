@@ -0,0 +1,122 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var dnsErrorCounter = metrics.GetOrRegisterCounter("backend.dns.error", metrics.DefaultRegistry)
+
+// Resolver resolves a target hostname to a list of addresses, caching results
+// for a refresh interval. Connections are spread across all addresses the name
+// resolves to. If resolution fails, the last known-good addresses are used.
+type Resolver struct {
+	host     string
+	port     string
+	interval time.Duration
+	logger   Logger
+	lookup   func(host string) ([]string, error)
+
+	// Mutex for cached addresses
+	mu       sync.Mutex
+	addrs    []string
+	resolved time.Time
+	// Counter for rotating through addresses
+	next uint32
+}
+
+// NewResolver creates a resolver for the given host and port. If interval is
+// zero, the host is resolved again on every call to Addresses.
+func NewResolver(host, port string, interval time.Duration, logger Logger) *Resolver {
+	return &Resolver{
+		host:     host,
+		port:     port,
+		interval: interval,
+		logger:   logger,
+		lookup:   net.LookupHost,
+	}
+}
+
+// Addresses returns the addresses (as HOST:PORT) to dial, rotated so that
+// consecutive calls start with a different address.
+func (r *Resolver) Addresses() ([]string, error) {
+	addrs, err := r.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	start := int(atomic.AddUint32(&r.next, 1)-1) % len(addrs)
+	out := make([]string, 0, len(addrs))
+	for i := range addrs {
+		out = append(out, net.JoinHostPort(addrs[(start+i)%len(addrs)], r.port))
+	}
+	return out, nil
+}
+
+// Get cached addresses, or resolve again if the cache expired.
+func (r *Resolver) resolve() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.addrs) > 0 && r.interval > 0 && time.Since(r.resolved) < r.interval {
+		return r.addrs, nil
+	}
+
+	addrs, err := r.lookup(r.host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses found")
+	}
+	if err != nil {
+		dnsErrorCounter.Inc(1)
+		if len(r.addrs) == 0 {
+			return nil, fmt.Errorf("unable to resolve %s: %s", r.host, err)
+		}
+		logging.Warnf(r.logger, "warning: unable to resolve %s, using last known addresses (%s): %s", r.host, strings.Join(r.addrs, ", "), err)
+		// Don't retry on every dial while resolution is failing.
+		r.resolved = time.Now()
+		return r.addrs, nil
+	}
+
+	if !equalStrings(addrs, r.addrs) && len(r.addrs) > 0 {
+		r.logger.Printf("addresses for %s changed from (%s) to (%s)", r.host, strings.Join(r.addrs, ", "), strings.Join(addrs, ", "))
+	}
+	r.addrs = addrs
+	r.resolved = time.Now()
+	return addrs, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a resolver with a fake lookup function that returns *addrs (or
+// an error, if addrs is nil) and counts lookups.
+func testResolver(interval time.Duration, addrs *[]string, lookups *int) *Resolver {
+	r := NewResolver("backend.example.com", "8080", interval, &testLogger{})
+	r.lookup = func(host string) ([]string, error) {
+		*lookups++
+		if *addrs == nil {
+			return nil, errors.New("failure for test")
+		}
+		return *addrs, nil
+	}
+	return r
+}
+
+func TestResolverRotates(t *testing.T) {
+	addrs := []string{"10.0.0.1", "10.0.0.2"}
+	lookups := 0
+	r := testResolver(0, &addrs, &lookups)
+
+	first, err := r.Addresses()
+	assert.Nil(t, err, "should resolve addresses")
+	assert.Equal(t, []string{"10.0.0.1:8080", "10.0.0.2:8080"}, first)
+
+	second, err := r.Addresses()
+	assert.Nil(t, err, "should resolve addresses")
+	assert.Equal(t, []string{"10.0.0.2:8080", "10.0.0.1:8080"}, second, "should rotate addresses")
+	assert.Equal(t, 2, lookups, "should resolve on every call without interval")
+}
+
+func TestResolverCaches(t *testing.T) {
+	addrs := []string{"10.0.0.1"}
+	lookups := 0
+	r := testResolver(time.Hour, &addrs, &lookups)
+
+	for i := 0; i < 3; i++ {
+		_, err := r.Addresses()
+		assert.Nil(t, err, "should resolve addresses")
+	}
+	assert.Equal(t, 1, lookups, "should cache addresses within interval")
+
+	// Expire cache
+	r.resolved = time.Time{}
+	addrs = []string{"10.0.0.3"}
+	out, err := r.Addresses()
+	assert.Nil(t, err, "should resolve addresses")
+	assert.Equal(t, []string{"10.0.0.3:8080"}, out, "should pick up changed addresses")
+}
+
+func TestResolverFallsBackToLastKnown(t *testing.T) {
+	var addrs []string
+	lookups := 0
+	r := testResolver(0, &addrs, &lookups)
+
+	_, err := r.Addresses()
+	assert.NotNil(t, err, "should fail without known addresses")
+
+	addrs = []string{"10.0.0.1"}
+	_, err = r.Addresses()
+	assert.Nil(t, err, "should resolve addresses")
+
+	addrs = nil
+	out, err := r.Addresses()
+	assert.Nil(t, err, "should fall back to last known addresses")
+	assert.Equal(t, []string{"10.0.0.1:8080"}, out)
+}
@@ -0,0 +1,220 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5Connect      = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+)
+
+// Reply codes from RFC 1928, section 6.
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5Dialer establishes TCP connections to targets through a SOCKS5 proxy
+// (RFC 1928), optionally authenticating with a username and password (RFC
+// 1929). Connections are returned once the proxy has connected to the target,
+// any TLS handshake happens end-to-end over the returned connection.
+type SOCKS5Dialer struct {
+	// Proxy is the address of the SOCKS5 proxy (HOST:PORT).
+	Proxy string
+	// Dialer used to connect to the proxy. Its timeout also bounds the SOCKS5
+	// handshake with the proxy.
+	Dialer *net.Dialer
+	// Username and Password for authentication, if the username is set.
+	Username string
+	Password string
+	// RemoteDNS passes target hostnames to the proxy to resolve (like socks5h
+	// URLs). By default, hostnames are resolved locally, and the proxy is
+	// asked to connect to the resolved IP address.
+	RemoteDNS bool
+	// Network to restrict locally resolved addresses to ("tcp4" or "tcp6"),
+	// or "tcp" for both.
+	Network string
+}
+
+// Dial connects to the address through the proxy. Errors talking to the proxy
+// mention the proxy, to tell them apart from errors with the target.
+func (d *SOCKS5Dialer) Dial(network, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in target address %s", address)
+	}
+	if ip := net.ParseIP(host); ip == nil && !d.RemoteDNS {
+		ip, err = d.lookup(host)
+		if err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	}
+
+	conn, err := d.Dialer.Dial("tcp", d.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to SOCKS5 proxy %s: %s", d.Proxy, err)
+	}
+	if d.Dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Dialer.Timeout))
+	}
+	err = d.handshake(conn, host, port)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to %s through SOCKS5 proxy %s: %s", address, d.Proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// lookup resolves a target hostname locally.
+func (d *SOCKS5Dialer) lookup(host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		if (d.Network == "tcp4" && !isIPv4) || (d.Network == "tcp6" && isIPv4) {
+			continue
+		}
+		return addr.IP, nil
+	}
+	return nil, fmt.Errorf("no %s addresses found for %s", d.Network, host)
+}
+
+func (d *SOCKS5Dialer) handshake(conn net.Conn, host string, port int) error {
+	method := byte(socks5AuthNone)
+	if d.Username != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d in reply", reply[0])
+	}
+	if reply[1] != method {
+		return errors.New("proxy doesn't accept our authentication method")
+	}
+	if method == socks5AuthPassword {
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %s is too long", host)
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddrIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Reply is version, status, reserved, and the bound address (which we
+	// don't need, but have to read past).
+	reply = make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		if message, ok := socks5Replies[reply[1]]; ok {
+			return errors.New(message)
+		}
+		return fmt.Errorf("unknown SOCKS5 reply code %d", reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", reply[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// authenticate performs username/password authentication (RFC 1929).
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("username and password must be at most 255 bytes")
+	}
+	request := []byte{1, byte(len(d.Username))}
+	request = append(request, d.Username...)
+	request = append(request, byte(len(d.Password)))
+	request = append(request, d.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
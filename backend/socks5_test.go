@@ -0,0 +1,153 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSOCKS5Proxy accepts a single connection, and answers with the given
+// reply code. On success, it echoes data back. The requested target (address
+// type and address) is sent on the returned channel.
+func fakeSOCKS5Proxy(t *testing.T, username, password string, code byte) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	targets := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		if username == "" {
+			conn.Write([]byte{5, 0})
+		} else {
+			conn.Write([]byte{5, 2})
+			header := make([]byte, 2)
+			io.ReadFull(conn, header)
+			user := make([]byte, header[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, header[:1])
+			pass := make([]byte, header[0])
+			io.ReadFull(conn, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+		}
+
+		request := make([]byte, 4)
+		io.ReadFull(conn, request)
+		var addr []byte
+		switch request[3] {
+		case 1:
+			addr = make([]byte, 4)
+			io.ReadFull(conn, addr)
+			addr = []byte(net.IP(addr).String())
+		case 3:
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			addr = make([]byte, length[0])
+			io.ReadFull(conn, addr)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		targets <- string(addr)
+
+		conn.Write([]byte{5, code, 0, 1, 127, 0, 0, 1, 0, 0})
+		if code == 0 {
+			io.Copy(conn, conn)
+		}
+	}()
+	return listener, targets
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	proxy, targets := fakeSOCKS5Proxy(t, "", "", 0)
+	defer proxy.Close()
+
+	d := &SOCKS5Dialer{Proxy: proxy.Addr().String(), Dialer: &net.Dialer{Timeout: time.Second}, RemoteDNS: true}
+	conn, err := d.Dial("tcp", "target.example.com:443")
+	assert.Nil(t, err, "should connect through proxy")
+	defer conn.Close()
+	assert.Equal(t, "target.example.com", <-targets, "should pass hostname to proxy")
+
+	_, err = conn.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write through proxy")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should be able to read through proxy")
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestSOCKS5DialerLocalDNS(t *testing.T) {
+	proxy, targets := fakeSOCKS5Proxy(t, "", "", 0)
+	defer proxy.Close()
+
+	d := &SOCKS5Dialer{Proxy: proxy.Addr().String(), Dialer: &net.Dialer{Timeout: time.Second}, Network: "tcp4"}
+	conn, err := d.Dial("tcp", "localhost:443")
+	assert.Nil(t, err, "should connect through proxy")
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", <-targets, "should resolve hostname locally")
+}
+
+func TestSOCKS5DialerAuthentication(t *testing.T) {
+	proxy, targets := fakeSOCKS5Proxy(t, "user", "secret", 0)
+	defer proxy.Close()
+
+	d := &SOCKS5Dialer{Proxy: proxy.Addr().String(), Dialer: &net.Dialer{Timeout: time.Second}, Username: "user", Password: "secret"}
+	conn, err := d.Dial("tcp", "127.0.0.1:443")
+	assert.Nil(t, err, "should authenticate to proxy")
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.1", <-targets)
+
+	proxy, _ = fakeSOCKS5Proxy(t, "user", "secret", 0)
+	defer proxy.Close()
+
+	d = &SOCKS5Dialer{Proxy: proxy.Addr().String(), Dialer: &net.Dialer{Timeout: time.Second}, Username: "user", Password: "wrong"}
+	_, err = d.Dial("tcp", "127.0.0.1:443")
+	assert.NotNil(t, err, "should fail with wrong password")
+	assert.Contains(t, err.Error(), "SOCKS5 proxy", "error should mention proxy")
+}
+
+func TestSOCKS5DialerErrors(t *testing.T) {
+	proxy, _ := fakeSOCKS5Proxy(t, "", "", 5)
+	defer proxy.Close()
+
+	d := &SOCKS5Dialer{Proxy: proxy.Addr().String(), Dialer: &net.Dialer{Timeout: time.Second}}
+	_, err := d.Dial("tcp", "127.0.0.1:443")
+	assert.NotNil(t, err, "should fail if proxy can't connect to target")
+	assert.Contains(t, err.Error(), "connection refused")
+	assert.Contains(t, err.Error(), "through SOCKS5 proxy "+proxy.Addr().String())
+
+	// Proxy that isn't listening
+	addr := proxy.Addr().String()
+	proxy.Close()
+	_, err = d.Dial("tcp", "127.0.0.1:443")
+	assert.NotNil(t, err, "should fail if proxy is down")
+	assert.Contains(t, err.Error(), "unable to connect to SOCKS5 proxy "+addr)
+}
@@ -0,0 +1,306 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Protocols supported by StartTLSDialer.
+const (
+	StartTLSSMTP     = "smtp"
+	StartTLSLDAP     = "ldap"
+	StartTLSPostgres = "postgres"
+)
+
+// OID of the LDAP StartTLS extended operation (RFC 4511, section 4.14.1).
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Code of the PostgreSQL SSLRequest message.
+const postgresSSLRequest = 80877103
+
+// NetDialer connects to an address, like net.Dialer.
+type NetDialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// StartTLSDialer connects to targets that only offer TLS after a plaintext
+// exchange in their own protocol (STARTTLS in SMTP and LDAP, SSLRequest in
+// PostgreSQL). Connections are returned once the target agreed to upgrade,
+// the TLS handshake then happens over the returned connection.
+type StartTLSDialer struct {
+	// Dialer used to connect to the target.
+	Dialer NetDialer
+	// Protocol to speak before the upgrade, one of the StartTLS constants.
+	Protocol string
+	// Timeout for the exchange with the target (zero for no timeout).
+	Timeout time.Duration
+	// Hostname to send with EHLO (SMTP only).
+	Hostname string
+}
+
+// Dial connects to the address, and negotiates the upgrade to TLS. Errors
+// include what the target replied, if it refused.
+func (d *StartTLSDialer) Dial(network, address string) (net.Conn, error) {
+	var upgrade func(conn net.Conn) error
+	switch d.Protocol {
+	case StartTLSSMTP:
+		upgrade = d.smtp
+	case StartTLSLDAP:
+		upgrade = ldapStartTLS
+	case StartTLSPostgres:
+		upgrade = postgresStartTLS
+	default:
+		return nil, fmt.Errorf("unsupported STARTTLS protocol '%s'", d.Protocol)
+	}
+
+	conn, err := d.Dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	if err := upgrade(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s STARTTLS with %s failed: %s", d.Protocol, address, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// SMTP upgrade (RFC 3207): wait for the greeting, send EHLO, and ask for
+// STARTTLS if the server offers it.
+func (d *StartTLSDialer) smtp(conn net.Conn) error {
+	buffered := bufio.NewReader(conn)
+	reader := textproto.NewReader(buffered)
+	if _, _, err := reader.ReadResponse(220); err != nil {
+		return smtpError("greeting", err)
+	}
+
+	hostname := d.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if _, err := fmt.Fprintf(conn, "EHLO %s\r\n", hostname); err != nil {
+		return err
+	}
+	_, message, err := reader.ReadResponse(250)
+	if err != nil {
+		return smtpError("EHLO", err)
+	}
+	if !smtpHasExtension(message, "STARTTLS") {
+		return fmt.Errorf("server doesn't offer STARTTLS (EHLO response %q)", message)
+	}
+
+	if _, err := io.WriteString(conn, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	if _, _, err := reader.ReadResponse(220); err != nil {
+		return smtpError("STARTTLS", err)
+	}
+	// The server must wait for our TLS handshake, anything else it sent
+	// wasn't protected by TLS (and could have been injected).
+	if buffered.Buffered() > 0 {
+		return errors.New("server sent unexpected data after STARTTLS response")
+	}
+	return nil
+}
+
+// Format an error reading an SMTP response, with the reply of the server if
+// it was an error reply.
+func smtpError(command string, err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return fmt.Errorf("server rejected %s: %q", command, fmt.Sprintf("%d %s", reply.Code, reply.Msg))
+	}
+	return fmt.Errorf("error reading %s response: %s", command, err)
+}
+
+// Check whether an EHLO response lists the given extension. The first line
+// is the greeting, the others are extensions with optional parameters.
+func smtpHasExtension(message, extension string) bool {
+	lines := strings.Split(message, "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.EqualFold(fields[0], extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// LDAP upgrade (RFC 4511, section 4.14): send a StartTLS extended request,
+// and check that the extended response has result code success.
+func ldapStartTLS(conn net.Conn) error {
+	// LDAPMessage { messageID 1, [APPLICATION 23] ExtendedRequest {
+	// [0] requestName } }, in BER.
+	request := berElement(0x77, berElement(0x80, []byte(ldapStartTLSOID)))
+	message := berElement(0x30, append([]byte{0x02, 0x01, 0x01}, request...))
+	if _, err := conn.Write(message); err != nil {
+		return err
+	}
+
+	tag, body, err := readBER(conn)
+	if err != nil {
+		return fmt.Errorf("error reading extended response: %s", err)
+	}
+	if tag != 0x30 {
+		return fmt.Errorf("unexpected response (tag 0x%02x)", tag)
+	}
+	fields := bytes.NewReader(body)
+	if tag, _, err = readBER(fields); err != nil || tag != 0x02 {
+		return errors.New("invalid message ID in response")
+	}
+	tag, response, err := readBER(fields)
+	if err != nil || tag != 0x78 {
+		return fmt.Errorf("unexpected response (tag 0x%02x), expected extended response", tag)
+	}
+
+	// ExtendedResponse { resultCode, matchedDN, diagnosticMessage, ... }
+	fields = bytes.NewReader(response)
+	tag, code, err := readBER(fields)
+	if err != nil || tag != 0x0a || len(code) == 0 {
+		return errors.New("invalid result code in extended response")
+	}
+	result := 0
+	for _, b := range code {
+		result = result<<8 | int(b)
+	}
+	if result == 0 {
+		return nil
+	}
+	readBER(fields)
+	_, diagnostic, _ := readBER(fields)
+	return fmt.Errorf("server rejected StartTLS request with result code %d: %q", result, diagnostic)
+}
+
+// Encode a BER element with the given tag and contents.
+func berElement(tag byte, contents []byte) []byte {
+	element := []byte{tag}
+	length := len(contents)
+	if length < 0x80 {
+		element = append(element, byte(length))
+	} else {
+		var encoded []byte
+		for ; length > 0; length >>= 8 {
+			encoded = append([]byte{byte(length)}, encoded...)
+		}
+		element = append(element, 0x80|byte(len(encoded)))
+		element = append(element, encoded...)
+	}
+	return append(element, contents...)
+}
+
+// Read a BER element (with a single-byte tag, as used by LDAP), returning
+// its tag and contents. Reads exactly the bytes of the element.
+func readBER(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, fmt.Errorf("unsupported BER length encoding 0x%02x", header[1])
+		}
+		encoded := make([]byte, size)
+		if _, err := io.ReadFull(r, encoded); err != nil {
+			return 0, nil, err
+		}
+		length = 0
+		for _, b := range encoded {
+			length = length<<8 | int(b)
+		}
+	}
+	// Responses we care about are small.
+	if length > 64*1024 {
+		return 0, nil, fmt.Errorf("BER element too large (%d bytes)", length)
+	}
+	contents := make([]byte, length)
+	if _, err := io.ReadFull(r, contents); err != nil {
+		return 0, nil, err
+	}
+	return header[0], contents, nil
+}
+
+// PostgreSQL upgrade: send an SSLRequest, the server answers with a single
+// byte, 'S' if it's willing to do TLS.
+func postgresStartTLS(conn net.Conn) error {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], postgresSSLRequest)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Read exactly one byte: anything after it must be part of the TLS
+	// handshake (see CVE-2021-23222).
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fmt.Errorf("error reading SSLRequest response: %s", err)
+	}
+	switch response[0] {
+	case 'S':
+		return nil
+	case 'N':
+		return errors.New("server doesn't support SSL")
+	case 'E':
+		return fmt.Errorf("server rejected SSLRequest: %q", postgresErrorMessage(conn))
+	default:
+		return fmt.Errorf("unexpected response to SSLRequest: %q", response)
+	}
+}
+
+// Read the rest of a PostgreSQL ErrorResponse message, and return its
+// message field (or all fields, if there is no message).
+func postgresErrorMessage(conn net.Conn) string {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return ""
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 4 || length > 64*1024 {
+		return ""
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return ""
+	}
+	// Fields are a type byte and a NUL-terminated string each.
+	var fields []string
+	for _, field := range bytes.Split(body, []byte{0}) {
+		if len(field) < 2 {
+			continue
+		}
+		if field[0] == 'M' {
+			return string(field[1:])
+		}
+		fields = append(fields, string(field[1:]))
+	}
+	return strings.Join(fields, " ")
+}
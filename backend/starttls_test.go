@@ -0,0 +1,240 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Self-signed certificate for localhost, and a pool that trusts it.
+func starttlsCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should be able to generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should be able to create certificate")
+	leaf, err := x509.ParseCertificate(der)
+	assert.Nil(t, err, "should be able to parse certificate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// fakeStartTLSServer accepts a single connection, runs the plaintext part of
+// a protocol with exchange, and (if that succeeds) does a TLS handshake and
+// echoes data back.
+func fakeStartTLSServer(t *testing.T, exchange func(conn net.Conn, reader *bufio.Reader) bool) (net.Listener, *x509.CertPool) {
+	cert, roots := starttlsCertificate(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if !exchange(conn, bufio.NewReader(conn)) {
+			return
+		}
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		io.Copy(tlsConn, tlsConn)
+	}()
+	return listener, roots
+}
+
+// Dial the fake server with STARTTLS, and check that TLS works afterwards.
+func testStartTLS(t *testing.T, protocol string, listener net.Listener, roots *x509.CertPool) error {
+	dialer := &StartTLSDialer{
+		Dialer:   &net.Dialer{Timeout: time.Second},
+		Protocol: protocol,
+		Timeout:  time.Second,
+		Hostname: "client.example.com",
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", RootCAs: roots})
+	assert.Nil(t, tlsConn.Handshake(), "should be able to do verified TLS handshake after upgrade")
+	tlsConn.Write([]byte("ping"))
+	response := make([]byte, 4)
+	_, err = io.ReadFull(tlsConn, response)
+	assert.Nil(t, err, "should be able to read over TLS")
+	assert.Equal(t, "ping", string(response))
+	return nil
+}
+
+// SMTP server that offers (or refuses) STARTTLS with the given reply.
+func smtpExchange(t *testing.T, starttlsReply string) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		text := textproto.NewReader(reader)
+		io.WriteString(conn, "220-mail.example.com ESMTP\r\n220 ready\r\n")
+		line, _ := text.ReadLine()
+		assert.Equal(t, "EHLO client.example.com", line, "should send EHLO with hostname")
+		io.WriteString(conn, "250-mail.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n")
+		line, _ = text.ReadLine()
+		assert.Equal(t, "STARTTLS", line, "should ask for STARTTLS")
+		io.WriteString(conn, starttlsReply)
+		return starttlsReply[:3] == "220"
+	}
+}
+
+func TestStartTLSSMTP(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, smtpExchange(t, "220 go ahead\r\n"))
+	defer listener.Close()
+	assert.Nil(t, testStartTLS(t, StartTLSSMTP, listener, roots), "should upgrade SMTP connection")
+}
+
+func TestStartTLSSMTPRejected(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, smtpExchange(t, "454 4.7.0 TLS not available due to temporary reason\r\n"))
+	defer listener.Close()
+	err := testStartTLS(t, StartTLSSMTP, listener, roots)
+	assert.NotNil(t, err, "should fail if server rejects STARTTLS")
+	assert.Contains(t, err.Error(), `"454 4.7.0 TLS not available due to temporary reason"`, "should include server reply verbatim")
+}
+
+func TestStartTLSSMTPNotOffered(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		io.WriteString(conn, "220 mail.example.com ESMTP\r\n")
+		textproto.NewReader(reader).ReadLine()
+		io.WriteString(conn, "250-mail.example.com\r\n250 PIPELINING\r\n")
+		return false
+	})
+	defer listener.Close()
+	err := testStartTLS(t, StartTLSSMTP, listener, roots)
+	assert.NotNil(t, err, "should fail if server doesn't offer STARTTLS")
+	assert.Contains(t, err.Error(), "doesn't offer STARTTLS")
+}
+
+func TestStartTLSSMTPInjectedData(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, smtpExchange(t, "220 go ahead\r\n250 injected\r\n"))
+	defer listener.Close()
+	err := testStartTLS(t, StartTLSSMTP, listener, roots)
+	assert.NotNil(t, err, "should fail if server sends data after STARTTLS response")
+}
+
+// LDAP server that answers the StartTLS request with the given result code.
+func ldapExchange(t *testing.T, result byte, diagnostic string) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		tag, body, err := readBER(reader)
+		assert.Nil(t, err, "should be able to read request")
+		assert.Equal(t, byte(0x30), tag, "request should be an LDAPMessage")
+		assert.Contains(t, string(body), ldapStartTLSOID, "should send StartTLS request")
+
+		response := []byte{0x0a, 0x01, result}
+		response = append(response, berElement(0x04, nil)...)
+		response = append(response, berElement(0x04, []byte(diagnostic))...)
+		response = append(response, berElement(0x8a, []byte(ldapStartTLSOID))...)
+		message := append([]byte{0x02, 0x01, 0x01}, berElement(0x78, response)...)
+		conn.Write(berElement(0x30, message))
+		return result == 0
+	}
+}
+
+func TestStartTLSLDAP(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, ldapExchange(t, 0, ""))
+	defer listener.Close()
+	assert.Nil(t, testStartTLS(t, StartTLSLDAP, listener, roots), "should upgrade LDAP connection")
+}
+
+func TestStartTLSLDAPRejected(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, ldapExchange(t, 2, "unsupported extended operation"))
+	defer listener.Close()
+	err := testStartTLS(t, StartTLSLDAP, listener, roots)
+	assert.NotNil(t, err, "should fail if server rejects StartTLS")
+	assert.Contains(t, err.Error(), `result code 2: "unsupported extended operation"`, "should include diagnostic message verbatim")
+}
+
+// PostgreSQL server that answers the SSLRequest with the given response.
+func postgresExchange(t *testing.T, response []byte) func(net.Conn, *bufio.Reader) bool {
+	return func(conn net.Conn, reader *bufio.Reader) bool {
+		request := make([]byte, 8)
+		io.ReadFull(reader, request)
+		assert.Equal(t, uint32(8), binary.BigEndian.Uint32(request[0:4]), "should send SSLRequest length")
+		assert.Equal(t, uint32(postgresSSLRequest), binary.BigEndian.Uint32(request[4:8]), "should send SSLRequest code")
+		conn.Write(response)
+		return response[0] == 'S'
+	}
+}
+
+func TestStartTLSPostgres(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, postgresExchange(t, []byte("S")))
+	defer listener.Close()
+	assert.Nil(t, testStartTLS(t, StartTLSPostgres, listener, roots), "should upgrade PostgreSQL connection")
+}
+
+func TestStartTLSPostgresRejected(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, postgresExchange(t, []byte("N")))
+	defer listener.Close()
+	err := testStartTLS(t, StartTLSPostgres, listener, roots)
+	assert.NotNil(t, err, "should fail if server doesn't support SSL")
+	assert.Contains(t, err.Error(), "doesn't support SSL")
+
+	fields := []byte("SFATAL\x00C0A000\x00Munsupported frontend protocol\x00\x00")
+	message := make([]byte, 5, 5+len(fields))
+	message[0] = 'E'
+	binary.BigEndian.PutUint32(message[1:5], uint32(4+len(fields)))
+	listener, roots = fakeStartTLSServer(t, postgresExchange(t, append(message, fields...)))
+	defer listener.Close()
+	err = testStartTLS(t, StartTLSPostgres, listener, roots)
+	assert.NotNil(t, err, "should fail on error response")
+	assert.Contains(t, err.Error(), `"unsupported frontend protocol"`, "should include error message verbatim")
+}
+
+func TestStartTLSTimeout(t *testing.T) {
+	listener, roots := fakeStartTLSServer(t, func(conn net.Conn, reader *bufio.Reader) bool {
+		// Never send a greeting
+		time.Sleep(2 * time.Second)
+		return false
+	})
+	defer listener.Close()
+	start := time.Now()
+	err := testStartTLS(t, StartTLSSMTP, listener, roots)
+	assert.NotNil(t, err, "should time out waiting for greeting")
+	assert.True(t, time.Since(start) < 1900*time.Millisecond, "should not wait past timeout")
+}
+
+func TestStartTLSUnknownProtocol(t *testing.T) {
+	_, err := (&StartTLSDialer{Dialer: &net.Dialer{}, Protocol: "imap"}).Dial("tcp", "127.0.0.1:1")
+	assert.NotNil(t, err, "should reject unknown protocol")
+}
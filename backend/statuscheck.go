@@ -0,0 +1,32 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"time"
+)
+
+// NewStatusCheck creates a health check that probes the backend reached via
+// dial by dialing it (which, for a TLS backend, includes the handshake), to
+// report whether it's reachable on the status port. Probes fail if they don't
+// complete within timeout, and the backend is considered down once threshold
+// probes in a row failed.
+func NewStatusCheck(dial Dialer, timeout time.Duration, threshold int, logger Logger) *HealthCheck {
+	h := newHealthCheck([]*Target{{Dial: dial}}, nil, "status check", threshold, logger)
+	h.timeout = timeout
+	return h
+}
@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Logger that keeps logged messages around.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.messages)
+}
+
+func TestStatusCheckThreshold(t *testing.T) {
+	fail := false
+	check := NewStatusCheck(func() (net.Conn, error) {
+		if fail {
+			return nil, errors.New("failure for test")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}, time.Second, 2, &testLogger{})
+	assert.True(t, check.Result().Checked.IsZero(), "should have no result before first probe")
+	assert.Nil(t, check.Err(), "should be up before first probe")
+
+	check.check()
+	result := check.Result()
+	assert.Nil(t, result.Err)
+	assert.False(t, result.LastSuccess.IsZero(), "should record last success")
+	assert.Equal(t, result.Checked, result.LastSuccess)
+
+	fail = true
+	check.check()
+	assert.Equal(t, 1, check.Result().Failures)
+	assert.Nil(t, check.Err(), "should still be up below threshold")
+
+	check.check()
+	assert.Equal(t, 2, check.Result().Failures)
+	assert.NotNil(t, check.Err(), "should be down once threshold is reached")
+	assert.Equal(t, result.LastSuccess, check.Result().LastSuccess, "should keep last success while down")
+
+	fail = false
+	check.check()
+	assert.Equal(t, 0, check.Result().Failures)
+	assert.Nil(t, check.Err(), "should be up again after a successful probe")
+}
+
+func TestStatusCheckTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	check := NewStatusCheck(func() (net.Conn, error) {
+		<-block
+		return nil, errors.New("failure for test")
+	}, 10*time.Millisecond, 1, &testLogger{})
+
+	start := time.Now()
+	check.check()
+	assert.True(t, time.Since(start) < time.Second, "should give up on probe after timeout")
+	assert.Contains(t, check.Result().Err.Error(), "timed out")
+	assert.NotNil(t, check.Err())
+}
+
+func TestStatusCheckLogRateLimit(t *testing.T) {
+	fail := true
+	logger := &recordingLogger{}
+	check := NewStatusCheck(func() (net.Conn, error) {
+		if fail {
+			return nil, errors.New("failure for test")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}, time.Second, 1, logger)
+
+	for i := 0; i < 10; i++ {
+		check.check()
+	}
+	assert.Equal(t, 1, logger.count(), "should only log first failure within log interval")
+
+	check.logInterval = 0
+	check.check()
+	assert.Equal(t, 2, logger.count(), "should log again after log interval")
+	assert.Contains(t, logger.messages[1], "11 failed probe(s) in a row, 9 not logged")
+
+	fail = false
+	check.check()
+	assert.Equal(t, 3, logger.count(), "should log recovery")
+
+	check.logInterval = time.Hour
+	fail = true
+	check.check()
+	assert.Equal(t, 4, logger.count(), "should log first failure of a new outage right away")
+}
@@ -0,0 +1,85 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var backendCertExpiredCounter = metrics.GetOrRegisterCounter("backend.cert.expired.total", metrics.DefaultRegistry)
+
+// backendCertError classifies an error from dialing a TLS backend in client
+// mode: handshakes that failed because a certificate presented by the
+// backend has expired are counted, and the error says when it expired.
+// Other errors are returned as is.
+func backendCertError(err error) error {
+	var invalid x509.CertificateInvalidError
+	if !errors.As(err, &invalid) || invalid.Reason != x509.Expired || invalid.Cert == nil {
+		return err
+	}
+	// The same reason is used for certificates that aren't valid yet.
+	expiredAgo := time.Since(invalid.Cert.NotAfter)
+	if expiredAgo <= 0 {
+		return err
+	}
+	backendCertExpiredCounter.Inc(1)
+	return fmt.Errorf("backend certificate for '%s' expired at %s (%s ago): %w",
+		invalid.Cert.Subject, invalid.Cert.NotAfter.UTC().Format(time.RFC3339), expiredAgo.Truncate(time.Second), err)
+}
+
+// backendExpiryWarner is a VerifyConnection callback for --warn-backend-cert-expiry,
+// which logs a warning if the backend certificate expires within the given
+// duration. Each certificate is only warned about once, not on every
+// connection.
+type backendExpiryWarner struct {
+	within time.Duration
+	mu     sync.Mutex
+	warned map[[sha256.Size]byte]bool
+}
+
+func (w *backendExpiryWarner) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	remaining := time.Until(leaf.NotAfter)
+	if remaining > w.within {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fingerprint := sha256.Sum256(leaf.Raw)
+	if w.warned[fingerprint] {
+		return nil
+	}
+	if w.warned == nil {
+		w.warned = map[[sha256.Size]byte]bool{}
+	}
+	w.warned[fingerprint] = true
+	logger.Warnf("warning: backend certificate for '%s' expires at %s (in %s)",
+		leaf.Subject, leaf.NotAfter.UTC().Format(time.RFC3339), remaining.Truncate(time.Second))
+	return nil
+}
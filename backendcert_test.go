@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func backendTestCert(t *testing.T, notBefore, notAfter time.Time) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err, "should generate key")
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "backend"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err, "should create certificate")
+	cert, err := x509.ParseCertificate(raw)
+	assert.Nil(t, err, "should parse certificate")
+	return cert
+}
+
+func verifyBackendTestCert(cert *x509.Certificate) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	_, err := cert.Verify(x509.VerifyOptions{Roots: roots})
+	// Wrapped like crypto/tls does for failed handshakes.
+	return &tls.CertificateVerificationError{UnverifiedCertificates: []*x509.Certificate{cert}, Err: err}
+}
+
+func TestBackendCertError(t *testing.T) {
+	expired := backendTestCert(t, time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour))
+	before := backendCertExpiredCounter.Count()
+	err := backendCertError(verifyBackendTestCert(expired))
+	assert.Equal(t, before+1, backendCertExpiredCounter.Count(), "should count expired backend certificate")
+	assert.True(t, strings.HasPrefix(err.Error(), "backend certificate for 'CN=backend' expired at "+expired.NotAfter.UTC().Format(time.RFC3339)), "should log expiry, got: %s", err)
+	var invalid x509.CertificateInvalidError
+	assert.True(t, errors.As(err, &invalid), "should keep original error")
+
+	notYetValid := backendTestCert(t, time.Now().Add(time.Hour), time.Now().Add(48*time.Hour))
+	original := verifyBackendTestCert(notYetValid)
+	assert.Equal(t, original, backendCertError(original), "should not classify certificates that aren't valid yet")
+
+	original = fmt.Errorf("dial tcp: connection refused")
+	assert.Equal(t, original, backendCertError(original), "should not classify other errors")
+	assert.Equal(t, before+1, backendCertExpiredCounter.Count(), "should only count expired certificates")
+}
+
+func TestBackendExpiryWarner(t *testing.T) {
+	warner := &backendExpiryWarner{within: 24 * time.Hour}
+
+	valid := backendTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(48*time.Hour))
+	assert.Nil(t, warner.verifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{valid}}))
+	assert.Equal(t, 0, len(warner.warned), "should not warn about certificate that doesn't expire soon")
+
+	expiring := backendTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, warner.verifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{expiring}}), "should not reject connection")
+	}
+	assert.Equal(t, 1, len(warner.warned), "should warn once about expiring certificate")
+
+	assert.Nil(t, warner.verifyConnection(tls.ConnectionState{}), "should ignore connections without certificate")
+}
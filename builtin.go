@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// Built-in targets, a testing aid for measuring the overhead of ghostunnel
+// itself (e.g. in load tests) without having to run a separate backend. These
+// are not meant to be used in production.
+var builtinTargets = map[string]func(net.Conn){
+	"builtin-echo":    echoHandler,
+	"builtin-discard": discardHandler,
+}
+
+var (
+	builtinListeners   = map[string]net.Listener{}
+	builtinListenersMu sync.Mutex
+)
+
+func isBuiltinTarget(address string) bool {
+	_, ok := builtinTargets[address]
+	return ok
+}
+
+// builtinTargetAddress starts an in-process server for the given built-in
+// target on a random loopback port (once), and returns its address. We use a
+// real socket rather than an in-memory pipe so that half-closes work as they
+// would with any other backend.
+func builtinTargetAddress(name string) (string, error) {
+	builtinListenersMu.Lock()
+	defer builtinListenersMu.Unlock()
+
+	if listener, ok := builtinListeners[name]; ok {
+		return listener.Addr().String(), nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	builtinListeners[name] = listener
+	logger.Warnf("warning: using built-in %s target on %s, for testing only", name, listener.Addr())
+
+	handler := builtinTargets[name]
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// echoHandler sends back everything it receives.
+func echoHandler(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+// discardHandler reads and drops everything it receives.
+func discardHandler(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(ioutil.Discard, conn)
+}
@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltinEchoTarget(t *testing.T) {
+	assert.True(t, validateTarget("builtin-echo"), "built-in target should be valid")
+
+	dial, err := backendDialer("builtin-echo")
+	assert.Nil(t, err, "should get dialer for built-in target")
+
+	conn, err := dial()
+	assert.Nil(t, err, "should be able to dial built-in target")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err, "should be able to write to echo target")
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 4)
+	_, err = io.ReadFull(conn, received)
+	assert.Nil(t, err, "should receive echo")
+	assert.Equal(t, "ping", string(received))
+
+	first, err := builtinTargetAddress("builtin-echo")
+	assert.Nil(t, err, "should get address of built-in target")
+	second, err := builtinTargetAddress("builtin-echo")
+	assert.Nil(t, err, "should get address of built-in target")
+	assert.Equal(t, first, second, "should reuse built-in listener")
+}
+
+func TestBuiltinDiscardTarget(t *testing.T) {
+	dial, err := backendDialer("builtin-discard")
+	assert.Nil(t, err, "should get dialer for built-in target")
+
+	conn, err := dial()
+	assert.Nil(t, err, "should be able to dial built-in target")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(t, err, "should be able to write to discard target")
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "discard target should not send anything")
+}
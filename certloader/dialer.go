@@ -28,7 +28,7 @@ func (timeoutError) Error() string   { return "tls: DialWithDialer timed out" }
 func (timeoutError) Timeout() bool   { return true }
 func (timeoutError) Temporary() bool { return true }
 
-// Dialer is an interface for dialers. Can be a net.Dialer, http_dialer.HttpTunnel, or a dialer from this package.
+// Dialer is an interface for dialers. Can be a net.Dialer, one of the proxy dialers in backend, or a dialer from this package.
 type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
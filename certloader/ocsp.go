@@ -0,0 +1,149 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"golang.org/x/crypto/ocsp"
+)
+
+type staplingCertificate struct {
+	Certificate
+	// Path to OCSP response (DER)
+	path   string
+	logger Logger
+	// Cached *tls.Certificate, with OCSP response
+	cached unsafe.Pointer
+}
+
+// CertificateWithOCSPStaple wraps a certificate to staple the OCSP response
+// from the given file (in DER form) to it, for setups that fetch responses out
+// of band. The file is read again whenever the certificate is reloaded. The
+// response must be for the current certificate, and signed by its issuer if
+// the chain includes it. Expired responses are logged, and not stapled.
+func CertificateWithOCSPStaple(cert Certificate, path string, logger Logger) (Certificate, error) {
+	c := &staplingCertificate{
+		Certificate: cert,
+		path:        path,
+		logger:      logger,
+	}
+	err := c.staple()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reloads the certificate and the OCSP response. If either fails, the
+// old state is kept.
+func (c *staplingCertificate) Reload() error {
+	err := c.Certificate.Reload()
+	if err != nil {
+		return err
+	}
+	return c.staple()
+}
+
+// GetCertificate retrieves the actual underlying tls.Certificate, with OCSP
+// response.
+func (c *staplingCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cached)), nil
+}
+
+// GetClientCertificate retrieves the actual underlying tls.Certificate, with
+// OCSP response.
+func (c *staplingCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return (*tls.Certificate)(atomic.LoadPointer(&c.cached)), nil
+}
+
+// staple reads the OCSP response, and caches a copy of the current
+// certificate with the response attached.
+func (c *staplingCertificate) staple() error {
+	current, err := c.Certificate.GetCertificate(nil)
+	if err != nil {
+		return err
+	}
+	if current == nil || len(current.Certificate) == 0 {
+		return errors.New("no certificate to staple OCSP response to")
+	}
+
+	leaf := current.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(current.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	der, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return fmt.Errorf("unable to read OCSP response: %s", err)
+	}
+	response, err := parseOCSPResponse(der, current, leaf)
+	if err != nil {
+		return fmt.Errorf("invalid OCSP response in %s: %s", c.path, err)
+	}
+
+	stapled := *current
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		logging.Warnf(c.logger, "warning: OCSP response in %s expired at %s, not stapling it until it's replaced", c.path, response.NextUpdate.Format(time.RFC3339))
+		stapled.OCSPStaple = nil
+	} else {
+		stapled.OCSPStaple = der
+	}
+	atomic.StorePointer(&c.cached, unsafe.Pointer(&stapled))
+	return nil
+}
+
+// parseOCSPResponse parses an OCSP response, and checks that it is for the
+// leaf certificate and says it's good. If the chain includes the issuer, the
+// signature on the response is verified too.
+func parseOCSPResponse(der []byte, cert *tls.Certificate, leaf *x509.Certificate) (*ocsp.Response, error) {
+	var issuer *x509.Certificate
+	if len(cert.Certificate) > 1 {
+		parsed, err := x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			return nil, err
+		}
+		issuer = parsed
+	}
+
+	response, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if response.SerialNumber == nil || response.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		return nil, fmt.Errorf("response is for serial number %s, not for certificate with serial number %s", response.SerialNumber, leaf.SerialNumber)
+	}
+	switch response.Status {
+	case ocsp.Good:
+		return response, nil
+	case ocsp.Revoked:
+		return nil, fmt.Errorf("certificate was revoked at %s", response.RevokedAt.Format(time.RFC3339))
+	default:
+		return nil, errors.New("responder doesn't know the certificate")
+	}
+}
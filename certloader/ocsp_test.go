@@ -0,0 +1,153 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+// fakeCertificate serves a fixed certificate, and counts reloads.
+type fakeCertificate struct {
+	cert    *tls.Certificate
+	reloads int
+}
+
+func (c *fakeCertificate) Reload() error {
+	c.reloads++
+	return nil
+}
+
+func (c *fakeCertificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert, nil
+}
+
+func (c *fakeCertificate) GetClientCertificate(certInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.cert, nil
+}
+
+// Issue a leaf certificate from a fresh CA, returning the leaf (with chain)
+// and the CA certificate and key for signing OCSP responses.
+func ocspTestCertificates(t *testing.T) (*tls.Certificate, *x509.Certificate, crypto.Signer) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	assert.Nil(t, err)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	assert.Nil(t, err)
+	leaf, _ := x509.ParseCertificate(der)
+
+	return &tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key, Leaf: leaf}, ca, caKey
+}
+
+func writeOCSPResponse(t *testing.T, path string, ca *x509.Certificate, caKey crypto.Signer, template ocsp.Response) {
+	der, err := ocsp.CreateResponse(ca, ca, template, caKey)
+	assert.Nil(t, err, "should be able to create OCSP response")
+	assert.Nil(t, ioutil.WriteFile(path, der, 0600))
+}
+
+func TestCertificateWithOCSPStaple(t *testing.T) {
+	cert, ca, caKey := ocspTestCertificates(t)
+	file, err := ioutil.TempFile("", "ghostunnel-test-ocsp")
+	assert.Nil(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	writeOCSPResponse(t, file.Name(), ca, caKey, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(42),
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	})
+
+	inner := &fakeCertificate{cert: cert}
+	c, err := CertificateWithOCSPStaple(inner, file.Name(), testLogger)
+	assert.Nil(t, err, "should load valid OCSP response")
+
+	served, _ := c.GetCertificate(nil)
+	staple, _ := ioutil.ReadFile(file.Name())
+	assert.True(t, bytes.Equal(staple, served.OCSPStaple), "should staple OCSP response")
+	assert.Nil(t, cert.OCSPStaple, "should not modify underlying certificate")
+
+	// Expired response is replaced on reload, but not stapled.
+	writeOCSPResponse(t, file.Name(), ca, caKey, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: big.NewInt(42),
+		ThisUpdate:   time.Now().Add(-2 * time.Hour),
+		NextUpdate:   time.Now().Add(-time.Hour),
+	})
+	assert.Nil(t, c.Reload(), "should accept expired OCSP response")
+	assert.Equal(t, 1, inner.reloads, "should reload underlying certificate")
+	served, _ = c.GetCertificate(nil)
+	assert.Nil(t, served.OCSPStaple, "should not staple expired OCSP response")
+
+	// Invalid responses fail the reload, and keep the old state.
+	for _, template := range []ocsp.Response{
+		{Status: ocsp.Good, SerialNumber: big.NewInt(43), ThisUpdate: time.Now()},
+		{Status: ocsp.Revoked, SerialNumber: big.NewInt(42), ThisUpdate: time.Now(), RevokedAt: time.Now()},
+	} {
+		writeOCSPResponse(t, file.Name(), ca, caKey, template)
+		assert.NotNil(t, c.Reload(), "should reject OCSP response with status %d for serial %s", template.Status, template.SerialNumber)
+		current, _ := c.GetClientCertificate(nil)
+		assert.Equal(t, served, current, "should keep old state")
+	}
+
+	// Signed by another CA
+	_, otherCA, otherKey := ocspTestCertificates(t)
+	writeOCSPResponse(t, file.Name(), otherCA, otherKey, ocsp.Response{Status: ocsp.Good, SerialNumber: big.NewInt(42), ThisUpdate: time.Now()})
+	assert.NotNil(t, c.Reload(), "should reject OCSP response from other issuer")
+
+	ioutil.WriteFile(file.Name(), []byte("garbage"), 0600)
+	assert.NotNil(t, c.Reload(), "should reject invalid OCSP response")
+
+	os.Remove(file.Name())
+	_, err = CertificateWithOCSPStaple(inner, file.Name(), testLogger)
+	assert.NotNil(t, err, "should fail if OCSP response is missing")
+}
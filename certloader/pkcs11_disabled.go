@@ -18,7 +18,10 @@
 
 package certloader
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // SupportsPKCS11 returns true or false, depending on whether the binary
 // was built with PKCS11 support or not (requires CGO to build).
@@ -27,6 +30,12 @@ func SupportsPKCS11() bool {
 }
 
 // CertificateFromPKCS11Module creates a reloadable certificate from a PKCS#11 module.
-func CertificateFromPKCS11Module(certificatePath, modulePath, tokenLabel, pin string) (Certificate, error) {
+func CertificateFromPKCS11Module(certificatePath, modulePath, tokenLabel, pin string, logger Logger) (Certificate, error) {
+	return nil, errors.New("not supported")
+}
+
+// CertificateFromPKCS11PINPad creates a reloadable certificate from a PKCS#11
+// module, logging in via the token's PIN pad.
+func CertificateFromPKCS11PINPad(certificatePath, modulePath, tokenLabel string, timeout time.Duration, logger Logger) (Certificate, error) {
 	return nil, errors.New("not supported")
 }
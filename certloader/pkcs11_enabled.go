@@ -19,11 +19,17 @@
 package certloader
 
 import (
+	"crypto"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/letsencrypt/pkcs11key"
+	"github.com/miekg/pkcs11"
 )
 
 type pkcs11Certificate struct {
@@ -31,6 +37,12 @@ type pkcs11Certificate struct {
 	certificatePath string
 	// Params for loading key from a PKCS#11 module
 	modulePath, tokenLabel, pin string
+	// If set, login via the token's protected authentication path (PIN pad)
+	// instead of passing a PIN, and give up waiting after pinPadTimeout.
+	pinPad        bool
+	pinPadTimeout time.Duration
+	// Logger for re-login events
+	logger Logger
 	// Cached *tls.Certificate
 	cached unsafe.Pointer
 }
@@ -42,12 +54,36 @@ func SupportsPKCS11() bool {
 }
 
 // CertificateFromPKCS11Module creates a reloadable certificate from a PKCS#11 module.
-func CertificateFromPKCS11Module(certificatePath, modulePath, tokenLabel, pin string) (Certificate, error) {
+// If the session on the token goes stale (e.g. because the token was removed
+// and reinserted), we log in again before the next signing operation.
+func CertificateFromPKCS11Module(certificatePath, modulePath, tokenLabel, pin string, logger Logger) (Certificate, error) {
 	c := pkcs11Certificate{
 		certificatePath: certificatePath,
 		modulePath:      modulePath,
 		tokenLabel:      tokenLabel,
 		pin:             pin,
+		logger:          logger,
+	}
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// CertificateFromPKCS11PINPad creates a reloadable certificate from a PKCS#11
+// module, logging in via the token's protected authentication path. The module
+// will prompt for the PIN on the reader's PIN pad, and we give up after timeout
+// if no PIN was entered (zero means wait forever). Logging in again after the
+// session went stale will prompt on the PIN pad again.
+func CertificateFromPKCS11PINPad(certificatePath, modulePath, tokenLabel string, timeout time.Duration, logger Logger) (Certificate, error) {
+	c := pkcs11Certificate{
+		certificatePath: certificatePath,
+		modulePath:      modulePath,
+		tokenLabel:      tokenLabel,
+		pinPad:          true,
+		pinPadTimeout:   timeout,
+		logger:          logger,
 	}
 	err := c.Reload()
 	if err != nil {
@@ -79,17 +115,119 @@ func (c *pkcs11Certificate) Reload() error {
 		old, _ := c.GetCertificate(nil)
 		certAndKey.PrivateKey = old.PrivateKey
 	} else {
-		privateKey, err := pkcs11key.New(c.modulePath, c.tokenLabel, c.pin, certAndKey.Leaf.PublicKey)
+		publicKey := certAndKey.Leaf.PublicKey
+		privateKey, err := c.loadKey(publicKey)
 		if err != nil {
 			return err
 		}
-		certAndKey.PrivateKey = privateKey
+		// Note that there's no way to reinitialize the module itself, as
+		// pkcs11key keeps it loaded for the lifetime of the process. Logging in
+		// again opens a new session on the (already initialized) module.
+		certAndKey.PrivateKey = newReloginSigner(privateKey, c.tokenLabel, func() (pkcs11Key, error) {
+			key, err := c.loadKey(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			return key, nil
+		}, c.logger)
 	}
 
 	atomic.StorePointer(&c.cached, unsafe.Pointer(&certAndKey))
 	return nil
 }
 
+func (c *pkcs11Certificate) loadKey(publicKey crypto.PublicKey) (*pkcs11key.Key, error) {
+	if !c.pinPad {
+		return pkcs11key.New(c.modulePath, c.tokenLabel, c.pin, publicKey)
+	}
+
+	err := checkProtectedAuthPath(c.modulePath, c.tokenLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty PIN makes the module call C_Login with a NULL PIN, which per the
+	// PKCS#11 spec means the token authenticates via its protected path. The
+	// call blocks until the user enters (or cancels) the PIN on the PIN pad.
+	type result struct {
+		key *pkcs11key.Key
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		key, err := pkcs11key.New(c.modulePath, c.tokenLabel, "", publicKey)
+		done <- result{key, err}
+	}()
+
+	var timeout <-chan time.Time
+	if c.pinPadTimeout > 0 {
+		timeout = time.After(c.pinPadTimeout)
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, pinPadError(r.err)
+		}
+		return r.key, nil
+	case <-timeout:
+		// There is no way to abort a pending C_Login, so the goroutine is left
+		// to finish (or fail) on its own and its result is discarded.
+		return nil, fmt.Errorf("timed out after %s waiting for PIN entry on PIN pad", c.pinPadTimeout)
+	}
+}
+
+// checkProtectedAuthPath verifies that the token with the given label has a
+// protected authentication path (e.g. a PIN pad on the reader). The module is
+// finalized again afterwards so that pkcs11key can initialize it as usual.
+func checkProtectedAuthPath(modulePath, tokenLabel string) error {
+	module := pkcs11.New(modulePath)
+	if module == nil {
+		return fmt.Errorf("failed to load module '%s'", modulePath)
+	}
+	defer module.Destroy()
+
+	err := module.Initialize()
+	if err != nil {
+		return fmt.Errorf("failed to initialize module: %s", err)
+	}
+	defer module.Finalize()
+
+	slots, err := module.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		info, err := module.GetTokenInfo(slot)
+		if err != nil {
+			return err
+		}
+		if info.Label != tokenLabel {
+			continue
+		}
+		if info.Flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH == 0 {
+			return fmt.Errorf("token %q does not have a protected authentication path (PIN pad), use a PIN instead", tokenLabel)
+		}
+		return nil
+	}
+	return fmt.Errorf("no slot found matching token label %q", tokenLabel)
+}
+
+// pinPadError translates login failures from the PIN pad into something more
+// readable. Errors are wrapped as strings by pkcs11key, hence the matching.
+func pinPadError(err error) error {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "CKR_FUNCTION_CANCELED"):
+		return errors.New("PIN entry on PIN pad was cancelled")
+	case strings.Contains(msg, "CKR_PIN_INCORRECT"):
+		return errors.New("incorrect PIN entered on PIN pad")
+	case strings.Contains(msg, "CKR_PIN_LOCKED"):
+		return errors.New("PIN is locked, too many incorrect attempts on PIN pad")
+	}
+	return err
+}
+
 // GetCertificate retrieves the actual underlying tls.Certificate.
 func (c *pkcs11Certificate) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return (*tls.Certificate)(atomic.LoadPointer(&c.cached)), nil
@@ -0,0 +1,166 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Bounds for the backoff between failed attempts to log in to a token again.
+const (
+	minReloginBackoff = time.Second
+	maxReloginBackoff = time.Minute
+)
+
+var (
+	reloginCounter      = metrics.GetOrRegisterCounter("pkcs11.relogin", metrics.DefaultRegistry)
+	reloginErrorCounter = metrics.GetOrRegisterCounter("pkcs11.relogin.error", metrics.DefaultRegistry)
+)
+
+// Logger is used by this package to log messages
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// PKCS#11 errors that indicate our session is gone (e.g. because the token
+// was removed and reinserted), and that we need to log in again.
+var sessionErrors = []string{
+	"CKR_SESSION_HANDLE_INVALID",
+	"CKR_SESSION_CLOSED",
+	"CKR_DEVICE_REMOVED",
+	"CKR_TOKEN_NOT_PRESENT",
+	"CKR_USER_NOT_LOGGED_IN",
+}
+
+// pkcs11Key is a private key handle on a PKCS#11 token.
+type pkcs11Key interface {
+	crypto.Signer
+	Destroy() error
+}
+
+// reloginSigner wraps a PKCS#11 key, and transparently logs in to the token
+// again (opening a new session) if signing fails because the session went
+// stale. Failed attempts are retried with exponential backoff, on the next
+// signing operation after the backoff has passed.
+type reloginSigner struct {
+	publicKey crypto.PublicKey
+	label     string
+	load      func() (pkcs11Key, error)
+	logger    Logger
+
+	mu sync.Mutex
+	// Current key, nil if the last attempt to log in again failed.
+	key         pkcs11Key
+	backoff     time.Duration
+	nextAttempt time.Time
+}
+
+func newReloginSigner(key pkcs11Key, label string, load func() (pkcs11Key, error), logger Logger) *reloginSigner {
+	return &reloginSigner{
+		publicKey: key.Public(),
+		label:     label,
+		load:      load,
+		logger:    logger,
+		key:       key,
+	}
+}
+
+// Public returns the public key.
+func (s *reloginSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs msg with the key on the token, logging in again if needed.
+func (s *reloginSigner) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	key := s.key
+	s.mu.Unlock()
+
+	if key != nil {
+		signature, err := key.Sign(rand, msg, opts)
+		if err == nil || !isSessionError(err) {
+			return signature, err
+		}
+		logging.Warnf(s.logger, "warning: lost session on PKCS#11 token '%s', logging in again: %s", s.label, err)
+	}
+
+	key, err := s.relogin(key)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(rand, msg, opts)
+}
+
+// relogin replaces the stale key with a freshly loaded one, unless another
+// handshake already did so in the meantime or we're still backing off.
+func (s *reloginSigner) relogin(stale pkcs11Key) (pkcs11Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.key != stale {
+		return s.key, nil
+	}
+	if wait := time.Until(s.nextAttempt); wait > 0 {
+		return nil, fmt.Errorf("not logged in to PKCS#11 token '%s', next attempt in %s", s.label, wait.Truncate(time.Millisecond))
+	}
+
+	if stale != nil {
+		// Closing the stale session is expected to fail if the token was removed.
+		stale.Destroy()
+		s.key = nil
+	}
+
+	key, err := s.load()
+	if err != nil {
+		reloginErrorCounter.Inc(1)
+		s.backoff *= 2
+		if s.backoff < minReloginBackoff {
+			s.backoff = minReloginBackoff
+		}
+		if s.backoff > maxReloginBackoff {
+			s.backoff = maxReloginBackoff
+		}
+		s.nextAttempt = time.Now().Add(s.backoff)
+		logging.Errorf(s.logger, "error logging in to PKCS#11 token '%s' again, retrying in %s: %s", s.label, s.backoff, err)
+		return nil, err
+	}
+
+	reloginCounter.Inc(1)
+	s.key = key
+	s.backoff = 0
+	s.nextAttempt = time.Time{}
+	s.logger.Printf("logged in to PKCS#11 token '%s' again", s.label)
+	return key, nil
+}
+
+func isSessionError(err error) bool {
+	msg := err.Error()
+	for _, code := range sessionErrors {
+		if strings.Contains(msg, code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePKCS11Key struct {
+	err       error
+	destroyed bool
+}
+
+func (k *fakePKCS11Key) Public() crypto.PublicKey {
+	return "public"
+}
+
+func (k *fakePKCS11Key) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return []byte("signature"), nil
+}
+
+func (k *fakePKCS11Key) Destroy() error {
+	k.destroyed = true
+	return nil
+}
+
+var testLogger = log.New(os.Stderr, "", 0)
+
+func TestReloginSignerSessionInvalid(t *testing.T) {
+	stale := &fakePKCS11Key{err: errors.New("pkcs11key: sign init: pkcs11: 0xB3: CKR_SESSION_HANDLE_INVALID")}
+	fresh := &fakePKCS11Key{}
+	loads := 0
+	signer := newReloginSigner(stale, "test", func() (pkcs11Key, error) {
+		loads++
+		return fresh, nil
+	}, testLogger)
+
+	relogins := reloginCounter.Count()
+	signature, err := signer.Sign(nil, nil, crypto.SHA256)
+	assert.Nil(t, err, "should sign after logging in again")
+	assert.Equal(t, []byte("signature"), signature)
+	assert.Equal(t, 1, loads, "should have loaded key again")
+	assert.True(t, stale.destroyed, "should have closed stale session")
+	assert.Equal(t, relogins+1, reloginCounter.Count(), "should count re-login")
+	assert.Equal(t, "public", signer.Public())
+
+	_, err = signer.Sign(nil, nil, crypto.SHA256)
+	assert.Nil(t, err, "should sign with new key")
+	assert.Equal(t, 1, loads, "should not log in again on success")
+}
+
+func TestReloginSignerOtherError(t *testing.T) {
+	key := &fakePKCS11Key{err: errors.New("pkcs11key: sign: pkcs11: 0x30: CKR_DEVICE_ERROR")}
+	signer := newReloginSigner(key, "test", func() (pkcs11Key, error) {
+		t.Fatal("should not log in again on unrelated errors")
+		return nil, nil
+	}, testLogger)
+
+	_, err := signer.Sign(nil, nil, crypto.SHA256)
+	assert.Equal(t, key.err, err, "should pass through unrelated errors")
+}
+
+func TestReloginSignerBackoff(t *testing.T) {
+	key := &fakePKCS11Key{err: errors.New("pkcs11key: sign init: pkcs11: 0x32: CKR_DEVICE_REMOVED")}
+	loads := 0
+	signer := newReloginSigner(key, "test", func() (pkcs11Key, error) {
+		loads++
+		return nil, errors.New("no slot found matching token label")
+	}, testLogger)
+
+	failures := reloginErrorCounter.Count()
+	_, err := signer.Sign(nil, nil, crypto.SHA256)
+	assert.NotNil(t, err, "should fail while token is missing")
+	assert.Equal(t, failures+1, reloginErrorCounter.Count(), "should count failed re-login")
+
+	// Should not try again until backoff has passed
+	_, err = signer.Sign(nil, nil, crypto.SHA256)
+	assert.NotNil(t, err, "should fail while backing off")
+	assert.Equal(t, 1, loads, "should not log in again during backoff")
+	assert.Equal(t, minReloginBackoff, signer.backoff)
+
+	// Once backoff has passed, try again (and succeed)
+	signer.nextAttempt = time.Now()
+	signer.load = func() (pkcs11Key, error) {
+		return &fakePKCS11Key{}, nil
+	}
+	_, err = signer.Sign(nil, nil, crypto.SHA256)
+	assert.Nil(t, err, "should sign once token is back")
+	assert.Equal(t, time.Duration(0), signer.backoff, "should reset backoff")
+}
@@ -20,6 +20,7 @@ package certloader
 
 import (
 	"crypto/tls"
+	"errors"
 	"testing"
 	"unsafe"
 
@@ -27,10 +28,26 @@ import (
 )
 
 func TestInvalidPKCS11Module(t *testing.T) {
-	_, err := CertificateFromPKCS11Module("", "", "", "")
+	_, err := CertificateFromPKCS11Module("", "", "", "", nil)
 	assert.NotNil(t, err, "should not load invalid PKCS11 certificate/key")
 }
 
+func TestInvalidPKCS11PINPadModule(t *testing.T) {
+	_, err := CertificateFromPKCS11PINPad("", "", "", 0, nil)
+	assert.NotNil(t, err, "should not load invalid PKCS11 certificate/key")
+}
+
+func TestPINPadError(t *testing.T) {
+	err := pinPadError(errors.New("pkcs11key: opening session: pkcs11: 0x50: CKR_FUNCTION_CANCELED"))
+	assert.Equal(t, "PIN entry on PIN pad was cancelled", err.Error())
+
+	err = pinPadError(errors.New("pkcs11key: opening session: pkcs11: 0xA0: CKR_PIN_INCORRECT"))
+	assert.Equal(t, "incorrect PIN entered on PIN pad", err.Error())
+
+	other := errors.New("pkcs11key: opening session: pkcs11: 0x30: CKR_DEVICE_ERROR")
+	assert.Equal(t, other, pinPadError(other), "should pass through unrelated errors")
+}
+
 func TestGetCachedCertificatePKCS11(t *testing.T) {
 	tlscert := &tls.Certificate{}
 	p11cert := &pkcs11Certificate{
@@ -0,0 +1,46 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certloader
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateSelfSigned(t *testing.T) {
+	c, err := CertificateSelfSigned([]string{"localhost", "127.0.0.1"})
+	assert.Nil(t, err, "should generate certificate")
+
+	cert, err := c.GetCertificate(nil)
+	assert.Nil(t, err, "should return certificate")
+	assert.Equal(t, "localhost", cert.Leaf.Subject.CommonName, "should use first name as common name")
+	assert.Equal(t, []string{"localhost"}, cert.Leaf.DNSNames, "should include DNS names")
+	assert.Equal(t, "127.0.0.1", cert.Leaf.IPAddresses[0].String(), "should include IP addresses")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	for _, name := range []string{"localhost", "127.0.0.1"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: pool})
+		assert.Nil(t, err, "certificate should be valid for %s", name)
+	}
+
+	assert.Nil(t, c.Reload(), "reload should succeed")
+	reloaded, _ := c.GetClientCertificate(nil)
+	assert.Equal(t, cert, reloaded, "reload should keep generated certificate")
+}
@@ -0,0 +1,113 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Environment variable that tells the child process started with --exec
+// where to connect to the tunnel (in --listen syntax, i.e. HOST:PORT or
+// unix:PATH).
+const execAddressEnv = "GHOSTUNNEL_ADDR"
+
+// childProcess is a command started with --exec, which ghostunnel wraps: the
+// tunnel shuts down once it exits.
+type childProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// childExitError is returned from run if the child process exited with a
+// non-zero status, which we use as our own exit code.
+type childExitError int
+
+func (code childExitError) Error() string {
+	return fmt.Sprintf("child process exited with status %d", int(code))
+}
+
+// startChild runs the given command, with stdio inherited from us and
+// execAddressEnv pointing at the local end of the tunnel.
+func startChild(args []string, address string) (*childProcess, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), execAddressEnv+"="+address)
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("started child process %s (pid %d)", args[0], cmd.Process.Pid)
+
+	child := &childProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(child.done)
+	}()
+	return child, nil
+}
+
+// exited returns a channel that's closed once the child exits (or blocks
+// forever, if there's no child).
+func (c *childProcess) exited() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.done
+}
+
+// signal relays a signal (e.g. on shutdown) to the child, if still running.
+func (c *childProcess) signal(sig os.Signal) {
+	if c == nil {
+		return
+	}
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	// Not all signals can be relayed on all platforms (e.g. Windows).
+	if err := c.cmd.Process.Signal(sig); err != nil {
+		logger.Warnf("warning: unable to relay %s to child process: %s", sig, err)
+	}
+}
+
+// exitCode returns the exit status of the child. Children killed by a signal
+// don't have one, we treat those as a failure.
+func (c *childProcess) exitCode() int {
+	code := c.cmd.ProcessState.ExitCode()
+	if code < 0 {
+		return 1
+	}
+	return code
+}
+
+// err returns the error to exit with once the child is done, if any.
+func (c *childProcess) err() error {
+	if c == nil {
+		return nil
+	}
+	<-c.done
+	if code := c.exitCode(); code != 0 {
+		return childExitError(code)
+	}
+	return nil
+}
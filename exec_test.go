@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChildExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	child, err := startChild([]string{"sh", "-c", "exit 3"}, "127.0.0.1:8080")
+	assert.Nil(t, err, "should be able to start child")
+	<-child.exited()
+	assert.Equal(t, 3, child.exitCode(), "should return exit code of child")
+	assert.Equal(t, childExitError(3), child.err(), "should exit with code of child")
+
+	child, err = startChild([]string{"true"}, "127.0.0.1:8080")
+	assert.Nil(t, err, "should be able to start child")
+	assert.Nil(t, child.err(), "should exit cleanly if child succeeded")
+
+	_, err = startChild([]string{"/does/not/exist"}, "127.0.0.1:8080")
+	assert.NotNil(t, err, "should fail to start invalid command")
+
+	// No child without --exec
+	var none *childProcess
+	assert.Nil(t, none.err())
+	none.signal(os.Interrupt)
+}
+
+func TestChildEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	out, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+	out.Close()
+	defer os.Remove(out.Name())
+
+	child, err := startChild([]string{"sh", "-c", `printf %s "$` + execAddressEnv + `" > "$0"`, out.Name()}, "unix:/tmp/tunnel.sock")
+	assert.Nil(t, err, "should be able to start child")
+	assert.Nil(t, child.err(), "child should succeed")
+
+	address, err := ioutil.ReadFile(out.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "unix:/tmp/tunnel.sock", string(address), "child should see listen address")
+}
@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// Cipher suites allowed with --fips-only, the same ones crypto/tls allows in
+// FIPS 140-3 mode: ECDHE key exchange with AES-GCM. The TLS 1.3 suites can't
+// be configured, see verifyFIPS.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+var fipsTLS13CipherSuites = []uint16{
+	tls.TLS_AES_128_GCM_SHA256,
+	tls.TLS_AES_256_GCM_SHA384,
+}
+
+// Groups allowed with --fips-only (no X25519).
+var fipsCurves = []tls.CurveID{
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+func isFIPSCipherSuite(id uint16) bool {
+	for _, suites := range [][]uint16{fipsCipherSuites, fipsTLS13CipherSuites} {
+		for _, suite := range suites {
+			if suite == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFIPSCipherSuites returns an error if --fips-only is set, and one of
+// the given cipher suites isn't FIPS-approved.
+func checkFIPSCipherSuites(suites []uint16) ([]uint16, error) {
+	if !*fipsOnly {
+		return suites, nil
+	}
+	for _, suite := range suites {
+		if !isFIPSCipherSuite(suite) {
+			return nil, fmt.Errorf("cipher suite %s isn't FIPS-approved, and can't be used with --fips-only", tls.CipherSuiteName(suite))
+		}
+	}
+	return suites, nil
+}
+
+// applyFIPSOnly restricts a config to TLS 1.2 or newer, FIPS-approved cipher
+// suites and groups, if --fips-only is set. Cipher suites already set are
+// expected to have been checked with checkFIPSCipherSuites.
+func applyFIPSOnly(config *tls.Config) {
+	if !*fipsOnly {
+		return
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = fipsCipherSuites
+	}
+	config.CurvePreferences = fipsCurves
+	config.VerifyConnection = withFIPSCheck(config.VerifyConnection)
+}
+
+// withFIPSCheck returns a VerifyConnection callback that runs verifyFIPS
+// ahead of the given callback (which may be nil), if --fips-only is set.
+// Code that replaces or clears config.VerifyConnection must use it to keep
+// the check.
+func withFIPSCheck(verify func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	if !*fipsOnly {
+		return verify
+	}
+	return func(state tls.ConnectionState) error {
+		if err := verifyFIPS(state); err != nil {
+			return err
+		}
+		if verify != nil {
+			return verify(state)
+		}
+		return nil
+	}
+}
+
+// verifyFIPS rejects connections that negotiated a cipher suite that isn't
+// FIPS-approved. Go doesn't allow disabling ChaCha20 for TLS 1.3, so a peer
+// that prefers it would otherwise get it.
+func verifyFIPS(state tls.ConnectionState) error {
+	if !isFIPSCipherSuite(state.CipherSuite) {
+		return fmt.Errorf("negotiated cipher suite %s isn't FIPS-approved (--fips-only)", tls.CipherSuiteName(state.CipherSuite))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildConfigFIPSOnly(t *testing.T) {
+	tmpCaBundle, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+
+	tmpCaBundle.WriteString(testCertificate)
+	tmpCaBundle.WriteString("\n")
+
+	tmpCaBundle.Sync()
+	defer os.Remove(tmpCaBundle.Name())
+
+	*fipsOnly = true
+	defer func() { *fipsOnly = false }()
+
+	conf, err := buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.Nil(t, err, "should be able to build TLS config with --fips-only")
+	assert.Equal(t, fipsCipherSuites, conf.CipherSuites, "expecting only AES-GCM cipher suites")
+	assert.Equal(t, fipsCurves, conf.CurvePreferences, "expecting no X25519")
+	assert.Equal(t, uint16(tls.VersionTLS12), conf.MinVersion, "expecting TLS 1.2 or newer")
+	assert.NotNil(t, conf.VerifyConnection, "expecting negotiated cipher suite to be checked")
+
+	cipherSuitesSet = true
+	defer func() { cipherSuitesSet = false }()
+	_, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.NotNil(t, err, "should reject --cipher-suites=CHACHA with --fips-only")
+
+	_, err = buildConfig("AES,CBC", tmpCaBundle.Name())
+	assert.NotNil(t, err, "should reject --cipher-suites=CBC (with 3DES) with --fips-only")
+
+	*cipherSuiteNames = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	defer func() { *cipherSuiteNames = nil }()
+	cipherSuitesSet = false
+	conf, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.Nil(t, err, "should accept FIPS-approved --cipher-suite with --fips-only")
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, conf.CipherSuites, "expecting exactly the given cipher suite")
+
+	*cipherSuiteNames = []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}
+	_, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.NotNil(t, err, "should reject --cipher-suite that isn't FIPS-approved")
+}
+
+func TestWithFIPSCheck(t *testing.T) {
+	called := false
+	verify := func(tls.ConnectionState) error {
+		called = true
+		return nil
+	}
+
+	assert.Nil(t, withFIPSCheck(nil), "should leave callback as is without --fips-only")
+
+	*fipsOnly = true
+	defer func() { *fipsOnly = false }()
+
+	check := withFIPSCheck(verify)
+	assert.Nil(t, check(tls.ConnectionState{CipherSuite: tls.TLS_AES_128_GCM_SHA256}), "should accept TLS 1.3 AES-GCM")
+	assert.True(t, called, "should call wrapped callback")
+
+	called = false
+	assert.NotNil(t, check(tls.ConnectionState{CipherSuite: tls.TLS_CHACHA20_POLY1305_SHA256}), "should reject TLS 1.3 ChaCha20")
+	assert.False(t, called, "should not call wrapped callback for rejected connections")
+
+	assert.NotNil(t, withFIPSCheck(nil)(tls.ConnectionState{CipherSuite: tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}), "should reject ChaCha20 without wrapped callback")
+	assert.Nil(t, withFIPSCheck(nil)(tls.ConnectionState{CipherSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}), "should accept AES-GCM without wrapped callback")
+}
+
+func TestApplyFIPSOnly(t *testing.T) {
+	config := &tls.Config{MinVersion: tls.VersionTLS10}
+	applyFIPSOnly(config)
+	assert.Nil(t, config.CipherSuites, "should leave config as is without --fips-only")
+
+	*fipsOnly = true
+	defer func() { *fipsOnly = false }()
+
+	applyFIPSOnly(config)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion, "expecting TLS 1.2 or newer")
+	assert.Equal(t, fipsCipherSuites, config.CipherSuites, "expecting FIPS-approved cipher suites by default")
+	assert.Equal(t, fipsCurves, config.CurvePreferences, "expecting no X25519")
+
+	config = &tls.Config{MinVersion: tls.VersionTLS13}
+	applyFIPSOnly(config)
+	assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion, "should not lower minimum version")
+}
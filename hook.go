@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/proxy"
+)
+
+// Maximum number of bytes of hook output to include in errors.
+const hookOutputLimit = 4096
+
+// preConnectHook returns a hook for --pre-connect-hook, which runs the command
+// at path before every backend connection, with details about the connection
+// in the environment (see hookEnv). The connection proceeds only if the
+// command exits with status 0 within timeout.
+func preConnectHook(path string, timeout time.Duration, target string) proxy.PreConnectHook {
+	return func(conn net.Conn) error {
+		return runHook("pre-connect", path, timeout, hookEnv(conn, target))
+	}
+}
+
+// postAcceptHook returns a hook for --post-accept-hook, which runs the command
+// at path for every accepted connection once the handshake completed, with
+// the same environment as the pre-connect hook. The connection is closed
+// unless the command exits with status 0 within timeout.
+func postAcceptHook(path string, timeout time.Duration, target string) proxy.PostAcceptHook {
+	return func(conn net.Conn) error {
+		return runHook("post-accept", path, timeout, hookEnv(conn, target))
+	}
+}
+
+// Run a hook command with the given extra environment, and return an error
+// if it doesn't exit with status 0 within timeout.
+func runHook(name, path string, timeout time.Duration, env []string) error {
+	hookCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(hookCtx, path)
+	cmd.Env = append(os.Environ(), env...)
+	// Don't wait for children of the hook that keep its output open.
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if hookCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook %s timed out after %s%s", name, path, timeout, hookOutput(output))
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %s failed: %s%s", name, path, err, hookOutput(output))
+	}
+	return nil
+}
+
+// hookEnv returns environment variables describing a connection for the
+// pre-connect and post-accept hooks. Peer certificate details are only set if the client
+// presented one.
+func hookEnv(conn net.Conn, target string) []string {
+	env := []string{
+		"GHOSTUNNEL_CLIENT_ADDR=" + conn.RemoteAddr().String(),
+		"GHOSTUNNEL_TARGET=" + target,
+	}
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return env
+	}
+	state := tlsConn.ConnectionState()
+	if state.ServerName != "" {
+		env = append(env, "GHOSTUNNEL_SERVER_NAME="+state.ServerName)
+	}
+	if len(state.PeerCertificates) > 0 {
+		leaf := state.PeerCertificates[0]
+		uris := []string{}
+		for _, uri := range leaf.URIs {
+			uris = append(uris, uri.String())
+		}
+		env = append(env,
+			"GHOSTUNNEL_PEER_SUBJECT="+leaf.Subject.String(),
+			"GHOSTUNNEL_PEER_CN="+leaf.Subject.CommonName,
+			"GHOSTUNNEL_PEER_DNS_SANS="+strings.Join(leaf.DNSNames, ","),
+			"GHOSTUNNEL_PEER_URI_SANS="+strings.Join(uris, ","))
+	}
+	return env
+}
+
+// Format output of a failed hook for errors, if there is any.
+func hookOutput(output []byte) string {
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return ""
+	}
+	if len(output) > hookOutputLimit {
+		output = append(output[:hookOutputLimit], "..."...)
+	}
+	return fmt.Sprintf(" (output: %q)", output)
+}
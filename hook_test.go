@@ -0,0 +1,101 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeHook(t *testing.T, dir, script string) string {
+	path := filepath.Join(dir, "hook.sh")
+	err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)
+	assert.Nil(t, err, "should be able to write hook")
+	return path
+}
+
+func TestPreConnectHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	dir, err := ioutil.TempDir("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	env := filepath.Join(dir, "env")
+	hook := preConnectHook(writeHook(t, dir, "env > "+env), time.Second, "localhost:8080")
+	assert.Nil(t, hook(server), "should succeed if hook exits with status 0")
+	out, err := ioutil.ReadFile(env)
+	assert.Nil(t, err, "hook should have run")
+	assert.Contains(t, string(out), "GHOSTUNNEL_CLIENT_ADDR=pipe\n", "should pass client address to hook")
+	assert.Contains(t, string(out), "GHOSTUNNEL_TARGET=localhost:8080\n", "should pass target to hook")
+	assert.NotContains(t, string(out), "GHOSTUNNEL_PEER_", "should not pass peer details without certificate")
+
+	hook = preConnectHook(writeHook(t, dir, "echo denied; exit 1"), time.Second, "localhost:8080")
+	err = hook(server)
+	assert.NotNil(t, err, "should fail if hook exits with non-zero status")
+	assert.True(t, strings.HasSuffix(err.Error(), `failed: exit status 1 (output: "denied")`), "should include hook output, got: %s", err)
+
+	hook = preConnectHook(writeHook(t, dir, "sleep 10"), 100*time.Millisecond, "localhost:8080")
+	start := time.Now()
+	err = hook(server)
+	assert.NotNil(t, err, "should fail if hook times out")
+	assert.Contains(t, err.Error(), "timed out after 100ms", "should report timeout")
+	assert.True(t, time.Since(start) < 5*time.Second, "should not wait for hook past timeout")
+}
+
+func TestPostAcceptHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	dir, err := ioutil.TempDir("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	hook := postAcceptHook(writeHook(t, dir, `test "$GHOSTUNNEL_CLIENT_ADDR" = pipe`), time.Second, "localhost:8080")
+	assert.Nil(t, hook(server), "should pass client address to hook")
+
+	hook = postAcceptHook(writeHook(t, dir, "exit 3"), time.Second, "localhost:8080")
+	err = hook(server)
+	assert.NotNil(t, err, "should fail if hook exits with non-zero status")
+	assert.True(t, strings.HasPrefix(err.Error(), "post-accept hook "), "should say which hook failed, got: %s", err)
+}
+
+func TestHookOutput(t *testing.T) {
+	assert.Equal(t, "", hookOutput([]byte(" \n")), "should omit empty output")
+	assert.Equal(t, ` (output: "a\nb")`, hookOutput([]byte("a\nb\n")), "should trim output")
+	long := hookOutput([]byte(strings.Repeat("x", 2*hookOutputLimit)))
+	assert.True(t, len(long) < hookOutputLimit+32, "should truncate long output")
+}
@@ -0,0 +1,59 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Elbandi/ghostunnel/sockopt"
+)
+
+// Prefix for listen addresses that refer to an inherited file descriptor, for
+// process managers that pass sockets by number (e.g. "fd:3").
+const fdAddressPrefix = "fd:"
+
+func isFdAddress(address string) bool {
+	return strings.HasPrefix(address, fdAddressPrefix)
+}
+
+// listenFd builds a listener from an inherited file descriptor, which must be
+// a listening socket. The listener takes over the descriptor: it's closed in
+// our process once the listener has been created (which holds a duplicate).
+func listenFd(address string) (net.Listener, error) {
+	fd, err := strconv.Atoi(strings.TrimPrefix(address, fdAddressPrefix))
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid file descriptor in listen address %s", address)
+	}
+
+	file := os.NewFile(uintptr(fd), address)
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on file descriptor %d: %s", fd, err)
+	}
+	listening, err := sockopt.IsListening(listener)
+	if err == nil && !listening {
+		listener.Close()
+		return nil, fmt.Errorf("file descriptor %d is not a listening socket", fd)
+	}
+	return listener, nil
+}
@@ -0,0 +1,106 @@
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Get a listen address for a duplicate of the file descriptor underlying a
+// listener or connection, as if it had been inherited.
+func inheritedFd(t *testing.T, f interface{ File() (*os.File, error) }) string {
+	file, err := f.File()
+	assert.Nil(t, err, "should be able to get file descriptor")
+	defer file.Close()
+	return dupFd(t, file)
+}
+
+func dupFd(t *testing.T, file *os.File) string {
+	fd, err := syscall.Dup(int(file.Fd()))
+	assert.Nil(t, err, "should be able to duplicate file descriptor")
+	return fmt.Sprintf("fd:%d", fd)
+}
+
+func TestListenFd(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer ln.Close()
+
+	listener, err := listenFd(inheritedFd(t, ln.(*net.TCPListener)))
+	assert.Nil(t, err, "should be able to listen on inherited socket")
+	defer listener.Close()
+	assert.Equal(t, ln.Addr().String(), listener.Addr().String(), "should listen on same address")
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connections on inherited socket")
+	conn.Close()
+}
+
+func TestListenFdInvalid(t *testing.T) {
+	for _, address := range []string{"fd:", "fd:-1", "fd:three"} {
+		_, err := listenFd(address)
+		assert.NotNil(t, err, "should reject invalid address %s", address)
+	}
+
+	file, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = listenFd(dupFd(t, file))
+	assert.NotNil(t, err, "should reject regular files")
+
+	// Connected (not listening) socket
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	panicOnError(err)
+	defer conn.Close()
+	_, err = listenFd(inheritedFd(t, conn.(*net.TCPConn)))
+	assert.NotNil(t, err, "should reject sockets that aren't listening")
+}
+
+func TestClientListenFdUnsafe(t *testing.T) {
+	ln, err := net.Listen("tcp", "0.0.0.0:0")
+	panicOnError(err)
+	defer ln.Close()
+
+	*clientUnsafeListen = false
+	_, err = clientListenFd(inheritedFd(t, ln.(*net.TCPListener)))
+	assert.NotNil(t, err, "should reject inherited socket that isn't on localhost")
+
+	*clientUnsafeListen = true
+	defer func() { *clientUnsafeListen = false }()
+	listener, err := clientListenFd(inheritedFd(t, ln.(*net.TCPListener)))
+	assert.Nil(t, err, "should accept inherited socket with --unsafe-listen")
+	listener.Close()
+}
@@ -0,0 +1,168 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is a log level. Messages are only logged if their level is at or
+// below the level of the logger.
+type Level int32
+
+const (
+	// Error is for failures that need attention.
+	Error Level = iota
+	// Warn is for unexpected conditions that we can recover from.
+	Warn
+	// Info is for regular operational messages, e.g. per-connection logs.
+	Info
+	// Debug is for detailed messages useful for debugging, e.g. handshake details.
+	Debug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+// Levels returns the names of all log levels, e.g. for flag parsing.
+func Levels() []string {
+	return levelNames
+}
+
+// ParseLevel parses a log level name (error, warn, info or debug).
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level '%s'", name)
+}
+
+func (l Level) String() string {
+	if int(l) < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// Printer is the minimal logger interface used by all packages.
+type Printer interface {
+	Printf(format string, v ...interface{})
+}
+
+// Leveled is implemented by loggers that support log levels.
+type Leveled interface {
+	Printer
+	Errorf(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Debugf(format string, v ...interface{})
+}
+
+// Logger wraps a standard library logger, and drops messages above the
+// configured level. The embedded logger can be passed to APIs that require a
+// *log.Logger, but logging through it directly bypasses level checks.
+type Logger struct {
+	*log.Logger
+	level int32
+}
+
+// New creates a new leveled logger writing to out.
+func New(out *log.Logger, level Level) *Logger {
+	return &Logger{Logger: out, level: int32(level)}
+}
+
+// SetLevel changes the level of the logger.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Enabled returns true if messages at the given level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	return level <= Level(atomic.LoadInt32(&l.level))
+}
+
+// Printf logs a message at info level.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.logf(Info, format, v...)
+}
+
+// Errorf logs a message at error level.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.logf(Error, format, v...)
+}
+
+// Warnf logs a message at warn level.
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.logf(Warn, format, v...)
+}
+
+// Infof logs a message at info level.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.logf(Info, format, v...)
+}
+
+// Debugf logs a message at debug level.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.logf(Debug, format, v...)
+}
+
+func (l *Logger) logf(level Level, format string, v ...interface{}) {
+	if l.Enabled(level) {
+		// Calldepth 3: caller of Printf/Errorf/etc.
+		_ = l.Logger.Output(3, fmt.Sprintf(format, v...))
+	}
+}
+
+// Errorf logs to p at error level if it supports levels, or via Printf otherwise.
+func Errorf(p Printer, format string, v ...interface{}) {
+	if l, ok := p.(Leveled); ok {
+		l.Errorf(format, v...)
+		return
+	}
+	p.Printf(format, v...)
+}
+
+// Warnf logs to p at warn level if it supports levels, or via Printf otherwise.
+func Warnf(p Printer, format string, v ...interface{}) {
+	if l, ok := p.(Leveled); ok {
+		l.Warnf(format, v...)
+		return
+	}
+	p.Printf(format, v...)
+}
+
+// Debugf logs to p at debug level if it supports levels, or via Printf otherwise.
+func Debugf(p Printer, format string, v ...interface{}) {
+	if l, ok := p.(Leveled); ok {
+		l.Debugf(format, v...)
+		return
+	}
+	p.Printf(format, v...)
+}
+
+// DebugEnabled returns true if p logs debug messages. Can be used to avoid
+// computing expensive debug messages.
+func DebugEnabled(p Printer) bool {
+	if l, ok := p.(interface{ Enabled(Level) bool }); ok {
+		return l.Enabled(Debug)
+	}
+	return true
+}
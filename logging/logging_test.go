@@ -0,0 +1,76 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPrinter struct {
+	messages []string
+}
+
+func (t *testPrinter) Printf(format string, v ...interface{}) {
+	t.messages = append(t.messages, fmt.Sprintf(format, v...))
+}
+
+func TestParseLevel(t *testing.T) {
+	for i, name := range Levels() {
+		level, err := ParseLevel(name)
+		assert.Nil(t, err, "should parse level %s", name)
+		assert.Equal(t, Level(i), level)
+		assert.Equal(t, name, level.String())
+	}
+
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err, "should parse level case-insensitively")
+	assert.Equal(t, Warn, level)
+
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err, "should not parse unknown level")
+}
+
+func TestLoggerLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(log.New(buf, "", 0), Warn)
+
+	logger.Errorf("error %d", 1)
+	logger.Warnf("warn %d", 2)
+	logger.Printf("info %d", 3)
+	logger.Debugf("debug %d", 4)
+	assert.Equal(t, "error 1\nwarn 2\n", buf.String(), "should only log messages at or below level")
+
+	buf.Reset()
+	logger.SetLevel(Debug)
+	Debugf(logger, "debug %d", 5)
+	assert.Equal(t, "debug 5\n", buf.String(), "should log debug messages at debug level")
+	assert.True(t, DebugEnabled(logger))
+}
+
+func TestHelpersWithPrinter(t *testing.T) {
+	printer := &testPrinter{}
+	Errorf(printer, "error")
+	Warnf(printer, "warn")
+	Debugf(printer, "debug")
+	assert.Equal(t, []string{"error", "warn", "debug"}, printer.messages, "should log everything via Printf")
+	assert.True(t, DebugEnabled(printer))
+}
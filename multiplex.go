@@ -0,0 +1,76 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/Elbandi/ghostunnel/mux"
+	"github.com/Elbandi/ghostunnel/proxy"
+)
+
+// ALPN protocol negotiated by ghostunnel clients and servers with
+// --multiplex, for connections that carry multiplexed streams.
+const multiplexProtocol = "ghostunnel-mux/1"
+
+// Advertise the multiplexing protocol on a server config. If the config
+// doesn't offer any other protocols, it's only advertised to clients that
+// ask for it: Go servers reject clients that offer ALPN protocols but have
+// none in common with the server, which would break regular clients.
+func enableMultiplexALPN(config *tls.Config) {
+	if len(config.NextProtos) > 0 {
+		config.NextProtos = append(config.NextProtos, multiplexProtocol)
+		return
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, protocol := range hello.SupportedProtos {
+			if protocol == multiplexProtocol {
+				multiplexed := config.Clone()
+				multiplexed.GetConfigForClient = nil
+				multiplexed.NextProtos = []string{multiplexProtocol}
+				return multiplexed, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// Wrap a dialer for the target in client mode, so that connections are opened
+// as streams over --multiplex-connections shared connections. If a shared
+// connection dies, all its streams are dropped, and it's reconnected for the
+// next stream.
+func multiplexedDialer(dial func() (net.Conn, error)) func() (net.Conn, error) {
+	pool := &mux.Pool{
+		Dial: func() (net.Conn, error) {
+			conn, err := dial()
+			if err != nil {
+				return nil, err
+			}
+			if tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok && tlsConn.ConnectionState().NegotiatedProtocol == multiplexProtocol {
+				return conn, nil
+			}
+			conn.Close()
+			return nil, fmt.Errorf("target %s doesn't support multiplexing (is --multiplex set on the server?)", conn.RemoteAddr())
+		},
+		Size:   *clientMultiplexConns,
+		Config: proxy.MultiplexConfig(*muxKeepalive),
+		Logger: logger,
+	}
+	return pool.Open
+}
@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnableMultiplexALPN(t *testing.T) {
+	config := &tls.Config{}
+	enableMultiplexALPN(config)
+
+	c, err := config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", "http/1.1"}})
+	assert.Nil(t, err)
+	assert.Nil(t, c, "should leave config alone for regular clients")
+
+	c, err = config.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{multiplexProtocol}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{multiplexProtocol}, c.NextProtos, "should advertise protocol to multiplexing clients")
+	assert.Nil(t, c.GetConfigForClient)
+
+	config = &tls.Config{NextProtos: []string{"h2"}}
+	enableMultiplexALPN(config)
+	assert.Equal(t, []string{"h2", multiplexProtocol}, config.NextProtos, "should add protocol to other protocols")
+	assert.Nil(t, config.GetConfigForClient)
+}
+
+func TestMultiplexedDialerRequiresProtocol(t *testing.T) {
+	// Server that doesn't negotiate the multiplexing protocol.
+	cert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-pkcs8.pem")
+	assert.Nil(t, err, "should load test certificate")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, err, "should listen on random port")
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	*clientMultiplexConns = 1
+	defer func() { *clientMultiplexConns = 0 }()
+	dial := multiplexedDialer(func() (net.Conn, error) {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{multiplexProtocol}})
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+	_, err = dial()
+	assert.NotNil(t, err, "should reject servers without multiplexing")
+}
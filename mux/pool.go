@@ -0,0 +1,121 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"net"
+	"sync"
+)
+
+// Logger is used by this package to log messages
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Pool opens streams over a fixed number of client sessions, which are
+// connected with Dial when first needed (and again after they closed).
+// Streams are spread across sessions round-robin.
+type Pool struct {
+	// Dial connects to the server end.
+	Dial func() (net.Conn, error)
+	// Number of sessions (at least one).
+	Size int
+	// Config for new sessions.
+	Config Config
+	// Logger (optional) for session lifecycle messages.
+	Logger Logger
+
+	mu    sync.Mutex
+	slots []*poolSlot
+	next  int
+}
+
+type poolSlot struct {
+	mu      sync.Mutex
+	session *Session
+}
+
+// Open opens a new stream on one of the sessions, connecting it first if
+// needed (or if the server asked us to go away, in which case streams still
+// open on the old session keep going). Dialing only holds up streams waiting
+// for the same session.
+func (p *Pool) Open() (net.Conn, error) {
+	slot := p.nextSlot()
+
+	slot.mu.Lock()
+	if slot.session == nil || !slot.session.acceptsStreams() {
+		conn, err := p.Dial()
+		if err != nil {
+			slot.mu.Unlock()
+			return nil, err
+		}
+		slot.session = Client(conn, p.Config)
+		p.logf("opened multiplexed connection to %s", conn.RemoteAddr())
+		go p.watch(slot.session)
+	}
+	session := slot.session
+	slot.mu.Unlock()
+
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Close closes all sessions, dropping their streams.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, slot := range p.slots {
+		slot.mu.Lock()
+		if slot.session != nil {
+			slot.session.Close()
+		}
+		slot.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *Pool) nextSlot() *poolSlot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.slots == nil {
+		size := p.Size
+		if size < 1 {
+			size = 1
+		}
+		for i := 0; i < size; i++ {
+			p.slots = append(p.slots, &poolSlot{})
+		}
+	}
+	slot := p.slots[p.next]
+	p.next = (p.next + 1) % len(p.slots)
+	return slot
+}
+
+// Log once a session closes, with the number of streams that were dropped.
+func (p *Pool) watch(session *Session) {
+	<-session.Done()
+	p.logf("%s (to %s), dropped %d streams", session.Err(), session.RemoteAddr(), session.Dropped())
+}
+
+func (p *Pool) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,139 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLogger struct{}
+
+func (t *testLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+// Server end for pool tests, echoing data on each stream.
+type echoServer struct {
+	mu       sync.Mutex
+	sessions []*Session
+}
+
+func (e *echoServer) dial() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	session := Server(c2, Config{})
+	e.mu.Lock()
+	e.sessions = append(e.sessions, session)
+	e.mu.Unlock()
+	go func() {
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+	return c1, nil
+}
+
+func (e *echoServer) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.sessions)
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("ping"))
+	assert.Nil(t, err, "should write to stream")
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should read echo")
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestPoolSpreadsStreams(t *testing.T) {
+	server := &echoServer{}
+	pool := &Pool{Dial: server.dial, Size: 2, Logger: &testLogger{}}
+	defer pool.Close()
+
+	for i := 0; i < 6; i++ {
+		conn, err := pool.Open()
+		assert.Nil(t, err, "should open stream")
+		echo(t, conn)
+		defer conn.Close()
+	}
+	assert.Equal(t, 2, server.count(), "should only connect once per session")
+	for _, session := range server.sessions {
+		assert.Equal(t, 3, session.NumStreams(), "should spread streams evenly")
+	}
+}
+
+func TestPoolReconnects(t *testing.T) {
+	server := &echoServer{}
+	pool := &Pool{Dial: server.dial, Size: 1, Logger: &testLogger{}}
+	defer pool.Close()
+
+	conn, err := pool.Open()
+	assert.Nil(t, err, "should open stream")
+	echo(t, conn)
+
+	// All streams drop with the connection, new ones use a new session.
+	server.sessions[0].Close()
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "stream should drop with its session")
+
+	conn, err = pool.Open()
+	assert.Nil(t, err, "should reconnect")
+	echo(t, conn)
+	conn.Close()
+	assert.Equal(t, 2, server.count())
+}
+
+func TestPoolReconnectsAfterGoAway(t *testing.T) {
+	server := &echoServer{}
+	pool := &Pool{Dial: server.dial, Size: 1, Logger: &testLogger{}}
+	defer pool.Close()
+
+	conn, err := pool.Open()
+	assert.Nil(t, err, "should open stream")
+	echo(t, conn)
+	defer conn.Close()
+
+	server.sessions[0].Shutdown()
+	session := conn.(*Stream).Session()
+	for i := 0; i < 100 && session.acceptsStreams(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	other, err := pool.Open()
+	assert.Nil(t, err, "should reconnect")
+	echo(t, other)
+	other.Close()
+	echo(t, conn)
+	assert.Equal(t, 2, server.count(), "should open new session while old one drains")
+}
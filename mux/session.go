@@ -0,0 +1,517 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	protoVersion uint8 = 0
+
+	// Frame types
+	typeData         uint8 = 0
+	typeWindowUpdate uint8 = 1
+	typePing         uint8 = 2
+	typeGoAway       uint8 = 3
+
+	// Frame flags
+	flagSYN uint16 = 1
+	flagACK uint16 = 2
+	flagFIN uint16 = 4
+	flagRST uint16 = 8
+
+	headerSize = 12
+
+	// Go away reason for normal termination.
+	goAwayNormal = 0
+
+	// Receive window for each stream, as in yamux.
+	initialWindow = 256 * 1024
+
+	// Incoming streams not yet accepted, beyond which new ones are reset.
+	acceptBacklog = 256
+
+	// Control frames (acks, window updates, pings) waiting to be written.
+	controlBacklog = 1024
+)
+
+var (
+	// ErrSessionClosed is returned for operations on a closed session, and
+	// on its streams. If the session failed, the error wraps it.
+	ErrSessionClosed = errors.New("multiplexed connection closed")
+
+	// ErrStreamReset is returned when the peer reset (aborted) a stream.
+	ErrStreamReset = errors.New("stream reset by peer")
+
+	// ErrStreamClosed is returned for operations on a closed stream.
+	ErrStreamClosed = errors.New("stream closed")
+
+	// ErrGoAway is returned from Open if the peer doesn't accept new streams.
+	ErrGoAway = errors.New("peer doesn't accept new streams")
+
+	errShuttingDown     = errors.New("multiplexed connection is shutting down")
+	errKeepAliveTimeout = errors.New("keepalive timeout")
+	errWindowExceeded   = errors.New("peer exceeded receive window")
+)
+
+// Config holds the options for a session.
+type Config struct {
+	// Interval between keepalive pings (zero to disable). The session is
+	// closed if a ping isn't answered before the next one is due.
+	KeepAliveInterval time.Duration
+	// Called with the round-trip time of each keepalive ping answered by the
+	// peer (optional).
+	RoundTrip func(rtt time.Duration)
+}
+
+type header [headerSize]byte
+
+func newHeader(typ uint8, flags uint16, id, length uint32) header {
+	var h header
+	h[0] = protoVersion
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+	return h
+}
+
+func (h header) version() uint8   { return h[0] }
+func (h header) typ() uint8       { return h[1] }
+func (h header) flags() uint16    { return binary.BigEndian.Uint16(h[2:4]) }
+func (h header) streamID() uint32 { return binary.BigEndian.Uint32(h[4:8]) }
+func (h header) length() uint32   { return binary.BigEndian.Uint32(h[8:12]) }
+
+// Session multiplexes streams over a connection. Either end can open
+// streams: by convention, the client end opens them and the server end
+// accepts them.
+type Session struct {
+	conn   net.Conn
+	config Config
+	client bool
+
+	// Serializes frames written to conn.
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	// Peer sent a go away, or we're shutting down.
+	goAway   bool
+	shutdown bool
+	err      error
+
+	accept  chan *Stream
+	control chan header
+	closed  chan struct{}
+
+	// Number of streams open when the session was closed.
+	dropped int
+
+	// Last keepalive ping sent, when it was sent, and whether the peer
+	// answered it.
+	pingID   uint32
+	pingSent time.Time
+	pong     bool
+}
+
+// Client starts a session on the client end of conn.
+func Client(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, true)
+}
+
+// Server starts a session on the server end of conn.
+func Server(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, false)
+}
+
+func newSession(conn net.Conn, config Config, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		config:  config,
+		client:  client,
+		streams: map[uint32]*Stream{},
+		accept:  make(chan *Stream, acceptBacklog),
+		control: make(chan header, controlBacklog),
+		closed:  make(chan struct{}),
+	}
+	// Client streams have odd IDs, server streams even ones.
+	if client {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	go s.recvLoop()
+	go s.controlLoop()
+	if config.KeepAliveInterval > 0 {
+		go s.keepalive(config.KeepAliveInterval)
+	}
+	return s
+}
+
+// Open opens a new stream to the peer. This doesn't wait for the peer to
+// accept it, data can be written right away.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil, errShuttingDown
+	}
+	if s.goAway {
+		s.mu.Unlock()
+		return nil, ErrGoAway
+	}
+	id := s.nextID
+	if id > ^uint32(0)-2 {
+		s.mu.Unlock()
+		return nil, errors.New("stream IDs exhausted")
+	}
+	s.nextID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	// Written directly rather than as a control frame, so that the SYN goes
+	// out before any data on the stream.
+	if err := s.writeFrame(newHeader(typeWindowUpdate, flagSYN, id, 0), nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the peer to open a new stream.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Close closes the session and the underlying connection. All streams are
+// dropped, i.e. fail with ErrSessionClosed.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+// Shutdown closes the session gracefully: the peer is told not to open new
+// streams (and any it opens anyway are reset), and the session is closed
+// once all open streams are closed.
+func (s *Session) Shutdown() {
+	s.mu.Lock()
+	if s.shutdown || s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.shutdown = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+
+	if s.writeFrame(newHeader(typeGoAway, 0, 0, goAwayNormal), nil) == nil && idle {
+		s.Close()
+	}
+}
+
+// acceptsStreams returns true if new streams can be opened.
+func (s *Session) acceptsStreams() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err == nil && !s.goAway && !s.shutdown
+}
+
+// Done returns a channel that's closed once the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// IsClosed returns true if the session was closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the reason the session was closed (nil if still open).
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Dropped returns the number of streams that were still open when the
+// session was closed.
+func (s *Session) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// LocalAddr returns the local address of the underlying connection.
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	if err != ErrSessionClosed {
+		err = fmt.Errorf("%w: %s", ErrSessionClosed, err)
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*Stream{}
+	s.dropped = len(streams)
+	s.mu.Unlock()
+
+	close(s.closed)
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.sessionClosed(err)
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	idle := s.shutdown && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *Session) writeFrame(h header, body []byte) error {
+	frame := make([]byte, headerSize+len(body))
+	copy(frame, h[:])
+	copy(frame[headerSize:], body)
+
+	s.writeMu.Lock()
+	_, err := s.conn.Write(frame)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.closeWithError(err)
+		return s.Err()
+	}
+	return nil
+}
+
+// Queue a control frame, written in the background so that the receive
+// loop never blocks on writes.
+func (s *Session) sendControl(h header) {
+	select {
+	case s.control <- h:
+	case <-s.closed:
+	}
+}
+
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case h := <-s.control:
+			if s.writeFrame(h, nil) != nil {
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			missed := s.pingID > 0 && !s.pong
+			s.pingID++
+			s.pingSent = time.Now()
+			s.pong = false
+			id := s.pingID
+			s.mu.Unlock()
+			if missed {
+				s.closeWithError(errKeepAliveTimeout)
+				return
+			}
+			s.sendControl(newHeader(typePing, flagSYN, 0, id))
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// handlePong records the answer to a keepalive ping. Answers to pings other
+// than the last one are late, and ignored.
+func (s *Session) handlePong(id uint32) {
+	s.mu.Lock()
+	if id != s.pingID || s.pong {
+		s.mu.Unlock()
+		return
+	}
+	s.pong = true
+	rtt := time.Since(s.pingSent)
+	s.mu.Unlock()
+
+	if s.config.RoundTrip != nil {
+		s.config.RoundTrip(rtt)
+	}
+}
+
+func (s *Session) recvLoop() {
+	err := s.recv(bufio.NewReader(s.conn))
+	if err == io.EOF {
+		err = ErrSessionClosed
+	}
+	s.closeWithError(err)
+}
+
+func (s *Session) recv(r io.Reader) error {
+	var h header
+	for {
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			return err
+		}
+		if h.version() != protoVersion {
+			return fmt.Errorf("unsupported protocol version %d", h.version())
+		}
+
+		var err error
+		switch h.typ() {
+		case typeData, typeWindowUpdate:
+			err = s.handleStreamFrame(h, r)
+		case typePing:
+			if h.flags()&flagSYN != 0 {
+				s.sendControl(newHeader(typePing, flagACK, 0, h.length()))
+			} else if h.flags()&flagACK != 0 {
+				s.handlePong(h.length())
+			}
+		case typeGoAway:
+			s.mu.Lock()
+			s.goAway = true
+			s.mu.Unlock()
+		default:
+			err = fmt.Errorf("invalid frame type %d", h.typ())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Session) handleStreamFrame(h header, r io.Reader) error {
+	id, flags := h.streamID(), h.flags()
+	if flags&flagSYN != 0 {
+		if err := s.incomingStream(id); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	stream := s.streams[id]
+	s.mu.Unlock()
+
+	if stream == nil {
+		// Stream was already closed (or reset), discard any data for it.
+		if h.typ() == typeData && h.length() > 0 {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(h.length())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if h.typ() == typeWindowUpdate {
+		stream.growSendWindow(h.length())
+	} else if err := stream.receive(r, h.length()); err != nil {
+		return err
+	}
+	if flags&flagFIN != 0 {
+		stream.remoteClosed()
+	}
+	if flags&flagRST != 0 {
+		s.removeStream(id)
+		stream.remoteReset()
+	}
+	return nil
+}
+
+func (s *Session) incomingStream(id uint32) error {
+	// The peer must use IDs of the other parity than ours.
+	if id == 0 || (id%2 == 1) == s.client {
+		return fmt.Errorf("invalid stream ID %d from peer", id)
+	}
+
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("duplicate stream ID %d from peer", id)
+	}
+	if s.shutdown {
+		s.mu.Unlock()
+		s.sendControl(newHeader(typeWindowUpdate, flagRST, id, 0))
+		return nil
+	}
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- stream:
+		s.sendControl(newHeader(typeWindowUpdate, flagACK, id, 0))
+	default:
+		// Too many streams waiting to be accepted.
+		s.removeStream(id)
+		s.sendControl(newHeader(typeWindowUpdate, flagRST, id, 0))
+	}
+	return nil
+}
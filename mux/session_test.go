@@ -0,0 +1,323 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the two ends of a session over an in-memory connection.
+func sessionPair(t *testing.T) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	client, server := Client(c1, Config{}), Server(c2, Config{})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// Accept a stream with a timeout, to fail tests instead of hanging.
+func acceptStream(t *testing.T, session *Session) *Stream {
+	type result struct {
+		stream *Stream
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stream, err := session.Accept()
+		done <- result{stream, err}
+	}()
+	select {
+	case r := <-done:
+		assert.Nil(t, r.err, "should accept stream")
+		return r.stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stream")
+		return nil
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	client, server := sessionPair(t)
+
+	// Open several streams, and check data doesn't get mixed up.
+	for i := 0; i < 3; i++ {
+		stream, err := client.Open()
+		assert.Nil(t, err, "should open stream")
+		_, err = stream.Write([]byte{'a' + byte(i)})
+		assert.Nil(t, err, "should write to stream")
+
+		accepted := acceptStream(t, server)
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(accepted, buf)
+		assert.Nil(t, err, "should read from stream")
+		assert.Equal(t, []byte{'a' + byte(i)}, buf)
+
+		_, err = accepted.Write([]byte("reply"))
+		assert.Nil(t, err, "should write reply")
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(stream, reply)
+		assert.Nil(t, err, "should read reply")
+		assert.Equal(t, "reply", string(reply))
+	}
+	assert.Equal(t, 3, client.NumStreams())
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	stream.Write([]byte("request"))
+	stream.CloseWrite()
+
+	accepted := acceptStream(t, server)
+	request, err := ioutil.ReadAll(accepted)
+	assert.Nil(t, err, "should read until EOF")
+	assert.Equal(t, "request", string(request))
+
+	// The other direction still works after the half-close.
+	accepted.Write([]byte("response"))
+	accepted.Close()
+	response, err := ioutil.ReadAll(stream)
+	assert.Nil(t, err, "should read response until EOF")
+	assert.Equal(t, "response", string(response))
+	stream.Close()
+
+	_, err = stream.Write([]byte("more"))
+	assert.Equal(t, ErrStreamClosed, err)
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client, server := sessionPair(t)
+
+	// More than the receive window, so the writer has to wait for updates.
+	data := make([]byte, 4*initialWindow+123)
+	rand.Read(data)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	go func() {
+		stream.Write(data)
+		stream.CloseWrite()
+	}()
+
+	accepted := acceptStream(t, server)
+	received, err := ioutil.ReadAll(accepted)
+	assert.Nil(t, err, "should read all data")
+	assert.True(t, bytes.Equal(data, received), "should receive data unchanged")
+}
+
+func TestStreamWriteBlocksOnWindow(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	acceptStream(t, server)
+
+	// Nobody reads on the other end, so writes past the window block.
+	stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := stream.Write(make([]byte, initialWindow+1))
+	assert.Equal(t, initialWindow, n, "should write up to the window")
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should time out waiting for window")
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, _ := sessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "should time out")
+
+	// Setting the deadline to now interrupts a blocked read.
+	stream.SetReadDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stream.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		assert.NotNil(t, err, "read should be interrupted")
+	case <-time.After(5 * time.Second):
+		t.Fatal("read wasn't interrupted by deadline")
+	}
+}
+
+func TestStreamResetOnClose(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	stream.Write([]byte("data"))
+
+	// Closing without reading to EOF resets the stream, after the data
+	// that was already sent.
+	accepted := acceptStream(t, server)
+	accepted.Close()
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(accepted, buf)
+	assert.Equal(t, ErrStreamClosed, err, "reads fail after Close")
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Read(buf)
+	assert.Equal(t, ErrStreamReset, err, "peer should see reset")
+}
+
+func TestSessionCloseDropsStreams(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	stream.Write([]byte("x"))
+	accepted := acceptStream(t, server)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(accepted, buf)
+	assert.Nil(t, err, "should read from stream")
+
+	server.Close()
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, ErrSessionClosed), "client streams should drop")
+
+	_, err = accepted.Read(buf)
+	assert.True(t, errors.Is(err, ErrSessionClosed), "server streams should drop")
+
+	<-client.Done()
+	assert.Equal(t, 1, client.Dropped())
+	_, err = client.Open()
+	assert.True(t, errors.Is(err, ErrSessionClosed), "can't open streams on closed session")
+	_, err = server.Accept()
+	assert.True(t, errors.Is(err, ErrSessionClosed), "can't accept streams on closed session")
+}
+
+func TestSessionKeepAlive(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := Server(c2, Config{})
+	defer server.Close()
+	rtts := make(chan time.Duration, 100)
+	client := Client(c1, Config{
+		KeepAliveInterval: 20 * time.Millisecond,
+		RoundTrip:         func(rtt time.Duration) { rtts <- rtt },
+	})
+	defer client.Close()
+
+	// Pings are answered, so the session stays up.
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, client.IsClosed(), "session should stay open")
+	select {
+	case rtt := <-rtts:
+		assert.True(t, rtt > 0 && rtt < time.Second, "should measure round-trip time of pings")
+	default:
+		t.Error("should report round-trip time of answered pings")
+	}
+
+	// Peer that never answers.
+	c3, c4 := net.Pipe()
+	go io.Copy(ioutil.Discard, c4)
+	defer c4.Close()
+	dead := Client(c3, Config{KeepAliveInterval: 20 * time.Millisecond})
+	select {
+	case <-dead.Done():
+		assert.Equal(t, ErrSessionClosed, errors.Unwrap(dead.Err()))
+	case <-time.After(5 * time.Second):
+		t.Fatal("session wasn't closed after missed keepalives")
+	}
+}
+
+func TestSessionRejectsInvalidFrames(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := Server(c2, Config{})
+
+	// Streams opened by the client must have odd IDs.
+	h := newHeader(typeWindowUpdate, flagSYN, 2, 0)
+	c1.Write(h[:])
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session wasn't closed after protocol error")
+	}
+	c1.Close()
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := Server(c2, Config{})
+	go io.Copy(ioutil.Discard, c1)
+
+	h := newHeader(typeWindowUpdate, flagSYN, 1, 0)
+	c1.Write(h[:])
+	h = newHeader(typeData, 0, 1, initialWindow+1)
+	c1.Write(h[:])
+	select {
+	case <-server.Done():
+		assert.True(t, errors.Is(server.Err(), ErrSessionClosed))
+	case <-time.After(5 * time.Second):
+		t.Fatal("session wasn't closed after window was exceeded")
+	}
+	c1.Close()
+}
+
+func TestSessionShutdown(t *testing.T) {
+	client, server := sessionPair(t)
+
+	stream, err := client.Open()
+	assert.Nil(t, err, "should open stream")
+	stream.Write([]byte("x"))
+	accepted := acceptStream(t, server)
+
+	server.Shutdown()
+	for i := 0; i < 100 && client.acceptsStreams(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = client.Open()
+	assert.Equal(t, ErrGoAway, err, "should not open streams after go away")
+
+	// Open streams keep working until they're closed.
+	accepted.Write([]byte("y"))
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(stream, buf)
+	assert.Nil(t, err, "stream should keep working after shutdown")
+	assert.False(t, server.IsClosed())
+
+	stream.Close()
+	accepted.Close()
+	select {
+	case <-server.Done():
+		assert.Equal(t, 0, server.Dropped())
+	case <-time.After(5 * time.Second):
+		t.Fatal("session wasn't closed after last stream")
+	}
+}
@@ -0,0 +1,331 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a connection multiplexed over a session. It implements net.Conn,
+// with the addresses of the underlying connection.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu sync.Mutex
+	// Data received and not yet read.
+	buf bytes.Buffer
+	// Window granted to the peer, and bytes read since the last update.
+	recvWindow uint32
+	consumed   uint32
+	// Bytes we can send before waiting for a window update.
+	sendWindow uint32
+	// FIN received, FIN sent, and Close called.
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+	// Reset by peer, or session closed.
+	err error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Signalled when state changes that blocked reads or writes wait on.
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for ch to be signalled, or for the deadline to pass. Callers check the
+// deadline themselves, as it might have changed in the meantime.
+func wait(ch chan struct{}, deadline time.Time) {
+	if deadline.IsZero() {
+		<-ch
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// timeoutError is returned if a deadline passes, as in the net package.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+func (timeoutError) Unwrap() error   { return os.ErrDeadlineExceeded }
+
+// ID returns the ID of the stream within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Session returns the session the stream belongs to.
+func (st *Stream) Session() *Session {
+	return st.session
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			update := st.consume(uint32(n))
+			st.mu.Unlock()
+			if update > 0 {
+				st.session.sendControl(newHeader(typeWindowUpdate, 0, st.id, update))
+			}
+			return n, nil
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return 0, st.err
+		}
+		if st.readClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if expired(deadline) {
+			return 0, timeoutError{}
+		}
+		wait(st.readReady, deadline)
+	}
+}
+
+// Account for n bytes read, and return the window update to send (if any).
+// Like yamux, we only send an update once half the window has been used up.
+func (st *Stream) consume(n uint32) uint32 {
+	st.consumed += n
+	if st.consumed < initialWindow/2 || st.readClosed {
+		return 0
+	}
+	update := st.consumed
+	st.recvWindow += update
+	st.consumed = 0
+	return update
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		if st.closed || st.writeClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return written, st.err
+		}
+		deadline := st.writeDeadline
+		if expired(deadline) {
+			st.mu.Unlock()
+			return written, timeoutError{}
+		}
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			wait(st.writeReady, deadline)
+			continue
+		}
+		n := len(b) - written
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		err := st.session.writeFrame(newHeader(typeData, 0, st.id, uint32(n)), b[written:written+n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream: the peer reads EOF after the data
+// written so far, but can still send data back.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.writeClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	st.mu.Unlock()
+
+	st.session.sendControl(newHeader(typeWindowUpdate, flagFIN, st.id, 0))
+	return nil
+}
+
+// Close closes the stream. If the peer hasn't finished sending, the stream
+// is reset rather than closed gracefully (like a TCP socket closed with
+// unread data), so that the peer doesn't block on a stream nobody reads.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	var flags uint16
+	if st.err == nil {
+		if !st.readClosed {
+			flags = flagRST
+		} else if !st.writeClosed {
+			flags = flagFIN
+		}
+	}
+	st.writeClosed = true
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+	signal(st.readReady)
+	signal(st.writeReady)
+	if flags != 0 {
+		st.session.sendControl(newHeader(typeWindowUpdate, flags, st.id, 0))
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	signal(st.readReady)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writes waiting on flow control.
+// Writes blocked on the underlying connection aren't interrupted, as they
+// hold up all streams of the session anyway.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	signal(st.writeReady)
+	return nil
+}
+
+// Data frame from the peer, with length bytes of data to read from r.
+func (st *Stream) receive(r io.Reader, length uint32) error {
+	if length == 0 {
+		return nil
+	}
+	st.mu.Lock()
+	if length > st.recvWindow {
+		st.mu.Unlock()
+		return errWindowExceeded
+	}
+	st.recvWindow -= length
+	st.mu.Unlock()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	if !st.closed {
+		st.buf.Write(data)
+	}
+	st.mu.Unlock()
+	signal(st.readReady)
+	return nil
+}
+
+func (st *Stream) growSendWindow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	signal(st.writeReady)
+}
+
+func (st *Stream) remoteClosed() {
+	st.mu.Lock()
+	st.readClosed = true
+	st.mu.Unlock()
+	signal(st.readReady)
+}
+
+func (st *Stream) remoteReset() {
+	st.fail(ErrStreamReset)
+}
+
+func (st *Stream) sessionClosed(err error) {
+	st.fail(err)
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	signal(st.readReady)
+	signal(st.writeReady)
+}
@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix for addresses that refer to a Windows named pipe, e.g.
+// "npipe://\\.\pipe\NAME" (or "npipe:////./pipe/NAME" with forward slashes).
+const namedPipePrefix = "npipe://"
+
+// Named pipes can only be local, the pipe name must start with this prefix.
+const localNamedPipePrefix = `\\.\pipe\`
+
+func isNamedPipeAddress(address string) bool {
+	return strings.HasPrefix(address, namedPipePrefix)
+}
+
+// Parse a named pipe address into the pipe path used by the Windows APIs.
+// Only pipes on the local machine are supported. Returns an error if named
+// pipes aren't supported on this platform.
+func parseNamedPipeAddress(address string) (string, error) {
+	path := strings.Replace(strings.TrimPrefix(address, namedPipePrefix), "/", `\`, -1)
+	if !strings.HasPrefix(path, localNamedPipePrefix) || len(path) == len(localNamedPipePrefix) {
+		return "", fmt.Errorf(`invalid named pipe address %s, must be npipe://\\.\pipe\NAME`, address)
+	}
+	if !namedPipesSupported {
+		return "", fmt.Errorf("invalid address %s, named pipes are only supported on Windows", address)
+	}
+	return path, nil
+}
+
+// Validate the syntax of an address given with flag, if it's a named pipe.
+func validateNamedPipe(flag, address string) error {
+	if !isNamedPipeAddress(address) {
+		return nil
+	}
+	if _, err := parseNamedPipeAddress(address); err != nil {
+		return fmt.Errorf("invalid %s address: %s", flag, err)
+	}
+	return nil
+}
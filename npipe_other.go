@@ -0,0 +1,37 @@
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const namedPipesSupported = false
+
+var errNamedPipesUnsupported = errors.New("named pipes are only supported on Windows")
+
+func listenNamedPipe(path, sddl string) (net.Listener, error) {
+	return nil, errNamedPipesUnsupported
+}
+
+func dialNamedPipe(path string, timeout time.Duration) (net.Conn, error) {
+	return nil, errNamedPipesUnsupported
+}
@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNamedPipeAddress(t *testing.T) {
+	for _, address := range []string{`npipe://\\.\pipe\ghostunnel`, "npipe:////./pipe/ghostunnel"} {
+		path, err := parseNamedPipeAddress(address)
+		if namedPipesSupported {
+			assert.Nil(t, err, "should accept %s", address)
+			assert.Equal(t, `\\.\pipe\ghostunnel`, path)
+		} else {
+			assert.NotNil(t, err, "should reject named pipes on this platform")
+		}
+	}
+
+	for _, address := range []string{`npipe://\\.\pipe\`, `npipe://\\server\pipe\ghostunnel`, "npipe://ghostunnel"} {
+		_, err := parseNamedPipeAddress(address)
+		assert.NotNil(t, err, "should reject %s", address)
+	}
+}
+
+func TestNamedPipeFlagValidation(t *testing.T) {
+	*keystorePath = "file"
+	*clientListenAddress = `npipe://\\.\pipe\ghostunnel`
+	defer func() { *clientListenAddress = "" }()
+	*enabledCipherSuites = "AES"
+
+	err := clientValidateFlags()
+	if namedPipesSupported {
+		assert.Nil(t, err, "should accept named pipe for --listen")
+	} else {
+		assert.NotNil(t, err, "should reject named pipe for --listen")
+	}
+
+	*clientListenAddress = "npipe://ghostunnel"
+	err = clientValidateFlags()
+	assert.NotNil(t, err, "should reject invalid named pipe for --listen")
+}
@@ -0,0 +1,308 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The syscall package doesn't wrap the named pipe APIs, so we load them from
+// kernel32/advapi32 directly.
+var (
+	errClosedPipeListener = errors.New("use of closed network connection")
+
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateNamedPipeW    = kernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = kernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = kernel32.NewProc("DisconnectNamedPipe")
+	procWaitNamedPipeW      = kernel32.NewProc("WaitNamedPipeW")
+	procCancelIoEx          = kernel32.NewProc("CancelIoEx")
+	procCreateEventW        = kernel32.NewProc("CreateEventW")
+	procGetOverlappedResult = kernel32.NewProc("GetOverlappedResult")
+
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = advapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	namedPipesSupported = true
+
+	pipeAccessDuplex         = 0x3
+	fileFlagFirstPipeInst    = 0x80000
+	pipeTypeByte             = 0x0
+	pipeReadModeByte         = 0x0
+	pipeWait                 = 0x0
+	pipeRejectRemoteClients  = 0x8
+	pipeUnlimitedInstances   = 255
+	pipeBufferSize           = 64 * 1024
+	securityDescriptorRev1   = 1
+	securitySqosPresent      = 0x100000
+	securityIdentification   = 0x10000
+	errorPipeBusy            = syscall.Errno(231)
+	errorPipeConnected       = syscall.Errno(535)
+	errorNoData              = syscall.Errno(232)
+	namedPipeDefaultWaitTime = 0
+)
+
+// pipeAddr is the net.Addr of both ends of a named pipe connection.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connection on a named pipe. Pipe handles are opened for
+// overlapped I/O, so the os package runs reads and writes through the
+// runtime's I/O completion port and supports deadlines.
+type pipeConn struct {
+	*os.File
+	addr pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+// pipeListener accepts connections on a named pipe. There's always one pipe
+// instance waiting for a client, so that the name exists for as long as the
+// listener is open and can't be taken over by another process.
+type pipeListener struct {
+	path string
+	sa   *syscall.SecurityAttributes
+
+	mu      sync.Mutex
+	pending syscall.Handle
+	closed  bool
+}
+
+// listenNamedPipe creates a named pipe at the given path, and returns a
+// listener for it. If sddl is set, it's used as the security descriptor (in
+// SDDL form) of the pipe, otherwise the pipe gets the default ACL (which
+// grants full access to administrators, LocalSystem and the owner, and read
+// access to everyone else).
+func listenNamedPipe(path, sddl string) (net.Listener, error) {
+	l := &pipeListener{path: path}
+	if sddl != "" {
+		sa, err := securityAttributes(sddl)
+		if err != nil {
+			return nil, err
+		}
+		l.sa = sa
+	}
+
+	h, err := l.createPipe(true)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(path), Err: err}
+	}
+	l.pending = h
+	return l, nil
+}
+
+// securityAttributes converts an SDDL string to security attributes for
+// CreateNamedPipe. The descriptor is never freed, as listeners live for the
+// lifetime of the process.
+func securityAttributes(sddl string) (*syscall.SecurityAttributes, error) {
+	str, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return nil, err
+	}
+	var sd uintptr
+	r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(
+		uintptr(unsafe.Pointer(str)), securityDescriptorRev1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return nil, errors.New("invalid security descriptor " + sddl + ": " + err.Error())
+	}
+	return &syscall.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(syscall.SecurityAttributes{})),
+		SecurityDescriptor: sd,
+	}, nil
+}
+
+// Create a new instance of the pipe. The first instance is created with
+// FILE_FLAG_FIRST_PIPE_INSTANCE, which fails if the pipe already exists.
+func (l *pipeListener) createPipe(first bool) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(l.path)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	mode := uint32(pipeAccessDuplex | syscall.FILE_FLAG_OVERLAPPED)
+	if first {
+		mode |= fileFlagFirstPipeInst
+	}
+	r, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(name)),
+		uintptr(mode),
+		pipeTypeByte|pipeReadModeByte|pipeWait|pipeRejectRemoteClients,
+		pipeUnlimitedInstances,
+		pipeBufferSize,
+		pipeBufferSize,
+		namedPipeDefaultWaitTime,
+		uintptr(unsafe.Pointer(l.sa)))
+	h := syscall.Handle(r)
+	if h == syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+	return h, nil
+}
+
+// Accept waits for a client to connect to the pending pipe instance, and
+// creates a new instance for the next client.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, l.opError(errClosedPipeListener)
+	}
+	h := l.pending
+	l.mu.Unlock()
+
+	for {
+		err := connectPipe(h)
+		if err == errorNoData {
+			// The client went away before we got to it, so reuse the
+			// instance for the next one.
+			procDisconnectNamedPipe.Call(uintptr(h))
+			continue
+		}
+		if err != nil {
+			if l.isClosed() {
+				return nil, l.opError(errClosedPipeListener)
+			}
+			return nil, l.opError(err)
+		}
+		break
+	}
+
+	next, err := l.createPipe(false)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		// The pending handle was closed by Close.
+		if err == nil {
+			syscall.CloseHandle(next)
+		}
+		return nil, l.opError(errClosedPipeListener)
+	}
+	if err != nil {
+		// Drop the client, and keep the instance as the pending one so that
+		// the name doesn't go away.
+		procDisconnectNamedPipe.Call(uintptr(h))
+		return nil, l.opError(err)
+	}
+	l.pending = next
+	return &pipeConn{File: os.NewFile(uintptr(h), l.path), addr: pipeAddr(l.path)}, nil
+}
+
+func (l *pipeListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Wait for a client to connect on the given pipe instance. This blocks until
+// a client connects, or until the pending operation is cancelled by Close.
+func connectPipe(h syscall.Handle) error {
+	r, _, err := procCreateEventW.Call(0, 1, 0, 0)
+	if r == 0 {
+		return err
+	}
+	event := syscall.Handle(r)
+	defer syscall.CloseHandle(event)
+
+	overlapped := &syscall.Overlapped{HEvent: event}
+	r, _, err = procConnectNamedPipe.Call(uintptr(h), uintptr(unsafe.Pointer(overlapped)))
+	if r != 0 || err == errorPipeConnected {
+		return nil
+	}
+	if err != syscall.ERROR_IO_PENDING {
+		return err
+	}
+	var done uint32
+	r, _, err = procGetOverlappedResult.Call(uintptr(h), uintptr(unsafe.Pointer(overlapped)), uintptr(unsafe.Pointer(&done)), 1)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	// Cancel a pending ConnectNamedPipe in Accept, which closes the handle.
+	procCancelIoEx.Call(uintptr(l.pending), 0)
+	return syscall.CloseHandle(l.pending)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+func (l *pipeListener) opError(err error) error {
+	return &net.OpError{Op: "accept", Net: "pipe", Addr: pipeAddr(l.path), Err: err}
+}
+
+// dialNamedPipe connects to the named pipe at the given path. If all pipe
+// instances are busy, it waits for one to become available until the timeout
+// (zero means the default timeout of the pipe).
+func dialNamedPipe(path string, timeout time.Duration) (net.Conn, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		// SECURITY_IDENTIFICATION keeps the pipe server from impersonating us.
+		h, err := syscall.CreateFile(name,
+			syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+			0, nil, syscall.OPEN_EXISTING,
+			syscall.FILE_FLAG_OVERLAPPED|securitySqosPresent|securityIdentification, 0)
+		if err == nil {
+			return &pipeConn{File: os.NewFile(uintptr(h), path), addr: pipeAddr(path)}, nil
+		}
+		if err != errorPipeBusy {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(path), Err: err}
+		}
+
+		wait := uint32(namedPipeDefaultWaitTime)
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(path), Err: errors.New("timed out waiting for pipe")}
+			}
+			wait = uint32(remaining / time.Millisecond)
+			if wait == 0 {
+				wait = 1
+			}
+		}
+		r, _, err := procWaitNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(wait))
+		if r == 0 {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(path), Err: err}
+		}
+	}
+}
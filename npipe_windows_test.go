@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPipePath() string {
+	return fmt.Sprintf(`\\.\pipe\ghostunnel-test-%d-%d`, os.Getpid(), time.Now().UnixNano())
+}
+
+func TestNamedPipeRoundTrip(t *testing.T) {
+	path := testPipePath()
+	listener, err := listenNamedPipe(path, "")
+	assert.Nil(t, err, "should listen on named pipe")
+	defer listener.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			buf := make([]byte, 4)
+			if _, err := conn.Read(buf); err != nil {
+				done <- err
+				return
+			}
+			conn.Write(buf)
+			conn.Close()
+		}
+		done <- nil
+	}()
+
+	// Connect twice, to make sure a new pipe instance is ready after Accept.
+	for i := 0; i < 2; i++ {
+		conn, err := dialNamedPipe(path, time.Second)
+		assert.Nil(t, err, "should connect to named pipe")
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := ioutil.ReadAll(conn)
+		assert.Nil(t, err, "should read until server closes the pipe")
+		assert.Equal(t, "ping", string(data))
+		assert.Equal(t, path, conn.RemoteAddr().String())
+		conn.Close()
+	}
+	assert.Nil(t, <-done, "server side should succeed")
+}
+
+func TestNamedPipeInUse(t *testing.T) {
+	path := testPipePath()
+	listener, err := listenNamedPipe(path, "")
+	assert.Nil(t, err, "should listen on named pipe")
+	defer listener.Close()
+
+	_, err = listenNamedPipe(path, "")
+	assert.NotNil(t, err, "should not create pipe that already exists")
+}
+
+func TestNamedPipeCloseUnblocksAccept(t *testing.T) {
+	listener, err := listenNamedPipe(testPipePath(), "")
+	assert.Nil(t, err, "should listen on named pipe")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case err := <-done:
+		assert.NotNil(t, err, "Accept should fail after Close")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't return after Close")
+	}
+}
+
+func TestNamedPipeSecurityDescriptor(t *testing.T) {
+	listener, err := listenNamedPipe(testPipePath(), "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GA;;;OW)")
+	assert.Nil(t, err, "should accept valid SDDL")
+	listener.Close()
+
+	_, err = listenNamedPipe(testPipePath(), "not-sddl")
+	assert.NotNil(t, err, "should reject invalid SDDL")
+}
+
+func TestDialNamedPipeMissing(t *testing.T) {
+	_, err := dialNamedPipe(testPipePath(), time.Second)
+	assert.NotNil(t, err, "should fail to connect to missing pipe")
+}
@@ -0,0 +1,180 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Elbandi/ghostunnel/certloader"
+	"github.com/Elbandi/ghostunnel/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Quantiles reported for timers and histograms.
+var promQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Counters that count how many of something are open right now (they go down
+// as well as up), exposed as gauges. Names are without labels.
+var promGauges = map[string]bool{
+	"conn.open":          true,
+	"conn.tcp.multipath": true,
+	"conn.tcp.plain":     true,
+	"listener.conn.open": true,
+	"mux.session.open":   true,
+	"quic.conn.open":     true,
+}
+
+// Metric name prefixes that carry the address of a listener or target, or the
+// name of a route, which we turn into a label (see proxy.MetricLabel).
+var promLabels = []string{"listener", "target", "route"}
+
+// prometheusHandler serves metrics from registry at /metrics, in Prometheus
+// text format (with --metrics-prometheus). Unlike /_metrics?format=prometheus,
+// which mirrors metric names as they are, names follow Prometheus conventions
+// and are labeled by listener, target and route. Values are read on each
+// scrape, so scraping is cheap and always up to date.
+func prometheusHandler(registry metrics.Registry, namespace string) http.Handler {
+	promRegistry := prometheus.NewRegistry()
+	promRegistry.MustRegister(&promCollector{registry: registry, namespace: promName(namespace)})
+	promRegistry.MustRegister(prometheus.NewGoCollector())
+	promRegistry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{
+		ErrorLog:      logger.Logger,
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// promCollector collects metrics from a go-metrics registry. It's an
+// unchecked collector, as the set of metrics in the registry grows over time.
+type promCollector struct {
+	registry  metrics.Registry
+	namespace string
+}
+
+func (c *promCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *promCollector) Collect(ch chan<- prometheus.Metric) {
+	// Different metrics may map to the same name (e.g. "accept" and
+	// "accept.total"), only the first one is kept.
+	seen := map[string]bool{}
+	c.registry.Each(func(name string, metric interface{}) {
+		base, labels := promLabelsFor(name)
+		fqName := c.namespace + "_" + promName(base)
+		var suffix string
+		switch metric.(type) {
+		case metrics.Counter:
+			if !promGauges[base] {
+				suffix = "_total"
+			}
+		case metrics.Meter:
+			suffix = "_total"
+		case metrics.Timer:
+			suffix = "_seconds"
+		}
+		fqName = strings.TrimSuffix(fqName, suffix) + suffix
+
+		key := fqName
+		for _, label := range promLabels {
+			key += "," + labels[label]
+		}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		desc := prometheus.NewDesc(fqName, "Ghostunnel metric "+base+" (see /_metrics).", nil, labels)
+		switch m := metric.(type) {
+		case metrics.Counter:
+			valueType := prometheus.CounterValue
+			if promGauges[base] {
+				valueType = prometheus.GaugeValue
+			}
+			ch <- prometheus.MustNewConstMetric(desc, valueType, float64(m.Count()))
+		case metrics.Meter:
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(m.Count()))
+		case metrics.Gauge:
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.Value())
+		case metrics.Timer:
+			// Timers record nanoseconds.
+			snapshot := m.Snapshot()
+			ch <- prometheus.MustNewConstSummary(desc, uint64(snapshot.Count()), float64(snapshot.Sum())/float64(time.Second), promSummaryQuantiles(snapshot.Percentiles(promQuantiles), 1/float64(time.Second)))
+		case metrics.Histogram:
+			snapshot := m.Snapshot()
+			ch <- prometheus.MustNewConstSummary(desc, uint64(snapshot.Count()), float64(snapshot.Sum()), promSummaryQuantiles(snapshot.Percentiles(promQuantiles), 1))
+		}
+	})
+}
+
+func promSummaryQuantiles(values []float64, scale float64) map[float64]float64 {
+	quantiles := map[float64]float64{}
+	for i, quantile := range promQuantiles {
+		quantiles[quantile] = values[i] * scale
+	}
+	return quantiles
+}
+
+// promLabelsFor splits the name of a metric about a listener, target or route
+// (e.g. "target.tcp_127_0_0_1_8080.bytes.upstream") into a name without it
+// ("target.bytes.upstream"), and a label with its original address or name.
+func promLabelsFor(name string) (string, prometheus.Labels) {
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) == 3 {
+		for _, kind := range promLabels {
+			if parts[0] != kind {
+				continue
+			}
+			if label, ok := proxy.MetricLabel(parts[0] + "." + parts[1]); ok {
+				return parts[0] + "." + parts[2], prometheus.Labels{kind: label}
+			}
+		}
+	}
+	return name, nil
+}
+
+// promName turns a metric name into snake_case, as Prometheus names only
+// allow letters, digits and underscores.
+func promName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToLower(r)
+		}
+		return '_'
+	}, name)
+}
+
+// registerCertExpiry exposes when the current certificate expires, as a UNIX
+// timestamp in the cert.expiry metric (zero if it can't be read). The
+// certificate is read on each collection, to pick up reloads.
+func registerCertExpiry(cert certloader.Certificate) {
+	if cert == nil {
+		return
+	}
+	metrics.GetOrRegister("cert.expiry", metrics.NewFunctionalGauge(func() int64 {
+		leaf, err := certificateLeaf(cert)
+		if err != nil {
+			return 0
+		}
+		return leaf.NotAfter.Unix()
+	}))
+}
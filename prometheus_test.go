@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/proxy"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("accept.total", registry).Inc(3)
+	metrics.GetOrRegisterCounter("accept.error", registry).Inc(1)
+	metrics.GetOrRegisterCounter("conn.open", registry).Inc(2)
+	metrics.GetOrRegisterGauge("backend.healthy", registry).Update(1)
+	metrics.GetOrRegisterTimer("conn.handshake", registry).Update(2 * time.Second)
+
+	// Proxy a connection, to get metrics labeled by listener and target.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	p := proxy.New(incoming, time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, logger)
+	p.AddListener(extra)
+	go p.Accept()
+	conn, err := net.Dial("tcp", extra.Addr().String())
+	panicOnError(err)
+	ioutil.ReadAll(conn)
+	conn.Close()
+	p.Shutdown()
+	p.Wait()
+	for _, name := range []string{
+		"listener.tcp_" + metricAddress(extra.Addr()) + ".accept.total",
+		"target.tcp_" + metricAddress(target.Addr()) + ".bytes.upstream",
+	} {
+		registry.Register(name, metrics.DefaultRegistry.Get(name))
+	}
+
+	recorder := httptest.NewRecorder()
+	prometheusHandler(registry, "ghostunnel").ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code, "should serve metrics")
+	body := recorder.Body.String()
+
+	assert.Contains(t, body, "\nghostunnel_accept_total 3", "should not repeat _total suffix")
+	assert.Contains(t, body, "\nghostunnel_accept_error_total 1", "should add _total suffix to counters")
+	assert.Contains(t, body, "# TYPE ghostunnel_conn_open gauge\nghostunnel_conn_open 2", "should expose open connections as gauge")
+	assert.Contains(t, body, "\nghostunnel_backend_healthy 1", "should expose gauges")
+	assert.Contains(t, body, "# TYPE ghostunnel_conn_handshake_seconds summary", "should expose timers as summaries")
+	assert.Contains(t, body, "\nghostunnel_conn_handshake_seconds_sum 2", "should expose timers in seconds")
+	assert.Contains(t, body, `ghostunnel_listener_accept_total{listener="tcp:`+extra.Addr().String()+`"} 1`, "should label listener metrics")
+	assert.Contains(t, body, `ghostunnel_target_bytes_upstream_total{target="tcp:`+target.Addr().String()+`"} 0`, "should label target metrics")
+	assert.Contains(t, body, "go_goroutines", "should expose Go runtime metrics")
+}
+
+func TestCertExpiryMetric(t *testing.T) {
+	tmpKeystore, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+
+	tmpKeystore.Write(testKeystore)
+	tmpKeystore.Sync()
+
+	defer os.Remove(tmpKeystore.Name())
+
+	cert, err := buildCertificate(tmpKeystore.Name(), testKeystorePassword)
+	panicOnError(err)
+	registerCertExpiry(cert)
+	defer metrics.DefaultRegistry.Unregister("cert.expiry")
+
+	tlsCert, err := cert.GetCertificate(nil)
+	panicOnError(err)
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	panicOnError(err)
+	gauge := metrics.DefaultRegistry.Get("cert.expiry").(metrics.Gauge)
+	assert.Equal(t, leaf.NotAfter.Unix(), gauge.Value(), "should expose certificate expiry")
+}
+
+// Address as it appears in metric names.
+func metricAddress(addr net.Addr) string {
+	name := []byte(addr.String())
+	for i, c := range name {
+		if c == '.' || c == ':' {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,145 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var acceptThrottledCounter = metrics.GetOrRegisterCounter("accept.throttled", metrics.DefaultRegistry)
+
+// EnableAcceptRate limits the rate of accepted connections to rate per second,
+// allowing bursts of up to burst connections (if zero, one second worth of
+// connections). This keeps a reconnect storm from overloading the proxy with
+// handshakes. Once the rate is exceeded, the proxy delays accepting new
+// connections. If reject is set, the proxy instead keeps accepting but closes
+// connections over the rate before the TLS handshake.
+func (p *Proxy) EnableAcceptRate(rate float64, burst int, reject bool) {
+	p.acceptRate = &acceptRateLimiter{reject: reject}
+	p.acceptRate.set(rate, burst)
+}
+
+// SetAcceptRate changes the rate and burst set with EnableAcceptRate at
+// runtime (a zero rate disables limiting). Has no effect if EnableAcceptRate
+// wasn't called.
+func (p *Proxy) SetAcceptRate(rate float64, burst int) {
+	p.acceptRate.set(rate, burst)
+}
+
+// AcceptRate returns the current rate and burst set with EnableAcceptRate or
+// SetAcceptRate (zero if not enabled).
+func (p *Proxy) AcceptRate() (rate float64, burst int) {
+	return p.acceptRate.get()
+}
+
+// acceptRateLimiter is a token bucket with one token per accepted connection.
+type acceptRateLimiter struct {
+	reject bool
+
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func (l *acceptRateLimiter) set(rate float64, burst int) {
+	if l == nil {
+		return
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = float64(burst)
+		l.last = time.Now()
+	}
+	l.rate = rate
+	l.burst = burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+}
+
+func (l *acceptRateLimiter) get() (float64, int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.burst
+}
+
+// take takes a token if one is available (or always, if force is set, which
+// may put the bucket in debt). Returns how long it will take until the bucket
+// is out of debt, or -1 if no token was taken.
+func (l *acceptRateLimiter) take(force bool) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens = math.Min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 && !force {
+		return -1
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until the next connection may be accepted (in pause mode), or
+// ctx is done.
+func (l *acceptRateLimiter) wait(ctx context.Context) {
+	if l == nil || l.reject {
+		return
+	}
+	delay := l.take(true)
+	if delay <= 0 {
+		return
+	}
+	acceptThrottledCounter.Inc(1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// admit returns false if a newly accepted connection should be closed
+// because it's over the rate (in reject mode).
+func (l *acceptRateLimiter) admit() bool {
+	if l == nil || !l.reject || l.take(false) >= 0 {
+		return true
+	}
+	acceptThrottledCounter.Inc(1)
+	return false
+}
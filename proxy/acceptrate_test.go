@@ -0,0 +1,123 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptRateLimiter(t *testing.T) {
+	l := &acceptRateLimiter{}
+	l.set(10, 2)
+
+	assert.Equal(t, time.Duration(0), l.take(false), "should take token from full bucket")
+	assert.Equal(t, time.Duration(0), l.take(false), "should take token from full bucket")
+	assert.Equal(t, time.Duration(-1), l.take(false), "should not take token from empty bucket")
+
+	delay := l.take(true)
+	assert.True(t, delay > 0 && delay <= 100*time.Millisecond, "should wait for next token (%s)", delay)
+
+	l.set(0, 0)
+	assert.Equal(t, time.Duration(0), l.take(false), "should not limit with zero rate")
+}
+
+func TestAcceptRateDefaultBurst(t *testing.T) {
+	l := &acceptRateLimiter{}
+	l.set(2.5, 0)
+	rate, burst := l.get()
+	assert.Equal(t, 2.5, rate, "should keep rate")
+	assert.Equal(t, 3, burst, "should default to one second worth of connections")
+
+	l.set(0.1, 0)
+	_, burst = l.get()
+	assert.Equal(t, 1, burst, "should allow at least one connection")
+
+	var disabled *acceptRateLimiter
+	disabled.set(10, 10)
+	rate, burst = disabled.get()
+	assert.Equal(t, 0.0, rate, "should ignore changes if not enabled")
+	assert.Equal(t, 0, burst, "should ignore changes if not enabled")
+	assert.True(t, disabled.admit(), "should admit if not enabled")
+}
+
+func TestAcceptRateWait(t *testing.T) {
+	l := &acceptRateLimiter{}
+	l.set(20, 1)
+
+	throttled := acceptThrottledCounter.Count()
+	start := time.Now()
+	l.wait(context.Background())
+	l.wait(context.Background())
+	assert.True(t, time.Since(start) >= 40*time.Millisecond, "should delay second accept")
+	assert.Equal(t, throttled+1, acceptThrottledCounter.Count(), "should count throttled accept")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.set(0.01, 1)
+	start = time.Now()
+	l.wait(ctx)
+	assert.True(t, time.Since(start) < time.Second, "should stop waiting when context is done")
+}
+
+func TestAcceptRateReject(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableAcceptRate(0.01, 1, true)
+	go p.Accept()
+	defer p.Shutdown()
+
+	throttled := acceptThrottledCounter.Count()
+
+	first, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer first.Close()
+	firstBackend, err := target.Accept()
+	assert.Nil(t, err, "should receive first connection on target")
+	defer firstBackend.Close()
+
+	// Second connection should get closed immediately
+	second, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection over the rate should be closed")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection should be closed before read deadline")
+	}
+	assert.Equal(t, throttled+1, acceptThrottledCounter.Count(), "should count throttled connection")
+
+	p.SetAcceptRate(100, 10)
+	rate, burst := p.AcceptRate()
+	assert.Equal(t, 100.0, rate, "should change rate at runtime")
+	assert.Equal(t, 10, burst, "should change burst at runtime")
+}
@@ -0,0 +1,69 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// DefaultBufferSize is the default size of the buffers used to copy data
+// between connections.
+const DefaultBufferSize = 32 * 1024
+
+var (
+	buffersGauge       = metrics.GetOrRegisterGauge("conn.buffers.outstanding", metrics.DefaultRegistry)
+	outstandingBuffers int64
+)
+
+// SetBufferSize sets the size of the buffers used to copy data between
+// connections. Larger buffers can help with throughput on high bandwidth-delay
+// links, at the cost of memory per connection. Must be called before Accept.
+func (p *Proxy) SetBufferSize(size int) {
+	p.buffers = newBufferPool(size)
+}
+
+// bufferPool hands out copy buffers of a fixed size. Returned buffers are
+// kept in a sync.Pool, which releases idle buffers over the next garbage
+// collections, so a burst of connections doesn't pin memory forever.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				// Pointer to slice, to avoid an allocation on every put.
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+func (b *bufferPool) get() *[]byte {
+	buffersGauge.Update(atomic.AddInt64(&outstandingBuffers, 1))
+	return b.pool.Get().(*[]byte)
+}
+
+func (b *bufferPool) put(buf *[]byte) {
+	buffersGauge.Update(atomic.AddInt64(&outstandingBuffers, -1))
+	b.pool.Put(buf)
+}
@@ -0,0 +1,145 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/Elbandi/ghostunnel/sockopt"
+	"github.com/rcrowley/go-metrics"
+)
+
+var bufferLimitCounter = metrics.GetOrRegisterCounter("conn.buffer.limit", metrics.DefaultRegistry)
+
+var errBufferLimit = errors.New("buffer limit exceeded, peer isn't reading")
+
+// EnableBufferLimit bounds the data buffered for each direction of a proxied
+// connection to roughly max bytes, so that peers that stop reading can't pin
+// memory. The kernel send and receive buffers of both sockets are shrunk to
+// max, and data is copied in chunks of at most max bytes. Once the buffers are
+// full, the proxy stops reading from one side until the other side catches
+// up. If closeOnLimit is set, connections are instead closed as soon as more
+// than max bytes are waiting to be acknowledged by a peer. This needs
+// sockopt.SupportsQueuedBytes, and falls back to pausing otherwise.
+func (p *Proxy) EnableBufferLimit(max int, closeOnLimit bool) {
+	p.bufferLimit = max
+	p.bufferLimitClose = closeOnLimit && sockopt.SupportsQueuedBytes()
+}
+
+// bufferLimiter applies the buffer limit to a proxied connection.
+type bufferLimiter struct {
+	max             int
+	closeOnLimit    bool
+	client, backend net.Conn
+	// Set to 1 once the connection was closed for exceeding the limit.
+	exceeded int32
+}
+
+// newBufferLimiter shrinks the socket buffers of both sides of a connection,
+// and returns a limiter for copying (nil if there's no buffer limit).
+func (p *Proxy) newBufferLimiter(client, backend net.Conn) *bufferLimiter {
+	if p.bufferLimit <= 0 {
+		return nil
+	}
+	for _, conn := range []net.Conn{client, backend} {
+		if sock, ok := socket(conn).(interface {
+			SetReadBuffer(int) error
+			SetWriteBuffer(int) error
+		}); ok {
+			sock.SetReadBuffer(p.bufferLimit)
+			sock.SetWriteBuffer(p.bufferLimit)
+		}
+	}
+	return &bufferLimiter{
+		max:          p.bufferLimit,
+		closeOnLimit: p.bufferLimitClose,
+		client:       client,
+		backend:      backend,
+	}
+}
+
+// reader wraps src to read at most max bytes at a time.
+func (l *bufferLimiter) reader(src io.Reader) io.Reader {
+	if l == nil {
+		return src
+	}
+	return &cappedReader{src, l.max}
+}
+
+// writer wraps dst to close the connection (if enabled) once too much data is
+// waiting for the peer.
+func (l *bufferLimiter) writer(dst net.Conn) net.Conn {
+	if l == nil || !l.closeOnLimit {
+		return dst
+	}
+	return &queueLimitConn{dst, socket(dst), l}
+}
+
+// tripped returns true if the connection was closed for exceeding the limit.
+func (l *bufferLimiter) tripped() bool {
+	return l != nil && atomic.LoadInt32(&l.exceeded) == 1
+}
+
+type cappedReader struct {
+	io.Reader
+	max int
+}
+
+func (r *cappedReader) Read(b []byte) (int, error) {
+	if len(b) > r.max {
+		b = b[:r.max]
+	}
+	return r.Reader.Read(b)
+}
+
+type queueLimitConn struct {
+	net.Conn
+	socket  net.Conn
+	limiter *bufferLimiter
+}
+
+func (c *queueLimitConn) Write(b []byte) (int, error) {
+	queued, err := sockopt.QueuedBytes(c.socket)
+	if err == nil && queued+len(b) > c.limiter.max {
+		if atomic.CompareAndSwapInt32(&c.limiter.exceeded, 0, 1) {
+			bufferLimitCounter.Inc(1)
+			c.limiter.client.Close()
+			c.limiter.backend.Close()
+		}
+		return 0, errBufferLimit
+	}
+	return c.Conn.Write(b)
+}
+
+// socket returns the underlying socket of a connection.
+func socket(conn net.Conn) net.Conn {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return socket(c.NetConn())
+	case *proxyProtocolConn:
+		return socket(c.Conn)
+	case *handshakeLimitedConn:
+		return socket(c.Conn)
+	case interface{ NetConn() net.Conn }:
+		return socket(c.NetConn())
+	}
+	return conn
+}
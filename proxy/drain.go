@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var drainClosedCounter = metrics.GetOrRegisterCounter("conn.drain.closed", metrics.DefaultRegistry)
+
+// Drain shuts down the proxy (see Shutdown), and waits up to timeout for
+// in-flight connections to finish. Connections that are still open after
+// the timeout are closed. Returns the number of connections that finished on
+// their own, and the number that had to be closed.
+func (p *Proxy) Drain(timeout time.Duration) (drained, closed int) {
+	// Count connections before shutting down, as shutting down aborts
+	// handshakes and those connections may be gone right away.
+	active := p.Active()
+	p.Shutdown()
+
+	// Connections may still be in the handshake or dialing the backend, so
+	// wait for all tracked connections to close, not just for handlers.
+	p.connsMu.Lock()
+	remaining := len(p.conns)
+	if remaining > active {
+		// Accepted while shutting down
+		active = remaining
+	}
+	idle := make(chan struct{})
+	if remaining == 0 {
+		close(idle)
+	} else {
+		p.idle = idle
+	}
+	p.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-idle
+		p.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return active, 0
+	case <-time.After(timeout):
+	}
+
+	closed = p.closeConnections()
+	drainClosedCounter.Inc(int64(closed))
+	return active - closed, closed
+}
+
+// Active returns the number of open client connections, including ones that
+// are still in the handshake.
+func (p *Proxy) Active() int {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	return len(p.conns)
+}
+
+// connInfo is what we know about a tracked connection, for log messages.
+type connInfo struct {
+	// Listener the connection came in on (nil if there's only one).
+	listener *listenerTag
+	// Route selected for the connection (nil if not routed).
+	route *routeMetrics
+	// Which legs use Multipath TCP, for logs (empty if not reported).
+	multipath string
+	// Which legs used TCP Fast Open, for logs (empty if none, or not reported).
+	fastOpen string
+	// JA3 and JA4 fingerprints of the ClientHello, for logs (empty if not
+	// computed).
+	fingerprint string
+}
+
+// track registers an accepted connection (and the listener it came in on, if
+// tagged), so that it can be closed if it's still open after the shutdown
+// timeout.
+func (p *Proxy) track(conn net.Conn, tag *listenerTag) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	if p.conns == nil {
+		p.conns = map[net.Conn]*connInfo{}
+	}
+	p.conns[conn] = &connInfo{listener: tag}
+}
+
+// setRoute records the route selected for a tracked connection.
+func (p *Proxy) setRoute(conn net.Conn, route *routeMetrics) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	if info, ok := p.conns[conn]; ok {
+		info.route = route
+	}
+}
+
+// updateInfo updates the details of a tracked connection (if it's tracked).
+func (p *Proxy) updateInfo(conn net.Conn, update func(info *connInfo)) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	if info, ok := p.conns[conn]; ok {
+		update(info)
+	}
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	delete(p.conns, conn)
+	if len(p.conns) == 0 && p.idle != nil {
+		close(p.idle)
+		p.idle = nil
+	}
+}
+
+// closeConnections closes all open client connections. This also ends the
+// corresponding backend connections, as copying data fails.
+func (p *Proxy) closeConnections() int {
+	atomic.StoreInt32(&p.forceClosed, 1)
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	return len(p.conns)
+}
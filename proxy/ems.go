@@ -0,0 +1,57 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var emsMissingCounter = metrics.GetOrRegisterCounter("accept.ems.missing", metrics.DefaultRegistry)
+
+// EnableRequireEMS closes TLS 1.2 (and older) connections that didn't
+// negotiate the extended master secret extension (RFC 7627), which mitigates
+// triple handshake attacks, once the handshake completes. TLS 1.3 always
+// satisfies this.
+func (p *Proxy) EnableRequireEMS() {
+	p.requireEMS = true
+}
+
+// extendedMasterSecret reports whether a connection negotiated the extended
+// master secret (or TLS 1.3). crypto/tls doesn't expose this directly, but it
+// refuses to export keying material from TLS 1.2 connections without it. It
+// also refuses if renegotiation is enabled, which we never do on the
+// server side.
+func extendedMasterSecret(conn *tls.Conn) bool {
+	state := conn.ConnectionState()
+	if state.Version >= tls.VersionTLS13 {
+		return true
+	}
+	_, err := state.ExportKeyingMaterial("EXPORTER-ghostunnel-ems-check", nil, 1)
+	return err == nil
+}
+
+// admitEMS returns false if conn should be closed because it doesn't use the
+// extended master secret, with --require-ems.
+func (p *Proxy) admitEMS(conn *tls.Conn) bool {
+	if !p.requireEMS || extendedMasterSecret(conn) {
+		return true
+	}
+	emsMissingCounter.Inc(1)
+	return false
+}
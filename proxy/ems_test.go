@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakePair(t *testing.T, clientConfig *tls.Config) (client, server *tls.Conn) {
+	clientConn, serverConn := net.Pipe()
+	client = tls.Client(clientConn, clientConfig)
+	server = tls.Server(serverConn, testTLSConfig(t))
+
+	done := make(chan error, 1)
+	go func() { done <- client.Handshake() }()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Nil(t, server.Handshake(), "server handshake should succeed")
+	assert.Nil(t, <-done, "client handshake should succeed")
+	return client, server
+}
+
+func TestExtendedMasterSecret(t *testing.T) {
+	client, server := handshakePair(t, &tls.Config{InsecureSkipVerify: true})
+	defer client.Close()
+	defer server.Close()
+	assert.True(t, extendedMasterSecret(server), "TLS 1.3 should always satisfy EMS")
+
+	client, server = handshakePair(t, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	defer client.Close()
+	defer server.Close()
+	assert.True(t, extendedMasterSecret(server), "Go clients negotiate EMS with TLS 1.2")
+
+	p := &Proxy{}
+	missing := emsMissingCounter.Count()
+	assert.True(t, p.admitEMS(server), "should admit all connections by default")
+	p.EnableRequireEMS()
+	assert.True(t, p.admitEMS(server), "should admit TLS 1.2 connections with EMS")
+	assert.Equal(t, missing, emsMissingCounter.Count(), "should not count connections with EMS")
+}
+
+func TestExtendedMasterSecretUnavailable(t *testing.T) {
+	// crypto/tls can't be made to skip EMS, but like connections without
+	// it, connections with renegotiation enabled can't export keying
+	// material, which is all we look at.
+	client, server := handshakePair(t, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		Renegotiation:      tls.RenegotiateOnceAsClient,
+	})
+	defer client.Close()
+	defer server.Close()
+
+	p := &Proxy{}
+	p.EnableRequireEMS()
+	missing := emsMissingCounter.Count()
+	assert.False(t, p.admitEMS(client), "should reject connection without exportable keying material")
+	assert.Equal(t, missing+1, emsMissingCounter.Count(), "should count rejected connection")
+}
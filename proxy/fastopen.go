@@ -0,0 +1,60 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Elbandi/ghostunnel/sockopt"
+	"github.com/rcrowley/go-metrics"
+)
+
+// TCP connections (to clients and to the backend) that used TCP Fast Open.
+var fastOpenCounter = metrics.GetOrRegisterCounter("conn.tcp.fastopen", metrics.DefaultRegistry)
+
+// EnableFastOpenStats notes in connection logs which TCP connections (to
+// clients and to the backend) used TCP Fast Open, i.e. sent or accepted data
+// along with the SYN, and counts them in the conn.tcp.fastopen metric. This
+// is meant to verify that TFO works with --tcp-fast-open.
+func (p *Proxy) EnableFastOpenStats() {
+	p.fastOpenStats = true
+}
+
+// noteFastOpen records which legs of a connection between client and backend
+// used TCP Fast Open, for logs.
+func (p *Proxy) noteFastOpen(client, backend net.Conn) {
+	if !p.fastOpenStats {
+		return
+	}
+	legs := []string{}
+	for i, conn := range []net.Conn{client, backend} {
+		tcpConn, ok := socket(conn).(*net.TCPConn)
+		if !ok {
+			continue
+		}
+		if used, err := sockopt.UsedFastOpen(tcpConn); err == nil && used {
+			fastOpenCounter.Inc(1)
+			legs = append(legs, [2]string{"client", "target"}[i])
+		}
+	}
+	if len(legs) > 0 {
+		p.updateInfo(client, func(info *connInfo) {
+			info.fastOpen = strings.Join(legs, ", ")
+		})
+	}
+}
@@ -0,0 +1,330 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var fingerprintDeniedCounter = metrics.GetOrRegisterCounter("accept.fingerprint.denied", metrics.DefaultRegistry)
+
+// TLS extensions left out of the sorted JA4 extension hash.
+const (
+	extensionServerName = 0x0000
+	extensionALPN       = 0x0010
+)
+
+var (
+	ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern = regexp.MustCompile(`^[tqd](13|12|11|10|s3|00)[di][0-9]{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// ClientFingerprint holds the JA3 and JA4 fingerprints of a ClientHello.
+type ClientFingerprint struct {
+	JA3 string
+	JA4 string
+}
+
+func (f ClientFingerprint) String() string {
+	return "ja3=" + f.JA3 + ", ja4=" + f.JA4
+}
+
+// ValidFingerprint checks that value looks like a JA3 (MD5 hash) or JA4
+// fingerprint, as used in the allow and deny lists.
+func ValidFingerprint(value string) bool {
+	return ja3Pattern.MatchString(value) || ja4Pattern.MatchString(value)
+}
+
+// Fingerprint computes the JA3 and JA4 fingerprints of a ClientHello, from
+// what crypto/tls exposes of it. This covers all the fields they're based on,
+// except for the legacy version field used by JA3: clients that offer TLS 1.3
+// are assumed to send TLS 1.2 there, as required by RFC 8446.
+func Fingerprint(hello *tls.ClientHelloInfo) ClientFingerprint {
+	ciphers := withoutGREASE(hello.CipherSuites)
+	extensions := withoutGREASE(hello.Extensions)
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, curve := range hello.SupportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	curves = withoutGREASE(curves)
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, point := range hello.SupportedPoints {
+		points = append(points, uint16(point))
+	}
+	versions := withoutGREASE(hello.SupportedVersions)
+
+	return ClientFingerprint{
+		JA3: ja3(versions, ciphers, extensions, curves, points),
+		JA4: ja4(hello, versions, ciphers, extensions),
+	}
+}
+
+// JA3 is the MD5 hash of the legacy version, cipher suites, extensions,
+// curves and point formats, in the order sent.
+func ja3(versions, ciphers, extensions, curves, points []uint16) string {
+	version := uint16(0)
+	for _, v := range versions {
+		if v > version {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+	fields := []string{
+		strconv.Itoa(int(version)),
+		joinDecimal(ciphers),
+		joinDecimal(extensions),
+		joinDecimal(curves),
+		joinDecimal(points),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 is made of a readable prefix (protocol, highest version, whether SNI
+// was sent, number of cipher suites and extensions, and first ALPN protocol),
+// a truncated hash of the sorted cipher suites, and a truncated hash of the
+// sorted extensions (except SNI and ALPN) followed by the signature
+// algorithms, in the order sent.
+func ja4(hello *tls.ClientHelloInfo, versions, ciphers, extensions []uint16) string {
+	version := uint16(0)
+	for _, v := range versions {
+		if v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s", ja4Version(version), sni, ja4Count(len(ciphers)), ja4Count(len(extensions)), ja4ALPN(hello.SupportedProtos))
+
+	sorted := []uint16{}
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			sorted = append(sorted, extension)
+		}
+	}
+	extensionList := joinHex(sortedCopy(sorted))
+	if len(hello.SignatureSchemes) > 0 {
+		schemes := make([]uint16, 0, len(hello.SignatureSchemes))
+		for _, scheme := range hello.SignatureSchemes {
+			schemes = append(schemes, uint16(scheme))
+		}
+		extensionList += "_" + joinHex(schemes)
+	}
+
+	return prefix + "_" + ja4Hash(joinHex(sortedCopy(ciphers)), len(ciphers) == 0) + "_" + ja4Hash(extensionList, len(sorted) == 0)
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// Counts in the JA4 prefix are two digits, capped at 99.
+func ja4Count(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+// First and last character of the first ALPN protocol, or of its hex
+// encoding if either isn't alphanumeric ("00" if there's none).
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+	protocol := protocols[0]
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte(protocol))
+		return encoded[:1] + encoded[len(encoded)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func ja4Hash(list string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(list))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// GREASE values (RFC 8701) are random, so they're left out of fingerprints.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	result := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGREASE(value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func sortedCopy(values []uint16) []uint16 {
+	sorted := append([]uint16{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(int(value))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%04x", value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Fingerprints computes fingerprints of ClientHellos in the GetConfigForClient
+// callback, rejecting clients that aren't allowed, and keeps them until the
+// proxy picks them up once the handshake is done.
+type Fingerprints struct {
+	allowed map[string]bool
+	denied  map[string]bool
+	// Fingerprints by the connection under the TLS connection, as that's all
+	// ClientHelloInfo gives us.
+	mu     sync.Mutex
+	byConn map[net.Conn]ClientFingerprint
+}
+
+// NewFingerprints creates a fingerprint store. If allowed isn't empty,
+// clients must match one of its JA3 or JA4 fingerprints, and clients matching
+// one in denied are rejected.
+func NewFingerprints(allowed, denied []string) *Fingerprints {
+	f := &Fingerprints{
+		allowed: map[string]bool{},
+		denied:  map[string]bool{},
+		byConn:  map[net.Conn]ClientFingerprint{},
+	}
+	for _, value := range allowed {
+		f.allowed[value] = true
+	}
+	for _, value := range denied {
+		f.denied[value] = true
+	}
+	return f
+}
+
+// GetConfigForClient wraps a GetConfigForClient callback (which may be nil),
+// to fingerprint and check ClientHellos before calling it.
+func (f *Fingerprints) GetConfigForClient(next func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		fingerprint := Fingerprint(hello)
+		if hello.Conn != nil {
+			f.mu.Lock()
+			f.byConn[hello.Conn] = fingerprint
+			f.mu.Unlock()
+		}
+		if err := f.check(fingerprint); err != nil {
+			fingerprintDeniedCounter.Inc(1)
+			return nil, err
+		}
+		if next == nil {
+			return nil, nil
+		}
+		return next(hello)
+	}
+}
+
+func (f *Fingerprints) check(fingerprint ClientFingerprint) error {
+	if f.denied[fingerprint.JA3] || f.denied[fingerprint.JA4] {
+		return errors.New("unauthorized: client fingerprint denied")
+	}
+	if len(f.allowed) > 0 && !f.allowed[fingerprint.JA3] && !f.allowed[fingerprint.JA4] {
+		return errors.New("unauthorized: client fingerprint not allowed")
+	}
+	return nil
+}
+
+// take returns (and forgets) the fingerprint recorded for a TLS connection.
+func (f *Fingerprints) take(conn net.Conn) (ClientFingerprint, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ClientFingerprint{}, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fingerprint, ok := f.byConn[tlsConn.NetConn()]
+	delete(f.byConn, tlsConn.NetConn())
+	return fingerprint, ok
+}
+
+// EnableClientFingerprints records the JA3 and JA4 fingerprints computed by
+// fingerprints (whose GetConfigForClient must be set on the TLS config) for
+// each connection, and includes them in log messages.
+func (p *Proxy) EnableClientFingerprints(fingerprints *Fingerprints) {
+	p.fingerprints = fingerprints
+}
+
+// noteFingerprint moves the fingerprint of a connection from the store to its
+// tracking info, once the handshake is done (or failed).
+func (p *Proxy) noteFingerprint(conn net.Conn) {
+	if p.fingerprints == nil {
+		return
+	}
+	fingerprint, ok := p.fingerprints.take(conn)
+	if !ok {
+		return
+	}
+	p.updateInfo(conn, func(info *connInfo) {
+		info.fingerprint = fingerprint.String()
+	})
+}
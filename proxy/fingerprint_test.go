@@ -0,0 +1,109 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprintJA3(t *testing.T) {
+	// Example from the JA3 documentation.
+	hello := &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:        []uint16{0, 10, 11},
+		SupportedCurves:   []tls.CurveID{23, 24, 25},
+		SupportedPoints:   []uint8{0},
+		SupportedVersions: []uint16{tls.VersionTLS10},
+	}
+	assert.Equal(t, "ada70206e40642a3e4461f35503241d5", Fingerprint(hello).JA3)
+}
+
+func TestFingerprintJA4(t *testing.T) {
+	// Example from the JA4 documentation, with GREASE values added.
+	hello := &tls.ClientHelloInfo{
+		CipherSuites: []uint16{0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions:   []uint16{0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015},
+		SignatureSchemes: []tls.SignatureScheme{
+			0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+		},
+		SupportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		ServerName:        "example.com",
+	}
+	fingerprint := Fingerprint(hello)
+	assert.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", fingerprint.JA4)
+	assert.True(t, ValidFingerprint(fingerprint.JA3))
+	assert.True(t, ValidFingerprint(fingerprint.JA4))
+
+	// No SNI, ALPN, cipher suites or extensions
+	assert.Equal(t, "t12i000000_000000000000_000000000000", Fingerprint(&tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS12},
+	}).JA4)
+}
+
+func TestFingerprintALPN(t *testing.T) {
+	assert.Equal(t, "00", ja4ALPN(nil))
+	assert.Equal(t, "h2", ja4ALPN([]string{"h2", "http/1.1"}))
+	assert.Equal(t, "h1", ja4ALPN([]string{"http/1.1"}))
+	assert.Equal(t, "61", ja4ALPN([]string{"abc\x01"}))
+}
+
+func TestFingerprintsAccess(t *testing.T) {
+	hello := &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS12}}
+	fingerprint := Fingerprint(hello)
+	called := false
+	next := func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		called = true
+		return nil, nil
+	}
+
+	_, err := NewFingerprints(nil, nil).GetConfigForClient(next)(hello)
+	assert.Nil(t, err, "should allow all clients by default")
+	assert.True(t, called, "should call wrapped callback")
+
+	_, err = NewFingerprints(nil, []string{fingerprint.JA4}).GetConfigForClient(next)(hello)
+	assert.NotNil(t, err, "should reject denied fingerprint")
+
+	_, err = NewFingerprints([]string{"e7d705a3286e19ea42f587b344ee6865"}, nil).GetConfigForClient(nil)(hello)
+	assert.NotNil(t, err, "should reject fingerprint that isn't allowed")
+
+	_, err = NewFingerprints([]string{fingerprint.JA3}, nil).GetConfigForClient(nil)(hello)
+	assert.Nil(t, err, "should allow allowed fingerprint")
+}
+
+func TestFingerprintsTake(t *testing.T) {
+	raw, other := net.Pipe()
+	defer raw.Close()
+	defer other.Close()
+
+	fingerprints := NewFingerprints(nil, nil)
+	hello := &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS12}, Conn: raw}
+	_, err := fingerprints.GetConfigForClient(nil)(hello)
+	assert.Nil(t, err)
+
+	conn := tls.Server(raw, &tls.Config{})
+	fingerprint, ok := fingerprints.take(conn)
+	assert.True(t, ok, "should find fingerprint by underlying connection")
+	assert.Equal(t, Fingerprint(hello), fingerprint)
+
+	_, ok = fingerprints.take(conn)
+	assert.False(t, ok, "should forget fingerprint once taken")
+}
@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var firstByteTimeoutCounter = metrics.GetOrRegisterCounter("conn.firstbyte.timeout", metrics.DefaultRegistry)
+
+// EnableFirstByteTimeout closes proxied connections if the backend hasn't sent
+// any data within the given duration after connecting to it, e.g. because it
+// accepted the connection but is wedged and never reads or writes.
+func (p *Proxy) EnableFirstByteTimeout(timeout time.Duration) {
+	p.firstByteTimeout = timeout
+}
+
+// firstByteTimer closes both sides of a proxied connection if the backend
+// doesn't send its first byte within the timeout.
+type firstByteTimer struct {
+	timer *time.Timer
+	// Set to 1 once data was read from the client, and from the backend.
+	clientSent, backendSent int32
+	// Set to 1 once the connection was closed for timing out.
+	expired int32
+}
+
+func (p *Proxy) newFirstByteTimer(client, backend net.Conn) *firstByteTimer {
+	t := &firstByteTimer{}
+	timeout := p.firstByteTimeout
+	t.timer = time.AfterFunc(timeout, func() {
+		if atomic.LoadInt32(&t.backendSent) == 1 || !atomic.CompareAndSwapInt32(&t.expired, 0, 1) {
+			return
+		}
+		firstByteTimeoutCounter.Inc(1)
+		reason := "backend sent no data"
+		if atomic.LoadInt32(&t.clientSent) == 1 {
+			reason = "backend didn't respond to client data"
+		}
+		logging.Warnf(p.Logger, "warning: closing connection from %s (peer %s), %s within %s", client.RemoteAddr(), peerIdentity(client, backend), reason, timeout)
+		client.Close()
+		backend.Close()
+	})
+	return t
+}
+
+// reader wraps src to record data in the given direction (zero for data
+// from the backend), and disarm the timer once the backend sent data.
+func (t *firstByteTimer) reader(src io.Reader, direction int) io.Reader {
+	if t == nil {
+		return src
+	}
+	return &firstByteReader{src, t, direction}
+}
+
+func (t *firstByteTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// timedOut returns true if the connection was closed because the backend
+// didn't send anything in time.
+func (t *firstByteTimer) timedOut() bool {
+	return t != nil && atomic.LoadInt32(&t.expired) == 1
+}
+
+type firstByteReader struct {
+	io.Reader
+	timer     *firstByteTimer
+	direction int
+}
+
+func (r *firstByteReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		if r.direction == 1 {
+			atomic.StoreInt32(&r.timer.clientSent, 1)
+		} else if atomic.CompareAndSwapInt32(&r.timer.backendSent, 0, 1) {
+			r.timer.timer.Stop()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,259 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	handshakeBytesCounter = metrics.GetOrRegisterCounter("accept.handshake.toolarge", metrics.DefaultRegistry)
+	handshakeRateCounter  = metrics.GetOrRegisterCounter("accept.handshake.tooslow", metrics.DefaultRegistry)
+	handshakeIPCounter    = metrics.GetOrRegisterCounter("accept.handshake.perip", metrics.DefaultRegistry)
+)
+
+// How long clients can take at the start of a handshake before the minimum
+// rate applies, to allow for a few round trips.
+var handshakeRateGrace = 5 * time.Second
+
+// HandshakeLimits bound what clients can do before their TLS handshake
+// completes, to keep slow or stuck clients (e.g. slowloris attacks) from
+// holding on to connections. Zero values disable a limit.
+type HandshakeLimits struct {
+	// Maximum number of bytes read from a client during the handshake.
+	MaxBytes int64
+	// Minimum average rate (in bytes per second) at which clients must send
+	// handshake data, after a grace period of a few seconds.
+	MinRate int64
+	// Maximum number of connections from the same source IP that are still
+	// in the handshake.
+	MaxPerIP int
+}
+
+// HandshakeLimiter enforces handshake limits on connections accepted on the
+// listeners it wraps, which must be wrapped in a TLS listener (connections
+// are released from the limits once the proxy completed their handshake).
+// Connections over a limit are closed right away. Listeners wrapped by the
+// same limiter share the per-IP limit.
+type HandshakeLimiter struct {
+	limits HandshakeLimits
+	logger Logger
+
+	mu sync.Mutex
+	// Number of connections in the handshake, by source IP.
+	pending map[string]int
+}
+
+// NewHandshakeLimiter creates a limiter enforcing the given limits.
+func NewHandshakeLimiter(limits HandshakeLimits, logger Logger) *HandshakeLimiter {
+	return &HandshakeLimiter{
+		limits:  limits,
+		logger:  logger,
+		pending: map[string]int{},
+	}
+}
+
+// Listener wraps a listener to enforce the limits on its connections.
+func (l *HandshakeLimiter) Listener(listener net.Listener) net.Listener {
+	return &handshakeLimitListener{listener, l}
+}
+
+// acquire counts a connection from addr as in the handshake. Returns false if
+// there are too many already. Connections without an IP aren't limited.
+func (l *HandshakeLimiter) acquire(addr net.Addr) (string, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || l.limits.MaxPerIP <= 0 {
+		return "", true
+	}
+	ip := tcpAddr.IP.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending[ip] >= l.limits.MaxPerIP {
+		return "", false
+	}
+	l.pending[ip]++
+	return ip, true
+}
+
+func (l *HandshakeLimiter) release(ip string) {
+	if ip == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending[ip]--
+	if l.pending[ip] <= 0 {
+		delete(l.pending, ip)
+	}
+}
+
+type handshakeLimitListener struct {
+	net.Listener
+	limiter *HandshakeLimiter
+}
+
+func (l *handshakeLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		c := &handshakeLimitedConn{Conn: conn, limiter: l.limiter, start: time.Now()}
+		// With the PROXY protocol, we only know the client address once
+		// the header was read, on the first read.
+		if _, ok := conn.(*proxyProtocolConn); !ok {
+			if !c.acquire() {
+				continue
+			}
+		}
+		return c, nil
+	}
+}
+
+// handshakeLimitedConn enforces handshake limits on reads until the
+// handshake is done.
+type handshakeLimitedConn struct {
+	net.Conn
+	limiter *HandshakeLimiter
+	start   time.Time
+
+	mu       sync.Mutex
+	read     int64
+	acquired bool
+	ip       string
+	done     bool
+	// Read deadline set on the connection, as opposed to the one we set to
+	// enforce the minimum rate.
+	deadline time.Time
+}
+
+// acquire counts the connection against the per-IP limit, and closes it if
+// it's over the limit.
+func (c *handshakeLimitedConn) acquire() bool {
+	ip, ok := c.limiter.acquire(c.Conn.RemoteAddr())
+	if !ok {
+		handshakeIPCounter.Inc(1)
+		logging.Debugf(c.limiter.logger, "rejecting connection from %s, too many handshakes from same IP", c.Conn.RemoteAddr())
+		c.Conn.Close()
+		return false
+	}
+	c.acquired = true
+	c.ip = ip
+	return true
+}
+
+func (c *handshakeLimitedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return c.Conn.Read(b)
+	}
+
+	limits := c.limiter.limits
+	if limits.MaxBytes > 0 && int64(len(b)) > limits.MaxBytes-c.read+1 {
+		// Read at most one byte past the limit, to notice it's exceeded.
+		b = b[:limits.MaxBytes-c.read+1]
+	}
+	var rateDeadline time.Time
+	if limits.MinRate > 0 {
+		// The next byte must arrive in time to keep up the minimum rate.
+		rateDeadline = c.start.Add(handshakeRateGrace + time.Duration((c.read+1)*int64(time.Second)/limits.MinRate))
+		deadline := rateDeadline
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read += int64(n)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !rateDeadline.IsZero() && !time.Now().Before(rateDeadline) {
+		handshakeRateCounter.Inc(1)
+		c.Conn.Close()
+		return n, fmt.Errorf("handshake too slow, read %d bytes in %s (minimum rate is %d bytes/s)", c.read, time.Since(c.start).Round(time.Millisecond), limits.MinRate)
+	}
+	if limits.MaxBytes > 0 && c.read > limits.MaxBytes {
+		handshakeBytesCounter.Inc(1)
+		c.Conn.Close()
+		return 0, fmt.Errorf("handshake too large, read more than %d bytes", limits.MaxBytes)
+	}
+	if !c.acquired && !c.done && !c.acquire() {
+		return 0, fmt.Errorf("too many handshakes from %s", c.Conn.RemoteAddr())
+	}
+	return n, err
+}
+
+func (c *handshakeLimitedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *handshakeLimitedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *handshakeLimitedConn) Close() error {
+	c.handshakeDone()
+	return c.Conn.Close()
+}
+
+// handshakeDone releases the connection from the limits.
+func (c *handshakeLimitedConn) handshakeDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return
+	}
+	c.done = true
+	c.limiter.release(c.ip)
+	if c.limiter.limits.MinRate > 0 {
+		c.Conn.SetReadDeadline(c.deadline)
+	}
+}
+
+// Release a connection from handshake limits, once its handshake completed.
+// Wrapped connections are unwrapped (e.g. TLS within a WebSocket).
+func releaseHandshakeLimits(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *handshakeLimitedConn:
+			c.handshakeDone()
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func limitedTLSListener(t *testing.T, limits HandshakeLimits) (net.Listener, net.Listener) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	limiter := NewHandshakeLimiter(limits, &testLogger{})
+	return ln, tls.NewListener(limiter.Listener(ln), testTLSConfig(t))
+}
+
+func TestHandshakeLimitBytes(t *testing.T) {
+	ln, listener := limitedTLSListener(t, HandshakeLimits{MaxBytes: 64})
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer client.Close()
+	go tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	exceeded := handshakeBytesCounter.Count()
+	err = forceHandshake(context.Background(), 5*time.Second, conn)
+	assert.NotNil(t, err, "should fail handshake larger than limit")
+	assert.True(t, strings.Contains(err.Error(), "handshake too large"), "should fail because of limit (%s)", err)
+	assert.Equal(t, exceeded+1, handshakeBytesCounter.Count(), "should count connections over the limit")
+}
+
+func TestHandshakeLimitRate(t *testing.T) {
+	defer func(grace time.Duration) { handshakeRateGrace = grace }(handshakeRateGrace)
+	handshakeRateGrace = 50 * time.Millisecond
+
+	ln, listener := limitedTLSListener(t, HandshakeLimits{MinRate: 100})
+	defer listener.Close()
+
+	// Client sends the first byte of a ClientHello, and then stalls
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer client.Close()
+	client.Write([]byte{0x16})
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	slow := handshakeRateCounter.Count()
+	start := time.Now()
+	err = forceHandshake(context.Background(), 5*time.Second, conn)
+	assert.NotNil(t, err, "should fail handshake slower than minimum rate")
+	assert.True(t, strings.Contains(err.Error(), "handshake too slow"), "should fail because of rate (%s)", err)
+	assert.True(t, time.Since(start) < time.Second, "should not wait for handshake timeout")
+	assert.Equal(t, slow+1, handshakeRateCounter.Count(), "should count slow connections")
+
+	_, err = ioutil.ReadAll(client)
+	assert.Nil(t, err, "client should see connection closed")
+}
+
+func TestHandshakeLimitPerIP(t *testing.T) {
+	ln, listener := limitedTLSListener(t, HandshakeLimits{MaxPerIP: 1})
+	defer listener.Close()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer first.Close()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+
+	rejected := handshakeIPCounter.Count()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "should close second connection from same IP")
+	assert.Equal(t, rejected+1, handshakeIPCounter.Count(), "should count rejected connections")
+
+	// Once the first connection is gone, further ones are accepted
+	conn.Close()
+	third, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Error("should accept connection once under limit")
+	}
+}
+
+func TestHandshakeLimitReleased(t *testing.T) {
+	ln, listener := limitedTLSListener(t, HandshakeLimits{MaxBytes: 16 * 1024, MinRate: 1, MaxPerIP: 1})
+	defer listener.Close()
+
+	data := make([]byte, 64*1024)
+	go func() {
+		client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		client.Write(data)
+	}()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+	err = forceHandshake(context.Background(), 5*time.Second, conn)
+	assert.Nil(t, err, "should complete handshake within limits")
+	releaseHandshakeLimits(conn)
+
+	received, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err, "should read data past handshake limit once released")
+	assert.Equal(t, len(data), len(received))
+}
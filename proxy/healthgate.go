@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var backendDownCounter = metrics.GetOrRegisterCounter("accept.backend.down", metrics.DefaultRegistry)
+
+// How often to check if the backend is healthy again, while not accepting.
+var healthGatePoll = 100 * time.Millisecond
+
+// EnableHealthGate stops accepting connections while healthy returns false,
+// e.g. because a health check found the backend to be down, to avoid
+// handshakes with clients we can't forward anyway. If reject is set, the
+// proxy instead keeps accepting but closes new connections before the TLS
+// handshake.
+func (p *Proxy) EnableHealthGate(healthy func() bool, reject bool) {
+	p.health = &healthGate{
+		healthy: healthy,
+		reject:  reject,
+	}
+}
+
+type healthGate struct {
+	healthy func() bool
+	reject  bool
+}
+
+// wait blocks until the backend is healthy (in pause mode), or ctx is done.
+func (g *healthGate) wait(ctx context.Context) {
+	if g == nil || g.reject {
+		return
+	}
+	for !g.healthy() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(healthGatePoll):
+		}
+	}
+}
+
+// admit returns false if a newly accepted connection should be closed
+// because the backend is down (in reject mode).
+func (g *healthGate) admit() bool {
+	if g == nil || !g.reject || g.healthy() {
+		return true
+	}
+	backendDownCounter.Inc(1)
+	return false
+}
@@ -0,0 +1,115 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var idleTimeoutCounter = metrics.GetOrRegisterCounter("conn.idle.timeout", metrics.DefaultRegistry)
+
+// EnableIdleTimeout closes proxied connections if no data has been transferred
+// in either direction for the given duration.
+func (p *Proxy) EnableIdleTimeout(timeout time.Duration) {
+	p.idleTimeout = timeout
+}
+
+// idleTracker keeps track of the last time data was read in each direction of
+// a proxied connection, and closes both sides if the connection is idle.
+type idleTracker struct {
+	timeout time.Duration
+	// Last activity (as unix nanos) per direction.
+	last [2]int64
+	// Set to 1 once the connection was closed for being idle.
+	idle int32
+	done chan struct{}
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	now := time.Now().UnixNano()
+	return &idleTracker{
+		timeout: timeout,
+		last:    [2]int64{now, now},
+		done:    make(chan struct{}),
+	}
+}
+
+// reader wraps src to record activity for the given direction.
+func (t *idleTracker) reader(src io.Reader, direction int) io.Reader {
+	return &activityReader{src, &t.last[direction]}
+}
+
+// watch closes both connections once neither direction has seen any data for
+// the timeout. Returns when stop is called.
+func (t *idleTracker) watch(client, backend net.Conn) {
+	interval := t.timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			if time.Since(t.lastActivity()) >= t.timeout {
+				atomic.StoreInt32(&t.idle, 1)
+				idleTimeoutCounter.Inc(1)
+				client.Close()
+				backend.Close()
+				return
+			}
+		}
+	}
+}
+
+func (t *idleTracker) stop() {
+	close(t.done)
+}
+
+// timedOut returns true if the connection was closed for being idle.
+func (t *idleTracker) timedOut() bool {
+	return t != nil && atomic.LoadInt32(&t.idle) == 1
+}
+
+func (t *idleTracker) lastActivity() time.Time {
+	last := atomic.LoadInt64(&t.last[0])
+	if other := atomic.LoadInt64(&t.last[1]); other > last {
+		last = other
+	}
+	return time.Unix(0, last)
+}
+
+type activityReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
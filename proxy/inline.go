@@ -0,0 +1,163 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var inlineRequestCounter = metrics.GetOrRegisterCounter("http.inline.requests", metrics.DefaultRegistry)
+
+// Host used in URLs of requests forwarded to the backend. All requests go to
+// the same backend (via the proxy's dialer), so this only keys the pool of
+// idle backend connections. The Host header is passed through as is.
+const inlineBackendHost = "backend"
+
+// EnableInlineHTTP serves connections as HTTP (HTTP/2 if negotiated via ALPN,
+// HTTP/1.1 otherwise) instead of copying bytes, so that requests for the given
+// paths can be answered by ghostunnel itself. All other requests are forwarded
+// to the backend over plain HTTP/1.1. The decision is made on the cleaned
+// request path, so requests for these paths never reach the backend, and the
+// backend has no way to answer them.
+func (p *Proxy) EnableInlineHTTP(handlers map[string]http.Handler) {
+	backend := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = inlineBackendHost
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return p.Dial()
+			},
+			MaxIdleConnsPerHost: 16,
+		},
+		ErrorLog: log.New(logWriter{p.Logger}, "", 0),
+	}
+
+	router := &inlineRouter{handlers: map[string]http.Handler{}, backend: backend}
+	for pattern, handler := range handlers {
+		router.handlers[path.Clean("/"+pattern)] = handler
+	}
+	p.inline = newInlineServer(router, p.Logger)
+}
+
+// inlineRouter sends requests for inline paths to their handler, and all
+// others to the backend.
+type inlineRouter struct {
+	handlers map[string]http.Handler
+	backend  http.Handler
+}
+
+func (r *inlineRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if handler, ok := r.handlers[path.Clean("/"+req.URL.Path)]; ok {
+		inlineRequestCounter.Inc(1)
+		handler.ServeHTTP(w, req)
+		return
+	}
+	r.backend.ServeHTTP(w, req)
+}
+
+// inlineServer is a single HTTP server for all connections, which are handed
+// to it through a channel (it acts as the listener for the server). Handing
+// over the *tls.Conn as is lets net/http set up HTTP/2 if it was negotiated.
+type inlineServer struct {
+	server *http.Server
+	conns  chan net.Conn
+
+	mu   sync.Mutex
+	done map[net.Conn]chan struct{}
+}
+
+func newInlineServer(handler http.Handler, logger Logger) *inlineServer {
+	s := &inlineServer{
+		conns: make(chan net.Conn),
+		done:  map[net.Conn]chan struct{}{},
+	}
+	s.server = &http.Server{
+		Handler:   handler,
+		ConnState: s.connState,
+		ErrorLog:  log.New(logWriter{logger}, "", 0),
+	}
+	go s.server.Serve(s)
+	return s
+}
+
+// serve passes a connection to the HTTP server, and blocks until it's closed.
+func (s *inlineServer) serve(conn net.Conn) {
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.done[conn] = done
+	s.mu.Unlock()
+
+	s.conns <- conn
+	<-done
+}
+
+func (s *inlineServer) connState(conn net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	s.mu.Lock()
+	done := s.done[conn]
+	delete(s.done, conn)
+	s.mu.Unlock()
+	if done != nil {
+		close(done)
+	}
+}
+
+func (s *inlineServer) Accept() (net.Conn, error) {
+	conn, ok := <-s.conns
+	if !ok {
+		return nil, errors.New("inline HTTP server closed")
+	}
+	return conn, nil
+}
+
+// Close is a no-op, the proxy closes connections itself.
+func (s *inlineServer) Close() error {
+	return nil
+}
+
+func (s *inlineServer) Addr() net.Addr {
+	return inlineAddr{}
+}
+
+type inlineAddr struct{}
+
+func (inlineAddr) Network() string { return "inline" }
+func (inlineAddr) String() string  { return "inline" }
+
+// logWriter adapts a Logger for use as the output of a log.Logger.
+type logWriter struct {
+	logger Logger
+}
+
+func (w logWriter) Write(b []byte) (int, error) {
+	w.logger.Printf("%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
@@ -0,0 +1,94 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineHTTP(t *testing.T) {
+	// Backend HTTP server
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	var backendRequests int32
+	backend := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+		fmt.Fprintf(w, "backend %s %s", r.URL.Path, r.Host)
+	})}
+	go backend.Serve(target)
+	defer backend.Close()
+
+	config := testTLSConfig(t)
+	config.NextProtos = []string{"h2", "http/1.1"}
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(tls.NewListener(incoming, config), 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.EnableInlineHTTP(map[string]http.Handler{
+		"/healthz": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "inline %s", r.Proto)
+		}),
+	})
+	go p.Accept()
+	defer p.Shutdown()
+
+	for _, h2 := range []bool{true, false} {
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: h2,
+		}
+		if !h2 {
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		client := &http.Client{Transport: transport}
+		base := "https://" + incoming.Addr().String()
+
+		get := func(path string) string {
+			resp, err := client.Get(base + path)
+			if !assert.Nil(t, err, "should be able to make request for %s (h2: %t)", path, h2) {
+				return ""
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			return string(body)
+		}
+
+		proto := "HTTP/1.1"
+		if h2 {
+			proto = "HTTP/2.0"
+		}
+		assert.Equal(t, "inline "+proto, get("/healthz"), "should answer inline path ourselves")
+		assert.Equal(t, "inline "+proto, get("/healthz/"), "should match cleaned path")
+		assert.Equal(t, "inline "+proto, get("/x/../healthz"), "should match cleaned path")
+		assert.Equal(t, int32(0), atomic.LoadInt32(&backendRequests), "should never forward inline paths")
+
+		assert.Equal(t, "backend /other "+incoming.Addr().String(), get("/other"), "should forward other paths with original host")
+		assert.Equal(t, int32(1), atomic.SwapInt32(&backendRequests, 0))
+		transport.CloseIdleConnections()
+	}
+}
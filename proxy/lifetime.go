@@ -0,0 +1,166 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Time to wait after sending a FIN on an expired connection before closing it,
+// to give both sides a chance to see the end of stream.
+const lifetimeLinger = time.Second
+
+var (
+	lifetimeExpiredCounter = metrics.GetOrRegisterCounter("conn.lifetime.expired", metrics.DefaultRegistry)
+	reloadClosedCounter    = metrics.GetOrRegisterCounter("conn.reload.closed", metrics.DefaultRegistry)
+)
+
+// EnableMaxLifetime closes proxied connections once they have been open for
+// the given duration. Each connection's lifetime is shortened by a random
+// fraction of up to jitter (0 to 1), so that connections established at the
+// same time aren't all cut at once.
+func (p *Proxy) EnableMaxLifetime(lifetime time.Duration, jitter float64) {
+	p.maxLifetime = lifetime
+	p.lifetimeJitter = jitter
+}
+
+// CloseConnections gracefully closes all connections being proxied right now,
+// like connections that exceeded their maximum lifetime, e.g. so that clients
+// reconnect with a new certificate. New connections are still accepted.
+// Returns the number of connections closed.
+func (p *Proxy) CloseConnections() int {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	closed := 0
+	for t := range p.transfers {
+		if t.lifetime.expire(expiredByRequest) {
+			closed++
+		}
+	}
+	reloadClosedCounter.Inc(int64(closed))
+	return closed
+}
+
+// connectionLifetime returns the (jittered) lifetime for a new connection
+// (zero if connections don't have a maximum lifetime).
+func (p *Proxy) connectionLifetime() time.Duration {
+	if p.lifetimeJitter <= 0 {
+		return p.maxLifetime
+	}
+	return p.maxLifetime - time.Duration(rand.Float64()*p.lifetimeJitter*float64(p.maxLifetime))
+}
+
+// Why a connection's lifetime ended (see lifetimeTimer).
+const (
+	expiredByTimer   = 1
+	expiredByRequest = 2
+)
+
+// lifetimeTimer stops copying on a proxied connection once its lifetime has
+// passed (if it has a maximum lifetime), or it's closed via CloseConnections,
+// by expiring the read deadline on both sides.
+type lifetimeTimer struct {
+	start           time.Time
+	timer           *time.Timer
+	client, backend net.Conn
+	// Set to expiredBy* once the lifetime has expired.
+	expired int32
+}
+
+func newLifetimeTimer(lifetime time.Duration, client, backend net.Conn) *lifetimeTimer {
+	t := &lifetimeTimer{start: time.Now(), client: client, backend: backend}
+	if lifetime > 0 {
+		t.timer = time.AfterFunc(lifetime, func() {
+			if t.expire(expiredByTimer) {
+				lifetimeExpiredCounter.Inc(1)
+			}
+		})
+	}
+	return t
+}
+
+// expire ends the lifetime of the connection now, for the given reason.
+// Returns false if it already ended.
+func (t *lifetimeTimer) expire(reason int32) bool {
+	if t == nil || !atomic.CompareAndSwapInt32(&t.expired, 0, reason) {
+		return false
+	}
+	now := time.Now()
+	t.client.SetReadDeadline(now)
+	t.backend.SetReadDeadline(now)
+	return true
+}
+
+func (t *lifetimeTimer) stop() {
+	if t != nil && t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// timedOut returns true if the connection's lifetime ended.
+func (t *lifetimeTimer) timedOut() bool {
+	return t != nil && atomic.LoadInt32(&t.expired) != 0
+}
+
+// closedByRequest returns true if the connection was closed via
+// CloseConnections, rather than for exceeding its maximum lifetime.
+func (t *lifetimeTimer) closedByRequest() bool {
+	return t != nil && atomic.LoadInt32(&t.expired) == expiredByRequest
+}
+
+// closeExpired shuts down a connection that exceeded its lifetime: send a FIN
+// to both sides, wait for a short linger period, then close.
+func (p *Proxy) closeExpired(client, backend net.Conn, lifetime *lifetimeTimer) {
+	reason := "maximum lifetime exceeded"
+	if lifetime.closedByRequest() {
+		reason = "closing connections on request"
+	}
+	p.Logger.Printf(
+		"closing connection from %s (peer %s) after %s, %s",
+		client.RemoteAddr(),
+		peerIdentity(client, backend),
+		time.Since(lifetime.start).Truncate(time.Millisecond),
+		reason)
+
+	closeWrite(client)
+	closeWrite(backend)
+	time.Sleep(lifetimeLinger)
+	client.Close()
+	backend.Close()
+}
+
+// peerIdentity returns the subject of the peer certificate on whichever side
+// of the connection is TLS, for logging.
+func peerIdentity(conns ...net.Conn) string {
+	for _, conn := range conns {
+		tlsConn, ok := tlsConnection(conn)
+		if !ok || tlsConn == nil {
+			continue
+		}
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			return fmt.Sprintf("'%s'", state.PeerCertificates[0].Subject)
+		}
+	}
+	return "none"
+}
@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	connLimitGauge      = metrics.GetOrRegisterGauge("conn.limit", metrics.DefaultRegistry)
+	connActiveGauge     = metrics.GetOrRegisterGauge("conn.active", metrics.DefaultRegistry)
+	connRejectedCounter = metrics.GetOrRegisterCounter("conn.limit.rejected", metrics.DefaultRegistry)
+)
+
+// EnableConnectionLimit caps the number of concurrent connections (including
+// ones still in the handshake). Once max connections are active, the proxy
+// stops accepting until fewer than resume connections are active. If reject is
+// set, the proxy instead keeps accepting but immediately closes connections
+// over the limit, which keeps the listen queue from filling up.
+func (p *Proxy) EnableConnectionLimit(max, resume int, reject bool) {
+	if resume <= 0 || resume > max {
+		resume = max
+	}
+	p.limit = &connLimiter{
+		max:    int64(max),
+		resume: int64(resume),
+		reject: reject,
+		logger: p.Logger,
+	}
+	p.limit.cond = sync.NewCond(&p.limit.mu)
+	connLimitGauge.Update(int64(max))
+}
+
+// connLimiter keeps track of the number of active connections, and whether
+// we're currently over the limit.
+type connLimiter struct {
+	max, resume int64
+	reject      bool
+	logger      Logger
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	active  int64
+	limited bool
+	stopped bool
+}
+
+// wait blocks until we're below the limit again (in pause mode).
+func (l *connLimiter) wait() {
+	if l == nil || l.reject {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.limited && !l.stopped {
+		l.cond.Wait()
+	}
+}
+
+// admit registers a newly accepted connection. Returns false if the
+// connection is over the limit and should be closed (in reject mode).
+func (l *connLimiter) admit() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limited && l.reject {
+		connRejectedCounter.Inc(1)
+		return false
+	}
+
+	l.active++
+	connActiveGauge.Update(l.active)
+	if l.active >= l.max && !l.limited {
+		l.limited = true
+		if l.reject {
+			logging.Warnf(l.logger, "warning: reached limit of %d concurrent connections, rejecting new connections", l.max)
+		} else {
+			logging.Warnf(l.logger, "warning: reached limit of %d concurrent connections, no longer accepting", l.max)
+		}
+	}
+	return true
+}
+
+// release unregisters a connection once it's closed.
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	connActiveGauge.Update(l.active)
+	if l.limited && l.active < l.resume {
+		l.limited = false
+		l.logger.Printf("down to %d concurrent connections, accepting again", l.active)
+		l.cond.Broadcast()
+	}
+}
+
+// stop unblocks wait, so that the accept loop can exit on shutdown.
+func (l *connLimiter) stop() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	l.cond.Broadcast()
+}
@@ -0,0 +1,144 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// AddListener adds another listener to accept connections on, in addition to
+// Listener. All listeners share the same configuration and backend, and are
+// closed on Shutdown. If there's more than one listener, connection logs and
+// metrics are tagged with the address of the listener a connection came in
+// on. Must be called before Accept.
+func (p *Proxy) AddListener(listener net.Listener) {
+	p.extraListeners = append(p.extraListeners, listener)
+}
+
+// listenerTag identifies one of multiple listeners in logs and metrics. A nil
+// tag can be used if there's only one listener, and does nothing.
+type listenerTag struct {
+	name     string
+	accepted metrics.Counter
+	open     metrics.Counter
+	bytes    [2]metrics.Counter
+}
+
+func newListenerTag(listener net.Listener) *listenerTag {
+	addr := listener.Addr()
+	name := addr.Network() + ":" + addr.String()
+	prefix := labeledMetricPrefix("listener", name)
+	return &listenerTag{
+		name:     name,
+		accepted: metrics.GetOrRegisterCounter(prefix+".accept.total", metrics.DefaultRegistry),
+		open:     metrics.GetOrRegisterCounter(prefix+".conn.open", metrics.DefaultRegistry),
+		bytes: [2]metrics.Counter{
+			metrics.GetOrRegisterCounter(prefix+".bytes.downstream", metrics.DefaultRegistry),
+			metrics.GetOrRegisterCounter(prefix+".bytes.upstream", metrics.DefaultRegistry),
+		},
+	}
+}
+
+func (t *listenerTag) opened() {
+	if t != nil {
+		t.accepted.Inc(1)
+		t.open.Inc(1)
+	}
+}
+
+func (t *listenerTag) closed() {
+	if t != nil {
+		t.open.Dec(1)
+	}
+}
+
+func (t *listenerTag) addBytes(direction int, n int64) {
+	if t != nil {
+		t.bytes[direction].Inc(n)
+	}
+}
+
+// logSuffix returns a suffix for log messages about the given client
+// connection, naming the listener it came in on and the route it was sent
+// to (empty if neither applies).
+func (p *Proxy) logSuffix(conn net.Conn) string {
+	p.connsMu.Lock()
+	info := p.conns[conn]
+	p.connsMu.Unlock()
+
+	suffix := ""
+	if info == nil {
+		return suffix
+	}
+	if info.listener != nil {
+		suffix += " on " + info.listener.name
+	}
+	if info.route != nil {
+		suffix += " via route " + info.route.name
+	}
+	if info.multipath != "" {
+		suffix += " (multipath TCP: " + info.multipath + ")"
+	}
+	if info.fastOpen != "" {
+		suffix += " (TCP Fast Open: " + info.fastOpen + ")"
+	}
+	if info.fingerprint != "" {
+		suffix += " (fingerprint " + info.fingerprint + ")"
+	}
+	return suffix
+}
+
+// metricName replaces characters that have a special meaning in metric names
+// (e.g. dots and colons in addresses) with underscores.
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Names of listeners, routes and targets by the prefix of the metrics about
+// them, see MetricLabel.
+var metricLabels sync.Map
+
+// labeledMetricPrefix returns the prefix for metrics about a listener, route
+// or target (the kind) with the given name, e.g. "target.tcp_127_0_0_1_8080".
+func labeledMetricPrefix(kind, name string) string {
+	prefix := kind + "." + metricName(name)
+	if _, ok := metricLabels.Load(prefix); !ok {
+		metricLabels.Store(prefix, name)
+	}
+	return prefix
+}
+
+// MetricLabel returns the name of the listener, route or target that a metric
+// prefix (e.g. "listener.tcp_127_0_0_1_8443") is about, e.g. to use as a label
+// instead, as metric names don't keep addresses intact.
+func MetricLabel(prefix string) (string, bool) {
+	name, ok := metricLabels.Load(prefix)
+	if !ok {
+		return "", false
+	}
+	return name.(string), true
+}
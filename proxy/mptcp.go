@@ -0,0 +1,87 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	// Open TCP legs of proxied connections (to clients and to the backend),
+	// by whether they use Multipath TCP.
+	multipathCounter = metrics.GetOrRegisterCounter("conn.tcp.multipath", metrics.DefaultRegistry)
+	plainTCPCounter  = metrics.GetOrRegisterCounter("conn.tcp.plain", metrics.DefaultRegistry)
+)
+
+// EnableMultipathStats reports whether the TCP connections to clients and to
+// the backend actually use Multipath TCP (as opposed to falling back to plain
+// TCP), in connection logs and in the conn.tcp.multipath and conn.tcp.plain
+// metrics. This is meant to measure adoption with --mptcp-listen and
+// --mptcp-target.
+func (p *Proxy) EnableMultipathStats() {
+	p.multipathStats = true
+}
+
+// multipathTCP reports whether conn is a TCP connection, and if so, whether
+// it uses Multipath TCP.
+func multipathTCP(conn net.Conn) (tcp, multipath bool) {
+	tcpConn, ok := socket(conn).(*net.TCPConn)
+	if !ok {
+		return false, false
+	}
+	multipath, err := tcpConn.MultipathTCP()
+	return true, err == nil && multipath
+}
+
+// trackMultipath counts the open TCP legs of a connection between client and
+// backend, and records which ones use Multipath TCP for logs. Returns a
+// function to call once they're closed.
+func (p *Proxy) trackMultipath(client, backend net.Conn) func() {
+	if !p.multipathStats {
+		return func() {}
+	}
+	counters := []metrics.Counter{}
+	legs := []string{}
+	for i, conn := range []net.Conn{client, backend} {
+		tcp, multipath := multipathTCP(conn)
+		switch {
+		case multipath:
+			counters = append(counters, multipathCounter)
+			legs = append(legs, [2]string{"client", "target"}[i])
+		case tcp:
+			counters = append(counters, plainTCPCounter)
+		}
+	}
+	if len(legs) == 0 {
+		legs = append(legs, "none")
+	}
+	p.updateInfo(client, func(info *connInfo) {
+		info.multipath = strings.Join(legs, ", ")
+	})
+
+	for _, counter := range counters {
+		counter.Inc(1)
+	}
+	return func() {
+		for _, counter := range counters {
+			counter.Dec(1)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func multipathPair(t *testing.T, multipath bool) (client, server net.Conn) {
+	config := net.ListenConfig{}
+	config.SetMultipathTCP(multipath)
+	ln, err := config.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+
+	dialer := &net.Dialer{}
+	dialer.SetMultipathTCP(multipath)
+	client, err = dialer.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	server, err = ln.Accept()
+	assert.Nil(t, err, "should accept connection")
+	return client, server
+}
+
+func TestMultipathTCP(t *testing.T) {
+	client, server := multipathPair(t, false)
+	defer client.Close()
+	defer server.Close()
+	tcp, multipath := multipathTCP(server)
+	assert.True(t, tcp, "should detect TCP connection")
+	assert.False(t, multipath, "should detect plain TCP connection")
+
+	unixClient, unixServer := net.Pipe()
+	defer unixClient.Close()
+	defer unixServer.Close()
+	tcp, _ = multipathTCP(unixServer)
+	assert.False(t, tcp, "should not report non-TCP connections")
+
+	client, server = multipathPair(t, true)
+	defer client.Close()
+	defer server.Close()
+	if _, multipath := multipathTCP(server); !multipath {
+		t.Skip("kernel doesn't support multipath TCP")
+	}
+	_, multipath = multipathTCP(client)
+	assert.True(t, multipath, "should detect multipath TCP on dialed connection")
+}
+
+func TestTrackMultipath(t *testing.T) {
+	client, server := multipathPair(t, false)
+	defer client.Close()
+	defer server.Close()
+
+	p := New(nil, 0, nil, &testLogger{})
+	p.track(server, nil)
+	plain := plainTCPCounter.Count()
+	p.trackMultipath(server, client)()
+	assert.Equal(t, plain, plainTCPCounter.Count(), "should not count connections by default")
+
+	p.EnableMultipathStats()
+	done := p.trackMultipath(server, client)
+	assert.Equal(t, plain+2, plainTCPCounter.Count(), "should count both plain TCP legs")
+	assert.Equal(t, " (multipath TCP: none)", p.logSuffix(server), "should log that neither leg uses multipath TCP")
+	done()
+	assert.Equal(t, plain, plainTCPCounter.Count(), "should stop counting closed legs")
+}
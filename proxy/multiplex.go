@@ -0,0 +1,140 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/Elbandi/ghostunnel/mux"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	multiplexSessionCounter = metrics.GetOrRegisterCounter("mux.session.open", metrics.DefaultRegistry)
+	multiplexStreamCounter  = metrics.GetOrRegisterCounter("mux.stream.total", metrics.DefaultRegistry)
+	multiplexSuccessCounter = metrics.GetOrRegisterCounter("mux.stream.success", metrics.DefaultRegistry)
+	multiplexRTTTimer       = metrics.GetOrRegisterTimer("mux.session.rtt", metrics.DefaultRegistry)
+)
+
+// MultiplexConfig returns the session config for multiplexed connections,
+// with keepalive pings at the given interval (zero to disable). Connections
+// are closed (dropping their streams) if the peer stops answering, and the
+// round-trip time of pings is tracked in the mux.session.rtt metric.
+func MultiplexConfig(keepalive time.Duration) mux.Config {
+	return mux.Config{
+		KeepAliveInterval: keepalive,
+		RoundTrip:         multiplexRTTTimer.Update,
+	}
+}
+
+// EnableMultiplex demultiplexes connections that negotiated the given ALPN
+// protocol: each stream opened by the peer is forwarded to the backend as if
+// it was a connection of its own (with the same peer certificate and route).
+// Other connections are forwarded as usual. Keepalive pings are sent at the
+// given interval, see MultiplexConfig.
+func (p *Proxy) EnableMultiplex(protocol string, keepalive time.Duration) {
+	p.multiplex = protocol
+	p.multiplexKeepAlive = keepalive
+}
+
+// multiplexedStream is a stream of a multiplexed connection, which keeps
+// track of the connection for its TLS state.
+type multiplexedStream struct {
+	*mux.Stream
+	parent *tls.Conn
+}
+
+// tlsState is implemented by connections carrying a TLS session: TLS
+// connections, and streams on QUIC connections.
+type tlsState interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// tlsConnection returns the TLS connection a connection was accepted on,
+// which is the parent connection for multiplexed streams.
+func tlsConnection(conn net.Conn) (tlsState, bool) {
+	switch c := conn.(type) {
+	case *multiplexedStream:
+		if c.parent == nil {
+			return nil, false
+		}
+		return c.parent, true
+	case tlsState:
+		return c, true
+	case interface{ NetConn() net.Conn }:
+		// Wrapped connections, e.g. prewarmed ones from the backend package
+		return tlsConnection(c.NetConn())
+	}
+	return nil, false
+}
+
+func negotiatedProtocol(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+// Accept streams on a multiplexed connection until it's closed, which drops
+// all streams still open.
+func (p *Proxy) serveMultiplexed(conn net.Conn) {
+	multiplexSessionCounter.Inc(1)
+	defer multiplexSessionCounter.Dec(1)
+
+	session := mux.Server(conn, MultiplexConfig(p.multiplexKeepAlive))
+	defer session.Close()
+	if !p.quiet {
+		p.Logger.Printf("multiplexing streams over connection from %s%s", conn.RemoteAddr(), p.logSuffix(conn))
+	}
+
+	// On shutdown, stop accepting streams, and close the connection once the
+	// open ones are done (so that it can drain like any other connection).
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			session.Shutdown()
+		case <-session.Done():
+		}
+	}()
+
+	parent, _ := conn.(*tls.Conn)
+	streams := &sync.WaitGroup{}
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			break
+		}
+		multiplexStreamCounter.Inc(1)
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer stream.Close()
+			p.forward(&multiplexedStream{Stream: stream, parent: parent}, conn, multiplexSuccessCounter)
+		}()
+	}
+
+	if dropped := session.Dropped(); dropped > 0 {
+		logging.Warnf(p.Logger, "warning: %s (from %s), dropped %d streams", session.Err(), conn.RemoteAddr(), dropped)
+	} else if !p.quiet {
+		p.Logger.Printf("%s (from %s)", session.Err(), conn.RemoteAddr())
+	}
+	streams.Wait()
+}
@@ -0,0 +1,171 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiplex(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	config := testTLSConfig(t)
+	config.NextProtos = []string{"ghostunnel-mux"}
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(tls.NewListener(incoming, config), 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.EnableMultiplex("ghostunnel-mux", 0)
+	p.EnableProxyProtocol(ProxyProtocolV2)
+	go p.Accept()
+	defer p.Shutdown()
+
+	conn, err := tls.Dial("tcp", incoming.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"ghostunnel-mux"}})
+	assert.Nil(t, err, "should be able to connect to proxy")
+	session := mux.Client(conn, mux.Config{})
+	defer session.Close()
+
+	// Each stream gets its own backend connection.
+	var backends []net.Conn
+	for i := 0; i < 2; i++ {
+		stream, err := session.Open()
+		assert.Nil(t, err, "should be able to open stream")
+		stream.Write([]byte("hello"))
+		stream.CloseWrite()
+
+		backend, err := target.Accept()
+		assert.Nil(t, err, "should get backend connection for stream")
+		backends = append(backends, backend)
+		header := make([]byte, 16)
+		_, err = io.ReadFull(backend, header)
+		assert.Nil(t, err, "should get PROXY protocol header for stream")
+		header = make([]byte, binary.BigEndian.Uint16(header[14:16]))
+		_, err = io.ReadFull(backend, header)
+		assert.Nil(t, err, "should get PROXY protocol addresses and TLVs for stream")
+		assert.Contains(t, string(header), "ghostunnel-mux", "header should have TLS details of connection")
+		data, err := ioutil.ReadAll(backend)
+		assert.Nil(t, err, "should read until half-close")
+		assert.Equal(t, "hello", string(data))
+
+		backend.Write([]byte("world"))
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(stream, reply)
+		assert.Nil(t, err, "should read reply from backend")
+		assert.Equal(t, "world", string(reply))
+	}
+
+	// All streams (and their backend connections) drop with the connection.
+	conn.Close()
+	for _, backend := range backends {
+		backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := backend.Read(make([]byte, 1))
+		assert.NotNil(t, err, "backend connection should be closed")
+		netErr, ok := err.(net.Error)
+		assert.False(t, ok && netErr.Timeout(), "backend connection should be closed, not time out")
+		backend.Close()
+	}
+}
+
+func TestMultiplexPlainConnections(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	config := testTLSConfig(t)
+	config.NextProtos = []string{"ghostunnel-mux"}
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(tls.NewListener(incoming, config), 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.EnableMultiplex("ghostunnel-mux", 0)
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Connections that don't negotiate the protocol are forwarded as is.
+	conn, err := tls.Dial("tcp", incoming.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err, "should be able to connect to proxy")
+	defer conn.Close()
+	conn.Write([]byte("plain"))
+
+	backend, err := target.Accept()
+	assert.Nil(t, err, "should get backend connection")
+	defer backend.Close()
+	data := make([]byte, 5)
+	_, err = io.ReadFull(backend, data)
+	assert.Nil(t, err, "should read data from connection")
+	assert.Equal(t, "plain", string(data))
+}
+
+func TestMultiplexDrain(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	config := testTLSConfig(t)
+	config.NextProtos = []string{"ghostunnel-mux"}
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(tls.NewListener(incoming, config), 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.EnableMultiplex("ghostunnel-mux", 0)
+	go p.Accept()
+
+	conn, err := tls.Dial("tcp", incoming.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"ghostunnel-mux"}})
+	assert.Nil(t, err, "should be able to connect to proxy")
+	session := mux.Client(conn, mux.Config{})
+	defer session.Close()
+
+	stream, err := session.Open()
+	assert.Nil(t, err, "should be able to open stream")
+	stream.Write([]byte("x"))
+	backend, err := target.Accept()
+	assert.Nil(t, err, "should get backend connection for stream")
+
+	// The connection drains once its last stream is done, without waiting
+	// for the drain timeout.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stream.CloseWrite()
+		backend.Close()
+	}()
+	start := time.Now()
+	drained, closed := p.Drain(5 * time.Second)
+	assert.Equal(t, 1, drained, "connection should drain")
+	assert.Equal(t, 0, closed, "connection should not have to be closed")
+	assert.True(t, time.Since(start) < 2*time.Second, "should not wait for drain timeout")
+
+	_, err = session.Open()
+	assert.NotNil(t, err, "should not open streams on drained connection")
+}
@@ -0,0 +1,56 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// countNegotiated counts the TLS version and cipher suite negotiated on conn
+// (if it's a TLS connection that completed its handshake), in the
+// negotiated.version.<VERSION> and negotiated.cipher.<SUITE> metrics. This is
+// meant to spot peers still on old versions before raising the minimum.
+func countNegotiated(conn net.Conn) {
+	tlsConn, ok := conn.(tlsState)
+	if !ok {
+		return
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return
+	}
+	metrics.GetOrRegisterCounter("negotiated.version."+metricName(tlsVersionName(state.Version)), metrics.DefaultRegistry).Inc(1)
+	metrics.GetOrRegisterCounter("negotiated.cipher."+metricName(tls.CipherSuiteName(state.CipherSuite)), metrics.DefaultRegistry).Inc(1)
+}
+
+// negotiatedDetails returns the TLS version and cipher suite negotiated on the
+// first TLS connection in conns, formatted for connection logs.
+func negotiatedDetails(conns ...net.Conn) string {
+	for _, conn := range conns {
+		tlsConn, ok := tlsConnection(conn)
+		if !ok || tlsConn == nil {
+			continue
+		}
+		state := tlsConn.ConnectionState()
+		return fmt.Sprintf(" (%s, %s)", tlsVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+	return ""
+}
@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountNegotiated(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := tls.Client(clientConn, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	defer client.Close()
+	server := tls.Server(serverConn, testTLSConfig(t))
+	defer server.Close()
+
+	go client.Handshake()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	assert.Nil(t, server.Handshake(), "handshake should succeed")
+
+	version := metrics.GetOrRegisterCounter("negotiated.version.TLS_1_2", metrics.DefaultRegistry)
+	cipher := metrics.GetOrRegisterCounter("negotiated.cipher.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", metrics.DefaultRegistry)
+	versions, ciphers := version.Count(), cipher.Count()
+
+	countNegotiated(server)
+	assert.Equal(t, versions+1, version.Count(), "should count negotiated version")
+	assert.Equal(t, ciphers+1, cipher.Count(), "should count negotiated cipher suite")
+
+	details := negotiatedDetails(clientConn, server)
+	assert.True(t, strings.Contains(details, "TLS 1.2, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"), "should log version and cipher suite (%s)", details)
+
+	// Plain connections and unfinished handshakes aren't counted
+	countNegotiated(clientConn)
+	countNegotiated(tls.Client(clientConn, &tls.Config{}))
+	assert.Equal(t, versions+1, version.Count(), "should only count completed TLS handshakes")
+	assert.Equal(t, "", negotiatedDetails(clientConn), "should not log details for plain connections")
+}
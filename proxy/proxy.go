@@ -17,34 +17,39 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/pires/go-proxyproto"
+	"github.com/Elbandi/ghostunnel/logging"
 	"github.com/rcrowley/go-metrics"
 )
 
 var (
-	openCounter    = metrics.GetOrRegisterCounter("conn.open", metrics.DefaultRegistry)
-	totalCounter   = metrics.GetOrRegisterCounter("accept.total", metrics.DefaultRegistry)
-	successCounter = metrics.GetOrRegisterCounter("accept.success", metrics.DefaultRegistry)
-	errorCounter   = metrics.GetOrRegisterCounter("accept.error", metrics.DefaultRegistry)
-	timeoutCounter = metrics.GetOrRegisterCounter("accept.timeout", metrics.DefaultRegistry)
-	handshakeTimer = metrics.GetOrRegisterTimer("conn.handshake", metrics.DefaultRegistry)
-	connTimer      = metrics.GetOrRegisterTimer("conn.lifetime", metrics.DefaultRegistry)
+	openCounter     = metrics.GetOrRegisterCounter("conn.open", metrics.DefaultRegistry)
+	totalCounter    = metrics.GetOrRegisterCounter("accept.total", metrics.DefaultRegistry)
+	successCounter  = metrics.GetOrRegisterCounter("accept.success", metrics.DefaultRegistry)
+	errorCounter    = metrics.GetOrRegisterCounter("accept.error", metrics.DefaultRegistry)
+	timeoutCounter  = metrics.GetOrRegisterCounter("accept.timeout", metrics.DefaultRegistry)
+	noRouteCounter  = metrics.GetOrRegisterCounter("accept.noroute", metrics.DefaultRegistry)
+	hookCounter     = metrics.GetOrRegisterCounter("accept.hook.failed", metrics.DefaultRegistry)
+	postHookCounter = metrics.GetOrRegisterCounter("accept.posthook.failed", metrics.DefaultRegistry)
+	handshakeTimer  = metrics.GetOrRegisterTimer("conn.handshake", metrics.DefaultRegistry)
+	connTimer       = metrics.GetOrRegisterTimer("conn.lifetime", metrics.DefaultRegistry)
+
+	// Bytes transferred from backend to client (downstream) and from client
+	// to backend (upstream), counted once each direction of a connection is done.
+	bytesCounters = [2]metrics.Counter{
+		metrics.GetOrRegisterCounter("conn.bytes.downstream", metrics.DefaultRegistry),
+		metrics.GetOrRegisterCounter("conn.bytes.upstream", metrics.DefaultRegistry),
+	}
 )
 
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		// TODO maybe different buffer size?
-		// benchmark pls
-		return make([]byte, 1<<16)
-	},
-}
 // Logger is used by this package to log messages
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -53,6 +58,23 @@ type Logger interface {
 // Dialer represents a function that can dial a backend/destination for forwarding connections.
 type Dialer func() (net.Conn, error)
 
+// Router selects the dialer to use for an incoming connection, after the TLS
+// handshake has completed (e.g. based on negotiated connection parameters).
+// It also returns the name of the selected route, for logs and metrics (empty
+// if the connection isn't routed anywhere special, e.g. to the default
+// target). If no dialer can be found for the connection, it should return
+// false and the connection will be closed.
+type Router func(conn net.Conn) (dial Dialer, route string, ok bool)
+
+// PreConnectHook is called before dialing the backend for a connection,
+// with the connection that went through the handshake. If it returns an
+// error, the connection is closed without dialing the backend.
+type PreConnectHook func(conn net.Conn) error
+
+// PostAcceptHook is called for every accepted connection once the handshake
+// completed. If it returns an error, the connection is closed.
+type PostAcceptHook func(conn net.Conn) error
+
 // Proxy will take incoming connections from a listener and forward them to
 // a backend through the given dialer.
 type Proxy struct {
@@ -62,43 +84,135 @@ type Proxy struct {
 	ConnectTimeout time.Duration
 	// Dial function to reach backend to forward connections to.
 	Dial Dialer
+	// Router (optional) selects a dialer per connection, overriding Dial.
+	Router Router
 	// Logger is used to log information messages about connections, errors.
 	Logger Logger
 
-	// Internal state to indicate that we want to shut down.
-	quit int32
+	// Internal state to indicate that we want to shut down, and that open
+	// connections were closed after the drain timeout.
+	quit        int32
+	forceClosed int32
 
-	proxyProtocol bool
+	// Context cancelled on shutdown, to abort handshakes still in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	// Internal wait group to keep track of outstanding handlers.
-	handlers *sync.WaitGroup
-}
+	// Mutex for swapping the listener while accepting.
+	listenerMu sync.Mutex
 
-func getProxyProtoHeaderFor(c net.Conn) *proxyproto.Header {
+	// Additional listeners to accept connections on (see AddListener).
+	extraListeners []net.Listener
 
-	sAddr := c.RemoteAddr().(*net.TCPAddr)
-	dAddr := c.LocalAddr().(*net.TCPAddr)
+	// Number of goroutines accepting connections on each listener.
+	acceptWorkers int
 
-	return &proxyproto.Header{
-		Version:            2,
-		Command:            proxyproto.PROXY,
-		TransportProtocol:  proxyproto.TCPv4,
-		SourceAddress:      sAddr.IP,
-		DestinationAddress: dAddr.IP,
-		SourcePort:         uint16(sAddr.Port),
-		DestinationPort:    uint16(dAddr.Port),
-	}
+	// PROXY protocol version to send to the backend (zero if disabled).
+	proxyProtocol int
+
+	// Don't log routine connection lifecycle messages.
+	quiet bool
+
+	// Always copy data in userspace, even if splicing is possible.
+	noSplice bool
+
+	// Pool of buffers for copying data in userspace.
+	buffers *bufferPool
+
+	// Accept rate limiter during warmup (nil if disabled).
+	warmup *warmupLimiter
+
+	// Limit on concurrent connections (nil if disabled).
+	limit *connLimiter
+	// Pauses or rejects connections while the backend is down (nil if disabled).
+	health *healthGate
+	// Delays or rejects connections over the accept rate (nil if disabled).
+	acceptRate *acceptRateLimiter
+
+	// Close connections without activity for this long (zero to disable).
+	idleTimeout time.Duration
+	// Close connections if the backend sends nothing for this long after
+	// connecting (zero to disable).
+	firstByteTimeout time.Duration
+
+	// Close connections after this long, minus up to a random fraction of
+	// lifetimeJitter (zero to disable).
+	maxLifetime    time.Duration
+	lifetimeJitter float64
+
+	// Number of retries and initial backoff for failed backend dials.
+	dialRetries int
+	dialBackoff time.Duration
+
+	// Bandwidth limit per connection (zero to disable), and buckets shared
+	// by all connections for each direction (nil to disable).
+	connRate      int64
+	connBurst     int64
+	globalBuckets [2]*tokenBucket
+
+	// Limit on data buffered for each direction of a connection (zero to
+	// disable), and whether to close connections over the limit.
+	bufferLimit      int
+	bufferLimitClose bool
+
+	// ALPN protocol for multiplexed connections (empty if disabled), and
+	// interval between keepalive pings on them.
+	multiplex          string
+	multiplexKeepAlive time.Duration
+
+	// Path of the WebSocket inside connections (empty if disabled, and
+	// connections carry data right after the handshake).
+	websocketPath string
+
+	// HTTP server for connections, if answering some requests ourselves
+	// (nil if disabled, and connections are proxied byte for byte).
+	inline *inlineServer
+
+	// Target to mirror client data to (nil if disabled).
+	shadow *shadowTarget
+	// Dialer for connections from the client address (nil if disabled).
+	transparent func(client net.Addr) (net.Conn, error)
+
+	// Called before dialing the backend (nil if disabled).
+	preConnect PreConnectHook
+	// Called once a connection went through the handshake (nil if disabled).
+	postAccept PostAcceptHook
+
+	// Close TLS 1.2 connections without the extended master secret.
+	requireEMS bool
+
+	// Fingerprints of ClientHellos, to include in logs (nil if disabled).
+	fingerprints *Fingerprints
+
+	// Report whether TCP connections use Multipath TCP, and TCP Fast Open.
+	multipathStats bool
+	fastOpenStats  bool
+
+	// Internal wait group to keep track of outstanding handlers.
+	handlers *sync.WaitGroup
+
+	// Open client connections, to close them if they don't drain in time,
+	// channel to close once they're all gone (while draining), and
+	// connections being forwarded (see Connections).
+	connsMu   sync.Mutex
+	conns     map[net.Conn]*connInfo
+	idle      chan struct{}
+	transfers map[*transfer]struct{}
 }
 
 // New creates a new proxy.
 func New(listener net.Listener, timeout time.Duration, dial Dialer, logger Logger) *Proxy {
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &Proxy{
 		Listener:       listener,
 		ConnectTimeout: timeout,
 		Dial:           dial,
 		Logger:         logger,
 		quit:           0,
+		ctx:            ctx,
+		cancel:         cancel,
 		handlers:       &sync.WaitGroup{},
+		buffers:        newBufferPool(DefaultBufferSize),
 	}
 
 	// Add one handler to the wait group, so that Wait() will always block until
@@ -109,8 +223,46 @@ func New(listener net.Listener, timeout time.Duration, dial Dialer, logger Logge
 	return p
 }
 
-func (p *Proxy) EnableProxyProtocol() {
-	p.proxyProtocol = true
+// EnableQuiet disables logging of routine connection lifecycle messages
+// (opening/closing pipes). Errors are still logged, and metrics are
+// unaffected.
+func (p *Proxy) EnableQuiet() {
+	p.quiet = true
+}
+
+// EnableWarmup limits the rate of accepted connections for the given duration
+// after the proxy starts, ramping up from a low rate to maxRate (connections per
+// second). This avoids overwhelming the backend with a thundering herd of
+// reconnecting clients after a restart.
+func (p *Proxy) EnableWarmup(duration time.Duration, maxRate float64) {
+	p.warmup = newWarmupLimiter(duration, maxRate)
+}
+
+// StartWarmup starts the warmup window (over), see EnableWarmup. Accept calls
+// it, call it again when clients are expected to reconnect all at once, e.g.
+// after closing their connections. Does nothing if warmup isn't enabled.
+func (p *Proxy) StartWarmup() {
+	if p.warmup == nil {
+		return
+	}
+	p.Logger.Printf("warming up, limiting accept rate for %s", p.warmup.duration)
+	p.warmup.restart()
+}
+
+// EnablePreConnectHook runs hook before dialing the backend for every
+// connection (including multiplexed streams), e.g. to open a firewall or
+// refresh credentials the backend needs. Connections are closed if it fails.
+func (p *Proxy) EnablePreConnectHook(hook PreConnectHook) {
+	p.preConnect = hook
+}
+
+// EnablePostAcceptHook runs hook for every accepted connection once the
+// handshake completed, before it's forwarded (or served inline), e.g. for
+// external logging or authorization. Connections are closed if it fails.
+// Multiplexed streams share the connection they arrive on, and aren't
+// passed to the hook on their own.
+func (p *Proxy) EnablePostAcceptHook(hook PostAcceptHook) {
+	p.postAccept = hook
 }
 
 // Shutdown tells the proxy to close the listener & stop accepting connections.
@@ -119,10 +271,38 @@ func (p *Proxy) Shutdown() {
 		return
 	}
 	atomic.StoreInt32(&p.quit, 1)
-	p.Listener.Close()
+	p.cancel()
+	p.limit.stop()
+	p.currentListener().Close()
+	for _, listener := range p.extraListeners {
+		listener.Close()
+	}
 	p.handlers.Done()
 }
 
+// SwapListener replaces the listener the proxy accepts connections on. The old
+// listener is closed, so no new connections are accepted on it, but existing
+// connections are unaffected and will keep running until they're done.
+func (p *Proxy) SwapListener(listener net.Listener) {
+	p.listenerMu.Lock()
+	old := p.Listener
+	p.Listener = listener
+	p.listenerMu.Unlock()
+
+	old.Close()
+
+	// If we raced with Shutdown(), make sure new listener is closed too.
+	if atomic.LoadInt32(&p.quit) == 1 {
+		listener.Close()
+	}
+}
+
+func (p *Proxy) currentListener() net.Listener {
+	p.listenerMu.Lock()
+	defer p.listenerMu.Unlock()
+	return p.Listener
+}
+
 // Wait until the proxy is shut down (listener closed, connections drained).
 // This function will block even if the proxy isn't in the accept loop yet,
 // so it's safe to concurrently run Accept() in a Goroutine and then immediately
@@ -132,150 +312,458 @@ func (p *Proxy) Wait() {
 }
 
 // Accept incoming connections and spawn Go routines to handle them and forward
-// the data to the backend. Will stop accepting connections if Shutdown() is called.
+// the data to the backend. Will stop accepting connections if Shutdown() is called,
+// and returns once all accept loops have stopped.
 // Run this in a Goroutine, call Wait() to block on proxy shutdown/connection drain.
 func (p *Proxy) Accept() {
+	p.StartWarmup()
+
+	workers := p.acceptWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	loops := &sync.WaitGroup{}
+	start := func(current func() net.Listener, tag *listenerTag) {
+		for i := 0; i < workers; i++ {
+			loops.Add(1)
+			go func() {
+				defer loops.Done()
+				p.acceptLoop(current, tag)
+			}()
+		}
+	}
+
+	if len(p.extraListeners) == 0 {
+		start(p.currentListener, nil)
+	} else {
+		for _, listener := range p.extraListeners {
+			listener := listener
+			start(func() net.Listener { return listener }, newListenerTag(listener))
+		}
+		start(p.currentListener, newListenerTag(p.currentListener()))
+	}
+	loops.Wait()
+}
+
+// SetAcceptWorkers sets the number of goroutines accepting connections on
+// each listener (one by default). Running several helps to drain the listen
+// queue faster under bursty load, as the next connection can be accepted
+// while another worker is still busy with the previous one. Must be called
+// before Accept.
+func (p *Proxy) SetAcceptWorkers(workers int) {
+	p.acceptWorkers = workers
+}
+
+// acceptLoop accepts connections on the listener returned by current (which
+// may change, see SwapListener) until the proxy is shut down. If set, tag is
+// the listener's name for logs and metrics.
+func (p *Proxy) acceptLoop(current func() net.Listener, tag *listenerTag) {
 	for {
+		if p.warmup != nil && p.warmup.wait() {
+			p.Logger.Printf("warmup complete, no longer limiting accept rate")
+		}
+		p.limit.wait()
+		p.health.wait(p.ctx)
+		p.acceptRate.wait(p.ctx)
+
 		// Wait for new connection
-		conn, err := p.Listener.Accept()
+		listener := current()
+		conn, err := listener.Accept()
 		if err != nil {
 			// Check if we're supposed to stop
 			if atomic.LoadInt32(&p.quit) == 1 {
 				return
 			}
 
+			// Check if listener was swapped, continue on new listener
+			if current() != listener {
+				continue
+			}
+
 			errorCounter.Inc(1)
 			continue
 		}
 
+		if !p.acceptRate.admit() {
+			logging.Debugf(p.Logger, "rejecting connection from %s, over accept rate", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		if !p.health.admit() {
+			logging.Debugf(p.Logger, "rejecting connection from %s, backend is down", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		if !p.limit.admit() {
+			logging.Debugf(p.Logger, "rejecting connection from %s, over concurrent connection limit", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
 		openCounter.Inc(1)
 		totalCounter.Inc(1)
+		tag.opened()
 
+		p.track(conn, tag)
 		go connTimer.Time(func() {
 			defer conn.Close()
+			defer p.untrack(conn)
 			defer openCounter.Dec(1)
+			defer tag.closed()
+			defer p.limit.release()
 
-			err := forceHandshake(p.ConnectTimeout, conn)
+			err := forceHandshake(p.ctx, p.ConnectTimeout, conn)
+			p.noteFingerprint(conn)
+			if err == context.Canceled {
+				logging.Debugf(p.Logger, "aborted TLS handshake from %s, shutting down", conn.RemoteAddr())
+				return
+			}
 			if err != nil {
 				errorCounter.Inc(1)
-				p.Logger.Printf("error on TLS handshake from %s: %s", conn.RemoteAddr(), err)
+				logging.Warnf(p.Logger, "error on TLS handshake from %s%s: %s", conn.RemoteAddr(), p.logSuffix(conn), err)
+				tarpitFailure(conn, err)
 				return
 			}
+			releaseHandshakeLimits(conn)
+			countNegotiated(conn)
+			if tlsConn, ok := conn.(*tls.Conn); ok && !p.admitEMS(tlsConn) {
+				logging.Warnf(p.Logger, "warning: closing connection from %s%s, %s without extended master secret", conn.RemoteAddr(), p.logSuffix(conn), tlsVersionName(tlsConn.ConnectionState().Version))
+				return
+			}
+			if logging.DebugEnabled(p.Logger) {
+				logHandshakeDetails(p.Logger, conn)
+			}
+			if p.postAccept != nil {
+				if err := p.postAccept(conn); err != nil {
+					postHookCounter.Inc(1)
+					logging.Warnf(p.Logger, "error: closing connection from %s%s: %s", conn.RemoteAddr(), p.logSuffix(conn), err)
+					return
+				}
+			}
 
-			backend, err := p.Dial()
-			if err != nil {
-				p.Logger.Printf("error: %s", err)
+			if p.multiplex != "" && negotiatedProtocol(conn) == p.multiplex {
+				successCounter.Inc(1)
+				p.handlers.Add(1)
+				defer p.handlers.Done()
+				p.serveMultiplexed(conn)
 				return
 			}
 
-			if p.proxyProtocol {
-				h := getProxyProtoHeaderFor(conn)
-				_, err = h.WriteTo(backend)
-				if err != nil {
-					p.Logger.Printf("error: %s", err)
+			if p.inline != nil {
+				successCounter.Inc(1)
+				p.handlers.Add(1)
+				defer p.handlers.Done()
+				p.inline.serve(conn)
+				return
+			}
+
+			if p.websocketPath != "" {
+				ws, ok := p.upgradeWebSocket(conn)
+				if !ok {
 					return
 				}
+				p.forward(ws, conn, successCounter)
+				return
 			}
 
-			successCounter.Inc(1)
-			p.handlers.Add(1)
-			defer p.handlers.Done()
-			p.fuse(conn, backend)
+			p.forward(conn, conn, successCounter)
 		})
 	}
 }
 
+// Dial the backend for a connection, and copy data between them until done.
+// Routing is based on parent, the connection that went through the handshake
+// (which is conn itself, unless conn is a multiplexed stream). The success
+// counter is incremented once the backend has been dialed.
+func (p *Proxy) forward(conn, parent net.Conn, success metrics.Counter) {
+	dial := p.Dial
+	if transparent := p.transparentDialer(parent); transparent != nil {
+		dial = transparent
+	}
+	var route *routeMetrics
+	if p.Router != nil {
+		var name string
+		var ok bool
+		dial, name, ok = p.Router(parent)
+		if !ok {
+			noRouteCounter.Inc(1)
+			logging.Warnf(p.Logger, "error: no route for connection from %s, closing", conn.RemoteAddr())
+			return
+		}
+		if name != "" {
+			route = newRouteMetrics(name)
+			p.setRoute(parent, route)
+		}
+	}
+
+	if p.preConnect != nil {
+		if err := p.preConnect(parent); err != nil {
+			hookCounter.Inc(1)
+			logging.Warnf(p.Logger, "error: closing connection from %s%s: %s", conn.RemoteAddr(), p.logSuffix(parent), err)
+			return
+		}
+	}
+
+	dialStart := time.Now()
+	backend, err := p.dialWithRetry(dial, conn)
+	if err != nil {
+		logging.Errorf(p.Logger, "error: %s", err)
+		return
+	}
+	logging.Debugf(p.Logger, "dialed backend %s:%s for %s in %s", backend.RemoteAddr().Network(), backend.RemoteAddr(), conn.RemoteAddr(), time.Since(dialStart))
+	countNegotiated(backend)
+
+	var header []byte
+	if p.proxyProtocol != 0 {
+		// Write the header in one go, before any client data.
+		header = proxyProtocolHeader(p.proxyProtocol, conn)
+		if _, err := backend.Write(header); err != nil {
+			logging.Errorf(p.Logger, "error: unable to write PROXY protocol header: %s", err)
+			backend.Close()
+			return
+		}
+	}
+
+	success.Inc(1)
+	p.handlers.Add(1)
+	defer p.handlers.Done()
+	t := p.startTransfer(conn, parent, backend, route)
+	defer p.finishTransfer(t)
+	p.fuse(conn, backend, t, p.shadow.start(conn, header))
+}
+
 // Force handshake. Handshake usually happens on first read/write, but we want
 // to force it to make sure we can control the timeout for it. Otherwise,
 // unauthenticated clients would be able to open connections and leave them
 // hanging forever. Going through the handshake verifies that clients have a
-// valid client cert and are allowed to talk to us.
-func forceHandshake(timeout time.Duration, conn net.Conn) error {
+// valid client cert and are allowed to talk to us. The handshake is aborted
+// (and the connection closed) once the timeout passes, or ctx is cancelled.
+func forceHandshake(ctx context.Context, timeout time.Duration, conn net.Conn) error {
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		startTime := time.Now()
 		defer handshakeTimer.UpdateSince(startTime)
 
-		// Set deadline to avoid blocking forever
-		err := tlsConn.SetDeadline(time.Now().Add(timeout))
-		if err != nil {
-			return err
-		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
 
-		err = tlsConn.Handshake()
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		err := tlsConn.HandshakeContext(ctx)
+		if err == context.DeadlineExceeded {
 			// If we timed out, increment timeout metric
 			timeoutCounter.Inc(1)
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			timeoutCounter.Inc(1)
 		}
+		return err
+	}
 
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		// Success: clear deadline
-		err = tlsConn.SetDeadline(time.Time{})
-		if err != nil {
-			return err
-		}
+// Log details about a completed TLS handshake (at debug level).
+func logHandshakeDetails(logger Logger, conn net.Conn) {
+	tlsConn, ok := conn.(tlsState)
+	if !ok {
+		return
 	}
 
-	return nil
+	state := tlsConn.ConnectionState()
+	logging.Debugf(logger,
+		"handshake from %s: version %s, cipher suite %s, protocol '%s', server name '%s', resumed %t, peer %s",
+		conn.RemoteAddr(),
+		tlsVersionName(state.Version),
+		tls.CipherSuiteName(state.CipherSuite),
+		state.NegotiatedProtocol,
+		state.ServerName,
+		state.DidResume,
+		peerIdentity(conn))
 }
 
-// Fuse connections together
-func (p *Proxy) fuse(client, backend net.Conn) {
-	// Copy from client -> backend, and from backend -> client
-	defer p.logConnectionMessage("closed", client, backend)
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case 0x0304:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("%#04x", version)
+}
+
+// Fuse connections together, mirroring client data to shadow (if not nil)
+func (p *Proxy) fuse(client, backend net.Conn, t *transfer, shadow *shadowStream) {
+	defer p.trackMultipath(client, backend)()
+	p.noteFastOpen(client, backend)
 	p.logConnectionMessage("opening", client, backend)
 
+	var idle *idleTracker
+	if p.idleTimeout > 0 {
+		idle = newIdleTracker(p.idleTimeout)
+		go idle.watch(client, backend)
+	}
+
+	// Connections without a maximum lifetime can still be closed via
+	// CloseConnections.
+	lifetime := newLifetimeTimer(p.connectionLifetime(), client, backend)
+	p.setLifetime(t, lifetime)
+
+	var firstByte *firstByteTimer
+	if p.firstByteTimeout > 0 {
+		firstByte = p.newFirstByteTimer(client, backend)
+	}
+
+	buffers := p.newBufferLimiter(client, backend)
+
+	// Copy from client -> backend, and from backend -> client
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
-	go func() { p.copyData(client, backend, wg) }()
-	go func() { p.copyData(backend, client, wg) }()
+	go func() { p.copyData(client, backend, idle, lifetime, firstByte, buffers, t, nil, 0, wg) }()
+	go func() { p.copyData(backend, client, idle, lifetime, firstByte, buffers, t, shadow, 1, wg) }()
 	wg.Wait()
+	lifetime.stop()
+	firstByte.stop()
+	shadow.close()
+
+	if buffers.tripped() {
+		logging.Warnf(p.Logger, "warning: closing connection from %s (peer %s), more than %d bytes buffered for a peer that isn't reading", client.RemoteAddr(), peerIdentity(client, backend), buffers.max)
+		p.logConnectionMessage("closed (buffer limit)", client, backend)
+		p.logTransfer(t, "buffer limit")
+		if idle != nil {
+			idle.stop()
+		}
+		return
+	}
+	if firstByte.timedOut() {
+		p.logConnectionMessage("closed (first byte timeout)", client, backend)
+		p.logTransfer(t, "first byte timeout")
+		if idle != nil {
+			idle.stop()
+		}
+		return
+	}
+	if idle.timedOut() {
+		p.logConnectionMessage("closed (idle timeout)", client, backend)
+		p.logTransfer(t, "idle timeout")
+		return
+	}
+	if idle != nil {
+		idle.stop()
+	}
+	if lifetime.closedByRequest() {
+		p.closeExpired(client, backend, lifetime)
+		p.logConnectionMessage("closed (on request)", client, backend)
+		p.logTransfer(t, "closed on request")
+		return
+	}
+	if lifetime.timedOut() {
+		p.closeExpired(client, backend, lifetime)
+		p.logConnectionMessage("closed (max lifetime)", client, backend)
+		p.logTransfer(t, "max lifetime")
+		return
+	}
+	client.Close()
+	backend.Close()
+	p.logConnectionMessage("closed", client, backend)
+	p.logTransfer(t, "")
 }
 
 // Copy data between two connections
-func (p *Proxy) copyData(dst net.Conn, src net.Conn, wg *sync.WaitGroup) {
+func (p *Proxy) copyData(dst net.Conn, src net.Conn, idle *idleTracker, lifetime *lifetimeTimer, firstByte *firstByteTimer, buffers *bufferLimiter, t *transfer, shadow *shadowStream, direction int, wg *sync.WaitGroup) {
 	defer wg.Done()
-	buf := bufferPool.Get().([]byte)
-	defer bufferPool.Put(buf)
 
-	_, err := io.CopyBuffer(dst, src, buf)
+	var reader io.Reader = src
+	if idle != nil {
+		reader = idle.reader(src, direction)
+	}
+	reader = firstByte.reader(reader, direction)
+	if buckets := p.rateLimiters(direction); buckets != nil {
+		reader = newThrottledReader(reader, buckets)
+	}
+	reader = buffers.reader(reader)
+	if shadow != nil {
+		reader = io.TeeReader(reader, shadow)
+	}
+	n, err := p.copyBuffer(buffers.writer(dst), reader, &t.bytes[direction])
+	t.done(direction, n, err)
 
-	if err != nil {
-		p.Logger.Printf("error: %s", err)
+	// Errors are expected if we closed the connection for being idle, for
+	// exceeding the buffer limit, or for a backend that never sent anything.
+	if err != nil && !idle.timedOut() && !lifetime.timedOut() && !buffers.tripped() && !firstByte.timedOut() {
+		logging.Warnf(p.Logger, "error: %s", err)
 	}
 
-	switch srcConn := src.(type) {
+	// Expired connections are shut down by closeExpired, after both copies
+	// have stopped.
+	if lifetime.timedOut() {
+		return
+	}
+
+	// Propagate the half-close: stop reading from src, and signal EOF to dst
+	// while the other direction keeps going (e.g. a client that shuts down
+	// its write side and then waits for the response). Both connections are
+	// closed by fuse once both directions are done.
+	closeRead(src)
+	closeWrite(dst)
+}
+
+// closeRead shuts down the reading side of a connection, if supported.
+func closeRead(conn net.Conn) {
+	switch c := conn.(type) {
 	case *net.TCPConn:
-		srcConn.SetLinger(0)
-		srcConn.CloseRead()
+		c.CloseRead()
 	case *net.UnixConn:
-		srcConn.CloseRead()
-	default:
-		src.Close()
+		c.CloseRead()
+	case *proxyProtocolConn:
+		closeRead(c.Conn)
+	case *handshakeLimitedConn:
+		closeRead(c.Conn)
+	case *tarpitConn:
+		closeRead(c.Conn)
 	}
+}
 
-	switch dstConn := dst.(type) {
+// closeWrite shuts down the writing side of a connection. For TLS, this sends
+// a close_notify alert, followed by a FIN on the underlying socket for peers
+// that don't look for the alert. Connections that can't be half-closed are
+// closed entirely.
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
 	case *net.TCPConn:
-		dstConn.SetLinger(0)
-		dstConn.CloseWrite()
+		c.CloseWrite()
 	case *tls.Conn:
-		dstConn.CloseWrite()
+		c.CloseWrite()
+		closeWrite(c.NetConn())
 	case *net.UnixConn:
-		dstConn.CloseWrite()
+		c.CloseWrite()
+	case *proxyProtocolConn:
+		closeWrite(c.Conn)
+	case *handshakeLimitedConn:
+		closeWrite(c.Conn)
+	case *tarpitConn:
+		closeWrite(c.Conn)
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
 	default:
-		dst.Close()
+		conn.Close()
 	}
 }
 
 // Log information message about connection
 func (p *Proxy) logConnectionMessage(action string, dst net.Conn, src net.Conn) {
+	if p.quiet {
+		return
+	}
 	p.Logger.Printf(
-		"%s pipe: %s:%s <-> %s:%s",
+		"%s pipe: %s:%s <-> %s:%s%s%s",
 		action,
 		dst.RemoteAddr().Network(),
 		dst.RemoteAddr().String(),
 		src.RemoteAddr().Network(),
-		src.RemoteAddr().String())
+		src.RemoteAddr().String(),
+		negotiatedDetails(dst, src),
+		p.logSuffix(dst))
 }
@@ -18,14 +18,28 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Elbandi/ghostunnel/sockopt"
+	"github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -96,6 +110,142 @@ func TestProxySuccess(t *testing.T) {
 	p.Wait()
 }
 
+func TestMultipleListeners(t *testing.T) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	second, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	p := New(first, 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.AddListener(second)
+	go p.Accept()
+
+	secondTag := newListenerTag(second)
+	accepted := secondTag.accepted.Count()
+
+	for _, listener := range []net.Listener{first, second} {
+		src, err := net.Dial("tcp", listener.Addr().String())
+		assert.Nil(t, err, "should be able to dial into proxy on %s", listener.Addr())
+		dst, err := target.Accept()
+		assert.Nil(t, err, "should receive connection from %s on target", listener.Addr())
+
+		src.Write([]byte("A"))
+		_, err = io.ReadFull(dst, make([]byte, 1))
+		assert.Nil(t, err, "should receive data from %s on target", listener.Addr())
+		src.Close()
+		dst.Close()
+	}
+	assert.Equal(t, accepted+1, secondTag.accepted.Count(), "should count connections per listener")
+	name := fmt.Sprintf("listener.tcp_127_0_0_1_%d.accept.total", second.Addr().(*net.TCPAddr).Port)
+	assert.NotNil(t, metrics.DefaultRegistry.Get(name), "should register metrics named after listener")
+
+	p.Shutdown()
+	p.Wait()
+
+	_, err = net.Dial("tcp", second.Addr().String())
+	assert.NotNil(t, err, "should close all listeners on shutdown")
+}
+
+func TestAcceptWorkers(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.SetAcceptWorkers(4)
+	accepting := make(chan struct{})
+	go func() {
+		p.Accept()
+		close(accepting)
+	}()
+
+	for i := 0; i < 8; i++ {
+		src, err := net.Dial("tcp", incoming.Addr().String())
+		assert.Nil(t, err, "should be able to dial into proxy")
+		dst, err := target.Accept()
+		assert.Nil(t, err, "should be able to receive connection on target")
+		src.Close()
+		dst.Close()
+	}
+
+	p.Shutdown()
+	select {
+	case <-accepting:
+	case <-time.After(time.Second):
+		t.Error("all accept workers should stop on shutdown")
+	}
+	p.Wait()
+}
+
+func TestPreConnectHook(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dials := int32(0)
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("should not dial backend")
+	}, &testLogger{})
+	hooked := make(chan net.Addr, 1)
+	p.EnablePreConnectHook(func(conn net.Conn) error {
+		hooked <- conn.RemoteAddr()
+		return errors.New("denied by hook")
+	})
+	go p.Accept()
+	defer p.Shutdown()
+
+	failed := hookCounter.Count()
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	assert.Equal(t, src.LocalAddr().String(), (<-hooked).String(), "should call hook with client connection")
+
+	_, err = ioutil.ReadAll(src)
+	assert.Nil(t, err, "client should see connection closed")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials), "should not dial backend if hook fails")
+	assert.Equal(t, failed+1, hookCounter.Count(), "should count failed hook")
+}
+
+func TestPostAcceptHook(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dials := int32(0)
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("should not dial backend")
+	}, &testLogger{})
+	hooked := make(chan net.Addr, 1)
+	p.EnablePostAcceptHook(func(conn net.Conn) error {
+		hooked <- conn.RemoteAddr()
+		return errors.New("denied by hook")
+	})
+	go p.Accept()
+	defer p.Shutdown()
+
+	failed := postHookCounter.Count()
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	assert.Equal(t, src.LocalAddr().String(), (<-hooked).String(), "should call hook with client connection")
+
+	_, err = ioutil.ReadAll(src)
+	assert.Nil(t, err, "client should see connection closed")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials), "should not dial backend if hook fails")
+	assert.Equal(t, failed+1, postHookCounter.Count(), "should count failed hook")
+}
+
 func TestBackendDialError(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.Nil(t, err, "should be able to listen on random port")
@@ -130,3 +280,1103 @@ func TestBackendDialError(t *testing.T) {
 	p.Shutdown()
 	p.Wait()
 }
+
+func TestSwapListener(t *testing.T) {
+	// Incoming listeners
+	oldListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	newListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(oldListener, 60*time.Second, dialer, &testLogger{})
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Open connection on old listener
+	src1, err := net.Dial("tcp", oldListener.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src1.Close()
+	dst1, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst1.Close()
+
+	p.SwapListener(newListener)
+
+	_, err = net.Dial("tcp", oldListener.Addr().String())
+	assert.NotNil(t, err, "old listener should be closed")
+
+	// Open connection on new listener
+	src2, err := net.Dial("tcp", newListener.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy on new listener")
+	defer src2.Close()
+	dst2, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst2.Close()
+
+	// Existing connection should still work
+	_, err = src1.Write([]byte("A"))
+	assert.Nil(t, err, "should be able to write to existing connection")
+	received := make([]byte, 1)
+	_, err = io.ReadFull(dst1, received)
+	assert.Nil(t, err, "should receive data on existing connection")
+	assert.Equal(t, []byte("A"), received)
+}
+
+func TestBackendDialRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	client, _ := net.Pipe()
+	defer client.Close()
+
+	attempts := 0
+	dialer := func() (net.Conn, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("failure for test")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+
+	p := New(ln, 60*time.Second, dialer, &testLogger{})
+	defer p.Shutdown()
+
+	saved := retrySuccessCounter.Count()
+
+	// No retries by default
+	_, err = p.dialWithRetry(dialer, client)
+	assert.NotNil(t, err, "should not retry by default")
+	assert.Equal(t, 1, attempts)
+
+	// Retry until dial succeeds
+	attempts = 0
+	p.EnableDialRetry(3, time.Millisecond)
+	backend, err := p.dialWithRetry(dialer, client)
+	assert.Nil(t, err, "should succeed after retrying")
+	backend.Close()
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, saved+1, retrySuccessCounter.Count(), "should count connections saved by retry")
+
+	// Give up after max retries
+	attempts = -10
+	_, err = p.dialWithRetry(dialer, client)
+	assert.NotNil(t, err, "should give up after max retries")
+	assert.Equal(t, -6, attempts)
+
+	// Bounded by connect timeout
+	attempts = -10
+	p.ConnectTimeout = 10 * time.Millisecond
+	p.EnableDialRetry(3, time.Second)
+	_, err = p.dialWithRetry(dialer, client)
+	assert.NotNil(t, err, "should not retry past connect timeout")
+	assert.Equal(t, -9, attempts)
+}
+
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *recordingLogger) Printf(format string, v ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, fmt.Sprintf(format, v...))
+}
+
+func TestQuietConnectionLogs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	p := New(nil, time.Second, nil, logger)
+
+	p.logConnectionMessage("opening", client, server)
+	assert.Equal(t, 1, len(logger.messages), "should log connection messages by default")
+
+	p.EnableQuiet()
+	p.logConnectionMessage("opening", client, server)
+	assert.Equal(t, 1, len(logger.messages), "should not log connection messages in quiet mode")
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	// Incoming listener
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener, accepting connections but never reading or writing
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableFirstByteTimeout(200 * time.Millisecond)
+	go p.Accept()
+	defer p.Shutdown()
+
+	timeouts := firstByteTimeoutCounter.Count()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	_, err = src.Write([]byte("hello"))
+	assert.Nil(t, err, "should be able to write to connection")
+
+	start := time.Now()
+	src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = src.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection to wedged backend should be closed")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection should be closed before read deadline")
+	}
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "should wait for the timeout")
+	assert.Equal(t, timeouts+1, firstByteTimeoutCounter.Count(), "should count first byte timeout")
+
+	// Backends that respond in time aren't affected by the timeout later on
+	src, err = net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	dst, err = target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	_, err = dst.Write([]byte("banner"))
+	assert.Nil(t, err, "should be able to write to connection")
+	_, err = io.ReadFull(src, make([]byte, 6))
+	assert.Nil(t, err, "should receive banner")
+
+	time.Sleep(400 * time.Millisecond)
+	_, err = src.Write([]byte("A"))
+	assert.Nil(t, err, "should be able to write to connection")
+	_, err = io.ReadFull(dst, make([]byte, 1))
+	assert.Nil(t, err, "connection should stay open after first byte")
+	assert.Equal(t, timeouts+1, firstByteTimeoutCounter.Count(), "should not time out after first byte")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// Incoming listener
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableIdleTimeout(100 * time.Millisecond)
+	go p.Accept()
+	defer p.Shutdown()
+
+	idle := idleTimeoutCounter.Count()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	// Activity within the timeout should keep connection alive
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err = src.Write([]byte("A"))
+		assert.Nil(t, err, "should be able to write to connection")
+		received := make([]byte, 1)
+		_, err = io.ReadFull(dst, received)
+		assert.Nil(t, err, "should receive data while active")
+	}
+
+	// Without activity, connection should get closed
+	src.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = src.Read(make([]byte, 1))
+	assert.NotNil(t, err, "idle connection should be closed")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection should be closed before read deadline")
+	}
+	assert.Equal(t, idle+1, idleTimeoutCounter.Count(), "should count idle timeout")
+}
+
+func TestMaxLifetime(t *testing.T) {
+	// Incoming listener
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	// Target listener
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableMaxLifetime(200*time.Millisecond, 0)
+	go p.Accept()
+	defer p.Shutdown()
+
+	expired := lifetimeExpiredCounter.Count()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	_, err = src.Write([]byte("A"))
+	assert.Nil(t, err, "should be able to write to connection")
+	received := make([]byte, 1)
+	_, err = io.ReadFull(dst, received)
+	assert.Nil(t, err, "should receive data before lifetime expires")
+
+	// Both sides should see a FIN once the lifetime has expired
+	for _, conn := range []net.Conn{src, dst} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "expired connection should be half-closed")
+	}
+	assert.Equal(t, expired+1, lifetimeExpiredCounter.Count(), "should count expired connection")
+}
+
+func TestCloseConnections(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	// Make sure data is being copied before closing.
+	src.Write([]byte("A"))
+	_, err = io.ReadFull(dst, make([]byte, 1))
+	assert.Nil(t, err, "should receive data")
+
+	assert.Equal(t, 1, p.CloseConnections(), "should close open connection")
+	for _, conn := range []net.Conn{src, dst} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "closed connection should be half-closed")
+	}
+
+	// New connections are still accepted.
+	src2, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src2.Close()
+	dst2, err := target.Accept()
+	assert.Nil(t, err, "should still proxy new connections")
+	dst2.Close()
+}
+
+// Backend that reads the whole request until EOF, and only then responds
+// (like HTTP/1.0 clients that shut down their write side).
+func respondAfterEOF(t *testing.T, target net.Listener) {
+	conn, err := target.Accept()
+	assert.Nil(t, err, "should be able to accept connection")
+	defer conn.Close()
+
+	request, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err, "should read request until EOF")
+	_, err = conn.Write(append([]byte("response to "), request...))
+	assert.Nil(t, err, "should be able to write response after EOF")
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{raw}, PrivateKey: key}},
+	}
+}
+
+// Writes a banner and half-closes before reading the request.
+func bannerThenRead(t *testing.T, target net.Listener) {
+	conn, err := target.Accept()
+	assert.Nil(t, err, "should be able to accept connection")
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("banner"))
+	assert.Nil(t, err, "should be able to write banner")
+	err = conn.(*net.TCPConn).CloseWrite()
+	assert.Nil(t, err, "should be able to half-close connection")
+
+	request, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err, "should read request after half-close")
+	assert.Equal(t, "request", string(request), "should receive full request")
+}
+
+func halfClose(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return c.CloseWrite()
+	case *tls.Conn:
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+func halfCloseTarpit() *Tarpit {
+	return NewTarpit(TarpitLimits{Failures: 3, Window: time.Minute, Duration: time.Second, MaxPeers: 10}, &testLogger{})
+}
+
+func TestHalfClose(t *testing.T) {
+	cases := []struct {
+		name   string
+		tls    bool
+		proxy  bool
+		listen func(net.Listener) net.Listener
+	}{
+		{name: "tcp"},
+		{name: "tls", tls: true},
+		{name: "tls with proxy protocol", tls: true, proxy: true, listen: func(l net.Listener) net.Listener {
+			return NewProxyProtocolListener(l, nil, &testLogger{})
+		}},
+		{name: "tls with handshake limits", tls: true, listen: func(l net.Listener) net.Listener {
+			return NewHandshakeLimiter(HandshakeLimits{MaxBytes: 512 << 10}, &testLogger{}).Listener(l)
+		}},
+		{name: "tls with tarpit", tls: true, listen: func(l net.Listener) net.Listener {
+			return halfCloseTarpit().Listener(l)
+		}},
+		{name: "tls with full listener chain", tls: true, proxy: true, listen: func(l net.Listener) net.Listener {
+			l = halfCloseTarpit().Listener(NewProxyProtocolListener(l, nil, &testLogger{}))
+			return NewHandshakeLimiter(HandshakeLimits{MaxBytes: 512 << 10}, &testLogger{}).Listener(l)
+		}},
+	}
+
+	for _, tc := range cases {
+		for _, backendFirst := range []bool{false, true} {
+			incoming, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Nil(t, err, "should be able to listen on random port")
+			listener := incoming
+			if tc.listen != nil {
+				listener = tc.listen(listener)
+			}
+			if tc.tls {
+				listener = tls.NewListener(listener, testTLSConfig(t))
+			}
+
+			target, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.Nil(t, err, "should be able to listen on random port")
+
+			p := New(listener, 60*time.Second, func() (net.Conn, error) {
+				return net.Dial("tcp", target.Addr().String())
+			}, &testLogger{})
+			go p.Accept()
+
+			done := make(chan struct{})
+			go func() {
+				if backendFirst {
+					bannerThenRead(t, target)
+				} else {
+					respondAfterEOF(t, target)
+				}
+				close(done)
+			}()
+
+			var conn net.Conn
+			conn, err = net.Dial("tcp", incoming.Addr().String())
+			assert.Nil(t, err, "should be able to dial")
+			if tc.proxy {
+				_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 8443\r\n"))
+				assert.Nil(t, err, "should be able to write PROXY header")
+			}
+			if tc.tls {
+				conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			}
+
+			if backendFirst {
+				banner, err := ioutil.ReadAll(conn)
+				assert.Nil(t, err, "should read banner until EOF (%s)", tc.name)
+				assert.Equal(t, "banner", string(banner), "should receive full banner (%s)", tc.name)
+
+				_, err = conn.Write([]byte("request"))
+				assert.Nil(t, err, "should be able to write request after EOF (%s)", tc.name)
+				assert.Nil(t, halfClose(conn), "should be able to half-close connection")
+			} else {
+				_, err = conn.Write([]byte("request"))
+				assert.Nil(t, err, "should be able to write request")
+				assert.Nil(t, halfClose(conn), "should be able to half-close connection")
+
+				response, err := ioutil.ReadAll(conn)
+				assert.Nil(t, err, "should read response after half-close (%s)", tc.name)
+				assert.Equal(t, "response to request", string(response), "should receive full response (%s)", tc.name)
+			}
+
+			<-done
+			conn.Close()
+			p.Shutdown()
+			target.Close()
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	for _, finish := range []bool{true, false} {
+		incoming, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err, "should be able to listen on random port")
+
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err, "should be able to listen on random port")
+
+		p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+			return net.Dial("tcp", target.Addr().String())
+		}, &testLogger{})
+		go p.Accept()
+
+		src, err := net.Dial("tcp", incoming.Addr().String())
+		assert.Nil(t, err, "should be able to dial")
+		dst, err := target.Accept()
+		assert.Nil(t, err, "should be able to accept connection")
+
+		// Make sure the connection is fully established
+		_, err = src.Write([]byte("A"))
+		assert.Nil(t, err)
+		_, err = dst.Read(make([]byte, 1))
+		assert.Nil(t, err)
+
+		if finish {
+			// Client finishes shortly after shutdown started
+			time.AfterFunc(50*time.Millisecond, func() {
+				src.Close()
+				dst.Close()
+			})
+		}
+
+		forced := drainClosedCounter.Count()
+		drained, closed := p.Drain(500 * time.Millisecond)
+		if finish {
+			assert.Equal(t, 1, drained, "should drain finished connection")
+			assert.Equal(t, 0, closed, "should not close any connections")
+		} else {
+			assert.Equal(t, 0, drained, "should not drain stuck connection")
+			assert.Equal(t, 1, closed, "should close stuck connection")
+			assert.Equal(t, forced+1, drainClosedCounter.Count(), "should count closed connection")
+
+			_, err = ioutil.ReadAll(src)
+			assert.Nil(t, err, "client should see connection closed")
+			src.Close()
+			dst.Close()
+		}
+
+		_, err = net.Dial("tcp", incoming.Addr().String())
+		assert.NotNil(t, err, "should not accept new connections")
+		p.Wait()
+		target.Close()
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(incoming, 60*time.Second, nil, &testLogger{})
+	p.Router = func(conn net.Conn) (Dialer, string, bool) {
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", target.Addr().String())
+		}, "sni:test.route", true
+	}
+	go p.Accept()
+
+	conns := metrics.GetOrRegisterCounter("route.sni_test_route.conn", metrics.DefaultRegistry)
+	downstream := metrics.GetOrRegisterCounter("route.sni_test_route.bytes.downstream", metrics.DefaultRegistry)
+	upstream := metrics.GetOrRegisterCounter("route.sni_test_route.bytes.upstream", metrics.DefaultRegistry)
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+
+	_, err = src.Write([]byte("A"))
+	assert.Nil(t, err)
+	_, err = dst.Read(make([]byte, 1))
+	assert.Nil(t, err)
+	_, err = dst.Write([]byte("BC"))
+	assert.Nil(t, err)
+	_, err = io.ReadFull(src, make([]byte, 2))
+	assert.Nil(t, err)
+
+	src.Close()
+	dst.Close()
+	p.Shutdown()
+	p.Wait()
+	target.Close()
+
+	assert.Equal(t, int64(1), conns.Count(), "should count routed connection")
+	assert.Equal(t, int64(1), upstream.Count(), "should count bytes sent to backend")
+	assert.Equal(t, int64(2), downstream.Count(), "should count bytes sent to client")
+}
+
+func TestBufferLimit(t *testing.T) {
+	for _, closeOnLimit := range []bool{false, true} {
+		if closeOnLimit && !sockopt.SupportsQueuedBytes() {
+			continue
+		}
+
+		incoming, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err, "should be able to listen on random port")
+
+		target, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err, "should be able to listen on random port")
+
+		p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+			return net.Dial("tcp", target.Addr().String())
+		}, &testLogger{})
+		p.EnableBufferLimit(64*1024, closeOnLimit)
+		go p.Accept()
+
+		src, err := net.Dial("tcp", incoming.Addr().String())
+		assert.Nil(t, err, "should be able to dial into proxy")
+		dst, err := target.Accept()
+		assert.Nil(t, err, "should be able to receive connection on target")
+
+		// Backend sends a lot of data, but the client doesn't read for a while.
+		const size = 16 * 1024 * 1024
+		written := make(chan error, 1)
+		go func() {
+			_, err := dst.Write(make([]byte, size))
+			written <- err
+		}()
+
+		tripped := bufferLimitCounter.Count()
+		if closeOnLimit {
+			select {
+			case err := <-written:
+				assert.NotNil(t, err, "backend should see connection closed")
+			case <-time.After(5 * time.Second):
+				t.Error("connection should be closed once buffer limit is exceeded")
+			}
+			_, err = ioutil.ReadAll(src)
+			assert.Equal(t, tripped+1, bufferLimitCounter.Count(), "should count connection over limit")
+		} else {
+			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-written:
+				t.Error("backend write should be blocked while client isn't reading")
+			default:
+			}
+			n, err := io.ReadFull(src, make([]byte, size))
+			assert.Nil(t, err, "client should receive all data once reading")
+			assert.Equal(t, size, n)
+			assert.Nil(t, <-written, "backend write should complete")
+			assert.Equal(t, tripped, bufferLimitCounter.Count(), "should not close connection in pause mode")
+		}
+
+		src.Close()
+		dst.Close()
+		p.Shutdown()
+		p.Wait()
+		target.Close()
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	listener := tls.NewListener(ln, testTLSConfig(t))
+	defer listener.Close()
+
+	// Client connects, but never sends a ClientHello
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	timeouts := timeoutCounter.Count()
+	err = forceHandshake(context.Background(), 50*time.Millisecond, conn)
+	assert.Equal(t, context.DeadlineExceeded, err, "should time out waiting for hanging client")
+	assert.Equal(t, timeouts+1, timeoutCounter.Count(), "should count timeout")
+}
+
+func TestShutdownAbortsHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(tls.NewListener(ln, testTLSConfig(t)), 60*time.Second, func() (net.Conn, error) {
+		return nil, errors.New("should not dial backend")
+	}, &testLogger{})
+	go p.Accept()
+
+	// Client connects, but never sends a ClientHello
+	client, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer client.Close()
+
+	for i := 0; i < 100 && p.Active() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, p.Active(), "should be in handshake")
+
+	// Handshake should be aborted right away, rather than running into the
+	// (long) handshake timeout or the drain timeout.
+	start := time.Now()
+	drained, closed := p.Drain(5 * time.Second)
+	assert.Equal(t, 1, drained, "should abort handshake on shutdown")
+	assert.Equal(t, 0, closed, "should not have to close connection after drain timeout")
+	assert.True(t, time.Since(start) < time.Second, "should not block drain")
+
+	_, err = ioutil.ReadAll(client)
+	assert.Nil(t, err, "client should see connection closed")
+}
+
+func TestConnectionLifetimeJitter(t *testing.T) {
+	p := &Proxy{}
+	p.EnableMaxLifetime(time.Hour, 0)
+	assert.Equal(t, time.Hour, p.connectionLifetime(), "no jitter should use exact lifetime")
+
+	p.EnableMaxLifetime(time.Hour, 0.25)
+	for i := 0; i < 100; i++ {
+		lifetime := p.connectionLifetime()
+		assert.True(t, lifetime <= time.Hour && lifetime >= 45*time.Minute, "jittered lifetime out of range: %s", lifetime)
+	}
+}
+
+func TestConnectionLimitPause(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableConnectionLimit(1, 0, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	first, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	firstBackend, err := target.Accept()
+	assert.Nil(t, err, "should receive first connection on target")
+	defer firstBackend.Close()
+	assert.Equal(t, int64(1), connActiveGauge.Value(), "should count active connection")
+
+	// Second connection sits in the listen queue while at the limit
+	second, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into listen queue")
+	defer second.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("should not forward connection while at the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closing the first connection should resume accepting
+	first.Close()
+	firstBackend.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("should forward connection once below the limit")
+	}
+}
+
+func TestConnectionLimitReject(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableConnectionLimit(1, 0, true)
+	go p.Accept()
+	defer p.Shutdown()
+
+	rejected := connRejectedCounter.Count()
+
+	first, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer first.Close()
+	firstBackend, err := target.Accept()
+	assert.Nil(t, err, "should receive first connection on target")
+	defer firstBackend.Close()
+
+	// Second connection should get closed immediately
+	second, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection over the limit should be closed")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection should be closed before read deadline")
+	}
+	assert.Equal(t, rejected+1, connRejectedCounter.Count(), "should count rejected connection")
+}
+
+func TestHealthGatePause(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	var healthy int32
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableHealthGate(func() bool { return atomic.LoadInt32(&healthy) == 1 }, false)
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Connection sits in the listen queue while the backend is down
+	conn, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into listen queue")
+	defer conn.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("should not forward connection while backend is down")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("should forward connection once backend is healthy")
+	}
+}
+
+func TestHealthGateReject(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dialer := func() (net.Conn, error) {
+		return nil, errors.New("should not dial backend")
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableHealthGate(func() bool { return false }, true)
+	go p.Accept()
+	defer p.Shutdown()
+
+	rejected := backendDownCounter.Count()
+
+	conn, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "connection should be closed while backend is down")
+	if netErr, ok := err.(net.Error); ok {
+		assert.False(t, netErr.Timeout(), "connection should be closed before read deadline")
+	}
+	assert.Equal(t, rejected+1, backendDownCounter.Count(), "should count rejected connection")
+}
+
+func TestHealthGateShutdown(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	p := New(incoming, 60*time.Second, nil, &testLogger{})
+	p.EnableHealthGate(func() bool { return false }, false)
+
+	done := make(chan struct{})
+	go func() {
+		p.Accept()
+		close(done)
+	}()
+	p.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept loop should stop on shutdown while paused")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(1000, 100)
+	assert.Equal(t, time.Duration(0), bucket.reserve(100), "should allow initial burst")
+
+	delay := bucket.reserve(50)
+	assert.True(t, delay > 40*time.Millisecond && delay <= 50*time.Millisecond, "should wait for refill, got %s", delay)
+
+	bucket = newTokenBucket(1000, 0)
+	assert.Equal(t, int64(1000), bucket.burst, "burst should default to one second")
+}
+
+func TestRateLimit(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	p.EnableRateLimit(20000, 1000, 0, 0)
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	upstream := bytesCounters[1].Count()
+
+	// 11kB at 20kB/s with 1kB burst should take at least 0.5s
+	start := time.Now()
+	go func() {
+		src.Write(make([]byte, 11000))
+		src.(*net.TCPConn).CloseWrite()
+	}()
+	received, err := ioutil.ReadAll(dst)
+	assert.Nil(t, err, "should receive data")
+	assert.Equal(t, 11000, len(received), "should receive all data")
+	assert.True(t, time.Since(start) >= 500*time.Millisecond, "transfer should be throttled, took %s", time.Since(start))
+
+	src.Close()
+	dst.Close()
+	p.Shutdown()
+	p.Wait()
+	assert.Equal(t, upstream+11000, bytesCounters[1].Count(), "should count throttled bytes")
+}
+
+func TestCanSplice(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	conn, err := net.Dial("tcp", target.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer conn.Close()
+
+	assert.Equal(t, spliceSupported, canSplice(conn, conn), "should splice between plain TCP connections if supported")
+	assert.False(t, canSplice(conn, &activityReader{conn, new(int64)}), "should not splice from wrapped reader")
+	assert.False(t, canSplice(tls.Client(conn, &tls.Config{}), conn), "should not splice to TLS connection")
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := newBufferPool(1024)
+
+	outstanding := buffersGauge.Value()
+	buf := pool.get()
+	assert.Equal(t, 1024, len(*buf), "should hand out buffers of configured size")
+	assert.Equal(t, outstanding+1, buffersGauge.Value(), "should count outstanding buffer")
+
+	pool.put(buf)
+	assert.Equal(t, outstanding, buffersGauge.Value(), "should count returned buffer")
+}
+
+// Measure throughput of proxying between plain TCP connections, with and
+// without splicing, and with different buffer sizes. Use -cpuprofile and
+// -memprofile to compare CPU and memory usage.
+func BenchmarkProxyThroughput(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkProxyThroughput(b, false, DefaultBufferSize)
+	})
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		size := size
+		b.Run(fmt.Sprintf("portable/%dKiB", size>>10), func(b *testing.B) {
+			benchmarkProxyThroughput(b, true, size)
+		})
+	}
+}
+
+func benchmarkProxyThroughput(b *testing.B, portable bool, bufferSize int) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 60*time.Second, dialer, &testLogger{})
+	if portable {
+		p.DisableSplice()
+	}
+	p.SetBufferSize(bufferSize)
+	p.EnableQuiet()
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	dst, err := target.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dst.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, dst)
+		close(done)
+	}()
+
+	chunk := make([]byte, 1<<16)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = src.Write(chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	src.Close()
+	<-done
+}
+
+// Accept throughput with bursts of concurrent clients, with one accept
+// goroutine (the default) or several.
+func BenchmarkAcceptWorkers(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		workers := workers
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			benchmarkAcceptWorkers(b, workers)
+		})
+	}
+}
+
+func benchmarkAcceptWorkers(b *testing.B, workers int) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, log.New(ioutil.Discard, "", 0))
+	p.SetAcceptWorkers(workers)
+	p.EnableQuiet()
+	go p.Accept()
+	defer p.Shutdown()
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn, err := net.Dial("tcp", incoming.Addr().String())
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			// Wait for the proxy to close the connection once the
+			// backend closes its end.
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	})
+}
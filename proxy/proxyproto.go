@@ -0,0 +1,202 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Versions of the PROXY protocol, see
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 constants (version/command, address families, TLVs).
+const (
+	ppV2Proxy = 0x21
+
+	ppV2Unspec = 0x00
+	ppV2TCPv4  = 0x11
+	ppV2TCPv6  = 0x21
+	ppV2Unix   = 0x31
+
+	ppV2UnixPathLen = 108
+
+	ppTypeALPN      = 0x01
+	ppTypeAuthority = 0x02
+	ppTypeSSL       = 0x20
+	ppSubtypeSSLVer = 0x21
+	ppSubtypeSSLCN  = 0x22
+
+	ppClientSSL      = 0x01
+	ppClientCertConn = 0x02
+)
+
+// EnableProxyProtocol sends a PROXY protocol header (v1 or v2) with the
+// address of the client to the backend, before any data from the client.
+func (p *Proxy) EnableProxyProtocol(version int) {
+	p.proxyProtocol = version
+}
+
+// proxyProtocolHeader builds the PROXY protocol header for a connection.
+func proxyProtocolHeader(version int, conn net.Conn) []byte {
+	if version == ProxyProtocolV1 {
+		return proxyHeaderV1(conn.RemoteAddr(), conn.LocalAddr())
+	}
+	return proxyHeaderV2(conn.RemoteAddr(), conn.LocalAddr(), tlsTLVs(conn))
+}
+
+// tcpAddrs returns the IPs and ports of both ends if they're TCP, and
+// whether they're both IPv4. Streams on QUIC connections have UDP addresses,
+// and are described as TCP connections, like the ones they're proxied to.
+func tcpAddrs(src, dst net.Addr) (srcAddr, dstAddr *net.TCPAddr, ipv4, ok bool) {
+	srcAddr, srcOk := asTCPAddr(src)
+	dstAddr, dstOk := asTCPAddr(dst)
+	if !srcOk || !dstOk {
+		return nil, nil, false, false
+	}
+	ipv4 = srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+	return srcAddr, dstAddr, ipv4, true
+}
+
+func asTCPAddr(addr net.Addr) (*net.TCPAddr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a, true
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}, true
+	}
+	return nil, false
+}
+
+// proxyHeaderV1 builds a v1 (human-readable) header. Mixed IPv4/IPv6 ends
+// are sent as IPv6, and anything else (e.g. UNIX sockets) as UNKNOWN.
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	srcAddr, dstAddr, ipv4, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if ipv4 {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcAddr.IP), ipv6String(dstAddr.IP), srcAddr.Port, dstAddr.Port))
+}
+
+// ipv6String formats an IP as IPv6, including IPv4-mapped addresses (which
+// net.IP would print in dotted form).
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// proxyHeaderV2 builds a v2 (binary) header, followed by the given TLVs.
+func proxyHeaderV2(src, dst net.Addr, tlvs []byte) []byte {
+	var family byte
+	var addrs bytes.Buffer
+
+	srcAddr, dstAddr, ipv4, ok := tcpAddrs(src, dst)
+	srcUnix, srcUnixOk := src.(*net.UnixAddr)
+	dstUnix, dstUnixOk := dst.(*net.UnixAddr)
+	switch {
+	case ok && ipv4:
+		family = ppV2TCPv4
+		addrs.Write(srcAddr.IP.To4())
+		addrs.Write(dstAddr.IP.To4())
+		binary.Write(&addrs, binary.BigEndian, uint16(srcAddr.Port))
+		binary.Write(&addrs, binary.BigEndian, uint16(dstAddr.Port))
+	case ok:
+		family = ppV2TCPv6
+		addrs.Write(srcAddr.IP.To16())
+		addrs.Write(dstAddr.IP.To16())
+		binary.Write(&addrs, binary.BigEndian, uint16(srcAddr.Port))
+		binary.Write(&addrs, binary.BigEndian, uint16(dstAddr.Port))
+	case srcUnixOk && dstUnixOk:
+		family = ppV2Unix
+		addrs.Write(unixPath(srcUnix))
+		addrs.Write(unixPath(dstUnix))
+	default:
+		// Receivers must use the real connection endpoints for AF_UNSPEC.
+		family = ppV2Unspec
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+	header.WriteByte(ppV2Proxy)
+	header.WriteByte(family)
+	binary.Write(&header, binary.BigEndian, uint16(addrs.Len()+len(tlvs)))
+	header.Write(addrs.Bytes())
+	header.Write(tlvs)
+	return header.Bytes()
+}
+
+// unixPath encodes a UNIX socket address as a fixed-size, zero-padded path.
+func unixPath(addr *net.UnixAddr) []byte {
+	path := make([]byte, ppV2UnixPathLen)
+	copy(path, addr.Name)
+	return path
+}
+
+// tlsTLVs describes the TLS session of a connection in v2 TLVs: negotiated
+// ALPN protocol, SNI, and TLS version and client certificate CN.
+func tlsTLVs(conn net.Conn) []byte {
+	tlsConn, ok := tlsConnection(conn)
+	if !ok || tlsConn == nil {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+
+	var tlvs bytes.Buffer
+	if state.NegotiatedProtocol != "" {
+		writeTLV(&tlvs, ppTypeALPN, []byte(state.NegotiatedProtocol))
+	}
+	if state.ServerName != "" {
+		writeTLV(&tlvs, ppTypeAuthority, []byte(state.ServerName))
+	}
+
+	// PP2_TYPE_SSL: client flags, verify result (zero means success), and
+	// sub-TLVs. Connections only get here once the handshake succeeded, so
+	// client certificates were verified.
+	var ssl bytes.Buffer
+	client := byte(ppClientSSL)
+	if len(state.PeerCertificates) > 0 {
+		client |= ppClientCertConn
+	}
+	ssl.WriteByte(client)
+	binary.Write(&ssl, binary.BigEndian, uint32(0))
+	writeTLV(&ssl, ppSubtypeSSLVer, []byte(tlsVersionName(state.Version)))
+	if len(state.PeerCertificates) > 0 {
+		writeTLV(&ssl, ppSubtypeSSLCN, []byte(state.PeerCertificates[0].Subject.CommonName))
+	}
+	writeTLV(&tlvs, ppTypeSSL, ssl.Bytes())
+
+	return tlvs.Bytes()
+}
+
+func writeTLV(buf *bytes.Buffer, kind byte, value []byte) {
+	buf.WriteByte(kind)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
@@ -0,0 +1,278 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	proxyHeaderErrorCounter = metrics.GetOrRegisterCounter("conn.proxyproto.invalid", metrics.DefaultRegistry)
+	untrustedCounter        = metrics.GetOrRegisterCounter("accept.proxyproto.untrusted", metrics.DefaultRegistry)
+)
+
+// Longest possible v1 header, including CRLF.
+const proxyHeaderV1MaxLen = 107
+
+var errMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+// NewProxyProtocolListener wraps a listener to expect a PROXY protocol header
+// (v1 or v2) at the start of every connection, e.g. from a load balancer in
+// front of us. Connections report the addresses from the header as their
+// remote and local address once it has been read, which happens on the first
+// read (i.e. as part of the TLS handshake). Connections with a missing or
+// malformed header fail on read. If trusted is not empty, connections from
+// peers outside of these networks are closed right away.
+func NewProxyProtocolListener(listener net.Listener, trusted []*net.IPNet, logger Logger) net.Listener {
+	return &proxyProtocolListener{listener, trusted, logger}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	logger  Logger
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			untrustedCounter.Inc(1)
+			logging.Warnf(l.logger, "rejecting connection from %s, not a trusted PROXY protocol source", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		return &proxyProtocolConn{Conn: conn}, nil
+	}
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn reads the PROXY protocol header from a connection before
+// the first read, and then reports the addresses from the header.
+type proxyProtocolConn struct {
+	net.Conn
+
+	once   sync.Once
+	err    error
+	reader io.Reader
+
+	mu               sync.Mutex
+	source, destAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the address of
+// the peer (load balancer) if the header hasn't been read yet or doesn't carry
+// an address (e.g. health checks).
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header, if any.
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.destAddr != nil {
+		return c.destAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	reader := bufio.NewReaderSize(c.Conn, 256)
+	source, dest, err := readProxyHeader(reader)
+	if err != nil {
+		proxyHeaderErrorCounter.Inc(1)
+		c.err = fmt.Errorf("invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), err)
+		return
+	}
+
+	// Hand over whatever we read past the header, then read directly.
+	c.reader = c.Conn
+	if reader.Buffered() > 0 {
+		buffered, _ := reader.Peek(reader.Buffered())
+		c.reader = io.MultiReader(bytes.NewReader(buffered), c.Conn)
+	}
+
+	c.mu.Lock()
+	c.source, c.destAddr = source, dest
+	c.mu.Unlock()
+}
+
+// readProxyHeader parses a v1 or v2 header. Addresses are nil if the header
+// doesn't carry any (UNKNOWN, LOCAL or UNSPEC).
+func readProxyHeader(r *bufio.Reader) (source, dest net.Addr, err error) {
+	// The shortest valid header (v1 UNKNOWN) is longer than the v2 signature.
+	start, err := r.Peek(len(proxyProtocolV2Signature))
+	if err == io.EOF {
+		return nil, nil, errMissingProxyHeader
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errMissingProxyHeader
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (source, dest net.Addr, err error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > proxyHeaderV1MaxLen {
+		return nil, nil, errors.New("v1 header too long")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header '%s'", line[:len(line)-2])
+	}
+
+	srcAddr, err := parseV1Address(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseV1Address(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseV1Address(protocol, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (protocol == "TCP4") != (ip.To4() != nil && !strings.Contains(host, ":")) {
+		return nil, fmt.Errorf("invalid %s address '%s' in v1 header", protocol, host)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s' in v1 header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (source, dest net.Addr, err error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d in v2 header", versionCommand>>4)
+	}
+	command := versionCommand & 0x0f
+	if command > 1 {
+		return nil, nil, fmt.Errorf("unsupported command %d in v2 header", command)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections are initiated by the proxy itself (e.g. health
+	// checks), and the address block (if any) must be ignored.
+	if command == 0 {
+		return nil, nil, nil
+	}
+
+	switch family {
+	case ppV2Unspec:
+		return nil, nil, nil
+	case ppV2TCPv4:
+		if length < 12 {
+			return nil, nil, errors.New("v2 header too short for TCP over IPv4")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:]))}, nil
+	case ppV2TCPv6:
+		if length < 36 {
+			return nil, nil, errors.New("v2 header too short for TCP over IPv6")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:]))}, nil
+	case ppV2Unix:
+		if length < 2*ppV2UnixPathLen {
+			return nil, nil, errors.New("v2 header too short for UNIX stream")
+		}
+		return &net.UnixAddr{Name: unixPathString(payload[:ppV2UnixPathLen]), Net: "unix"},
+			&net.UnixAddr{Name: unixPathString(payload[ppV2UnixPathLen : 2*ppV2UnixPathLen]), Net: "unix"}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported address family/transport %#02x in v2 header", family)
+}
+
+func unixPathString(path []byte) string {
+	if i := bytes.IndexByte(path, 0); i >= 0 {
+		path = path[:i]
+	}
+	return string(path)
+}
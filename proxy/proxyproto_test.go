@@ -0,0 +1,315 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	ppIPv4Src = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	ppIPv4Dst = &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 8443}
+	ppIPv6Src = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	ppIPv6Dst = &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8443}
+	ppUnixSrc = &net.UnixAddr{Name: "@", Net: "unix"}
+	ppUnixDst = &net.UnixAddr{Name: "/run/ghostunnel.sock", Net: "unix"}
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 8443\r\n", string(proxyHeaderV1(ppIPv4Src, ppIPv4Dst)))
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 8443\r\n", string(proxyHeaderV1(ppIPv6Src, ppIPv6Dst)))
+	assert.Equal(t, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 8443\r\n", string(proxyHeaderV1(ppIPv4Src, ppIPv6Dst)), "should map mixed families to IPv6")
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyHeaderV1(ppUnixSrc, ppUnixDst)))
+
+	udpSrc := &net.UDPAddr{IP: ppIPv4Src.IP, Port: ppIPv4Src.Port}
+	udpDst := &net.UDPAddr{IP: ppIPv4Dst.IP, Port: ppIPv4Dst.Port}
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 8443\r\n", string(proxyHeaderV1(udpSrc, udpDst)), "should describe QUIC streams as TCP")
+}
+
+func TestProxyHeaderV2IPv4(t *testing.T) {
+	expected := []byte{
+		0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a,
+		0x21, 0x11, 0x00, 0x0c,
+		0xc0, 0x00, 0x02, 0x01,
+		0xc6, 0x33, 0x64, 0x02,
+		0xdc, 0x04, 0x20, 0xfb,
+	}
+	assert.Equal(t, expected, proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil))
+}
+
+func TestProxyHeaderV2IPv6(t *testing.T) {
+	expected := []byte{
+		0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a,
+		0x21, 0x21, 0x00, 0x24,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		0xdc, 0x04, 0x20, 0xfb,
+	}
+	assert.Equal(t, expected, proxyHeaderV2(ppIPv6Src, ppIPv6Dst, nil))
+}
+
+func TestProxyHeaderV2Unix(t *testing.T) {
+	expected := []byte{
+		0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a,
+		0x21, 0x31, 0x00, 0xd8,
+	}
+	src := make([]byte, 108)
+	src[0] = '@'
+	dst := make([]byte, 108)
+	copy(dst, "/run/ghostunnel.sock")
+	expected = append(append(expected, src...), dst...)
+
+	assert.Equal(t, expected, proxyHeaderV2(ppUnixSrc, ppUnixDst, nil))
+}
+
+func TestProxyHeaderV2Unspec(t *testing.T) {
+	expected := []byte{
+		0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a,
+		0x21, 0x00, 0x00, 0x00,
+	}
+	assert.Equal(t, expected, proxyHeaderV2(ppIPv4Src, ppUnixDst, nil), "should fall back to UNSPEC for mixed TCP/UNIX")
+
+	expected = append(expected[:14], 0x00, 0x04, 0x02, 0x00, 0x01, 'x')
+	assert.Equal(t, expected, proxyHeaderV2(ppIPv4Src, ppUnixDst, []byte{0x02, 0x00, 0x01, 'x'}), "should count TLVs in length")
+}
+
+// recordingConn records the individual writes to a connection.
+type recordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte{}, b...))
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestProxyProtocolHeaderBeforeData(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	var backend *recordingConn
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", target.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		backend = &recordingConn{Conn: conn}
+		return backend, nil
+	}, &testLogger{})
+	p.EnableProxyProtocol(ProxyProtocolV2)
+	go p.Accept()
+	defer p.Shutdown()
+
+	// Send data right away, before the proxy even dialed the backend.
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	src.Write([]byte("data"))
+
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+	defer dst.Close()
+
+	header := proxyHeaderV2(src.LocalAddr(), src.RemoteAddr(), nil)
+	received := make([]byte, len(header)+4)
+	_, err = io.ReadFull(dst, received)
+	assert.Nil(t, err, "should receive header and data")
+	assert.Equal(t, header, received[:len(header)], "should receive header first")
+	assert.Equal(t, "data", string(received[len(header):]), "should receive data after header")
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.True(t, len(backend.writes) > 0 && bytes.Equal(header, backend.writes[0]), "should write header in a single write")
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range []struct {
+		header    []byte
+		src, dst  net.Addr
+		extraData string
+	}{
+		{proxyHeaderV1(ppIPv4Src, ppIPv4Dst), ppIPv4Src, ppIPv4Dst, "data"},
+		{proxyHeaderV1(ppIPv6Src, ppIPv6Dst), ppIPv6Src, ppIPv6Dst, "data"},
+		{proxyHeaderV1(ppUnixSrc, ppUnixDst), nil, nil, "data"},
+		{proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil), ppIPv4Src, ppIPv4Dst, "data"},
+		{proxyHeaderV2(ppIPv6Src, ppIPv6Dst, []byte{0x02, 0x00, 0x01, 'x'}), ppIPv6Src, ppIPv6Dst, "data"},
+		{proxyHeaderV2(ppUnixSrc, ppUnixDst, nil), ppUnixSrc, ppUnixDst, ""},
+		{proxyHeaderV2(ppIPv4Src, ppUnixDst, nil), nil, nil, "data"},
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(test.header, test.extraData...)))
+		src, dst, err := readProxyHeader(r)
+		assert.Nil(t, err, "should parse header %q", test.header)
+		assert.Equal(t, fmt.Sprint(test.src), fmt.Sprint(src), "should read source address from %q", test.header)
+		assert.Equal(t, fmt.Sprint(test.dst), fmt.Sprint(dst), "should read destination address from %q", test.header)
+
+		rest, _ := ioutil.ReadAll(r)
+		assert.Equal(t, test.extraData, string(rest), "should not consume data after header")
+	}
+}
+
+func TestReadProxyHeaderLocal(t *testing.T) {
+	header := proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil)
+	header[12] = 0x20
+	src, dst, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+	assert.Nil(t, err, "should accept LOCAL command")
+	assert.Nil(t, src, "should ignore addresses for LOCAL command")
+	assert.Nil(t, dst, "should ignore addresses for LOCAL command")
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	truncated := proxyHeaderV2(ppIPv6Src, ppIPv6Dst, nil)
+	truncated = truncated[:len(truncated)-4]
+	badVersion := proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil)
+	badVersion[12] = 0x31
+	badFamily := proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil)
+	badFamily[13] = 0x41
+	shortAddress := proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil)
+	shortAddress[13] = ppV2TCPv6
+
+	for _, header := range [][]byte{
+		[]byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00"),
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+		[]byte("PROXY"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n"),
+		[]byte("PROXY TCP4 2001:db8::1 198.51.100.2 56324 8443\r\n"),
+		[]byte("PROXY TCP6 192.0.2.1 2001:db8::2 56324 8443\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 65536\r\n"),
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 8443\n"),
+		[]byte("PROXY UDP4 192.0.2.1 198.51.100.2 56324 8443\r\n"),
+		[]byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"),
+		truncated,
+		badVersion,
+		badFamily,
+		shortAddress,
+	} {
+		_, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+		assert.NotNil(t, err, "should reject header %q", header)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	listener := tls.NewListener(NewProxyProtocolListener(ln, nil, &testLogger{}), testTLSConfig(t))
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write(proxyHeaderV2(ppIPv4Src, ppIPv4Dst, nil))
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		client.Write([]byte("data"))
+		client.Close()
+	}()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	err = forceHandshake(context.Background(), time.Second, conn)
+	assert.Nil(t, err, "should complete handshake after header")
+	assert.Equal(t, ppIPv4Src.String(), conn.RemoteAddr().String(), "should report source address from header")
+	assert.Equal(t, ppIPv4Dst.String(), conn.LocalAddr().String(), "should report destination address from header")
+
+	data, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err, "should read data after handshake")
+	assert.Equal(t, "data", string(data))
+
+	// Should carry over the client address when sending a header downstream
+	header := proxyProtocolHeader(ProxyProtocolV1, conn)
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 8443\r\n", string(header))
+}
+
+func TestProxyProtocolListenerMissingHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	listener := tls.NewListener(NewProxyProtocolListener(ln, nil, &testLogger{}), testTLSConfig(t))
+	defer listener.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection")
+	defer conn.Close()
+
+	invalid := proxyHeaderErrorCounter.Count()
+	err = forceHandshake(context.Background(), time.Second, conn)
+	assert.NotNil(t, err, "should reject connection without header")
+	assert.Equal(t, invalid+1, proxyHeaderErrorCounter.Count(), "should count invalid header")
+}
+
+func TestProxyProtocolListenerTrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	_, untrusted, _ := net.ParseCIDR("10.0.0.0/8")
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	listener := NewProxyProtocolListener(ln, []*net.IPNet{untrusted}, &testLogger{})
+	defer listener.Close()
+
+	before := untrustedCounter.Count()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer conn.Close()
+
+	accepted := make(chan struct{})
+	go func() {
+		if c, err := listener.Accept(); err == nil {
+			c.Close()
+		}
+		close(accepted)
+	}()
+
+	// Untrusted connection should be closed without being returned
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "should close untrusted connection")
+	assert.Equal(t, before+1, untrustedCounter.Count(), "should count untrusted connection")
+	listener.Close()
+	<-accepted
+
+	l := &proxyProtocolListener{trusted: []*net.IPNet{untrusted, trusted}}
+	assert.True(t, l.isTrusted(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}))
+	assert.False(t, l.isTrusted(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	assert.False(t, l.isTrusted(&net.UnixAddr{Name: "@", Net: "unix"}))
+}
@@ -0,0 +1,141 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var throttledCounter = metrics.GetOrRegisterCounter("conn.throttled", metrics.DefaultRegistry)
+
+// EnableRateLimit limits the bandwidth of each proxied connection to perConn
+// bytes per second, and of all connections combined to global bytes per
+// second. Limits apply independently to each direction. The bursts give the
+// number of bytes that may be transferred at once; if zero, they default to
+// one second worth of data. A zero rate disables that level of limiting.
+func (p *Proxy) EnableRateLimit(perConn, perConnBurst, global, globalBurst int64) {
+	p.connRate = perConn
+	p.connBurst = perConnBurst
+	if global > 0 {
+		p.globalBuckets = [2]*tokenBucket{
+			newTokenBucket(global, globalBurst),
+			newTokenBucket(global, globalBurst),
+		}
+	}
+}
+
+// rateLimiters returns the buckets to apply to the given direction of a new
+// connection (nil if rate limiting is disabled).
+func (p *Proxy) rateLimiters(direction int) []*tokenBucket {
+	buckets := []*tokenBucket{}
+	if p.connRate > 0 {
+		buckets = append(buckets, newTokenBucket(p.connRate, p.connBurst))
+	}
+	if global := p.globalBuckets[direction]; global != nil {
+		buckets = append(buckets, global)
+	}
+	if len(buckets) == 0 {
+		return nil
+	}
+	return buckets
+}
+
+// tokenBucket is a token bucket rate limiter. Callers reserve tokens up front,
+// which may drive the bucket negative, and then sleep until the debt has been
+// refilled. This never busy-waits, and keeps concurrent callers in order.
+type tokenBucket struct {
+	rate  float64
+	burst int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket, and returns how long the caller has
+// to wait before they're available.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledReader limits the rate at which data can be read from a reader.
+type throttledReader struct {
+	io.Reader
+	buckets []*tokenBucket
+	// Maximum number of bytes per read (smallest burst).
+	max int
+}
+
+func newThrottledReader(src io.Reader, buckets []*tokenBucket) *throttledReader {
+	max := int(buckets[0].burst)
+	for _, bucket := range buckets[1:] {
+		if int(bucket.burst) < max {
+			max = int(bucket.burst)
+		}
+	}
+	return &throttledReader{src, buckets, max}
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > r.max {
+		b = b[:r.max]
+	}
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		var wait time.Duration
+		for _, bucket := range r.buckets {
+			if delay := bucket.reserve(n); delay > wait {
+				wait = delay
+			}
+		}
+		if wait > 0 {
+			throttledCounter.Inc(1)
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var retrySuccessCounter = metrics.GetOrRegisterCounter("accept.retry.success", metrics.DefaultRegistry)
+
+// EnableDialRetry retries failed backend dials up to the given number of times,
+// with exponential backoff starting at the given duration. The total time
+// spent dialing (including backoff) is bounded by the connect timeout.
+func (p *Proxy) EnableDialRetry(retries int, backoff time.Duration) {
+	p.dialRetries = retries
+	p.dialBackoff = backoff
+}
+
+// Dial backend, retrying as configured with EnableDialRetry.
+func (p *Proxy) dialWithRetry(dial Dialer, client net.Conn) (net.Conn, error) {
+	deadline := time.Now().Add(p.ConnectTimeout)
+	backoff := p.dialBackoff
+
+	for attempt := 1; ; attempt++ {
+		backend, err := dial()
+		if err == nil {
+			if attempt > 1 {
+				retrySuccessCounter.Inc(1)
+				logging.Debugf(p.Logger, "dialed backend for %s on attempt %d", client.RemoteAddr(), attempt)
+			}
+			return backend, nil
+		}
+
+		if attempt > p.dialRetries {
+			return nil, err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			logging.Debugf(p.Logger, "not retrying backend dial for %s, would exceed connect timeout", client.RemoteAddr())
+			return nil, err
+		}
+
+		logging.Debugf(p.Logger, "error dialing backend for %s (attempt %d of %d), retrying in %s: %s", client.RemoteAddr(), attempt, p.dialRetries+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,49 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+// routeMetrics counts connections and bytes transferred on one route (see
+// Router). A nil value does nothing, for connections that aren't routed.
+type routeMetrics struct {
+	name  string
+	conns metrics.Counter
+	bytes [2]metrics.Counter
+}
+
+func newRouteMetrics(name string) *routeMetrics {
+	prefix := labeledMetricPrefix("route", name)
+	route := &routeMetrics{
+		name:  name,
+		conns: metrics.GetOrRegisterCounter(prefix+".conn", metrics.DefaultRegistry),
+		bytes: [2]metrics.Counter{
+			metrics.GetOrRegisterCounter(prefix+".bytes.downstream", metrics.DefaultRegistry),
+			metrics.GetOrRegisterCounter(prefix+".bytes.upstream", metrics.DefaultRegistry),
+		},
+	}
+	route.conns.Inc(1)
+	return route
+}
+
+func (r *routeMetrics) addBytes(direction int, n int64) {
+	if r != nil {
+		r.bytes[direction].Inc(n)
+	}
+}
@@ -0,0 +1,206 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	shadowConnCounter    = metrics.GetOrRegisterCounter("shadow.conn", metrics.DefaultRegistry)
+	shadowErrorCounter   = metrics.GetOrRegisterCounter("shadow.error", metrics.DefaultRegistry)
+	shadowBytesCounter   = metrics.GetOrRegisterCounter("shadow.bytes", metrics.DefaultRegistry)
+	shadowDroppedCounter = metrics.GetOrRegisterCounter("shadow.dropped", metrics.DefaultRegistry)
+)
+
+// How long to keep writing buffered data to a shadow target after the client
+// connection closed.
+var shadowFlushTimeout = 5 * time.Second
+
+// EnableShadow mirrors the data clients send on proxied connections to a
+// shadow target, dialed with dial for every connection. Anything the shadow
+// target sends back is discarded. Up to bufferSize bytes per connection are
+// buffered for a shadow target that is slow (or still connecting); once the
+// buffer overflows, the shadow connection is closed and further data is
+// dropped, so that the shadow never holds up the actual backend connection.
+func (p *Proxy) EnableShadow(dial func() (net.Conn, error), bufferSize int) {
+	p.shadow = &shadowTarget{
+		dial:   dial,
+		size:   bufferSize,
+		logger: p.Logger,
+	}
+}
+
+type shadowTarget struct {
+	dial   func() (net.Conn, error)
+	size   int
+	logger Logger
+}
+
+// start mirroring a connection, starting with the given data (e.g. a PROXY
+// protocol header). Returns nil if shadowing is disabled.
+func (s *shadowTarget) start(client net.Conn, header []byte) *shadowStream {
+	if s == nil {
+		return nil
+	}
+	stream := &shadowStream{
+		target: s,
+		client: client,
+		buf:    append([]byte{}, header...),
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	go stream.run()
+	return stream
+}
+
+// shadowStream buffers data for a shadow connection, and writes it out in
+// the background.
+type shadowStream struct {
+	target *shadowTarget
+	client net.Conn
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+	buf  []byte
+	// Set once the client is done sending (closed), or once we gave up on the
+	// shadow connection (failed).
+	closed bool
+	failed bool
+}
+
+// Write buffers data for the shadow connection. It never blocks on the shadow
+// target and never fails, so that it can be used with io.TeeReader.
+func (s *shadowStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failed {
+		shadowDroppedCounter.Inc(int64(len(b)))
+		return len(b), nil
+	}
+	if len(s.buf)+len(b) > s.target.size {
+		shadowDroppedCounter.Inc(int64(len(s.buf) + len(b)))
+		logging.Warnf(s.target.logger, "warning: shadow target for %s is falling behind, more than %d bytes buffered, closing shadow connection", s.client.RemoteAddr(), s.target.size)
+		s.fail()
+		return len(b), nil
+	}
+	s.buf = append(s.buf, b...)
+	s.cond.Signal()
+	return len(b), nil
+}
+
+// close marks the client as done. Buffered data is still written out, for at
+// most shadowFlushTimeout.
+func (s *shadowStream) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.SetWriteDeadline(time.Now().Add(shadowFlushTimeout))
+	}
+	s.cond.Signal()
+}
+
+// fail gives up on the shadow connection, dropping buffered data. Must be
+// called with the mutex held.
+func (s *shadowStream) fail() {
+	s.failed = true
+	s.buf = nil
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.cond.Signal()
+}
+
+// Dial the shadow target, and write out buffered data until the client is
+// done or we failed.
+func (s *shadowStream) run() {
+	conn, err := s.target.dial()
+	if err != nil {
+		shadowErrorCounter.Inc(1)
+		logging.Warnf(s.target.logger, "warning: unable to dial shadow target for %s: %s", s.client.RemoteAddr(), err)
+		s.mu.Lock()
+		shadowDroppedCounter.Inc(int64(len(s.buf)))
+		s.fail()
+		s.mu.Unlock()
+		return
+	}
+	shadowConnCounter.Inc(1)
+	defer conn.Close()
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(drained)
+	}()
+
+	s.mu.Lock()
+	if s.failed {
+		s.mu.Unlock()
+		return
+	}
+	s.conn = conn
+	if s.closed {
+		conn.SetWriteDeadline(time.Now().Add(shadowFlushTimeout))
+	}
+	for {
+		for len(s.buf) == 0 && !s.closed && !s.failed {
+			s.cond.Wait()
+		}
+		if s.failed {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.buf) == 0 {
+			// Done. Closing with unread responses would reset the connection,
+			// so half-close and keep discarding until the target closes too.
+			s.mu.Unlock()
+			closeWrite(conn)
+			conn.SetReadDeadline(time.Now().Add(shadowFlushTimeout))
+			<-drained
+			return
+		}
+		data := s.buf
+		s.buf = nil
+		s.mu.Unlock()
+
+		n, err := conn.Write(data)
+		shadowBytesCounter.Inc(int64(n))
+
+		s.mu.Lock()
+		if err != nil {
+			if !s.failed {
+				shadowErrorCounter.Inc(1)
+				shadowDroppedCounter.Inc(int64(len(data) - n + len(s.buf)))
+				logging.Warnf(s.target.logger, "warning: error writing to shadow target for %s: %s", s.client.RemoteAddr(), err)
+				s.fail()
+			}
+			s.mu.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowMirrorsClientData(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	shadow, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer shadow.Close()
+
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.EnableShadow(func() (net.Conn, error) {
+		return net.Dial("tcp", shadow.Addr().String())
+	}, 1024)
+	go p.Accept()
+	defer p.Shutdown()
+
+	mirrored := shadowConnCounter.Count()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should receive connection on target")
+	defer dst.Close()
+	mirror, err := shadow.Accept()
+	assert.Nil(t, err, "should receive connection on shadow target")
+	defer mirror.Close()
+
+	// Shadow responses must not reach the client
+	mirror.Write([]byte("shadow"))
+	go func() {
+		io.Copy(dst, dst)
+		dst.(*net.TCPConn).CloseWrite()
+	}()
+
+	src.Write([]byte("hello"))
+	src.(*net.TCPConn).CloseWrite()
+
+	response, err := ioutil.ReadAll(src)
+	assert.Nil(t, err, "should read response from backend")
+	assert.Equal(t, "hello", string(response), "should only see backend response")
+
+	mirror.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(mirror)
+	assert.Nil(t, err, "shadow connection should be closed after client")
+	assert.Equal(t, "hello", string(data), "shadow should receive client data")
+	assert.Equal(t, mirrored+1, shadowConnCounter.Count(), "should count shadow connection")
+}
+
+func TestShadowOverflow(t *testing.T) {
+	dialed := make(chan struct{})
+	target := &shadowTarget{
+		dial: func() (net.Conn, error) {
+			// Never connects while the test writes data
+			<-dialed
+			return nil, errors.New("failure for test")
+		},
+		size:   10,
+		logger: &testLogger{},
+	}
+	defer close(dialed)
+
+	client, other := net.Pipe()
+	defer client.Close()
+	defer other.Close()
+
+	dropped := shadowDroppedCounter.Count()
+	stream := target.start(client, []byte("PROXY"))
+
+	n, err := stream.Write([]byte("12345"))
+	assert.Nil(t, err, "should buffer data")
+	assert.Equal(t, 5, n)
+	assert.Equal(t, dropped, shadowDroppedCounter.Count(), "should not drop data within buffer size")
+
+	n, err = stream.Write([]byte("6"))
+	assert.Nil(t, err, "should never fail writes")
+	assert.Equal(t, 1, n)
+	assert.Equal(t, dropped+11, shadowDroppedCounter.Count(), "should drop all buffered data on overflow")
+
+	stream.Write([]byte("789"))
+	assert.Equal(t, dropped+14, shadowDroppedCounter.Count(), "should drop data after overflow")
+	stream.close()
+}
+
+func TestShadowDialError(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, &testLogger{})
+	p.EnableShadow(func() (net.Conn, error) {
+		return nil, errors.New("failure for test")
+	}, 1024)
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should receive connection on target")
+	defer dst.Close()
+
+	src.Write([]byte("hello"))
+	received := make([]byte, 5)
+	dst.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(dst, received)
+	assert.Nil(t, err, "should forward data to backend despite shadow failure")
+	assert.Equal(t, "hello", string(received))
+}
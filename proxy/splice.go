@@ -0,0 +1,68 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"net"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var spliceCounter = metrics.GetOrRegisterCounter("conn.splice", metrics.DefaultRegistry)
+
+// DisableSplice forces the portable copy loop, even where the kernel could
+// move data between sockets directly (via splice(2) on Linux). Useful for
+// debugging.
+func (p *Proxy) DisableSplice() {
+	p.noSplice = true
+}
+
+// canSplice returns true if data can be copied from src to dst in the kernel,
+// via the ReadFrom fast path on *net.TCPConn. This requires both ends to be
+// plain sockets; TLS connections need their data to pass through userspace to
+// be encrypted or decrypted, so they always use the portable copy loop.
+func canSplice(dst net.Conn, src io.Reader) bool {
+	if !spliceSupported {
+		return false
+	}
+	if _, ok := dst.(*net.TCPConn); !ok {
+		return false
+	}
+	switch src.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// Copy from src to dst, splicing if possible and otherwise going through a
+// buffer from the pool. Bytes written are added to *written as they go, which
+// isn't possible while splicing (only the total is returned).
+func (p *Proxy) copyBuffer(dst net.Conn, src io.Reader, written *int64) (int64, error) {
+	if !p.noSplice && canSplice(dst, src) {
+		spliceCounter.Inc(1)
+		return dst.(*net.TCPConn).ReadFrom(src)
+	}
+
+	buf := p.buffers.get()
+	defer p.buffers.put(buf)
+
+	// Hide ReadFrom/WriteTo, which would otherwise let io.CopyBuffer bypass
+	// buf (and the splice setting).
+	return io.CopyBuffer(&countingWriter{dst, written}, struct{ io.Reader }{src}, *buf)
+}
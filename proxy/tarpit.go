@@ -0,0 +1,262 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	tarpitCounter      = metrics.GetOrRegisterCounter("accept.tarpit", metrics.DefaultRegistry)
+	tarpitPeersCounter = metrics.GetOrRegisterCounter("accept.tarpit.peers", metrics.DefaultRegistry)
+)
+
+var errTarpitted = errors.New("connection tarpitted after repeated authorization failures")
+
+// TarpitLimits configure a tarpit. All fields are required.
+type TarpitLimits struct {
+	// Number of authorization failures from the same source IP within Window
+	// after which its connections are tarpitted (for another Window).
+	Failures int
+	Window   time.Duration
+	// How long tarpitted connections are held open before closing them.
+	Duration time.Duration
+	// Maximum number of source IPs tracked, and of connections held open
+	// at once (further ones are closed right away).
+	MaxPeers int
+	// Returns true if a handshake error is an authorization failure.
+	Unauthorized func(err error) bool
+}
+
+// Tarpit slows down peers that keep failing authorization (e.g. clients with
+// the wrong certificate retrying in a loop): once a source IP had too many
+// failed handshakes, its connections are held open without reading from them
+// for a while, and then closed, instead of going through the handshake.
+// Listeners wrapped by the same tarpit share what they know about peers,
+// and must be wrapped in a TLS listener. The proxy reports failed handshakes.
+type Tarpit struct {
+	limits TarpitLimits
+	logger Logger
+
+	mu    sync.Mutex
+	peers map[string]*tarpitPeer
+	// Number of connections held open.
+	held int
+}
+
+type tarpitPeer struct {
+	// Authorization failures since start of the current window.
+	failures int
+	start    time.Time
+	// Connections are tarpitted until then (zero if not tarpitted).
+	until time.Time
+}
+
+// NewTarpit creates a tarpit with the given limits.
+func NewTarpit(limits TarpitLimits, logger Logger) *Tarpit {
+	return &Tarpit{
+		limits: limits,
+		logger: logger,
+		peers:  map[string]*tarpitPeer{},
+	}
+}
+
+// Listener wraps a listener to tarpit connections from peers that failed
+// authorization too often.
+func (t *Tarpit) Listener(listener net.Listener) net.Listener {
+	return &tarpitListener{listener, t}
+}
+
+// tarpitted returns true if connections from addr should be tarpitted.
+func (t *Tarpit) tarpitted(addr net.Addr) bool {
+	ip, ok := tarpitKey(addr)
+	if !ok {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peer, ok := t.peers[ip]
+	return ok && time.Now().Before(peer.until)
+}
+
+// fail records an authorization failure from addr (with the given peer
+// identity, for logs).
+func (t *Tarpit) fail(addr net.Addr, identity string) {
+	ip, ok := tarpitKey(addr)
+	if !ok {
+		return
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peer, ok := t.peers[ip]
+	if !ok {
+		if len(t.peers) >= t.limits.MaxPeers {
+			t.evict(now)
+		}
+		peer = &tarpitPeer{start: now}
+		t.peers[ip] = peer
+	}
+	if now.Sub(peer.start) > t.limits.Window {
+		peer.failures = 0
+		peer.start = now
+	}
+	peer.failures++
+	if peer.failures >= t.limits.Failures && !now.Before(peer.until) {
+		peer.until = now.Add(t.limits.Window)
+		tarpitPeersCounter.Inc(1)
+		logging.Warnf(t.logger, "tarpitting connections from %s for %s, after %d authorization failures (peer %s)", ip, t.limits.Window, peer.failures, identity)
+	}
+}
+
+// Drop expired peers to make room for a new one. If none expired, the one
+// whose window started first is dropped. Called with mu held.
+func (t *Tarpit) evict(now time.Time) {
+	var oldest string
+	for ip, peer := range t.peers {
+		if now.Sub(peer.start) > t.limits.Window && !now.Before(peer.until) {
+			delete(t.peers, ip)
+			continue
+		}
+		if oldest == "" || peer.start.Before(t.peers[oldest].start) {
+			oldest = ip
+		}
+	}
+	if len(t.peers) >= t.limits.MaxPeers && oldest != "" {
+		delete(t.peers, oldest)
+	}
+}
+
+// hold keeps a tarpitted connection open (unless too many are held already),
+// and closes it once the tarpit duration passed or closed is closed.
+func (t *Tarpit) hold(conn net.Conn, closed <-chan struct{}) {
+	tarpitCounter.Inc(1)
+	logging.Debugf(t.logger, "tarpitting connection from %s", conn.RemoteAddr())
+	defer conn.Close()
+
+	t.mu.Lock()
+	if t.held >= t.limits.MaxPeers {
+		t.mu.Unlock()
+		return
+	}
+	t.held++
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.held--
+		t.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(t.limits.Duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-closed:
+	}
+}
+
+// Source IP of a connection, to track peers by.
+func tarpitKey(addr net.Addr) (string, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return "", false
+	}
+	return tcpAddr.IP.String(), true
+}
+
+type tarpitListener struct {
+	net.Listener
+	tarpit *Tarpit
+}
+
+func (l *tarpitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// With the PROXY protocol, we only know the client address once
+		// the header was read, so the check happens on the first read.
+		_, proxied := conn.(*proxyProtocolConn)
+		if !proxied && l.tarpit.tarpitted(conn.RemoteAddr()) {
+			go l.tarpit.hold(conn, nil)
+			continue
+		}
+		return &tarpitConn{Conn: conn, tarpit: l.tarpit, checked: !proxied, closed: make(chan struct{})}, nil
+	}
+}
+
+// tarpitConn reports authorization failures to the tarpit (see
+// tarpitFailure), and checks connections with the PROXY protocol on their
+// first read.
+type tarpitConn struct {
+	net.Conn
+	tarpit *Tarpit
+
+	checked   bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *tarpitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.checked {
+		// Reads only happen on one goroutine during the handshake.
+		c.checked = true
+		if c.tarpit.tarpitted(c.Conn.RemoteAddr()) {
+			// Hold the connection until the tarpit duration passed, or the
+			// handshake timed out.
+			c.tarpit.hold(c.Conn, c.closed)
+			return 0, errTarpitted
+		}
+	}
+	return n, err
+}
+
+func (c *tarpitConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// Report a failed handshake on conn to the tarpit it came through (if any), if
+// it's an authorization failure. Wrapped connections are unwrapped.
+func tarpitFailure(conn net.Conn, err error) {
+	identity := peerIdentity(conn)
+	for {
+		switch c := conn.(type) {
+		case *tarpitConn:
+			if c.tarpit.limits.Unauthorized(err) {
+				c.tarpit.fail(c.Conn.RemoteAddr(), identity)
+			}
+			return
+		case *handshakeLimitedConn:
+			conn = c.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarpit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	tarpit := NewTarpit(TarpitLimits{
+		Failures: 2,
+		Window:   time.Minute,
+		Duration: 300 * time.Millisecond,
+		MaxPeers: 10,
+		Unauthorized: func(err error) bool {
+			return strings.HasPrefix(err.Error(), "unauthorized:")
+		},
+	}, &testLogger{})
+
+	// Server rejecting all client certificates
+	config := testTLSConfig(t)
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyPeerCertificate = func([][]byte, [][]*x509.Certificate) error {
+		return errors.New("unauthorized: not allowed")
+	}
+	incoming := tls.NewListener(tarpit.Listener(ln), config)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}
+
+	p := New(incoming, 5*time.Second, dialer, &testLogger{})
+	go p.Accept()
+	defer p.Shutdown()
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true, Certificates: testTLSConfig(t).Certificates}
+	handshake := func() error {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// With TLS 1.3, clients only find out once they try to read.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+
+	tarpitted := tarpitCounter.Count()
+	for i := 0; i < 2; i++ {
+		assert.NotNil(t, handshake(), "should reject client certificate")
+	}
+	assert.True(t, tarpit.tarpitted(ln.Addr()), "should tarpit peer after repeated failures")
+
+	// Connections are now held without reading the handshake, then closed.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer conn.Close()
+	start := time.Now()
+	tls.Client(conn, clientConfig).Handshake()
+	assert.True(t, time.Since(start) >= 250*time.Millisecond, "should hold tarpitted connection")
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "should close tarpitted connection")
+	assert.Equal(t, tarpitted+1, tarpitCounter.Count(), "should count tarpitted connections")
+}
+
+func TestTarpitExpiry(t *testing.T) {
+	tarpit := NewTarpit(TarpitLimits{
+		Failures: 2,
+		Window:   50 * time.Millisecond,
+		Duration: time.Second,
+		MaxPeers: 2,
+	}, &testLogger{})
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	// Failures further apart than the window don't add up.
+	tarpit.fail(addr("192.0.2.1"), "none")
+	time.Sleep(100 * time.Millisecond)
+	tarpit.fail(addr("192.0.2.1"), "none")
+	assert.False(t, tarpit.tarpitted(addr("192.0.2.1")), "should forget failures outside the window")
+
+	tarpit.fail(addr("192.0.2.1"), "none")
+	assert.True(t, tarpit.tarpitted(addr("192.0.2.1")), "should tarpit after failures within the window")
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, tarpit.tarpitted(addr("192.0.2.1")), "should stop tarpitting after the window")
+
+	// The number of tracked peers is bounded.
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		tarpit.fail(addr(ip), "none")
+	}
+	assert.Equal(t, 2, len(tarpit.peers), "should bound tracked peers")
+}
@@ -0,0 +1,273 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Why connections closed on their own (see closeReason): cleanly, because a
+// peer vanished (e.g. TCP keepalive probes went unanswered) or reset the
+// connection, or for any other error.
+var (
+	closeDoneCounter     = metrics.GetOrRegisterCounter("conn.close.done", metrics.DefaultRegistry)
+	closeVanishedCounter = [2]metrics.Counter{
+		metrics.GetOrRegisterCounter("conn.close.client.vanished", metrics.DefaultRegistry),
+		metrics.GetOrRegisterCounter("conn.close.backend.vanished", metrics.DefaultRegistry),
+	}
+	closeResetCounter = [2]metrics.Counter{
+		metrics.GetOrRegisterCounter("conn.close.client.reset", metrics.DefaultRegistry),
+		metrics.GetOrRegisterCounter("conn.close.backend.reset", metrics.DefaultRegistry),
+	}
+	closeErrorCounter = metrics.GetOrRegisterCounter("conn.close.error", metrics.DefaultRegistry)
+)
+
+// Connection returns the details of an open connection, see Connections.
+type Connection struct {
+	// Client and target addresses, as network:address.
+	Client string
+	Target string
+	// Subject of the peer certificate ("none" if there isn't any).
+	Peer string
+	// Listener and route of the connection (empty if not tagged or routed).
+	Listener string
+	Route    string
+	// When data started flowing, and bytes transferred so far.
+	Start      time.Time
+	Downstream int64
+	Upstream   int64
+}
+
+// transfer is the accounting for a connection between a client and the
+// backend, from when the backend is dialed until both are closed.
+type transfer struct {
+	client, backend net.Conn
+	listener        *listenerTag
+	route           *routeMetrics
+	target          string
+	start           time.Time
+
+	// Bytes written to the client (downstream) and to the backend
+	// (upstream), updated while data is being copied (except when splicing,
+	// see copyBuffer).
+	bytes [2]int64
+
+	// First copy error (and its direction), a likely reason for the
+	// connection to close.
+	errMu        sync.Mutex
+	err          error
+	errDirection int
+
+	// Set once data is being copied (protected by connsMu on the proxy).
+	lifetime *lifetimeTimer
+}
+
+// startTransfer starts accounting for a connection. Parent is the connection
+// that went through the handshake (see forward), to find its listener.
+func (p *Proxy) startTransfer(client, parent, backend net.Conn, route *routeMetrics) *transfer {
+	t := &transfer{
+		client:  client,
+		backend: backend,
+		route:   route,
+		target:  backend.RemoteAddr().Network() + ":" + backend.RemoteAddr().String(),
+		start:   time.Now(),
+	}
+
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	if info, ok := p.conns[parent]; ok {
+		t.listener = info.listener
+	}
+	if p.transfers == nil {
+		p.transfers = map[*transfer]struct{}{}
+	}
+	p.transfers[t] = struct{}{}
+	return t
+}
+
+// setLifetime records the lifetime timer of a connection, once fused.
+func (p *Proxy) setLifetime(t *transfer, lifetime *lifetimeTimer) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	t.lifetime = lifetime
+}
+
+// finish stops accounting for a connection.
+func (p *Proxy) finishTransfer(t *transfer) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	delete(p.transfers, t)
+}
+
+// done records the result of copying data in one direction: n bytes were
+// written in total, and copying stopped with err (nil on EOF).
+func (t *transfer) done(direction int, n int64, err error) {
+	atomic.StoreInt64(&t.bytes[direction], n)
+	bytesCounters[direction].Inc(n)
+	t.route.addBytes(direction, n)
+	t.listener.addBytes(direction, n)
+	targetBytesCounter(t.target, direction).Inc(n)
+
+	if err != nil {
+		t.errMu.Lock()
+		if t.err == nil {
+			t.err = err
+			t.errDirection = direction
+		}
+		t.errMu.Unlock()
+	}
+}
+
+// closeReason returns why a connection closed on its own: "done" once both
+// directions reached EOF, "<side> vanished" or "<side> reset" if the first
+// error copying data was a timeout from the network stack (ETIMEDOUT, e.g.
+// after unanswered keepalive probes) or a reset on the client or backend side,
+// or else the first error. Also counts the reason in metrics.
+func (t *transfer) closeReason() string {
+	t.errMu.Lock()
+	defer t.errMu.Unlock()
+	if t.err == nil {
+		closeDoneCounter.Inc(1)
+		return "done"
+	}
+	side := errorSide(t.errDirection, t.err)
+	switch {
+	case side >= 0 && errors.Is(t.err, syscall.ETIMEDOUT):
+		closeVanishedCounter[side].Inc(1)
+		return [2]string{"client", "backend"}[side] + " vanished"
+	case side >= 0 && errors.Is(t.err, syscall.ECONNRESET):
+		closeResetCounter[side].Inc(1)
+		return [2]string{"client", "backend"}[side] + " reset"
+	}
+	closeErrorCounter.Inc(1)
+	return fmt.Sprintf("error %s: %s", [2]string{"downstream", "upstream"}[t.errDirection], t.err)
+}
+
+// errorSide returns which connection an error copying data in the given
+// direction came from: 0 for the client, 1 for the backend, or -1 if unknown.
+// Downstream copies read from the backend and write to the client, and
+// upstream copies the other way around.
+func errorSide(direction int, err error) int {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return -1
+	}
+	switch opErr.Op {
+	case "read":
+		return 1 - direction
+	case "write":
+		return direction
+	}
+	return -1
+}
+
+// logTransfer logs the accounting for a closed connection, as key=value pairs
+// for log processing. If empty, the reason is taken from the transfer.
+func (p *Proxy) logTransfer(t *transfer, reason string) {
+	if reason == "" && atomic.LoadInt32(&p.forceClosed) == 1 {
+		reason = "drain timeout"
+	}
+	if reason == "" {
+		reason = t.closeReason()
+	}
+	if p.quiet {
+		return
+	}
+	conn := t.connection()
+	suffix := ""
+	if conn.Listener != "" {
+		suffix += " listener=" + conn.Listener
+	}
+	if conn.Route != "" {
+		suffix += " route=" + strconv.Quote(conn.Route)
+	}
+	p.Logger.Printf(
+		"connection closed: client=%s peer=%s target=%s%s duration=%s bytes_downstream=%d bytes_upstream=%d reason=%q",
+		conn.Client,
+		conn.Peer,
+		conn.Target,
+		suffix,
+		time.Since(conn.Start).Truncate(time.Millisecond),
+		conn.Downstream,
+		conn.Upstream,
+		reason)
+}
+
+func (t *transfer) connection() Connection {
+	conn := Connection{
+		Client:     t.client.RemoteAddr().Network() + ":" + t.client.RemoteAddr().String(),
+		Target:     t.target,
+		Peer:       peerIdentity(t.client, t.backend),
+		Start:      t.start,
+		Downstream: atomic.LoadInt64(&t.bytes[0]),
+		Upstream:   atomic.LoadInt64(&t.bytes[1]),
+	}
+	if t.listener != nil {
+		conn.Listener = t.listener.name
+	}
+	if t.route != nil {
+		conn.Route = t.route.name
+	}
+	return conn
+}
+
+// Connections returns the details of connections that are currently being
+// forwarded, oldest first. Connections that are still in the handshake, or
+// dialing the backend, aren't included.
+func (p *Proxy) Connections() []Connection {
+	p.connsMu.Lock()
+	conns := make([]Connection, 0, len(p.transfers))
+	for t := range p.transfers {
+		conns = append(conns, t.connection())
+	}
+	p.connsMu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Start.Before(conns[j].Start)
+	})
+	return conns
+}
+
+// Bytes transferred per target, in the same directions as bytesCounters.
+func targetBytesCounter(target string, direction int) metrics.Counter {
+	name := labeledMetricPrefix("target", target) + [2]string{".bytes.downstream", ".bytes.upstream"}[direction]
+	return metrics.GetOrRegisterCounter(name, metrics.DefaultRegistry)
+}
+
+// countingWriter adds the number of bytes written to *n. Note that it hides
+// ReadFrom of the underlying writer (see copyBuffer).
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,168 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferAccounting(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer target.Close()
+
+	logger := &recordingLogger{}
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, logger)
+	// Spliced bytes are only counted once a direction is done.
+	p.DisableSplice()
+	go p.Accept()
+
+	targetName := "tcp:" + target.Addr().String()
+	downstream := targetBytesCounter(targetName, 0)
+	upstream := targetBytesCounter(targetName, 1)
+	downstreamBefore, upstreamBefore := downstream.Count(), upstream.Count()
+	resets := closeResetCounter[1].Count()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	dst, err := target.Accept()
+	assert.Nil(t, err, "should be able to receive connection on target")
+
+	_, err = src.Write([]byte("A"))
+	assert.Nil(t, err)
+	_, err = dst.Read(make([]byte, 1))
+	assert.Nil(t, err)
+	_, err = dst.Write([]byte("BC"))
+	assert.Nil(t, err)
+	_, err = io.ReadFull(src, make([]byte, 2))
+	assert.Nil(t, err)
+
+	conns := p.Connections()
+	assert.Equal(t, 1, len(conns), "should list open connection")
+	assert.Equal(t, targetName, conns[0].Target, "should list target")
+	assert.Equal(t, "tcp:"+src.LocalAddr().String(), conns[0].Client, "should list client")
+	assert.Equal(t, "none", conns[0].Peer, "should list peer without certificate")
+	assert.Equal(t, int64(1), conns[0].Upstream, "should count bytes sent to backend so far")
+	assert.Equal(t, int64(2), conns[0].Downstream, "should count bytes sent to client so far")
+
+	// Reset the backend connection, so that copying to the client fails
+	// while the client can still send data.
+	dst.(*net.TCPConn).SetLinger(0)
+	dst.Close()
+	_, err = ioutil.ReadAll(src)
+	assert.Nil(t, err, "client should see EOF after backend error")
+	src.Close()
+
+	p.Shutdown()
+	p.Wait()
+
+	assert.Equal(t, 0, len(p.Connections()), "should not list closed connection")
+	assert.Equal(t, downstreamBefore+2, downstream.Count(), "should count bytes sent to client per target")
+	assert.Equal(t, upstreamBefore+1, upstream.Count(), "should count bytes sent to backend per target")
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var closed string
+	for _, message := range logger.messages {
+		if strings.HasPrefix(message, "connection closed: ") {
+			closed = message
+		}
+	}
+	assert.Contains(t, closed, "client=tcp:"+src.LocalAddr().String()+" peer=none target="+targetName, "should log connection details")
+	assert.Contains(t, closed, "bytes_downstream=2 bytes_upstream=1", "should log bytes in both directions")
+	assert.Contains(t, closed, `reason="backend reset"`, "should log why connection closed")
+	assert.Equal(t, resets+1, closeResetCounter[1].Count(), "should count backend reset")
+}
+
+func TestTransferCloseReason(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	p := New(nil, time.Second, nil, logger)
+	tr := p.startTransfer(client, client, server, nil)
+	tr.done(0, 10, nil)
+	tr.done(1, 20, nil)
+	p.logTransfer(tr, "")
+	assert.Contains(t, logger.messages[0], `bytes_downstream=10 bytes_upstream=20 reason="done"`, "should log normal close")
+
+	p.logTransfer(tr, "idle timeout")
+	assert.Contains(t, logger.messages[1], `reason="idle timeout"`, "should log given reason")
+
+	tr.done(1, 20, io.ErrUnexpectedEOF)
+	tr.done(0, 10, io.ErrClosedPipe)
+	p.logTransfer(tr, "")
+	assert.Contains(t, logger.messages[2], `reason="error upstream: unexpected EOF"`, "should log first error")
+
+	p.closeConnections()
+	p.logTransfer(tr, "")
+	assert.Contains(t, logger.messages[3], `reason="drain timeout"`, "should log connections closed while draining")
+
+	p.EnableQuiet()
+	p.logTransfer(tr, "")
+	assert.Equal(t, 4, len(logger.messages), "should not log in quiet mode")
+}
+
+func TestTransferCloseReasonNetworkErrors(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	opError := func(op string, errno syscall.Errno) error {
+		return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, errno)}
+	}
+	for _, test := range []struct {
+		direction int
+		err       error
+		reason    string
+		counter   metrics.Counter
+	}{
+		// Downstream copies read from the backend and write to the client.
+		{0, opError("read", syscall.ETIMEDOUT), "backend vanished", closeVanishedCounter[1]},
+		{0, opError("write", syscall.ECONNRESET), "client reset", closeResetCounter[0]},
+		{1, opError("read", syscall.ETIMEDOUT), "client vanished", closeVanishedCounter[0]},
+		{1, opError("write", syscall.ECONNRESET), "backend reset", closeResetCounter[1]},
+		{1, opError("read", syscall.EPIPE), "error upstream: ", closeErrorCounter},
+		// Without an OpError, we can't tell which side it came from.
+		{1, syscall.ETIMEDOUT, "error upstream: ", closeErrorCounter},
+	} {
+		p := New(nil, time.Second, nil, &testLogger{})
+		tr := p.startTransfer(client, client, server, nil)
+		tr.done(test.direction, 0, test.err)
+		before := test.counter.Count()
+		reason := tr.closeReason()
+		assert.True(t, strings.HasPrefix(reason, test.reason), "should classify %s as %s, not %s", test.err, test.reason, reason)
+		assert.Equal(t, before+1, test.counter.Count(), "should count %s", test.reason)
+	}
+}
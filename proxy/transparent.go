@@ -0,0 +1,42 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"net"
+)
+
+// EnableTransparent dials the backend with dial for every connection, passing
+// the client address (from the connection, or its PROXY header), instead of
+// using Dial. This is used for transparent proxying, where connections to the
+// backend are made from the address of the client. Routers are still used
+// for connections if set.
+func (p *Proxy) EnableTransparent(dial func(client net.Addr) (net.Conn, error)) {
+	p.transparent = dial
+}
+
+// Dialer for a connection with EnableTransparent, or nil if not enabled. For
+// multiplexed streams, conn is the parent connection.
+func (p *Proxy) transparentDialer(conn net.Conn) Dialer {
+	if p.transparent == nil {
+		return nil
+	}
+	client := conn.RemoteAddr()
+	return func() (net.Conn, error) {
+		return p.transparent(client)
+	}
+}
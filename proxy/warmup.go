@@ -0,0 +1,95 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Fraction of the maximum accept rate we start out with during warmup.
+const warmupInitialFactor = 0.1
+
+var warmupDelayCounter = metrics.GetOrRegisterCounter("accept.warmup.delayed", metrics.DefaultRegistry)
+
+// warmupLimiter limits the rate of accepted connections after startup. The
+// allowed rate is ramped up linearly from a fraction of the maximum rate to
+// the maximum rate over the warmup window, after which it has no effect.
+type warmupLimiter struct {
+	mu       sync.Mutex
+	start    time.Time
+	duration time.Duration
+	maxRate  float64
+	next     time.Time
+	done     bool
+}
+
+func newWarmupLimiter(duration time.Duration, maxRate float64) *warmupLimiter {
+	return &warmupLimiter{
+		start:    time.Now(),
+		duration: duration,
+		maxRate:  maxRate,
+	}
+}
+
+// restart starts the warmup window over.
+func (w *warmupLimiter) restart() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.start = time.Now()
+	w.next = time.Time{}
+	w.done = false
+}
+
+// wait blocks until the next connection may be accepted. Returns true exactly
+// once per warmup window, on the first call after the window has passed.
+func (w *warmupLimiter) wait() (completed bool) {
+	w.mu.Lock()
+	if w.done {
+		w.mu.Unlock()
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(w.start) >= w.duration {
+		w.done = true
+		w.mu.Unlock()
+		return true
+	}
+
+	// Reserve the next slot, and sleep until then without holding the lock,
+	// so that other accept loops can reserve the slots after it meanwhile.
+	at := now
+	if w.next.After(now) {
+		at = w.next
+	}
+	progress := float64(at.Sub(w.start)) / float64(w.duration)
+	if progress > 1 {
+		progress = 1
+	}
+	rate := w.maxRate * (warmupInitialFactor + (1-warmupInitialFactor)*progress)
+	w.next = at.Add(time.Duration(float64(time.Second) / rate))
+	w.mu.Unlock()
+
+	if at.After(now) {
+		warmupDelayCounter.Inc(1)
+		time.Sleep(at.Sub(now))
+	}
+	return false
+}
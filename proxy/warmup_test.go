@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmupLimiterDelaysAccepts(t *testing.T) {
+	// Initial rate is 10% of 100/s, i.e. 10/s or one accept per 100ms.
+	w := newWarmupLimiter(10*time.Second, 100)
+
+	start := time.Now()
+	assert.False(t, w.wait(), "warmup should not be complete")
+	assert.False(t, w.wait(), "warmup should not be complete")
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, "second accept should have been delayed")
+}
+
+func TestWarmupLimiterCompletes(t *testing.T) {
+	w := newWarmupLimiter(10*time.Millisecond, 1)
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	assert.True(t, w.wait(), "warmup should be complete")
+	assert.False(t, w.wait(), "completion should only be reported once")
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "accepts should not be delayed after warmup")
+}
+
+func TestWarmupLimiterDelaysWithoutLock(t *testing.T) {
+	w := newWarmupLimiter(10*time.Second, 100)
+	assert.False(t, w.wait(), "warmup should not be complete")
+
+	done := make(chan struct{})
+	go func() {
+		// Delayed by about 100ms
+		w.wait()
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	w.mu.Lock()
+	w.mu.Unlock()
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "should not hold lock while delaying accepts")
+	<-done
+}
+
+func TestWarmupLimiterRestart(t *testing.T) {
+	w := newWarmupLimiter(10*time.Millisecond, 1)
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, w.wait(), "warmup should be complete")
+
+	w.restart()
+	assert.False(t, w.wait(), "warmup should not be complete after restart")
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, w.wait(), "warmup should be complete again")
+}
@@ -0,0 +1,53 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/Elbandi/ghostunnel/websocket"
+	"github.com/rcrowley/go-metrics"
+)
+
+var websocketErrorCounter = metrics.GetOrRegisterCounter("accept.websocket.error", metrics.DefaultRegistry)
+
+// EnableWebSocket expects connections to carry a WebSocket for the given
+// path, once the TLS handshake completed, and proxies the data inside it.
+// Other requests get a 404 response, and are closed.
+func (p *Proxy) EnableWebSocket(path string) {
+	p.websocketPath = path
+}
+
+// Upgrade a connection to a WebSocket, within the connect timeout.
+func (p *Proxy) upgradeWebSocket(conn net.Conn) (net.Conn, bool) {
+	conn.SetDeadline(time.Now().Add(p.ConnectTimeout))
+	ws, err := websocket.Upgrade(conn, p.websocketPath)
+	if err != nil {
+		websocketErrorCounter.Inc(1)
+		if errors.Is(err, websocket.ErrNotWebSocket) {
+			logging.Debugf(p.Logger, "closing connection from %s%s: %s", conn.RemoteAddr(), p.logSuffix(conn), err)
+		} else {
+			logging.Warnf(p.Logger, "error on WebSocket upgrade from %s%s: %s", conn.RemoteAddr(), p.logSuffix(conn), err)
+		}
+		return nil, false
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, true
+}
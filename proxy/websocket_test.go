@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocket(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dials := int32(0)
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		backend, conn := net.Pipe()
+		go func() {
+			defer backend.Close()
+			io.Copy(backend, backend)
+		}()
+		return conn, nil
+	}, &testLogger{})
+	p.EnableWebSocket("/tunnel")
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+	ws, err := websocket.Client(src, incoming.Addr().String(), "/tunnel")
+	assert.Nil(t, err, "should open WebSocket")
+	if ws == nil {
+		t.FailNow()
+	}
+
+	_, err = ws.Write([]byte("hello"))
+	assert.Nil(t, err, "should write to WebSocket")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(ws, buf)
+	assert.Nil(t, err, "should read data echoed by backend")
+	assert.Equal(t, []byte("hello"), buf)
+}
+
+func TestWebSocketNotFound(t *testing.T) {
+	incoming, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+
+	dials := int32(0)
+	p := New(incoming, 60*time.Second, func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, io.EOF
+	}, &testLogger{})
+	p.EnableWebSocket("/tunnel")
+	go p.Accept()
+	defer p.Shutdown()
+
+	src, err := net.Dial("tcp", incoming.Addr().String())
+	assert.Nil(t, err, "should be able to dial into proxy")
+	defer src.Close()
+
+	failed := websocketErrorCounter.Count()
+	request, _ := http.NewRequest(http.MethodGet, "http://proxy/", nil)
+	assert.Nil(t, request.Write(src), "should send request")
+	reader := bufio.NewReader(src)
+	response, err := http.ReadResponse(reader, request)
+	assert.Nil(t, err, "should get response")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode, "non-WebSocket requests should get 404")
+
+	// Wait for the connection to be closed.
+	_, err = io.Copy(io.Discard, reader)
+	assert.Nil(t, err, "client should see connection closed")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dials), "should not dial backend")
+	assert.Equal(t, failed+1, websocketErrorCounter.Count(), "should count rejected request")
+}
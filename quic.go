@@ -0,0 +1,49 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/Elbandi/ghostunnel/certloader"
+	"github.com/Elbandi/ghostunnel/quic"
+)
+
+// Get backend dialer function in client mode for --transport=quic, opening
+// a stream on a (shared) QUIC connection to the target for every connection.
+// Certificates and verification are the same as for TLS connections.
+func clientQUICDialer(cert certloader.Certificate, config *tls.Config, address string) func() (net.Conn, error) {
+	if cert != nil {
+		config.GetClientCertificate = cert.GetClientCertificate
+	}
+	dialer := &quic.Dialer{
+		TLSConfig: config,
+		Timeout:   *timeoutDuration,
+		Logger:    logger,
+	}
+	if *localAddress != nil {
+		dialer.LocalAddr = net.JoinHostPort(localAddress.String(), "0")
+	}
+	return func() (net.Conn, error) {
+		conn, err := dialer.Dial(address)
+		if err != nil {
+			return nil, backendCertError(err)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,156 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	netquic "golang.org/x/net/quic"
+)
+
+// Dialer opens streams to a ghostunnel server listening for QUIC, sharing one
+// QUIC connection per address between all streams.
+type Dialer struct {
+	// TLS config for connections, with the client certificate and server
+	// verification settings (its ALPN protocols are replaced with Protocol).
+	TLSConfig *tls.Config
+	// Timeout for the QUIC handshake and for opening streams.
+	Timeout time.Duration
+	// Local UDP address to use (optional).
+	LocalAddr string
+	Logger    Logger
+
+	mu       sync.Mutex
+	endpoint *netquic.Endpoint
+	conns    map[string]*netquic.Conn
+}
+
+// Dial opens a stream to the given address, connecting first if there's no
+// QUIC connection to it yet.
+func (d *Dialer) Dial(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+
+	conn, fresh, err := d.conn(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.NewStream(ctx)
+	if err != nil && !fresh {
+		// The connection may have died since it was last used.
+		d.forget(address, conn)
+		conn, _, err = d.conn(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		stream, err = conn.NewStream(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := newStream(conn, stream, nil)
+	s.SetWriteDeadline(time.Now().Add(d.Timeout))
+	if _, err := s.Write([]byte{streamVersion}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.SetWriteDeadline(time.Time{})
+	streamCounter.Inc(1)
+	return s, nil
+}
+
+// Close closes all connections.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.endpoint == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err := d.endpoint.Close(ctx)
+	d.endpoint = nil
+	d.conns = nil
+	return err
+}
+
+// Returns the connection to the given address, and whether it's a new one.
+func (d *Dialer) conn(ctx context.Context, address string) (*netquic.Conn, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if conn, ok := d.conns[address]; ok {
+		return conn, false, nil
+	}
+
+	if d.endpoint == nil {
+		localAddr := d.LocalAddr
+		if localAddr == "" {
+			localAddr = ":0"
+		}
+		endpoint, err := netquic.Listen("udp", localAddr, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		d.endpoint = endpoint
+		d.conns = map[string]*netquic.Conn{}
+	}
+
+	config := d.TLSConfig.Clone()
+	config.NextProtos = []string{Protocol}
+	conn, err := d.endpoint.Dial(ctx, "udp", address, &netquic.Config{
+		TLSConfig:             config,
+		MaxBidiRemoteStreams:  -1,
+		MaxUniRemoteStreams:   -1,
+		MaxConnReadBufferSize: connReadBuffer,
+		KeepAlivePeriod:       keepAlivePeriod,
+		HandshakeTimeout:      d.Timeout,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("QUIC handshake with %s failed (is it a ghostunnel server with --transport=quic?): %w", address, err)
+	}
+	d.conns[address] = conn
+	connOpenCounter.Inc(1)
+	connTotalCounter.Inc(1)
+	logging.Debugf(d.Logger, "opened QUIC connection to %s", address)
+	go d.watch(address, conn)
+	return conn, true, nil
+}
+
+// Wait for a connection to close, and forget about it.
+func (d *Dialer) watch(address string, conn *netquic.Conn) {
+	err := conn.Wait(context.Background())
+	connOpenCounter.Dec(1)
+	if err != nil {
+		logging.Debugf(d.Logger, "closed QUIC connection to %s: %s", address, err)
+	}
+	d.forget(address, conn)
+}
+
+func (d *Dialer) forget(address string, conn *netquic.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns[address] == conn {
+		delete(d.conns, address)
+	}
+}
@@ -0,0 +1,281 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/logging"
+	"github.com/rcrowley/go-metrics"
+	netquic "golang.org/x/net/quic"
+)
+
+var (
+	connOpenCounter    = metrics.GetOrRegisterCounter("quic.conn.open", metrics.DefaultRegistry)
+	connTotalCounter   = metrics.GetOrRegisterCounter("quic.conn.total", metrics.DefaultRegistry)
+	streamCounter      = metrics.GetOrRegisterCounter("quic.stream.total", metrics.DefaultRegistry)
+	streamErrorCounter = metrics.GetOrRegisterCounter("quic.stream.error", metrics.DefaultRegistry)
+	rejectedCounter    = metrics.GetOrRegisterCounter("quic.conn.rejected", metrics.DefaultRegistry)
+)
+
+// Logger is used by this package to log messages
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+const (
+	// Limit on concurrent streams per connection.
+	maxStreams = 10000
+	// Buffer for data received on a connection, across all its streams.
+	connReadBuffer = 16 << 20
+	// Interval for keepalive packets on idle connections.
+	keepAlivePeriod = 10 * time.Second
+	// How long clients have to announce a stream.
+	streamTimeout = 10 * time.Second
+)
+
+// Listener accepts streams on QUIC connections, returning each stream as a
+// connection.
+//
+// Closing the listener stops accepting streams, but leaves streams that were
+// already accepted open: QUIC connections are closed once they have no open
+// streams left (so that clients reconnect, e.g. to a new process), and the
+// UDP socket once all connections are gone.
+type Listener struct {
+	endpoint *netquic.Endpoint
+	logger   Logger
+	streams  chan *Stream
+
+	// Cancelled once the listener is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Open connections, with their number of accepted streams still open.
+	mu     sync.Mutex
+	conns  map[*netquic.Conn]int
+	closed bool
+}
+
+// Listen listens for QUIC connections on the given UDP address. Clients are
+// verified by the TLS config, like for TLS connections (its ALPN protocols
+// are replaced with Protocol).
+func Listen(address string, config *tls.Config, logger Logger) (*Listener, error) {
+	tlsConfig := config.Clone()
+	tlsConfig.NextProtos = []string{Protocol}
+	if verify := tlsConfig.VerifyPeerCertificate; verify != nil {
+		// Failed handshakes aren't reported by the QUIC package, so log
+		// rejected clients here.
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			err := verify(rawCerts, chains)
+			if err != nil {
+				rejectedCounter.Inc(1)
+				logging.Warnf(logger, "error on QUIC handshake: %s", err)
+			}
+			return err
+		}
+	}
+	endpoint, err := netquic.Listen("udp", address, &netquic.Config{
+		TLSConfig:             tlsConfig,
+		MaxBidiRemoteStreams:  maxStreams,
+		MaxUniRemoteStreams:   -1,
+		MaxConnReadBufferSize: connReadBuffer,
+		KeepAlivePeriod:       keepAlivePeriod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		endpoint: endpoint,
+		logger:   logger,
+		streams:  make(chan *Stream),
+		ctx:      ctx,
+		cancel:   cancel,
+		conns:    map[*netquic.Conn]int{},
+	}
+	go l.acceptConns()
+	return l, nil
+}
+
+// Accept waits for the next stream.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting streams (see Listener).
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.cancel()
+	idle := []*netquic.Conn{}
+	for conn, streams := range l.conns {
+		if streams == 0 {
+			idle = append(idle, conn)
+		}
+	}
+	done := len(l.conns) == 0
+	l.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Abort(nil)
+	}
+	if done {
+		l.closeEndpoint()
+	}
+	return nil
+}
+
+// Addr returns the UDP address the listener is on.
+func (l *Listener) Addr() net.Addr {
+	return net.UDPAddrFromAddrPort(l.endpoint.LocalAddr())
+}
+
+func (l *Listener) acceptConns() {
+	for {
+		conn, err := l.endpoint.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Abort(nil)
+			continue
+		}
+		l.conns[conn] = 0
+		l.mu.Unlock()
+
+		connOpenCounter.Inc(1)
+		connTotalCounter.Inc(1)
+		logging.Debugf(l.logger, "accepted QUIC connection from %s, peer %s", conn.RemoteAddr(), peerName(conn.ConnectionState()))
+		go l.acceptStreams(conn)
+		go l.watch(conn)
+	}
+}
+
+func (l *Listener) acceptStreams(conn *netquic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		go l.announced(conn, stream)
+	}
+}
+
+// Wait for the client to announce a stream, and hand it over to Accept.
+func (l *Listener) announced(conn *netquic.Conn, stream *netquic.Stream) {
+	ctx, cancel := context.WithTimeout(l.ctx, streamTimeout)
+	defer cancel()
+	stream.SetReadContext(ctx)
+	version, err := stream.ReadByte()
+	if err != nil || version != streamVersion {
+		streamErrorCounter.Inc(1)
+		if err == nil {
+			err = fmt.Errorf("unknown stream version %d", version)
+		}
+		logging.Warnf(l.logger, "error on QUIC stream from %s: %s", conn.RemoteAddr(), err)
+		stream.Reset(0)
+		stream.CloseRead()
+		return
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		stream.Reset(0)
+		stream.CloseRead()
+		return
+	}
+	l.conns[conn]++
+	l.mu.Unlock()
+
+	streamCounter.Inc(1)
+	s := newStream(conn, stream, func() { l.release(conn) })
+	select {
+	case l.streams <- s:
+	case <-l.ctx.Done():
+		s.Close()
+	}
+}
+
+// Called once an accepted stream is closed.
+func (l *Listener) release(conn *netquic.Conn) {
+	l.mu.Lock()
+	streams, ok := l.conns[conn]
+	if ok {
+		l.conns[conn] = streams - 1
+	}
+	idle := ok && l.closed && streams == 1
+	l.mu.Unlock()
+	if idle {
+		conn.Abort(nil)
+	}
+}
+
+// Wait for a connection to close, and forget about it.
+func (l *Listener) watch(conn *netquic.Conn) {
+	err := conn.Wait(context.Background())
+	connOpenCounter.Dec(1)
+	if err != nil && !l.isClosed() {
+		logging.Debugf(l.logger, "closed QUIC connection from %s: %s", conn.RemoteAddr(), err)
+	}
+
+	l.mu.Lock()
+	delete(l.conns, conn)
+	done := l.closed && len(l.conns) == 0
+	l.mu.Unlock()
+	if done {
+		l.closeEndpoint()
+	}
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *Listener) closeEndpoint() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	l.endpoint.Close(ctx)
+}
+
+// Subject of the peer certificate, for logs.
+func peerName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) > 0 {
+		return fmt.Sprintf("'%s'", state.PeerCertificates[0].Subject)
+	}
+	return "none"
+}
@@ -0,0 +1,281 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	netquic "golang.org/x/net/quic"
+)
+
+type testLogger struct{}
+
+func (t *testLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+// Returns TLS configs for a server and a client, sharing a self-signed
+// certificate that both trust.
+func testConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gopher"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(raw)
+	assert.Nil(t, err)
+
+	cert := tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+		MinVersion:   tls.VersionTLS13,
+	}
+	return server, client
+}
+
+// Returns a listener, and a dialer for it.
+func listenerPair(t *testing.T, server, client *tls.Config) (*Listener, *Dialer) {
+	listener, err := Listen("127.0.0.1:0", server, &testLogger{})
+	assert.Nil(t, err, "should listen")
+	dialer := &Dialer{TLSConfig: client, Timeout: 5 * time.Second, Logger: &testLogger{}}
+	t.Cleanup(func() {
+		dialer.Close()
+		listener.Close()
+	})
+	return listener, dialer
+}
+
+// Accept a stream with a timeout, to fail tests instead of hanging.
+func acceptStream(t *testing.T, listener *Listener) net.Conn {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		assert.Nil(t, r.err, "should accept stream")
+		return r.conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stream")
+		return nil
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	server, client := testConfigs(t)
+	listener, dialer := listenerPair(t, server, client)
+	conns := connTotalCounter.Count()
+
+	// Open several streams, and check they share the connection.
+	for i := 0; i < 3; i++ {
+		stream, err := dialer.Dial(listener.Addr().String())
+		assert.Nil(t, err, "should open stream")
+		defer stream.Close()
+
+		// The server speaks first, to check streams are announced right away.
+		accepted := acceptStream(t, listener)
+		defer accepted.Close()
+		_, err = accepted.Write([]byte{'a' + byte(i)})
+		assert.Nil(t, err, "should write to stream")
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(stream, buf)
+		assert.Nil(t, err, "should read from stream")
+		assert.Equal(t, []byte{'a' + byte(i)}, buf)
+
+		_, err = stream.Write([]byte("reply"))
+		assert.Nil(t, err, "should write reply")
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(accepted, reply)
+		assert.Nil(t, err, "should read reply")
+		assert.Equal(t, "reply", string(reply))
+
+		state := accepted.(*Stream).ConnectionState()
+		assert.Equal(t, Protocol, state.NegotiatedProtocol)
+		assert.Equal(t, "gopher", state.PeerCertificates[0].Subject.CommonName)
+	}
+	// One connection on each side.
+	assert.Equal(t, conns+2, connTotalCounter.Count())
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	server, client := testConfigs(t)
+	listener, dialer := listenerPair(t, server, client)
+
+	stream, err := dialer.Dial(listener.Addr().String())
+	assert.Nil(t, err, "should open stream")
+	defer stream.Close()
+	stream.Write([]byte("request"))
+	stream.(*Stream).CloseWrite()
+
+	accepted := acceptStream(t, listener)
+	defer accepted.Close()
+	request, err := ioutil.ReadAll(accepted)
+	assert.Nil(t, err, "should read until EOF")
+	assert.Equal(t, "request", string(request))
+
+	// The other direction is still open.
+	_, err = accepted.Write([]byte("response"))
+	assert.Nil(t, err, "should write after peer closed its side")
+	accepted.(*Stream).CloseWrite()
+	response, err := ioutil.ReadAll(stream)
+	assert.Nil(t, err, "should read until EOF")
+	assert.Equal(t, "response", string(response))
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	server, client := testConfigs(t)
+	listener, dialer := listenerPair(t, server, client)
+
+	stream, err := dialer.Dial(listener.Addr().String())
+	assert.Nil(t, err, "should open stream")
+	defer stream.Close()
+	accepted := acceptStream(t, listener)
+	defer accepted.Close()
+
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), "read should time out")
+
+	// Moving the deadline makes the stream usable again.
+	stream.SetReadDeadline(time.Time{})
+	accepted.Write([]byte("x"))
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(stream, buf)
+	assert.Nil(t, err, "should read after clearing deadline")
+}
+
+func TestListenerRejectsClient(t *testing.T) {
+	server, client := testConfigs(t)
+	server.VerifyPeerCertificate = func([][]byte, [][]*x509.Certificate) error {
+		return errors.New("not allowed")
+	}
+	listener, dialer := listenerPair(t, server, client)
+	rejected := rejectedCounter.Count()
+
+	// With TLS 1.3, clients only find out once they try to read.
+	stream, err := dialer.Dial(listener.Addr().String())
+	if err == nil {
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = stream.Read(make([]byte, 1))
+		assert.False(t, errors.Is(err, os.ErrDeadlineExceeded), "stream should be closed")
+		stream.Close()
+	}
+	assert.NotNil(t, err, "should fail to use stream")
+	assert.Equal(t, rejected+1, rejectedCounter.Count(), "should count rejected client")
+}
+
+func TestDialNotQUIC(t *testing.T) {
+	_, client := testConfigs(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	dialer := &Dialer{TLSConfig: client, Timeout: 200 * time.Millisecond, Logger: &testLogger{}}
+	defer dialer.Close()
+	_, err = dialer.Dial(conn.LocalAddr().String())
+	assert.NotNil(t, err, "should fail to open stream")
+	assert.Contains(t, err.Error(), "--transport=quic")
+}
+
+func TestListenerResetsUnknownStreams(t *testing.T) {
+	server, client := testConfigs(t)
+	listener, _ := listenerPair(t, server, client)
+
+	endpoint, err := netquic.Listen("udp", "127.0.0.1:0", nil)
+	assert.Nil(t, err)
+	defer endpoint.Close(context.Background())
+	client.NextProtos = []string{Protocol}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := endpoint.Dial(ctx, "udp", listener.Addr().String(), &netquic.Config{TLSConfig: client})
+	assert.Nil(t, err, "should connect")
+	stream, err := conn.NewStream(ctx)
+	assert.Nil(t, err, "should open stream")
+	stream.SetReadContext(ctx)
+	stream.Write([]byte{streamVersion + 1})
+	stream.Flush()
+
+	_, err = stream.Read(make([]byte, 1))
+	var streamErr netquic.StreamError
+	assert.True(t, errors.As(err, &streamErr), "stream should be reset, got %v", err)
+}
+
+func TestListenerCloseKeepsStreams(t *testing.T) {
+	server, client := testConfigs(t)
+	listener, dialer := listenerPair(t, server, client)
+
+	stream, err := dialer.Dial(listener.Addr().String())
+	assert.Nil(t, err, "should open stream")
+	defer stream.Close()
+	accepted := acceptStream(t, listener)
+
+	listener.Close()
+	_, err = listener.Accept()
+	assert.Equal(t, net.ErrClosed, err)
+
+	// Accepted streams keep working.
+	_, err = accepted.Write([]byte("x"))
+	assert.Nil(t, err, "should write after listener is closed")
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(stream, buf)
+	assert.Nil(t, err, "should read after listener is closed")
+
+	// The connection goes away with its last stream.
+	accepted.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(stream)
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded), "stream should be closed")
+}
@@ -0,0 +1,188 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	netquic "golang.org/x/net/quic"
+)
+
+// Protocol is the ALPN protocol of QUIC connections between ghostunnel
+// clients and servers.
+const Protocol = "ghostunnel-quic/1"
+
+// First byte sent by the client on every stream. Peers only learn about a
+// stream once data is sent on it, so this announces streams right away
+// (e.g. for protocols where the server speaks first).
+const streamVersion = 1
+
+// How long Close waits for the peer to acknowledge data still buffered.
+const closeTimeout = time.Second
+
+// Stream is a proxied connection, carried by a stream on a QUIC connection.
+// Writes are flushed right away. Deadlines are supported, and expire with
+// os.ErrDeadlineExceeded.
+type Stream struct {
+	stream *netquic.Stream
+	conn   *netquic.Conn
+
+	read, write deadline
+
+	// Called once the stream is closed (nil if not needed).
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func newStream(conn *netquic.Conn, stream *netquic.Stream, onClose func()) *Stream {
+	s := &Stream{stream: stream, conn: conn, onClose: onClose}
+	stream.SetReadContext(s.read.context())
+	stream.SetWriteContext(s.write.context())
+	return s
+}
+
+// Read reads data from the stream.
+func (s *Stream) Read(b []byte) (int, error) {
+	// Contexts are only swapped by the reading goroutine itself, as streams
+	// don't allow changing them concurrently with reads.
+	ctx := s.read.context()
+	s.stream.SetReadContext(ctx)
+	n, err := s.stream.Read(b)
+	if err != nil && err != io.EOF && ctx.Err() != nil {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// Write writes data to the stream, and flushes it.
+func (s *Stream) Write(b []byte) (int, error) {
+	ctx := s.write.context()
+	s.stream.SetWriteContext(ctx)
+	n, err := s.stream.Write(b)
+	if err == nil {
+		err = s.stream.Flush()
+	}
+	if err != nil && ctx.Err() != nil {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+// CloseWrite closes the stream for writing, once data written so far is
+// sent. Data from the peer can still be read.
+func (s *Stream) CloseWrite() error {
+	return s.stream.CloseWrite()
+}
+
+// Close closes the stream, waiting a short while for written data to be
+// acknowledged by the peer.
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.write.set(time.Now().Add(closeTimeout))
+		err = s.stream.Close()
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+	return err
+}
+
+// ConnectionState returns details about the TLS handshake of the QUIC
+// connection the stream is on.
+func (s *Stream) ConnectionState() tls.ConnectionState {
+	return s.conn.ConnectionState()
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(s.conn.LocalAddr())
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(s.conn.RemoteAddr())
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.read.set(t)
+	s.write.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.read.set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.write.set(t)
+	return nil
+}
+
+// A deadline for reads or writes, as a context that's cancelled once the
+// deadline passes. Moving the deadline makes a new context if the current
+// one already expired.
+type deadline struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+func (d *deadline) context() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx == nil {
+		d.reset()
+	}
+	return d.ctx
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx == nil {
+		d.reset()
+	}
+	if d.timer != nil {
+		// The timer may have fired (or be firing) already.
+		if !d.timer.Stop() {
+			d.reset()
+		}
+		d.timer = nil
+	} else if d.ctx.Err() != nil {
+		d.reset()
+	}
+
+	if t.IsZero() {
+		return
+	}
+	if delay := time.Until(t); delay > 0 {
+		d.timer = time.AfterFunc(delay, d.cancel)
+	} else {
+		d.cancel()
+	}
+}
+
+func (d *deadline) reset() {
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+}
@@ -0,0 +1,313 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Elbandi/ghostunnel/backend"
+	"github.com/Elbandi/ghostunnel/certloader"
+	"github.com/Elbandi/ghostunnel/proxy"
+	"github.com/Elbandi/ghostunnel/wildcard"
+)
+
+// tlsRoute maps connections to a target address, based on either the server
+// name (SNI) requested by the client or the negotiated ALPN protocol.
+type tlsRoute struct {
+	// Either "sni" or "alpn".
+	kind string
+	// Server name pattern for SNI routes, protocol for ALPN routes.
+	pattern string
+	target  string
+}
+
+// Name of the route, as shown in logs and metrics (e.g. "sni:api.internal").
+func (r tlsRoute) name() string {
+	return r.kind + ":" + r.pattern
+}
+
+// tlsRouter routes connections to backends based on parameters negotiated in
+// the handshake. Routes are tried in order, and the first match wins.
+type tlsRouter struct {
+	routes []tlsRouterEntry
+	// Dialer for connections that didn't match any route.
+	// If nil, such connections will be closed.
+	fallback proxy.Dialer
+}
+
+type tlsRouterEntry struct {
+	route   tlsRoute
+	matcher wildcard.Matcher
+	dial    proxy.Dialer
+}
+
+// Parse --route flags. Each flag value is a comma-separated list of
+// sni:PATTERN=ADDR or alpn:PROTOCOL=ADDR routes, e.g.
+// "sni:api.internal=localhost:8080,alpn:postgres=localhost:5432". Server name
+// patterns are matched case-insensitively, and may use '*' in place of a
+// single label (e.g. "*.internal"). Protocols must match exactly. The
+// PROTOCOL=ADDR values of --alpn-route flags (alpnValues) are short for
+// alpn: routes, and are added after the --route ones.
+func parseRoutes(values, alpnValues []string) ([]tlsRoute, error) {
+	values = splitList(values)
+	for _, value := range splitList(alpnValues) {
+		values = append(values, "alpn:"+value)
+	}
+
+	routes := []tlsRoute{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		kind := strings.SplitN(value, ":", 2)[0]
+		parts := strings.SplitN(strings.TrimPrefix(value, kind+":"), "=", 2)
+		if (kind != "sni" && kind != "alpn") || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid route '%s', must be of the form sni:PATTERN=ADDR or alpn:PROTOCOL=ADDR", value)
+		}
+		route := tlsRoute{kind: kind, pattern: parts[0], target: parts[1]}
+		if kind == "sni" {
+			if _, err := compileServerName(route.pattern); err != nil {
+				return nil, fmt.Errorf("invalid pattern in route '%s': %s", value, err)
+			}
+		}
+		if seen[route.name()] {
+			return nil, fmt.Errorf("duplicate route for '%s'", route.name())
+		}
+		seen[route.name()] = true
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Patterns returns the list of SNI route patterns, e.g. for --route-keystore.
+func sniRoutePatterns(routes []tlsRoute) []string {
+	patterns := []string{}
+	for _, route := range routes {
+		if route.kind == "sni" {
+			patterns = append(patterns, route.pattern)
+		}
+	}
+	return patterns
+}
+
+// Protocols returns the list of ALPN routed protocols, for advertising via ALPN.
+func routeProtocols(routes []tlsRoute) []string {
+	protocols := []string{}
+	for _, route := range routes {
+		if route.kind == "alpn" {
+			protocols = append(protocols, route.pattern)
+		}
+	}
+	return protocols
+}
+
+func compileServerName(pattern string) (wildcard.Matcher, error) {
+	return wildcard.CompileWithSeparator(strings.ToLower(pattern), '.')
+}
+
+// Build a router from the given routes. The fallback dialer (may be nil) is
+// used for connections that didn't match any route.
+func newTLSRouter(routes []tlsRoute, fallback proxy.Dialer) (*tlsRouter, error) {
+	router := &tlsRouter{fallback: fallback}
+	for _, route := range routes {
+		entry := tlsRouterEntry{route: route}
+		if route.kind == "sni" {
+			matcher, err := compileServerName(route.pattern)
+			if err != nil {
+				return nil, err
+			}
+			entry.matcher = matcher
+		}
+		dial, err := backendDialer(route.target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target for route '%s': %s", route.name(), err)
+		}
+		entry.dial = dial
+		router.routes = append(router.routes, entry)
+	}
+	return router, nil
+}
+
+// dialerFor returns the dialer and route name for the given server name and
+// negotiated protocol (either may be empty).
+func (r *tlsRouter) dialerFor(serverName, protocol string) (proxy.Dialer, string, bool) {
+	serverName = strings.ToLower(serverName)
+	for _, entry := range r.routes {
+		var matched bool
+		switch entry.route.kind {
+		case "sni":
+			matched = serverName != "" && entry.matcher.Matches(serverName)
+		case "alpn":
+			matched = protocol != "" && entry.route.pattern == protocol
+		}
+		if matched {
+			return entry.dial, entry.route.name(), true
+		}
+	}
+	return r.fallback, "", r.fallback != nil
+}
+
+// route implements proxy.Router.
+func (r *tlsRouter) route(conn net.Conn) (proxy.Dialer, string, bool) {
+	serverName, protocol := "", ""
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		serverName, protocol = state.ServerName, state.NegotiatedProtocol
+	}
+	return r.dialerFor(serverName, protocol)
+}
+
+// Parse --route-no-client-auth flags, which must name --route entries (e.g.
+// "sni:public.example.com" or "alpn:http/1.1"). Returns the set of names.
+func parseOneWayRoutes(values []string, routes []tlsRoute) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, route := range routes {
+		names[route.name()] = false
+	}
+	for _, name := range splitList(values) {
+		if _, ok := names[name]; !ok {
+			return nil, fmt.Errorf("--route-no-client-auth '%s' doesn't match any --route (must be sni:PATTERN or alpn:PROTOCOL)", name)
+		}
+		names[name] = true
+	}
+	for name, oneWay := range names {
+		if !oneWay {
+			delete(names, name)
+		}
+	}
+	return names, nil
+}
+
+// clientAuthConfigs returns a tls.Config.GetConfigForClient callback that
+// selects a copy of config without client authentication for connections
+// that will match one of the oneWay routes, so that mTLS and one-way TLS can
+// be mixed on the same port. Other connections use config as is. The copy
+// is made now, so config must be fully set up.
+func (r *tlsRouter) clientAuthConfigs(config *tls.Config, oneWay map[string]bool) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	noClientAuth := config.Clone()
+	noClientAuth.ClientAuth = tls.NoClientCert
+	noClientAuth.VerifyPeerCertificate = nil
+	noClientAuth.VerifyConnection = withFIPSCheck(nil)
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// Same route as the one picked once the handshake completed.
+		protocol := negotiatedALPN(config.NextProtos, hello.SupportedProtos)
+		if _, name, _ := r.dialerFor(hello.ServerName, protocol); oneWay[name] {
+			return noClientAuth, nil
+		}
+		return nil, nil
+	}
+}
+
+// setServerConfigForClient wraps config.GetConfigForClient with the
+// callbacks for --route-no-client-auth (if oneWay isn't empty) and client
+// fingerprints (if fingerprints isn't nil), with fingerprints checked first.
+// The one-way config is a copy of config, so this has to be called after
+// all other changes to config.
+func setServerConfigForClient(config *tls.Config, router *tlsRouter, oneWay map[string]bool, fingerprints *proxy.Fingerprints) {
+	if len(oneWay) > 0 {
+		config.GetConfigForClient = router.clientAuthConfigs(config, oneWay)
+	}
+	if fingerprints != nil {
+		config.GetConfigForClient = fingerprints.GetConfigForClient(config.GetConfigForClient)
+	}
+}
+
+// Predict the protocol crypto/tls negotiates: the first of the server's
+// protocols that the client supports (or none).
+func negotiatedALPN(serverProtos, clientProtos []string) string {
+	for _, s := range serverProtos {
+		for _, c := range clientProtos {
+			if s == c {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// sniCertificates returns a tls.Config.GetCertificate callback that presents
+// the certificate of the first route matching the client's server name (if it
+// has one), and the default certificate otherwise.
+func sniCertificates(routes []tlsRoute, certs map[string]certloader.Certificate, fallback certloader.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	type entry struct {
+		matcher wildcard.Matcher
+		cert    certloader.Certificate
+	}
+	entries := []entry{}
+	for _, route := range routes {
+		if route.kind != "sni" {
+			continue
+		}
+		matcher, err := compileServerName(route.pattern)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{matcher, certs[route.pattern]})
+	}
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		serverName := strings.ToLower(hello.ServerName)
+		if serverName != "" {
+			for _, entry := range entries {
+				if entry.matcher.Matches(serverName) {
+					if entry.cert != nil {
+						return entry.cert.GetCertificate(hello)
+					}
+					break
+				}
+			}
+		}
+		return fallback.GetCertificate(hello)
+	}
+}
+
+// affinityRouter sends connections with the same key to the same target, via
+// consistent hashing across the --target addresses.
+type affinityRouter struct {
+	affinity *backend.Affinity
+	// Either "source-ip" or "client-cn".
+	key string
+}
+
+func newAffinityRouter(affinity *backend.Affinity, key string) *affinityRouter {
+	return &affinityRouter{affinity: affinity, key: key}
+}
+
+// affinityKey returns the key to hash for a connection. Falls back to the
+// client address if the connection has no client certificate.
+func (r *affinityRouter) affinityKey(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok && r.key == "client-cn" {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs[0].Subject.CommonName
+		}
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// route implements proxy.Router.
+func (r *affinityRouter) route(conn net.Conn) (proxy.Dialer, string, bool) {
+	key := r.affinityKey(conn)
+	return func() (net.Conn, error) {
+		return r.affinity.Dial(key)
+	}, "", true
+}
@@ -0,0 +1,370 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/backend"
+	"github.com/Elbandi/ghostunnel/certloader"
+	"github.com/Elbandi/ghostunnel/proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes([]string{"sni:api.internal=localhost:8080,sni:*.internal=localhost:8081", "alpn:postgres=unix:/tmp/pg", "alpn:http/1.1=localhost:8082"}, nil)
+	assert.Nil(t, err, "should parse valid routes")
+	assert.Equal(t, []tlsRoute{
+		{"sni", "api.internal", "localhost:8080"},
+		{"sni", "*.internal", "localhost:8081"},
+		{"alpn", "postgres", "unix:/tmp/pg"},
+		{"alpn", "http/1.1", "localhost:8082"},
+	}, routes)
+	assert.Equal(t, []string{"api.internal", "*.internal"}, sniRoutePatterns(routes))
+	assert.Equal(t, []string{"postgres", "http/1.1"}, routeProtocols(routes))
+
+	_, err = parseRoutes([]string{"api.internal=localhost:8080"}, nil)
+	assert.NotNil(t, err, "should reject route without type prefix")
+
+	_, err = parseRoutes([]string{"host:api.internal=localhost:8080"}, nil)
+	assert.NotNil(t, err, "should reject route with unknown type")
+
+	_, err = parseRoutes([]string{"sni:api.internal"}, nil)
+	assert.NotNil(t, err, "should reject route without target")
+
+	_, err = parseRoutes([]string{"sni:=localhost:8080"}, nil)
+	assert.NotNil(t, err, "should reject route without pattern")
+
+	_, err = parseRoutes([]string{"alpn:=localhost:8080"}, nil)
+	assert.NotNil(t, err, "should reject route without protocol")
+
+	_, err = parseRoutes([]string{"sni:**.internal=localhost:8080"}, nil)
+	assert.NotNil(t, err, "should reject invalid pattern")
+
+	_, err = parseRoutes([]string{"sni:api.internal=localhost:8080", "sni:api.internal=localhost:8081"}, nil)
+	assert.NotNil(t, err, "should reject duplicate routes")
+
+	_, err = parseRoutes([]string{"alpn:h2=localhost:8080", "alpn:h2=localhost:8081"}, nil)
+	assert.NotNil(t, err, "should reject duplicate routes")
+
+	_, err = parseRoutes([]string{"sni:h2=localhost:8080", "alpn:h2=localhost:8081"}, nil)
+	assert.Nil(t, err, "should allow same pattern for different route types")
+}
+
+func TestParseRoutesALPNFlag(t *testing.T) {
+	routes, err := parseRoutes([]string{"sni:api.internal=localhost:8080"}, []string{"h2=localhost:8081,http/1.1=localhost:8082", "postgres=unix:/tmp/pg"})
+	assert.Nil(t, err, "should parse --alpn-route values as alpn: routes")
+	assert.Equal(t, []tlsRoute{
+		{"sni", "api.internal", "localhost:8080"},
+		{"alpn", "h2", "localhost:8081"},
+		{"alpn", "http/1.1", "localhost:8082"},
+		{"alpn", "postgres", "unix:/tmp/pg"},
+	}, routes)
+
+	_, err = parseRoutes(nil, []string{"h2"})
+	assert.NotNil(t, err, "should reject route without target")
+
+	_, err = parseRoutes(nil, []string{"=localhost:8080"})
+	assert.NotNil(t, err, "should reject route without protocol")
+
+	_, err = parseRoutes([]string{"alpn:h2=localhost:8080"}, []string{"h2=localhost:8081"})
+	assert.NotNil(t, err, "should reject duplicate routes across --route and --alpn-route")
+}
+
+func TestTLSRouterSNI(t *testing.T) {
+	routes, err := parseRoutes([]string{"sni:api.internal=localhost:8080,sni:*.internal=localhost:8081"}, nil)
+	assert.Nil(t, err)
+
+	router, err := newTLSRouter(routes, dummyDial)
+	assert.Nil(t, err, "should build router")
+
+	dial, name, ok := router.dialerFor("API.internal", "")
+	assert.True(t, ok, "should route mapped server name")
+	assert.NotNil(t, dial)
+	assert.Equal(t, "sni:api.internal", name, "should match routes case-insensitively, in order")
+
+	_, name, ok = router.dialerFor("web.internal", "")
+	assert.True(t, ok, "should route wildcard match")
+	assert.Equal(t, "sni:*.internal", name)
+
+	_, name, ok = router.dialerFor("a.b.internal", "")
+	assert.True(t, ok, "should route unmatched server name to fallback")
+	assert.Equal(t, "", name)
+
+	_, _, ok = router.dialerFor("", "")
+	assert.True(t, ok, "should route connection without SNI to fallback")
+
+	router, err = newTLSRouter(routes, nil)
+	assert.Nil(t, err, "should build router")
+
+	_, _, ok = router.dialerFor("example.com", "")
+	assert.False(t, ok, "should reject unmatched server name without fallback")
+
+	_, _, ok = router.dialerFor("", "")
+	assert.False(t, ok, "should reject connection without SNI without fallback")
+
+	_, err = newTLSRouter([]tlsRoute{{"sni", "api.internal", "invalid"}}, nil)
+	assert.NotNil(t, err, "should reject invalid target")
+}
+
+func TestTLSRouterALPN(t *testing.T) {
+	routes, err := parseRoutes([]string{"sni:db.internal=localhost:8080,alpn:postgres=localhost:5432,alpn:http/1.1=localhost:8081,sni:*.internal=localhost:8082"}, nil)
+	assert.Nil(t, err)
+
+	router, err := newTLSRouter(routes, dummyDial)
+	assert.Nil(t, err, "should build router")
+
+	_, name, ok := router.dialerFor("", "postgres")
+	assert.True(t, ok, "should route mapped protocol")
+	assert.Equal(t, "alpn:postgres", name)
+
+	_, name, ok = router.dialerFor("", "HTTP/1.1")
+	assert.True(t, ok, "should route unmapped protocol to fallback")
+	assert.Equal(t, "", name, "should match protocols exactly")
+
+	_, name, _ = router.dialerFor("db.internal", "postgres")
+	assert.Equal(t, "sni:db.internal", name, "should use first matching route")
+
+	_, name, _ = router.dialerFor("web.internal", "http/1.1")
+	assert.Equal(t, "alpn:http/1.1", name, "should use first matching route")
+
+	_, name, _ = router.dialerFor("web.internal", "")
+	assert.Equal(t, "sni:*.internal", name, "should fall through to SNI routes without ALPN")
+
+	_, name, ok = router.dialerFor("example.com", "")
+	assert.True(t, ok, "should route connection without ALPN to fallback")
+	assert.Equal(t, "", name)
+}
+
+type fakeCertificate struct {
+	cert *tls.Certificate
+}
+
+func (c fakeCertificate) Reload() error {
+	return nil
+}
+
+func (c fakeCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert, nil
+}
+
+func (c fakeCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.cert, nil
+}
+
+func TestSNICertificates(t *testing.T) {
+	routes, err := parseRoutes([]string{"alpn:h2=localhost:8083,sni:api.internal=localhost:8080,sni:*.internal=localhost:8081,sni:*.example.com=localhost:8082"}, nil)
+	assert.Nil(t, err)
+
+	def, api, example := &tls.Certificate{}, &tls.Certificate{}, &tls.Certificate{}
+	getCertificate := sniCertificates(routes, map[string]certloader.Certificate{
+		"api.internal":  fakeCertificate{api},
+		"*.example.com": fakeCertificate{example},
+	}, fakeCertificate{def})
+
+	for serverName, expected := range map[string]*tls.Certificate{
+		"api.internal":    api,
+		"www.example.com": example,
+		"web.internal":    def,
+		"other.com":       def,
+		"":                def,
+	} {
+		cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		assert.Nil(t, err)
+		assert.True(t, cert == expected, "wrong certificate for server name '%s'", serverName)
+	}
+}
+
+func TestAffinityRouter(t *testing.T) {
+	pool := backend.NewPool([]*backend.Target{
+		backend.NewTarget("a:1", dummyDial),
+		backend.NewTarget("b:1", dummyDial),
+	}, time.Minute, logger)
+	router := newAffinityRouter(backend.NewAffinity(pool), "source-ip")
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &fakeAddrConn{Conn: c1, remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}
+	assert.Equal(t, "10.0.0.1", router.affinityKey(conn), "should use client IP without port")
+
+	dial, name, ok := router.route(conn)
+	assert.True(t, ok, "should always route")
+	assert.Equal(t, "", name, "should not name route")
+	assert.NotNil(t, dial)
+
+	router = newAffinityRouter(backend.NewAffinity(pool), "client-cn")
+	assert.Equal(t, "10.0.0.1", router.affinityKey(conn), "should fall back to client IP without certificate")
+}
+
+type fakeAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *fakeAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestParseOneWayRoutes(t *testing.T) {
+	routes, err := parseRoutes([]string{"sni:public.internal=localhost:8080,alpn:http/1.1=localhost:8081,sni:*.internal=localhost:8082"}, nil)
+	assert.Nil(t, err)
+
+	oneWay, err := parseOneWayRoutes([]string{"sni:public.internal,alpn:http/1.1"}, routes)
+	assert.Nil(t, err, "should accept route names")
+	assert.Equal(t, map[string]bool{"sni:public.internal": true, "alpn:http/1.1": true}, oneWay)
+
+	_, err = parseOneWayRoutes([]string{"sni:other.internal"}, routes)
+	assert.NotNil(t, err, "should reject names that aren't routes")
+
+	_, err = parseOneWayRoutes([]string{"public.internal"}, routes)
+	assert.NotNil(t, err, "should reject names without kind")
+}
+
+// Run a handshake between server and client configs, returning the error
+// from the server side.
+func serverHandshake(t *testing.T, server, client *tls.Config) error {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		conn := tls.Client(c1, client)
+		conn.Handshake()
+		// Read the server's response to the client certificate (TLS 1.3).
+		conn.Read(make([]byte, 1))
+		c1.Close()
+	}()
+	conn := tls.Server(c2, server)
+	err := conn.Handshake()
+	if err == nil {
+		conn.Write([]byte{0})
+	}
+	return err
+}
+
+func TestClientAuthConfigs(t *testing.T) {
+	routes, err := parseRoutes([]string{"sni:public.internal=localhost:8080,alpn:http/1.1=localhost:8081,sni:*.internal=localhost:8082"}, nil)
+	assert.Nil(t, err)
+	router, err := newTLSRouter(routes, dummyDial)
+	assert.Nil(t, err, "should build router")
+	oneWay, err := parseOneWayRoutes([]string{"sni:public.internal,alpn:http/1.1"}, routes)
+	assert.Nil(t, err)
+
+	serverCert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-pkcs8.pem")
+	assert.Nil(t, err, "should load test certificate")
+	clientCert, err := tls.LoadX509KeyPair("test-keys/client-cert.pem", "test-keys/client-pkcs8.pem")
+	assert.Nil(t, err, "should load test certificate")
+	caBundle, err := ioutil.ReadFile("test-keys/cacert.pem")
+	assert.Nil(t, err, "should load test CA")
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caBundle)
+
+	verified := 0
+	config := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+		NextProtos:   routeProtocols(routes),
+		VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+			verified++
+			return nil
+		},
+	}
+	config.GetConfigForClient = router.clientAuthConfigs(config, oneWay)
+
+	// The same listener mixes one-way TLS and mTLS, depending on the route.
+	for _, c := range []struct {
+		serverName string
+		protocols  []string
+		cert       bool
+		ok         bool
+	}{
+		{"public.internal", nil, false, true},
+		{"PUBLIC.internal", nil, false, true},
+		{"private.internal", []string{"http/1.1"}, false, true},
+		{"private.internal", nil, false, false},
+		{"private.internal", []string{"h2", "http/1.1"}, false, true},
+		{"private.internal", nil, true, true},
+		{"example.com", nil, false, false},
+	} {
+		client := &tls.Config{InsecureSkipVerify: true, ServerName: c.serverName, NextProtos: c.protocols}
+		if c.cert {
+			client.Certificates = []tls.Certificate{clientCert}
+		}
+		err := serverHandshake(t, config, client)
+		if c.ok {
+			assert.Nil(t, err, "should accept %s %v (client cert: %t)", c.serverName, c.protocols, c.cert)
+		} else {
+			assert.NotNil(t, err, "should reject %s %v (client cert: %t)", c.serverName, c.protocols, c.cert)
+		}
+	}
+	assert.Equal(t, 1, verified, "should only verify client certificates on mTLS routes")
+}
+
+func TestServerConfigForClient(t *testing.T) {
+	*fipsOnly = true
+	defer func() { *fipsOnly = false }()
+
+	routes, err := parseRoutes([]string{"sni:public.internal=localhost:8080"}, []string{"http/1.1=localhost:8081"})
+	assert.Nil(t, err)
+	router, err := newTLSRouter(routes, dummyDial)
+	assert.Nil(t, err, "should build router")
+	oneWay, err := parseOneWayRoutes([]string{"sni:public.internal"}, routes)
+	assert.Nil(t, err)
+
+	serverCert, err := tls.LoadX509KeyPair("test-keys/server-cert.pem", "test-keys/server-pkcs8.pem")
+	assert.Nil(t, err, "should load test certificate")
+
+	newConfig := func(fingerprints *proxy.Fingerprints) *tls.Config {
+		config := &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    x509.NewCertPool(),
+			NextProtos:   routeProtocols(routes),
+		}
+		applyFIPSOnly(config)
+		setServerConfigForClient(config, router, oneWay, fingerprints)
+		return config
+	}
+
+	// Offer a FIPS group up front, net.Pipe can't take the HelloRetryRequest.
+	client := func(serverName string, protocols []string) *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true, ServerName: serverName, NextProtos: protocols, CurvePreferences: fipsCurves}
+	}
+
+	// The one-way config keeps the --fips-only settings.
+	config := newConfig(proxy.NewFingerprints(nil, []string{"unknown"}))
+	err = serverHandshake(t, config, client("public.internal", nil))
+	assert.Nil(t, err, "should accept one-way route without client certificate")
+	chacha := client("public.internal", nil)
+	chacha.MaxVersion = tls.VersionTLS12
+	chacha.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}
+	err = serverHandshake(t, config, chacha)
+	assert.NotNil(t, err, "should reject cipher suite that isn't FIPS-approved on one-way route")
+	err = serverHandshake(t, config, client("private.internal", []string{"http/1.1"}))
+	assert.NotNil(t, err, "should require client certificate on other routes")
+
+	// Fingerprints are checked before picking the one-way config.
+	config = newConfig(proxy.NewFingerprints([]string{"unknown"}, nil))
+	err = serverHandshake(t, config, client("public.internal", nil))
+	assert.NotNil(t, err, "should reject fingerprint not in allow list on one-way route")
+}
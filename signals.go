@@ -20,11 +20,29 @@ import (
 	ctx "context"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"time"
 
 	"github.com/Elbandi/ghostunnel/proxy"
+	"github.com/rcrowley/go-metrics"
 )
 
+// How long to wait for connections to close after force-closing them at the
+// end of the shutdown timeout, before exiting anyway.
+const forceExitDelay = 5 * time.Second
+
+// Time of the last successful certificate reload (or of the initial load, at
+// startup), in UNIX nanoseconds. Exposed as seconds since then, to alert on
+// stuck certificate rotation.
+var lastCertReload atomic.Int64
+
+func init() {
+	lastCertReload.Store(time.Now().UnixNano())
+	metrics.GetOrRegister("cert.seconds_since_reload", metrics.NewFunctionalGauge(func() int64 {
+		return int64(time.Since(time.Unix(0, lastCertReload.Load())) / time.Second)
+	}))
+}
+
 // isShutdownSignal checks if the received signal is a shutdown signal
 // and returns true if that's the case. Returns false if the signal is
 // a refresh signal.
@@ -37,45 +55,103 @@ func isShutdownSignal(sig os.Signal) bool {
 	return false
 }
 
-// signalHandler listens for incoming shutdown or refresh signals. If we get
-// a shutdown signal, we stop listening for new connections and gracefully
-// terminate the process. If we get a refresh signal, reload certificates.
+// isUpgradeSignal checks if the received signal is an upgrade signal.
+func isUpgradeSignal(sig os.Signal) bool {
+	for _, upgradeSignal := range upgradeSignals {
+		if sig == upgradeSignal {
+			return true
+		}
+	}
+	return false
+}
+
+// signalHandler listens for incoming shutdown, upgrade or refresh signals. If
+// we get a shutdown signal, we stop listening for new connections and
+// gracefully terminate the process. If we get an upgrade signal, we start a
+// new process that takes over our listening sockets, and then stop like on
+// shutdown. If we get a refresh signal, reload certificates (and the listen
+// address, if --listen-file is set).
 func (context *Context) signalHandler(p *proxy.Proxy) {
 	signals := make(chan os.Signal, 3)
-	signal.Notify(signals, append(shutdownSignals, refreshSignals...)...)
+	signal.Notify(signals, append(append(shutdownSignals, upgradeSignals...), refreshSignals...)...)
 	defer signal.Stop(signals)
 
+	// Check in regularly, for /_liveness
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	context.status.Heartbeat()
+
 	for {
-		// Wait for a signal
+		// Wait for a signal, or for the --exec child to exit
 		select {
 		case sig := <-signals:
 			if isShutdownSignal(sig) {
+				// Fail /_readiness before anything else, so that load
+				// balancers stop sending new connections right away
+				context.status.Draining()
 				logger.Printf("received %s, shutting down", sig.String())
+				context.child.signal(sig)
+				context.shutdown(p)
+				return
+			}
 
-				// Best-effort graceful shutdown of status listener
-				if context.statusHTTP != nil {
-					go context.statusHTTP.Shutdown(ctx.Background())
+			if isUpgradeSignal(sig) {
+				logger.Printf("received %s, upgrading", sig.String())
+				err := context.upgrade()
+				if err != nil {
+					logger.Errorf("error upgrading, continuing to serve: %s", err)
+					continue
 				}
-
-				// Force-exit after timeout
-				time.AfterFunc(context.shutdownTimeout, func() {
-					// Graceful shutdown timeout reached. If we can't drain connections
-					// to exit gracefully after this timeout, let's just exit.
-					logger.Printf("graceful shutdown timeout: forcing exit")
-					exitFunc(1)
-				})
-
-				p.Shutdown()
-				logger.Printf("shutdown proxy, waiting for drain")
+				context.handOff(p)
 				return
 			}
 
-			logger.Printf("received %s, reloading certificates", sig.String())
+			logger.Printf("received %s, reloading", sig.String())
 			context.reload()
+
+		case <-heartbeat.C:
+			context.status.Heartbeat()
+
+		case <-context.child.exited():
+			logger.Printf("child process exited with status %d, shutting down", context.child.exitCode())
+			context.shutdown(p)
+			return
 		}
 	}
 }
 
+// shutdown stops listening for new connections, and waits for existing ones
+// to drain for up to the shutdown timeout. Connections still open after that
+// are closed.
+func (context *Context) shutdown(p *proxy.Proxy) {
+	// Tell load balancers to take us out of rotation right away
+	context.status.Draining()
+	context.stop(p)
+}
+
+// stop stops listening for new connections, and waits for existing ones to
+// drain for up to the shutdown timeout.
+func (context *Context) stop(p *proxy.Proxy) {
+	// Force-exit if we can't close connections (e.g. stuck backend dials)
+	time.AfterFunc(context.shutdownTimeout+forceExitDelay, func() {
+		logger.Warnf("graceful shutdown timeout: forcing exit")
+		exitFunc(1)
+	})
+
+	logger.Printf("shutdown proxy, waiting up to %s for connections to drain", context.shutdownTimeout)
+	drained, closed := p.Drain(context.shutdownTimeout)
+	if closed > 0 {
+		logger.Warnf("warning: drained %d connections, force-closed %d still open after shutdown timeout", drained, closed)
+	} else {
+		logger.Printf("drained %d connections", drained)
+	}
+
+	// Best-effort graceful shutdown of status listener
+	if context.statusHTTP != nil {
+		go context.statusHTTP.Shutdown(ctx.Background())
+	}
+}
+
 func (context *Context) reloadHandler(interval time.Duration) {
 	if interval == 0 {
 		return
@@ -87,10 +163,121 @@ func (context *Context) reloadHandler(interval time.Duration) {
 
 func (context *Context) reload() {
 	context.status.Reloading()
+	failed := false
 	err := context.cert.Reload()
 	if err != nil {
-		logger.Printf("error reloading certificates: %s", err)
+		logger.Errorf("error reloading certificates: %s", err)
+		failed = true
+	}
+	if context.statusCert != nil {
+		err = context.statusCert.Reload()
+		if err != nil {
+			logger.Errorf("error reloading status port certificates: %s", err)
+			failed = true
+		}
+	}
+	for name, cert := range context.extraCerts {
+		err = cert.Reload()
+		if err != nil {
+			logger.Errorf("error reloading certificates for %s: %s", name, err)
+			failed = true
+		}
+	}
+	if context.prewarm != nil {
+		// Pooled connections were made with the old certificate
+		context.prewarm.Flush()
+	}
+	context.reloadListener()
+	if !failed {
+		lastCertReload.Store(time.Now().UnixNano())
+		if *closeOnReload {
+			context.closeConnections()
+		}
 	}
 	logger.Printf("reloading complete")
 	context.status.Listening()
 }
+
+func (context *Context) setProxy(p *proxy.Proxy) {
+	context.listenMu.Lock()
+	context.proxy = p
+	if context.drained {
+		p.Shutdown()
+	}
+	context.listenMu.Unlock()
+}
+
+// closeConnections gracefully closes open connections after a reload (with
+// --close-on-reload), so that clients reconnect with the new certificates.
+func (context *Context) closeConnections() {
+	context.listenMu.Lock()
+	p := context.proxy
+	context.listenMu.Unlock()
+	if p == nil {
+		return
+	}
+	// Closed clients reconnect all at once, so ramp up again (with
+	// --warmup-duration).
+	p.StartWarmup()
+	logger.Printf("closing %d open connections after reload", p.CloseConnections())
+}
+
+// drain stops accepting new connections, on request via /_drain. Existing
+// connections keep running until they close, or we get a shutdown signal.
+func (context *Context) drain() {
+	context.status.Draining()
+
+	context.listenMu.Lock()
+	defer context.listenMu.Unlock()
+	if context.drained {
+		return
+	}
+	context.drained = true
+	logger.Printf("received drain request, no longer accepting connections")
+	if context.proxy != nil {
+		context.proxy.Shutdown()
+	}
+}
+
+// activeConnections returns the number of open client connections.
+func (context *Context) activeConnections() int {
+	context.listenMu.Lock()
+	defer context.listenMu.Unlock()
+	if context.proxy == nil {
+		return 0
+	}
+	return context.proxy.Active()
+}
+
+// reloadListener re-reads the listen address from --listen-file, and if it
+// changed, opens a listener on the new address and closes the old listener.
+// Existing connections are not affected and drain normally.
+func (context *Context) reloadListener() {
+	context.listenMu.Lock()
+	defer context.listenMu.Unlock()
+
+	if *listenFile == "" || context.proxy == nil || context.drained {
+		return
+	}
+
+	address, err := listenAddress(context.listenAddress)
+	if err != nil {
+		logger.Errorf("error reading listen address, keeping %s: %s", context.listenAddress, err)
+		return
+	}
+	if address == context.listenAddress {
+		return
+	}
+
+	listener, err := context.listen(address)
+	if err != nil {
+		logger.Errorf("error listening on new address %s, keeping %s: %s", address, context.listenAddress, err)
+		return
+	}
+
+	logger.Printf("moving listener from %s to %s, existing connections will drain", context.listenAddress, address)
+	context.proxy.SwapListener(listener)
+	context.sockets.remove(context.listenAddress)
+	context.listenAddress = address
+	logger.Printf("listening for connections on %s", address)
+}
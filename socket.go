@@ -0,0 +1,197 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Ownership and permissions for UNIX sockets we listen on, from the
+// --listen-socket-* flags. A uid or gid of -1 leaves it unchanged.
+type socketOptions struct {
+	mode     os.FileMode
+	setMode  bool
+	uid, gid int
+}
+
+func parseSocketOptions(mode, owner, group string) (socketOptions, error) {
+	opts := socketOptions{uid: -1, gid: -1}
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0777 {
+			return opts, fmt.Errorf("invalid socket mode '%s', must be octal (e.g. 0660)", mode)
+		}
+		opts.mode = os.FileMode(perm)
+		opts.setMode = true
+	}
+	if owner != "" {
+		uid, err := strconv.Atoi(owner)
+		if err != nil {
+			u, lookupErr := user.Lookup(owner)
+			if lookupErr != nil {
+				return opts, fmt.Errorf("invalid socket owner: %s", lookupErr)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		opts.uid = uid
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, lookupErr := user.LookupGroup(group)
+			if lookupErr != nil {
+				return opts, fmt.Errorf("invalid socket group: %s", lookupErr)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		opts.gid = gid
+	}
+	return opts, nil
+}
+
+func (o socketOptions) empty() bool {
+	return !o.setMode && o.uid == -1 && o.gid == -1
+}
+
+// listenUnix listens on a UNIX socket at path, and removes the socket file
+// when the listener is closed. A stale socket file left behind by a previous
+// run is removed first. If ownership or permissions are to be set, the socket
+// is created in a private directory, set up, and then moved into place, so
+// that no one can connect to it before it has the right permissions.
+func listenUnix(path string, opts socketOptions) (net.Listener, error) {
+	// Abstract sockets have no file, and go away with the listener.
+	if !isAbstractSocket(path) {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	} else if !opts.empty() {
+		return nil, errors.New("can't set ownership or permissions of abstract UNIX sockets")
+	}
+
+	if opts.empty() {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		listener.(*net.UnixListener).SetUnlinkOnClose(true)
+		return listener, nil
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".ghostunnel-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	ul := listener.(*net.UnixListener)
+
+	if opts.uid != -1 || opts.gid != -1 {
+		err = os.Chown(tmpPath, opts.uid, opts.gid)
+	}
+	if err == nil && opts.setMode {
+		err = os.Chmod(tmpPath, opts.mode)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		ul.Close()
+		return nil, err
+	}
+
+	ul.SetUnlinkOnClose(false)
+	return &unixSocketListener{ul, &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// unixSocketListener is a UNIX socket listener that was moved into place after
+// binding, and removes the socket file at its final path when closed.
+type unixSocketListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+}
+
+func (l *unixSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.addr.Name)
+	return err
+}
+
+// removeStaleSocket removes a socket file at path if nothing is listening on
+// it anymore (e.g. because a previous run crashed). Other files are left
+// alone, so that listening fails as usual.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is already listening on %s", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	logger.Printf("removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// isAbstractSocket checks if a UNIX socket address uses the "@NAME" syntax
+// for the abstract namespace.
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// validateAbstractSocket checks that abstract sockets are supported on this
+// platform. Elsewhere, "@NAME" would silently refer to a file in the current
+// directory instead.
+func validateAbstractSocket(path string) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("abstract UNIX socket %s is only supported on Linux", path)
+	}
+	if path == "@" {
+		return errors.New("abstract UNIX socket name can't be empty")
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	opts, err := parseSocketOptions("", "", "")
+	assert.Nil(t, err)
+	assert.True(t, opts.empty(), "should not change anything by default")
+
+	opts, err = parseSocketOptions("0660", "1234", "5678")
+	assert.Nil(t, err)
+	assert.Equal(t, socketOptions{mode: 0660, setMode: true, uid: 1234, gid: 5678}, opts)
+
+	current, err := user.Current()
+	panicOnError(err)
+	opts, err = parseSocketOptions("", current.Username, "")
+	assert.Nil(t, err, "should look up user names")
+	assert.Equal(t, current.Uid, strconv.Itoa(opts.uid))
+	assert.Equal(t, -1, opts.gid)
+
+	for _, mode := range []string{"999", "rw-rw----", "01777"} {
+		_, err = parseSocketOptions(mode, "", "")
+		assert.NotNil(t, err, "should reject mode %s", mode)
+	}
+	_, err = parseSocketOptions("", "ghostunnel-no-such-user", "")
+	assert.NotNil(t, err, "should reject unknown user")
+	_, err = parseSocketOptions("", "", "ghostunnel-no-such-group")
+	assert.NotNil(t, err, "should reject unknown group")
+}
+
+func TestListenUnixOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+
+	listener, err := listenUnix(path, socketOptions{mode: 0600, setMode: true, uid: os.Getuid(), gid: -1})
+	assert.Nil(t, err, "should be able to listen")
+	assert.Equal(t, path, listener.Addr().String(), "should report final path")
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "should create socket at path")
+	assert.True(t, info.Mode()&os.ModeSocket != 0, "should be a socket")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "should set mode")
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, 1, "should clean up temporary directory")
+
+	go func() {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connections on final path")
+	conn.Close()
+
+	listener.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "should remove socket on close")
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+
+	// Stale socket left behind, e.g. after a crash
+	stale, err := net.Listen("unix", path)
+	panicOnError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, socketOptions{uid: -1, gid: -1})
+	assert.Nil(t, err, "should replace stale socket")
+
+	_, err = listenUnix(path, socketOptions{uid: -1, gid: -1})
+	assert.NotNil(t, err, "should not replace socket that's in use")
+
+	listener.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "should remove socket on close")
+
+	// Regular files are never removed
+	panicOnError(ioutil.WriteFile(path, []byte("data"), 0600))
+	_, err = listenUnix(path, socketOptions{uid: -1, gid: -1})
+	assert.NotNil(t, err, "should fail to listen on regular file")
+	_, err = os.Stat(path)
+	assert.Nil(t, err, "should not remove regular file")
+}
+
+func TestListenUnixAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are only supported on Linux")
+	}
+
+	name := "@ghostunnel-test-" + strconv.Itoa(os.Getpid())
+	listener, err := listenUnix(name, socketOptions{uid: -1, gid: -1})
+	assert.Nil(t, err, "should listen on abstract socket")
+	defer listener.Close()
+	assert.Equal(t, name, listener.Addr().String(), "should render address with @")
+
+	go func() {
+		conn, err := net.Dial("unix", name)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connection on abstract socket")
+	conn.Close()
+
+	_, err = os.Lstat(name)
+	assert.True(t, os.IsNotExist(err), "should not create a file")
+
+	_, err = listenUnix("@other", socketOptions{mode: 0600, setMode: true, uid: -1, gid: -1})
+	assert.NotNil(t, err, "should reject permissions for abstract socket")
+}
@@ -0,0 +1,48 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetBacklog(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer listener.Close()
+
+	err = SetBacklog(listener, 17)
+	assert.Nil(t, err, "should be able to set backlog")
+
+	err = Apply(listener, func(fd uintptr) error {
+		// For listening sockets, Linux reports the backlog in tcpi_sacked.
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err == nil {
+			assert.Equal(t, uint32(17), info.Sacked, "should have set backlog")
+		}
+		return err
+	})
+	assert.Nil(t, err, "should be able to read socket options")
+
+	listening, err := IsListening(listener)
+	assert.Nil(t, err, "should be able to check socket")
+	assert.True(t, listening, "should still be listening")
+}
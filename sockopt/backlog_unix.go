@@ -0,0 +1,27 @@
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Calling listen(2) again on a listening socket updates its backlog.
+func setBacklog(fd uintptr, backlog int) error {
+	return unix.Listen(int(fd), backlog)
+}
@@ -0,0 +1,51 @@
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SupportsDSCP returns true if setting DSCP values is supported on this platform.
+func SupportsDSCP() bool {
+	return true
+}
+
+// Set the DSCP value in the IP TOS byte (IPv4) or traffic class (IPv6).
+func setDSCP(fd uintptr, dscp int) error {
+	// The DSCP value occupies the upper six bits of the TOS byte, the lower
+	// two bits are used for ECN.
+	tos := dscp << 2
+
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		if err != nil {
+			return err
+		}
+		// Also set IP_TOS for IPv4-mapped traffic on dual-stack sockets. This
+		// is best-effort, as not all platforms allow this on IPv6 sockets.
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		return nil
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SupportsFastOpen returns true if TCP Fast Open is supported on this platform.
+func SupportsFastOpen() bool {
+	return true
+}
+
+// EnableFastOpen enables TCP Fast Open on a listening socket, with the given
+// maximum queue length for pending TFO connections.
+func EnableFastOpen(listener net.Listener, queue int) error {
+	return Apply(listener, func(fd uintptr) error {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, queue)
+	})
+}
+
+// FastOpenConnect is a Control hook for net.Dialer that enables TCP Fast Open
+// on outgoing connections. The first write on the connection (e.g. the TLS
+// ClientHello) will be sent along with the SYN if the peer supports it. On
+// kernels (or socket types, e.g. MPTCP) without support for it, connections
+// are opened without TFO.
+func FastOpenConnect(network, address string, c syscall.RawConn) error {
+	if !isTCP(network) {
+		return nil
+	}
+	return control(c, func(fd uintptr) error {
+		err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+		if err == unix.ENOPROTOOPT || err == unix.EOPNOTSUPP {
+			return nil
+		}
+		return err
+	})
+}
+
+// Set in tcpi_options once data sent with the SYN was acknowledged (as a
+// client), or a connection was accepted with data in the SYN (as a server).
+const tcpiOptSynData = 0x20
+
+func usedFastOpen(fd uintptr) (bool, error) {
+	info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return false, err
+	}
+	return info.Options&tcpiOptSynData != 0, nil
+}
@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastOpenReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+
+	err = EnableFastOpen(ln, 16)
+	if err != nil {
+		t.Skipf("TCP Fast Open not available: %s", err)
+	}
+
+	// Echo server
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dialer := &net.Dialer{Control: FastOpenConnect}
+
+	// Connect multiple times, later connections may carry data in the SYN
+	// once the client has a TFO cookie from the first connection.
+	for i := 0; i < 5; i++ {
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err, "should be able to dial with TFO enabled")
+
+		sent := bytes.Repeat([]byte{byte('a' + i)}, 4096)
+		_, err = conn.Write(sent)
+		assert.Nil(t, err, "should be able to write")
+
+		received := make([]byte, len(sent))
+		_, err = io.ReadFull(conn, received)
+		assert.Nil(t, err, "should be able to read echoed data")
+		assert.Equal(t, sent, received, "data must be intact")
+		conn.Close()
+	}
+}
+
+func TestUsedFastOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+
+	err = EnableFastOpen(ln, 16)
+	if err != nil {
+		t.Skipf("TCP Fast Open not available: %s", err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("ok"))
+			accepted <- conn
+		}
+	}()
+
+	// The first connection fetches a TFO cookie (unless the kernel still has
+	// one cached from an earlier run), later ones can carry data in the SYN.
+	dialer := &net.Dialer{Control: FastOpenConnect}
+	used := false
+	for i := 0; i < 3; i++ {
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err, "should be able to dial with TFO enabled")
+		conn.Write([]byte("hello"))
+		io.ReadFull(conn, make([]byte, 2))
+		server := <-accepted
+
+		client, err := UsedFastOpen(conn)
+		assert.Nil(t, err, "should be able to check client connection")
+		usedTFO, err := UsedFastOpen(server)
+		assert.Nil(t, err, "should be able to check server connection")
+		assert.Equal(t, client, usedTFO, "client and server should agree on TFO use")
+		used = used || client
+		conn.Close()
+		server.Close()
+	}
+	if !used {
+		sysctl, _ := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+		t.Skipf("TCP Fast Open not used, check net.ipv4.tcp_fastopen sysctl (%s)", strings.TrimSpace(string(sysctl)))
+	}
+}
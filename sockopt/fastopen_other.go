@@ -0,0 +1,44 @@
+// +build !linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+)
+
+// SupportsFastOpen returns true if TCP Fast Open is supported on this platform.
+func SupportsFastOpen() bool {
+	return false
+}
+
+// EnableFastOpen enables TCP Fast Open on a listening socket (Linux only).
+func EnableFastOpen(listener net.Listener, queue int) error {
+	return ErrUnsupported
+}
+
+// FastOpenConnect is a Control hook for net.Dialer that enables TCP Fast Open
+// on outgoing connections (Linux only).
+func FastOpenConnect(network, address string, c syscall.RawConn) error {
+	return ErrUnsupported
+}
+
+func usedFastOpen(fd uintptr) (bool, error) {
+	return false, ErrUnsupported
+}
@@ -0,0 +1,53 @@
+// +build linux darwin
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err, "should be able to dial listener")
+	defer conn.Close()
+
+	err = SetKeepAlive(conn, 30*time.Second, 3)
+	assert.Nil(t, err, "should be able to set keepalive")
+
+	err = Apply(conn, func(fd uintptr) error {
+		count, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT)
+		assert.Equal(t, 3, count, "should have set probe count")
+		keepalive, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		assert.Equal(t, 1, keepalive, "should have enabled keepalive")
+		return err
+	})
+	assert.Nil(t, err, "should be able to read socket options")
+
+	err = SetKeepAlive(conn, 0, 0)
+	assert.Nil(t, err, "should be able to disable keepalive")
+}
@@ -0,0 +1,31 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SupportsQueuedBytes returns true if the number of bytes queued in the send
+// buffer of a socket can be queried on this platform.
+func SupportsQueuedBytes() bool {
+	return true
+}
+
+func queuedBytes(fd uintptr) (int, error) {
+	return unix.IoctlGetInt(int(fd), unix.SIOCOUTQ)
+}
@@ -0,0 +1,55 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueuedBytes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	defer conn.Close()
+
+	peer, err := ln.Accept()
+	assert.Nil(t, err, "should be able to accept")
+	defer peer.Close()
+
+	queued, err := QueuedBytes(conn)
+	assert.Nil(t, err, "should be able to query send queue")
+	assert.Equal(t, 0, queued, "should have nothing queued on new connection")
+
+	// Peer never reads, so data piles up once its receive buffer is full.
+	peer.(*net.TCPConn).SetReadBuffer(4096)
+	go conn.Write(make([]byte, 4*1024*1024))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for queued == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		queued, err = QueuedBytes(conn)
+		assert.Nil(t, err)
+	}
+	assert.True(t, queued > 0, "should have data queued if peer doesn't read")
+}
@@ -0,0 +1,216 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrUnsupported is returned if a socket option is not supported on this platform.
+var ErrUnsupported = errors.New("socket option not supported on this platform")
+
+// Control is the signature of the Control hook on net.Dialer and net.ListenConfig.
+type Control func(network, address string, c syscall.RawConn) error
+
+// Apply runs the given function on the underlying file descriptor of a
+// listener or connection (anything implementing syscall.Conn).
+func Apply(conn interface{}, fn func(fd uintptr) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("socket options can't be set on this connection type")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return control(raw, fn)
+}
+
+// Chain combines multiple Control hooks into one. Nil hooks are skipped.
+func Chain(controls ...Control) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if control == nil {
+				continue
+			}
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// DSCP returns a Control hook that sets the given DSCP value (0-63) on TCP
+// sockets, for traffic prioritization. Non-TCP sockets are left untouched.
+func DSCP(dscp int) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		if !isTCP(network) {
+			return nil
+		}
+		return control(c, func(fd uintptr) error {
+			return setDSCP(fd, dscp)
+		})
+	}
+}
+
+// ReusePort is a Control hook that sets SO_REUSEADDR and SO_REUSEPORT on
+// listening TCP sockets, so that several processes can listen on the same
+// port (like with the go_reuseport package). Does nothing on Windows.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	if !isTCP(network) {
+		return nil
+	}
+	return control(c, setReusePort)
+}
+
+// SetDSCP sets the given DSCP value (0-63) on an existing TCP connection.
+func SetDSCP(conn net.Conn, dscp int) error {
+	if !isTCP(conn.LocalAddr().Network()) {
+		return nil
+	}
+	return Apply(conn, func(fd uintptr) error {
+		return setDSCP(fd, dscp)
+	})
+}
+
+// KeepAliveCount returns a Control hook that sets the number of unanswered TCP
+// keepalive probes after which a connection is dropped. Keepalive itself is
+// enabled via the KeepAlive field on net.Dialer. Non-TCP sockets are left
+// untouched.
+func KeepAliveCount(count int) Control {
+	return func(network, address string, c syscall.RawConn) error {
+		if !isTCP(network) {
+			return nil
+		}
+		return control(c, func(fd uintptr) error {
+			return setKeepAliveCount(fd, count)
+		})
+	}
+}
+
+// SetKeepAlive configures TCP keepalive on an existing connection. Probes are
+// sent every interval while the connection is idle, and the connection is
+// dropped after count unanswered probes (zero to keep the system default). A
+// zero interval disables keepalive. Non-TCP connections are left untouched.
+func SetKeepAlive(conn net.Conn, interval time.Duration, count int) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if interval <= 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := tcpConn.SetKeepAlivePeriod(interval); err != nil {
+		return err
+	}
+	if count > 0 {
+		return Apply(tcpConn, func(fd uintptr) error {
+			return setKeepAliveCount(fd, count)
+		})
+	}
+	return nil
+}
+
+// IsListening returns true if the socket underlying a listener is actually
+// listening for connections (e.g. for listeners made from inherited file
+// descriptors, which could be any kind of socket).
+func IsListening(listener net.Listener) (bool, error) {
+	var listening bool
+	err := Apply(listener, func(fd uintptr) error {
+		var err error
+		listening, err = isListening(fd)
+		return err
+	})
+	return listening, err
+}
+
+// SetBacklog changes the maximum length of the queue of pending connections on
+// a listening TCP or UNIX socket, which Go sets to the system maximum (e.g.
+// net.core.somaxconn on Linux). The kernel may cap the backlog at that
+// maximum. Not supported on Windows.
+func SetBacklog(listener net.Listener, backlog int) error {
+	return Apply(listener, func(fd uintptr) error {
+		return setBacklog(fd, backlog)
+	})
+}
+
+// QueuedBytes returns the number of bytes in the send buffer of a connection
+// that the peer hasn't acknowledged yet (see SupportsQueuedBytes).
+func QueuedBytes(conn net.Conn) (int, error) {
+	var queued int
+	err := Apply(conn, func(fd uintptr) error {
+		var err error
+		queued, err = queuedBytes(fd)
+		return err
+	})
+	return queued, err
+}
+
+// UsedFastOpen returns true if a TCP connection used TCP Fast Open, i.e. the
+// peer accepted data sent along with the SYN, or we accepted a connection with
+// data in the SYN (Linux only).
+func UsedFastOpen(conn net.Conn) (bool, error) {
+	var used bool
+	err := Apply(conn, func(fd uintptr) error {
+		var err error
+		used, err = usedFastOpen(fd)
+		return err
+	})
+	return used, err
+}
+
+// OnAccept wraps a listener so that fn is called on every accepted connection,
+// e.g. to set socket options on it.
+func OnAccept(listener net.Listener, fn func(conn net.Conn)) net.Listener {
+	return &acceptHookListener{listener, fn}
+}
+
+type acceptHookListener struct {
+	net.Listener
+	fn func(conn net.Conn)
+}
+
+func (l *acceptHookListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.fn(conn)
+	}
+	return conn, err
+}
+
+func isTCP(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
+
+func control(raw syscall.RawConn, fn func(fd uintptr) error) error {
+	var opErr error
+	err := raw.Control(func(fd uintptr) {
+		opErr = fn(fd)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
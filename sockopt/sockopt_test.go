@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDSCP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+		return
+	}
+
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			// IPv6 may not be available in test environment
+			t.Logf("unable to listen on %s: %s", addr, err)
+			continue
+		}
+
+		accepted := make(chan error, 1)
+		go func() {
+			conn, err := OnAccept(ln, func(conn net.Conn) {
+				accepted <- SetDSCP(conn, 46)
+			}).Accept()
+			if err == nil {
+				conn.Close()
+			}
+		}()
+
+		dialer := &net.Dialer{Control: DSCP(46)}
+		conn, err := dialer.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err, "should be able to dial with DSCP set")
+		assert.Nil(t, <-accepted, "should be able to set DSCP on accepted conn")
+		conn.Close()
+		ln.Close()
+	}
+}
+
+func TestChain(t *testing.T) {
+	calls := 0
+	count := func(network, address string, c syscall.RawConn) error {
+		calls++
+		return nil
+	}
+
+	dialer := &net.Dialer{Control: Chain(count, nil, count)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial")
+	conn.Close()
+	assert.Equal(t, 2, calls, "should call all hooks in chain")
+}
@@ -0,0 +1,56 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SupportsTransparent returns true if transparent proxying (binding outgoing
+// connections to non-local addresses) is supported on this platform.
+func SupportsTransparent() bool {
+	return true
+}
+
+// CheckTransparent returns an error if IP_TRANSPARENT can't be set on
+// sockets, usually because the process lacks the CAP_NET_ADMIN capability.
+func CheckTransparent() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+}
+
+// Transparent is a Control hook for net.Dialer that sets IP_TRANSPARENT (or
+// IPV6_TRANSPARENT) on outgoing TCP connections, so that they can be bound to
+// a non-local address, e.g. the address of a proxied client. Non-TCP sockets
+// are left untouched.
+func Transparent(network, address string, c syscall.RawConn) error {
+	if !isTCP(network) {
+		return nil
+	}
+	return control(c, func(fd uintptr) error {
+		if network == "tcp6" {
+			return unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+		return unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+	})
+}
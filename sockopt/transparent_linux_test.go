@@ -0,0 +1,45 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransparentDial(t *testing.T) {
+	if err := CheckTransparent(); err != nil {
+		t.Skipf("IP_TRANSPARENT not available (needs CAP_NET_ADMIN): %s", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should be able to listen on random port")
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	dialer := &net.Dialer{Control: Transparent, LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+	conn, err := dialer.Dial("tcp4", ln.Addr().String())
+	assert.Nil(t, err, "should be able to dial with IP_TRANSPARENT set")
+	conn.Close()
+}
@@ -0,0 +1,41 @@
+// +build !linux
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sockopt
+
+import (
+	"syscall"
+)
+
+// SupportsTransparent returns true if transparent proxying (binding outgoing
+// connections to non-local addresses) is supported on this platform.
+func SupportsTransparent() bool {
+	return false
+}
+
+// CheckTransparent returns an error if IP_TRANSPARENT can't be set on
+// sockets (Linux only).
+func CheckTransparent() error {
+	return ErrUnsupported
+}
+
+// Transparent is a Control hook for net.Dialer that sets IP_TRANSPARENT on
+// outgoing TCP connections (Linux only).
+func Transparent(network, address string, c syscall.RawConn) error {
+	return ErrUnsupported
+}
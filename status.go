@@ -17,13 +17,30 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Elbandi/ghostunnel/backend"
+	"github.com/Elbandi/ghostunnel/certloader"
+	"github.com/Elbandi/ghostunnel/proxy"
+)
+
+// How often the signal handler loop checks in, and how long it may go without
+// doing so before /_liveness reports the process as unresponsive.
+const (
+	heartbeatInterval = time.Second
+	livenessTimeout   = 30 * time.Second
 )
 
 type statusHandler struct {
@@ -31,26 +48,108 @@ type statusHandler struct {
 	mu *sync.Mutex
 	// Backend dialer to check if target is up and running
 	dial func() (net.Conn, error)
+	// Returns the backend target currently in use, if there are several (optional)
+	target func() string
+	// Returns the result of the last backend health check, used instead of
+	// dialing the backend if set (optional)
+	health func() error
+	// Background probe of the backend, with --status-check-target (optional)
+	check *backend.HealthCheck
+	// Certificate that must be loaded and valid for /_readiness (optional)
+	cert certloader.Certificate
+	// Whether /_readiness also requires the backend to be up
+	readyBackend bool
+	// Last check-in of the signal handler loop, in UNIX nanoseconds (zero
+	// until the loop starts)
+	heartbeat atomic.Int64
 	// Current status
 	listening bool
 	reloading bool
+	draining  bool
 }
 
 type statusResponse struct {
-	Ok            bool      `json:"ok"`
-	Status        string    `json:"status"`
-	BackendOk     bool      `json:"backend_ok"`
-	BackendStatus string    `json:"backend_status"`
-	BackendError  string    `json:"backend_error,omitempty"`
-	Time          time.Time `json:"time"`
-	Hostname      string    `json:"hostname,omitempty"`
-	Message       string    `json:"message"`
-	Revision      string    `json:"revision"`
-	Compiler      string    `json:"compiler"`
+	Ok            bool                  `json:"ok"`
+	Status        string                `json:"status"`
+	BackendOk     bool                  `json:"backend_ok"`
+	BackendStatus string                `json:"backend_status"`
+	BackendError  string                `json:"backend_error,omitempty"`
+	BackendTarget string                `json:"backend_target,omitempty"`
+	BackendCheck  *backendCheckResponse `json:"backend_check,omitempty"`
+	Time          time.Time             `json:"time"`
+	Hostname      string                `json:"hostname,omitempty"`
+	Message       string                `json:"message"`
+	Revision      string                `json:"revision"`
+	Compiler      string                `json:"compiler"`
+}
+
+type backendCheckResponse struct {
+	Ok                  bool       `json:"ok"`
+	Error               string     `json:"error,omitempty"`
+	LatencySeconds      float64    `json:"latency_seconds"`
+	LastCheck           time.Time  `json:"last_check"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+type livenessResponse struct {
+	Ok      bool      `json:"ok"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type readinessResponse struct {
+	Ok      bool             `json:"ok"`
+	Status  string           `json:"status"`
+	Message string           `json:"message"`
+	Checks  []readinessCheck `json:"checks"`
+	Time    time.Time        `json:"time"`
+}
+
+type readinessCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type drainResponse struct {
+	Draining          bool `json:"draining"`
+	ActiveConnections int  `json:"active_connections"`
+}
+
+type connectionsResponse struct {
+	Total       int                  `json:"total"`
+	Offset      int                  `json:"offset"`
+	Connections []connectionResponse `json:"connections"`
+}
+
+type connectionResponse struct {
+	Client          string    `json:"client"`
+	Peer            string    `json:"peer"`
+	Target          string    `json:"target"`
+	Listener        string    `json:"listener,omitempty"`
+	Route           string    `json:"route,omitempty"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesDownstream int64     `json:"bytes_downstream"`
+	BytesUpstream   int64     `json:"bytes_upstream"`
+}
+
+// Default and maximum number of connections per page of /_status/connections.
+const (
+	connectionsPageSize    = 100
+	connectionsMaxPageSize = 1000
+)
+
+type acceptRateResponse struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	Mode  string  `json:"mode"`
 }
 
 func newStatusHandler(dial func() (net.Conn, error)) *statusHandler {
-	status := &statusHandler{&sync.Mutex{}, dial, false, false}
+	status := &statusHandler{mu: &sync.Mutex{}, dial: dial}
 	return status
 }
 
@@ -67,6 +166,49 @@ func (s *statusHandler) Reloading() {
 	s.mu.Unlock()
 }
 
+// Draining marks us as shutting down, so that load balancers stop sending
+// new connections while existing ones drain.
+func (s *statusHandler) Draining() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+}
+
+// Heartbeat records that the signal handler loop is still responsive.
+func (s *statusHandler) Heartbeat() {
+	s.heartbeat.Store(time.Now().UnixNano())
+}
+
+// state returns whether we're listening and draining, and a message
+// describing the current state.
+func (s *statusHandler) state() (listening, draining bool, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		message = "draining"
+	} else if !s.listening {
+		message = "initializing"
+	} else if s.reloading {
+		message = "reloading"
+	} else {
+		message = "listening"
+	}
+	return s.listening, s.draining, message
+}
+
+// checkBackend checks if the backend is up, using the result of the last
+// health check if there is one, or by dialing it otherwise.
+func (s *statusHandler) checkBackend() error {
+	if s.health != nil {
+		return s.health()
+	}
+	conn, err := s.dial()
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
 func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	resp := statusResponse{
 		Time: time.Now(),
@@ -75,27 +217,39 @@ func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	resp.Revision = version
 	resp.Compiler = runtime.Version()
 
-	conn, err := s.dial()
+	err := s.checkBackend()
 	resp.BackendOk = err == nil
 
 	if resp.BackendOk {
-		conn.Close()
 		resp.BackendStatus = "ok"
 	} else {
 		resp.BackendError = err.Error()
 		resp.BackendStatus = "critical"
 	}
 
-	s.mu.Lock()
-	resp.Ok = s.listening && resp.BackendOk
-	if !s.listening {
-		resp.Message = "initializing"
-	} else if s.reloading {
-		resp.Message = "reloading"
-	} else {
-		resp.Message = "listening"
+	if s.target != nil {
+		resp.BackendTarget = s.target()
+	}
+
+	if s.check != nil {
+		result := s.check.Result()
+		resp.BackendCheck = &backendCheckResponse{
+			Ok:                  result.Err == nil,
+			LatencySeconds:      result.Latency.Seconds(),
+			LastCheck:           result.Checked,
+			ConsecutiveFailures: result.Failures,
+		}
+		if result.Err != nil {
+			resp.BackendCheck.Error = result.Err.Error()
+		}
+		if !result.LastSuccess.IsZero() {
+			resp.BackendCheck.LastSuccess = &result.LastSuccess
+		}
 	}
-	s.mu.Unlock()
+
+	listening, draining, message := s.state()
+	resp.Ok = listening && !draining && resp.BackendOk
+	resp.Message = message
 
 	if resp.Ok && resp.BackendOk {
 		resp.Status = "ok"
@@ -117,3 +271,259 @@ func (s *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	_, _ = w.Write(out)
 }
+
+// livenessHandler serves /_liveness, which reports whether the process should
+// be restarted. It's ok for as long as we're running (including while
+// initializing or draining), unless the signal handler loop stopped checking
+// in, e.g. because it's deadlocked.
+func (s *statusHandler) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	resp := livenessResponse{
+		Ok:      true,
+		Status:  "ok",
+		Message: "alive",
+		Time:    time.Now(),
+	}
+
+	// The loop doesn't check in before it starts, or once we shut down.
+	_, draining, _ := s.state()
+	if last := s.heartbeat.Load(); last != 0 && !draining {
+		if since := resp.Time.Sub(time.Unix(0, last)); since > livenessTimeout {
+			resp.Ok = false
+			resp.Status = "critical"
+			resp.Message = fmt.Sprintf("signal handler unresponsive for %s", since.Truncate(time.Second))
+		}
+	}
+
+	out, err := json.Marshal(resp)
+	panicOnError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(out)
+}
+
+// readinessHandler serves /_readiness, which reports whether we should be
+// sent new connections: the certificate must be loaded and valid, and the
+// listener must be accepting connections (so it fails as soon as we start
+// draining). With --readiness-check-backend, the backend must be up too. The
+// response lists each check, with the reason it failed, if it did.
+func (s *statusHandler) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	resp := readinessResponse{
+		Ok:     true,
+		Checks: []readinessCheck{},
+		Time:   time.Now(),
+	}
+	check := func(name string, err error) {
+		result := readinessCheck{Name: name, Ok: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			resp.Ok = false
+		}
+		resp.Checks = append(resp.Checks, result)
+	}
+
+	listening, draining, message := s.state()
+	resp.Message = message
+	if draining {
+		check("listener", errors.New("draining, not accepting new connections"))
+	} else if !listening {
+		check("listener", errors.New("not accepting connections yet"))
+	} else {
+		check("listener", nil)
+	}
+	if s.cert != nil {
+		check("certificate", checkCertificate(s.cert, resp.Time))
+	}
+	if s.readyBackend {
+		check("backend", s.checkBackend())
+	}
+
+	if resp.Ok {
+		resp.Status = "ok"
+	} else {
+		resp.Status = "critical"
+	}
+
+	out, err := json.Marshal(resp)
+	panicOnError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(out)
+}
+
+// checkCertificate returns an error if the current certificate can't be
+// loaded, or isn't valid at the given time.
+func checkCertificate(cert certloader.Certificate, now time.Time) error {
+	leaf, err := certificateLeaf(cert)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate: %s", err)
+	}
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certificateLeaf returns the parsed leaf of the current certificate.
+func certificateLeaf(cert certloader.Certificate) (*x509.Certificate, error) {
+	tlsCert, err := cert.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		return nil, err
+	}
+	if tlsCert != nil && tlsCert.Leaf != nil {
+		return tlsCert.Leaf, nil
+	}
+	if tlsCert == nil || len(tlsCert.Certificate) == 0 {
+		return nil, errors.New("no certificate loaded")
+	}
+	return x509.ParseCertificate(tlsCert.Certificate[0])
+}
+
+// drainHandler serves /_drain, for orchestrators that want to take us out of
+// rotation before sending a shutdown signal: POST stops accepting new
+// connections, and GET (or POST) reports how many are still open.
+func (context *Context) drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		context.drain()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context.listenMu.Lock()
+	draining := context.drained
+	context.listenMu.Unlock()
+
+	out, err := json.Marshal(drainResponse{
+		Draining:          draining,
+		ActiveConnections: context.activeConnections(),
+	})
+	panicOnError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// acceptRateHandler serves /_accept_rate: GET reports the current accept rate
+// limit, and POST changes it to the rate (and optionally, burst) given in the
+// form, e.g. to slow down a reconnect storm without restarting.
+func (context *Context) acceptRateHandler(w http.ResponseWriter, r *http.Request) {
+	context.listenMu.Lock()
+	p := context.proxy
+	context.listenMu.Unlock()
+	if p == nil {
+		http.Error(w, "not listening yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+		if err != nil || rate < 0 {
+			http.Error(w, "invalid rate, must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		burst := 0
+		if value := r.FormValue("burst"); value != "" {
+			burst, err = strconv.Atoi(value)
+			if err != nil || burst < 0 {
+				http.Error(w, "invalid burst, must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+		}
+		p.SetAcceptRate(rate, burst)
+		rate, burst = p.AcceptRate()
+		logger.Printf("changed accept rate to %g connections per second (burst %d)", rate, burst)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rate, burst := p.AcceptRate()
+	out, err := json.Marshal(acceptRateResponse{
+		Rate:  rate,
+		Burst: burst,
+		Mode:  *acceptRateMode,
+	})
+	panicOnError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// connectionsHandler serves /_status/connections, listing the connections
+// that are currently being forwarded (oldest first) with the bytes
+// transferred so far. As there may be many, the list is paginated with the
+// offset and limit query parameters.
+func (context *Context) connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	offset, limit := 0, connectionsPageSize
+	var err error
+	if value := r.FormValue("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset, must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > connectionsMaxPageSize {
+			http.Error(w, fmt.Sprintf("invalid limit, must be between 1 and %d", connectionsMaxPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	context.listenMu.Lock()
+	p := context.proxy
+	context.listenMu.Unlock()
+
+	var conns []proxy.Connection
+	if p != nil {
+		conns = p.Connections()
+	}
+	resp := connectionsResponse{
+		Total:       len(conns),
+		Offset:      offset,
+		Connections: []connectionResponse{},
+	}
+	now := time.Now()
+	for i := offset; i < len(conns) && i < offset+limit; i++ {
+		conn := conns[i]
+		resp.Connections = append(resp.Connections, connectionResponse{
+			Client:          conn.Client,
+			Peer:            conn.Peer,
+			Target:          conn.Target,
+			Listener:        conn.Listener,
+			Route:           conn.Route,
+			Start:           conn.Start,
+			DurationSeconds: now.Sub(conn.Start).Seconds(),
+			BytesDownstream: conn.Downstream,
+			BytesUpstream:   conn.Upstream,
+		})
+	}
+
+	out, err := json.Marshal(resp)
+	panicOnError(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
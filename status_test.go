@@ -17,13 +17,20 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/Elbandi/ghostunnel/backend"
+	"github.com/Elbandi/ghostunnel/proxy"
 )
 
 // Mock net.Conn for testing
@@ -93,6 +100,34 @@ func TestStatusHandlerListeningBackendDown(t *testing.T) {
 	}
 }
 
+func TestStatusHandlerBackendCheck(t *testing.T) {
+	handler := newStatusHandler(func() (net.Conn, error) {
+		t.Error("status should not dial backend with a background check")
+		return dummyDialError()
+	})
+	check := backend.NewStatusCheck(dummyDialError, time.Second, 2, logger)
+	check.Start(time.Hour)()
+	handler.check = check
+	handler.health = check.Err
+	handler.Listening()
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, nil)
+	var resp statusResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid status response: %s", err)
+	}
+	if response.Code != 200 || !resp.BackendOk {
+		t.Error("status should return 200 until enough probes in a row failed")
+	}
+	if resp.BackendCheck == nil || resp.BackendCheck.Ok || resp.BackendCheck.Error != "fail" || resp.BackendCheck.ConsecutiveFailures != 1 {
+		t.Errorf("status should report result of last probe, got %q", response.Body.String())
+	}
+	if resp.BackendCheck.LastSuccess != nil || resp.BackendCheck.LastCheck.IsZero() {
+		t.Errorf("status should report time of last probe, but no last success, got %q", response.Body.String())
+	}
+}
+
 func TestStatusHandlerReloading(t *testing.T) {
 	handler := newStatusHandler(dummyDial)
 	response := httptest.NewRecorder()
@@ -104,3 +139,342 @@ func TestStatusHandlerReloading(t *testing.T) {
 		t.Error("status should return 200 during reload")
 	}
 }
+
+func TestStatusHandlerDraining(t *testing.T) {
+	handler := newStatusHandler(dummyDial)
+	response := httptest.NewRecorder()
+	handler.Listening()
+	handler.Draining()
+	handler.ServeHTTP(response, nil)
+
+	if response.Code != 503 {
+		t.Error("status should return 503 while draining")
+	}
+	if !strings.Contains(response.Body.String(), `"message":"draining"`) {
+		t.Error("status should report draining")
+	}
+}
+
+func TestStatusHandlerBackendTarget(t *testing.T) {
+	handler := newStatusHandler(dummyDial)
+	handler.target = func() string { return "localhost:8081" }
+	response := httptest.NewRecorder()
+	handler.Listening()
+	handler.ServeHTTP(response, nil)
+
+	if !strings.Contains(response.Body.String(), `"backend_target":"localhost:8081"`) {
+		t.Error("status should include active backend target")
+	}
+}
+
+func TestStatusHandlerHealthCheck(t *testing.T) {
+	var healthErr error
+	handler := newStatusHandler(dummyDialError)
+	handler.health = func() error { return healthErr }
+	handler.Listening()
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, nil)
+	if response.Code != 200 {
+		t.Error("status should use health check result instead of dialing")
+	}
+
+	healthErr = errors.New("no backend reachable")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, nil)
+	if response.Code != 503 {
+		t.Error("status should return 503 if health check failed")
+	}
+	if !strings.Contains(response.Body.String(), `"backend_error":"no backend reachable"`) {
+		t.Error("status should include health check error")
+	}
+}
+
+func TestDrainHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+
+	context := &Context{status: newStatusHandler(dummyDial)}
+	p := proxy.New(ln, time.Second, dummyDial, logger)
+	context.setProxy(p)
+	go p.Accept()
+	defer p.Shutdown()
+	context.status.Listening()
+
+	response := httptest.NewRecorder()
+	context.drainHandler(response, httptest.NewRequest("GET", "/_drain", nil))
+	if response.Code != 200 || response.Body.String() != `{"draining":false,"active_connections":0}` {
+		t.Errorf("unexpected response before drain: %d %s", response.Code, response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	context.drainHandler(response, httptest.NewRequest("POST", "/_drain", nil))
+	if response.Code != 200 || response.Body.String() != `{"draining":true,"active_connections":0}` {
+		t.Errorf("unexpected response to drain request: %d %s", response.Code, response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	context.status.ServeHTTP(response, nil)
+	if response.Code != 503 {
+		t.Error("status should return 503 after drain request")
+	}
+
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("should stop accepting connections after drain request")
+	}
+
+	response = httptest.NewRecorder()
+	context.drainHandler(response, httptest.NewRequest("DELETE", "/_drain", nil))
+	if response.Code != 405 {
+		t.Error("should reject other methods")
+	}
+}
+
+func TestAcceptRateHandler(t *testing.T) {
+	defer func(mode string) { *acceptRateMode = mode }(*acceptRateMode)
+	*acceptRateMode = "pause"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+
+	context := &Context{status: newStatusHandler(dummyDial)}
+	response := httptest.NewRecorder()
+	context.acceptRateHandler(response, httptest.NewRequest("GET", "/_accept_rate", nil))
+	if response.Code != 503 {
+		t.Error("should return 503 before listening")
+	}
+
+	p := proxy.New(ln, time.Second, dummyDial, logger)
+	p.EnableAcceptRate(10, 0, false)
+	context.setProxy(p)
+	go p.Accept()
+	defer p.Shutdown()
+
+	response = httptest.NewRecorder()
+	context.acceptRateHandler(response, httptest.NewRequest("GET", "/_accept_rate", nil))
+	if response.Code != 200 || response.Body.String() != `{"rate":10,"burst":10,"mode":"pause"}` {
+		t.Errorf("unexpected response: %d %s", response.Code, response.Body.String())
+	}
+
+	request := httptest.NewRequest("POST", "/_accept_rate", strings.NewReader("rate=2.5&burst=5"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response = httptest.NewRecorder()
+	context.acceptRateHandler(response, request)
+	if response.Code != 200 || response.Body.String() != `{"rate":2.5,"burst":5,"mode":"pause"}` {
+		t.Errorf("unexpected response to change: %d %s", response.Code, response.Body.String())
+	}
+	if rate, burst := p.AcceptRate(); rate != 2.5 || burst != 5 {
+		t.Errorf("should change accept rate, got %g (burst %d)", rate, burst)
+	}
+
+	for _, body := range []string{"", "rate=-1", "rate=abc", "rate=1&burst=-1", "rate=1&burst=1.5"} {
+		request := httptest.NewRequest("POST", "/_accept_rate", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response = httptest.NewRecorder()
+		context.acceptRateHandler(response, request)
+		if response.Code != 400 {
+			t.Errorf("should reject invalid request %q, got %d", body, response.Code)
+		}
+	}
+
+	response = httptest.NewRecorder()
+	context.acceptRateHandler(response, httptest.NewRequest("DELETE", "/_accept_rate", nil))
+	if response.Code != 405 {
+		t.Error("should reject other methods")
+	}
+}
+
+func TestConnectionsHandler(t *testing.T) {
+	context := &Context{status: newStatusHandler(dummyDial)}
+	response := httptest.NewRecorder()
+	context.connectionsHandler(response, httptest.NewRequest("GET", "/_status/connections", nil))
+	if response.Code != 200 || response.Body.String() != `{"total":0,"offset":0,"connections":[]}` {
+		t.Errorf("unexpected response before listening: %d %s", response.Code, response.Body.String())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer target.Close()
+
+	p := proxy.New(ln, time.Second, func() (net.Conn, error) {
+		return net.Dial("tcp", target.Addr().String())
+	}, logger)
+	context.setProxy(p)
+	go p.Accept()
+	defer p.Shutdown()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		panicOnError(err)
+		defer conn.Close()
+		backend, err := target.Accept()
+		panicOnError(err)
+		defer backend.Close()
+	}
+	for i := 0; i < 100 && len(p.Connections()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response = httptest.NewRecorder()
+	context.connectionsHandler(response, httptest.NewRequest("GET", "/_status/connections?offset=1&limit=1", nil))
+	var resp connectionsResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &resp); err != nil || response.Code != 200 {
+		t.Fatalf("unexpected response: %d %s", response.Code, response.Body.String())
+	}
+	if resp.Total != 2 || resp.Offset != 1 || len(resp.Connections) != 1 {
+		t.Errorf("should return second page of connections, got %s", response.Body.String())
+	}
+	if len(resp.Connections) > 0 && resp.Connections[0].Target != "tcp:"+target.Addr().String() {
+		t.Errorf("should list target of connection, got %s", resp.Connections[0].Target)
+	}
+
+	for _, query := range []string{"offset=-1", "offset=abc", "limit=0", "limit=1001"} {
+		response = httptest.NewRecorder()
+		context.connectionsHandler(response, httptest.NewRequest("GET", "/_status/connections?"+query, nil))
+		if response.Code != 400 {
+			t.Errorf("should reject invalid request %q, got %d", query, response.Code)
+		}
+	}
+
+	response = httptest.NewRecorder()
+	context.connectionsHandler(response, httptest.NewRequest("POST", "/_status/connections", nil))
+	if response.Code != 405 {
+		t.Error("should reject other methods")
+	}
+}
+
+func TestDrainBeforeListening(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+
+	context := &Context{status: newStatusHandler(dummyDial)}
+	context.drain()
+
+	p := proxy.New(ln, time.Second, dummyDial, logger)
+	context.setProxy(p)
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("should not accept connections if drain was requested before listening")
+	}
+}
+
+func TestLivenessHandler(t *testing.T) {
+	handler := newStatusHandler(dummyDialError)
+	response := httptest.NewRecorder()
+	handler.livenessHandler(response, nil)
+	if response.Code != 200 {
+		t.Error("liveness should return 200 while initializing, even if backend is down")
+	}
+
+	handler.Listening()
+	handler.Heartbeat()
+	response = httptest.NewRecorder()
+	handler.livenessHandler(response, nil)
+	if response.Code != 200 {
+		t.Error("liveness should return 200 while signal handler is responsive")
+	}
+
+	handler.heartbeat.Store(time.Now().Add(-2 * livenessTimeout).UnixNano())
+	response = httptest.NewRecorder()
+	handler.livenessHandler(response, nil)
+	if response.Code != 503 {
+		t.Error("liveness should return 503 if signal handler is unresponsive")
+	}
+	var resp livenessResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &resp); err != nil || !strings.Contains(resp.Message, "unresponsive") {
+		t.Errorf("liveness should explain failure, got %q", response.Body.String())
+	}
+
+	handler.Draining()
+	response = httptest.NewRecorder()
+	handler.livenessHandler(response, nil)
+	if response.Code != 200 {
+		t.Error("liveness should return 200 while draining")
+	}
+}
+
+func readinessChecks(t *testing.T, handler *statusHandler) (int, map[string]string) {
+	response := httptest.NewRecorder()
+	handler.readinessHandler(response, nil)
+
+	var resp readinessResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid readiness response: %s", err)
+	}
+	if resp.Ok != (response.Code == 200) {
+		t.Errorf("readiness ok (%t) doesn't match status code (%d)", resp.Ok, response.Code)
+	}
+	checks := map[string]string{}
+	for _, check := range resp.Checks {
+		if check.Ok != (check.Error == "") {
+			t.Errorf("check %s should have an error if (and only if) it failed", check.Name)
+		}
+		checks[check.Name] = check.Error
+	}
+	return response.Code, checks
+}
+
+func TestReadinessHandler(t *testing.T) {
+	handler := newStatusHandler(dummyDialError)
+	code, checks := readinessChecks(t, handler)
+	if code != 503 || !strings.Contains(checks["listener"], "not accepting") {
+		t.Errorf("readiness should fail on listener while initializing, got %d %v", code, checks)
+	}
+
+	handler.Listening()
+	code, checks = readinessChecks(t, handler)
+	if code != 200 {
+		t.Errorf("readiness should return 200 once listening, got %d %v", code, checks)
+	}
+	if _, ok := checks["backend"]; ok {
+		t.Error("readiness should not check backend unless enabled")
+	}
+
+	handler.readyBackend = true
+	code, checks = readinessChecks(t, handler)
+	if code != 503 || checks["backend"] != "fail" {
+		t.Errorf("readiness should fail on backend if enabled and backend is down, got %d %v", code, checks)
+	}
+
+	handler.readyBackend = false
+	handler.Draining()
+	code, checks = readinessChecks(t, handler)
+	if code != 503 || !strings.Contains(checks["listener"], "draining") {
+		t.Errorf("readiness should fail on listener while draining, got %d %v", code, checks)
+	}
+}
+
+func TestReadinessHandlerCertificate(t *testing.T) {
+	handler := newStatusHandler(dummyDial)
+	handler.Listening()
+
+	leaf := &x509.Certificate{
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	handler.cert = fakeCertificate{&tls.Certificate{Leaf: leaf}}
+	code, checks := readinessChecks(t, handler)
+	if code != 200 || checks["certificate"] != "" {
+		t.Errorf("readiness should return 200 with valid certificate, got %d %v", code, checks)
+	}
+
+	leaf.NotAfter = time.Now().Add(-time.Minute)
+	code, checks = readinessChecks(t, handler)
+	if code != 503 || !strings.Contains(checks["certificate"], "expired") {
+		t.Errorf("readiness should fail on expired certificate, got %d %v", code, checks)
+	}
+
+	leaf.NotBefore = time.Now().Add(time.Hour)
+	leaf.NotAfter = time.Now().Add(2 * time.Hour)
+	code, checks = readinessChecks(t, handler)
+	if code != 503 || !strings.Contains(checks["certificate"], "not valid before") {
+		t.Errorf("readiness should fail on certificate that isn't valid yet, got %d %v", code, checks)
+	}
+
+	handler.cert = fakeCertificate{}
+	code, checks = readinessChecks(t, handler)
+	if code != 503 || !strings.Contains(checks["certificate"], "no certificate loaded") {
+		t.Errorf("readiness should fail if no certificate is loaded, got %d %v", code, checks)
+	}
+}
@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Prefix for listen addresses that refer to a socket passed in with systemd
+// socket activation, by name (e.g. "systemd:proxy" for a socket with
+// FileDescriptorName=proxy).
+const systemdAddressPrefix = "systemd:"
+
+// First file descriptor passed in with socket activation, see sd_listen_fds(3).
+const systemdFirstFd = 3
+
+// Original systemd:NAME addresses, by the fd:NUM address they resolved to.
+var systemdResolved = map[string]string{}
+
+func isSystemdAddress(address string) bool {
+	return strings.HasPrefix(address, systemdAddressPrefix)
+}
+
+// resolveSystemdAddresses replaces systemd:NAME addresses with fd:NUM
+// addresses for the sockets passed in with socket activation, based on the
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables. If systemd
+// didn't pass names, sockets are assigned to the addresses in order. Every
+// passed socket must be used by exactly one address. The variables are
+// cleared afterwards, so that child processes (with --exec) don't pick them up.
+// Addresses with a socket passed in on upgrade are left as they are.
+func resolveSystemdAddresses(addresses []*string) error {
+	names := []string{}
+	for _, address := range addresses {
+		if isSystemdAddress(*address) && !inherited.has(*address) {
+			names = append(names, strings.TrimPrefix(*address, systemdAddressPrefix))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	fds, err := systemdSockets(names)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if isSystemdAddress(*address) && !inherited.has(*address) {
+			name := strings.TrimPrefix(*address, systemdAddressPrefix)
+			logger.Printf("using socket '%s' passed in by systemd (fd:%d)", name, fds[name])
+			resolved := fmt.Sprintf("%s%d", fdAddressPrefix, fds[name])
+			systemdResolved[resolved] = *address
+			*address = resolved
+		}
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return nil
+}
+
+// systemdSockets maps the given socket names (in the order given in flags) to
+// the file descriptors passed in by systemd.
+func systemdSockets(names []string) (map[string]int, error) {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("invalid listen address %s, missing socket name", systemdAddressPrefix)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("socket '%s' from systemd is used in more than one address", name)
+		}
+		seen[name] = true
+	}
+
+	if os.Getenv("LISTEN_FDS") == "" {
+		return nil, fmt.Errorf("%s%s address given, but no sockets were passed in by systemd (LISTEN_FDS is not set)", systemdAddressPrefix, names[0])
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS value '%s'", os.Getenv("LISTEN_FDS"))
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("sockets from systemd were passed to process %s, not to us (%d)", pid, os.Getpid())
+	}
+	if count != len(names) {
+		return nil, fmt.Errorf("got %d sockets from systemd (LISTEN_FDS), but flags use %d %s addresses", count, len(names), systemdAddressPrefix)
+	}
+
+	fds := map[string]int{}
+	passed := os.Getenv("LISTEN_FDNAMES")
+	if passed == "" {
+		// No names, use sockets in order.
+		for i, name := range names {
+			fds[name] = systemdFirstFd + i
+		}
+		return fds, nil
+	}
+
+	passedNames := strings.Split(passed, ":")
+	if len(passedNames) != count {
+		return nil, fmt.Errorf("got %d sockets from systemd (LISTEN_FDS), but %d names (LISTEN_FDNAMES)", count, len(passedNames))
+	}
+	for i, name := range passedNames {
+		if _, ok := fds[name]; ok {
+			return nil, fmt.Errorf("got more than one socket named '%s' from systemd", name)
+		}
+		fds[name] = systemdFirstFd + i
+	}
+	for _, name := range names {
+		if _, ok := fds[name]; !ok {
+			return nil, fmt.Errorf("no socket named '%s' passed in by systemd (got %s)", name, strings.Join(passedNames, ", "))
+		}
+	}
+	return fds, nil
+}
+
+// flagAddress returns the listen address as given in flags, before resolving
+// systemd:NAME addresses.
+func flagAddress(address string) string {
+	if original, ok := systemdResolved[address]; ok {
+		return original
+	}
+	return address
+}
@@ -0,0 +1,101 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Simulate socket activation, as if systemd had passed in the given number of
+// sockets (and names, if set).
+func setSystemdEnv(t *testing.T, count int, names string) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(count))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestResolveSystemdAddressesNamed(t *testing.T) {
+	setSystemdEnv(t, 2, "status:proxy")
+
+	listen, status, other := "systemd:proxy", "systemd:status", "localhost:8080"
+	err := resolveSystemdAddresses([]*string{&listen, &other, &status})
+	assert.Nil(t, err, "should map named sockets")
+	assert.Equal(t, "fd:4", listen)
+	assert.Equal(t, "fd:3", status)
+	assert.Equal(t, "localhost:8080", other, "should leave other addresses alone")
+	assert.Equal(t, "systemd:proxy", flagAddress(listen), "should remember address from flags")
+
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok, "should clear environment for child processes")
+}
+
+func TestResolveSystemdAddressesPositional(t *testing.T) {
+	setSystemdEnv(t, 2, "")
+
+	listen, status := "systemd:proxy", "systemd:status"
+	err := resolveSystemdAddresses([]*string{&listen, &status})
+	assert.Nil(t, err, "should map sockets in order without names")
+	assert.Equal(t, "fd:3", listen)
+	assert.Equal(t, "fd:4", status)
+}
+
+func TestResolveSystemdAddressesNone(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "")
+	listen := "localhost:8080"
+	err := resolveSystemdAddresses([]*string{&listen})
+	assert.Nil(t, err, "should do nothing without systemd addresses")
+
+	listen = "systemd:proxy"
+	err = resolveSystemdAddresses([]*string{&listen})
+	assert.NotNil(t, err, "should fail if no sockets were passed in")
+}
+
+func TestResolveSystemdAddressesMismatch(t *testing.T) {
+	for _, test := range []struct {
+		count     int
+		names     string
+		addresses []string
+		reason    string
+	}{
+		{1, "proxy", []string{"systemd:proxy", "systemd:status"}, "more addresses than sockets"},
+		{2, "proxy:status", []string{"systemd:proxy"}, "unused socket"},
+		{2, "", []string{"systemd:proxy"}, "unused socket without names"},
+		{2, "proxy:admin", []string{"systemd:proxy", "systemd:status"}, "unknown name"},
+		{2, "proxy:proxy", []string{"systemd:proxy", "systemd:status"}, "duplicate names from systemd"},
+		{2, "proxy:status", []string{"systemd:proxy", "systemd:proxy"}, "duplicate names in flags"},
+		{2, "proxy", []string{"systemd:proxy", "systemd:status"}, "fewer names than sockets"},
+		{1, "", []string{"systemd:"}, "missing name"},
+	} {
+		setSystemdEnv(t, test.count, test.names)
+		addresses := []*string{}
+		for i := range test.addresses {
+			addresses = append(addresses, &test.addresses[i])
+		}
+		err := resolveSystemdAddresses(addresses)
+		assert.NotNil(t, err, "should reject %s", test.reason)
+	}
+
+	setSystemdEnv(t, 1, "proxy")
+	t.Setenv("LISTEN_PID", "1")
+	listen := "systemd:proxy"
+	err := resolveSystemdAddresses([]*string{&listen})
+	assert.NotNil(t, err, "should reject sockets passed to other process")
+}
@@ -17,16 +17,28 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 
+	"github.com/Elbandi/ghostunnel/auth"
 	"github.com/Elbandi/ghostunnel/certloader"
+	"github.com/Elbandi/ghostunnel/wildcard"
 )
 
+// Writer for TLS session secrets, with --keylog-file (nil if not set).
+var keyLogWriter io.Writer
+
+// Set if --cipher-suites was given on the command line (it has a default).
+var cipherSuitesSet bool
+
 var cipherSuites = map[string][]uint16{
 	"AES": {
 		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
@@ -57,6 +69,126 @@ var cipherSuites = map[string][]uint16{
 	},
 }
 
+// cipherSuiteByName looks up a TLS 1.2 (or older) cipher suite by its
+// standard name (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Insecure suites
+// that aren't in any of the built-in groups (e.g. RC4) require
+// --allow-unsafe-cipher-suites.
+func cipherSuiteByName(name string) (*tls.CipherSuite, error) {
+	name = strings.TrimSpace(name)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		// The crypto/tls constants for ChaCha20 suites lack the _SHA256 suffix.
+		alias := strings.TrimSuffix(suite.Name, "_SHA256")
+		if name != suite.Name && (name != alias || !strings.HasSuffix(alias, "_CHACHA20_POLY1305")) {
+			continue
+		}
+		if !supportsPreTLS13(suite) {
+			return nil, fmt.Errorf("cipher suite %s is only used with TLS 1.3, which isn't configurable", suite.Name)
+		}
+		if suite.Insecure && !inCipherSuiteGroup(suite.ID) && !*allowUnsafeSuites {
+			return nil, fmt.Errorf("cipher suite %s is unsafe, and requires --allow-unsafe-cipher-suites", suite.Name)
+		}
+		return suite, nil
+	}
+	return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+}
+
+// TLS 1.3 cipher suites can't be configured in Go.
+func supportsPreTLS13(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version < tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a cipher suite is in one of the built-in groups.
+func inCipherSuiteGroup(id uint16) bool {
+	for _, suites := range cipherSuites {
+		for _, suite := range suites {
+			if suite == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCipherSuiteGroups parses custom groups of cipher suites from
+// --cipher-suite-group flags (NAME=SUITE,SUITE,...), see cipherSuiteByName.
+func parseCipherSuiteGroups(groups []string) (map[string][]uint16, error) {
+	parsed := map[string][]uint16{}
+	for _, group := range groups {
+		name, list, ok := strings.Cut(group, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.Contains(name, ",") || list == "" {
+			return nil, fmt.Errorf("invalid cipher suite group '%s', should be NAME=SUITE,SUITE,...", group)
+		}
+		if _, ok := cipherSuites[name]; ok {
+			return nil, fmt.Errorf("cipher suite group %s is built in, and can't be redefined", name)
+		}
+		if _, ok := parsed[name]; ok {
+			return nil, fmt.Errorf("duplicate cipher suite group %s", name)
+		}
+		suites := []uint16{}
+		for _, suiteName := range strings.Split(list, ",") {
+			suite, err := cipherSuiteByName(suiteName)
+			if err != nil {
+				return nil, fmt.Errorf("%s, in group %s", err, name)
+			}
+			suites = append(suites, suite.ID)
+		}
+		parsed[name] = suites
+	}
+	return parsed, nil
+}
+
+// resolveCipherSuites returns the cipher suites to use, in order: either the
+// individual suites from --cipher-suite flags, or the suites in a
+// comma-separated list of groups, built in or defined with
+// --cipher-suite-group.
+func resolveCipherSuites(enabledCipherSuites string) ([]uint16, error) {
+	if *fipsOnly && !cipherSuitesSet {
+		// The default includes CHACHA, which isn't FIPS-approved.
+		enabledCipherSuites = "AES"
+	}
+
+	if len(*cipherSuiteNames) > 0 {
+		// Can't tell what order was meant when both are given.
+		if cipherSuitesSet {
+			return nil, errors.New("--cipher-suite can't be combined with --cipher-suites")
+		}
+		suites := []uint16{}
+		for _, name := range *cipherSuiteNames {
+			suite, err := cipherSuiteByName(name)
+			if err != nil {
+				return nil, err
+			}
+			suites = append(suites, suite.ID)
+		}
+		return checkFIPSCipherSuites(suites)
+	}
+
+	groups, err := parseCipherSuiteGroups(*cipherSuiteGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	suites := []uint16{}
+	for _, suite := range strings.Split(enabledCipherSuites, ",") {
+		ciphers, ok := cipherSuites[strings.TrimSpace(suite)]
+		if !ok {
+			ciphers, ok = groups[strings.TrimSpace(suite)]
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid cipher suite '%s' selected", suite)
+		}
+
+		suites = append(suites, ciphers...)
+	}
+	return checkFIPSCipherSuites(suites)
+}
+
 // Build reloadable certificate
 func buildCertificate(keystorePath, keystorePass string) (certloader.Certificate, error) {
 	if hasPKCS11() {
@@ -65,6 +197,9 @@ func buildCertificate(keystorePath, keystorePass string) (certloader.Certificate
 	if hasKeychainIdentity() {
 		return buildCertificateFromCertstore()
 	}
+	if hasSelfSigned() {
+		return buildSelfSignedCertificate()
+	}
 	if keystorePath != "" {
 		return certloader.CertificateFromKeystore(keystorePath, keystorePass)
 	}
@@ -72,13 +207,21 @@ func buildCertificate(keystorePath, keystorePass string) (certloader.Certificate
 }
 
 func buildCertificateFromPKCS11(certificatePath string) (certloader.Certificate, error) {
-	return certloader.CertificateFromPKCS11Module(certificatePath, *pkcs11Module, *pkcs11TokenLabel, *pkcs11PIN)
+	if hasPKCS11PINPad() {
+		logger.Printf("waiting for PIN entry on PIN pad of token '%s'", *pkcs11TokenLabel)
+		return certloader.CertificateFromPKCS11PINPad(certificatePath, *pkcs11Module, *pkcs11TokenLabel, *pkcs11PINTimeout, logger)
+	}
+	return certloader.CertificateFromPKCS11Module(certificatePath, *pkcs11Module, *pkcs11TokenLabel, *pkcs11PIN, logger)
 }
 
 func hasPKCS11() bool {
 	return pkcs11Module != nil && *pkcs11Module != ""
 }
 
+func hasPKCS11PINPad() bool {
+	return pkcs11PINPad != nil && *pkcs11PINPad
+}
+
 func buildCertificateFromCertstore() (certloader.Certificate, error) {
 	return certloader.CertificateFromKeychainIdentity(*keychainIdentity)
 }
@@ -87,9 +230,78 @@ func hasKeychainIdentity() bool {
 	return keychainIdentity != nil && *keychainIdentity != ""
 }
 
+func buildSelfSignedCertificate() (certloader.Certificate, error) {
+	cert, err := certloader.CertificateSelfSigned(*serverSelfSigned)
+	if err != nil {
+		return nil, err
+	}
+	leaf, _ := cert.GetCertificate(nil)
+	logger.Warnf("warning: using generated self-signed certificate for %s (SHA-256 fingerprint %X), this is insecure and only meant for testing",
+		strings.Join(*serverSelfSigned, ", "), sha256.Sum256(leaf.Certificate[0]))
+	return cert, nil
+}
+
+func hasSelfSigned() bool {
+	return serverSelfSigned != nil && len(*serverSelfSigned) > 0
+}
+
+// Build TLS config for the status port. It's independent of the config for
+// the data listener: it can use its own certificate (--status-keystore), and
+// require client certificates issued by its own CA (--status-cacert).
+func (context *Context) buildStatusConfig() (*tls.Config, error) {
+	caBundlePath := *caBundlePath
+	if *statusCABundle != "" {
+		caBundlePath = *statusCABundle
+	}
+	config, err := buildConfig(*enabledCipherSuites, caBundlePath)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.NoClientCert
+
+	cert := context.cert
+	if *statusKeystore != "" {
+		cert, err = certloader.CertificateFromKeystore(*statusKeystore, *statusStorePass)
+		if err != nil {
+			return nil, err
+		}
+		context.statusCert = cert
+	}
+	if cert != nil {
+		config.GetCertificate = cert.GetCertificate
+	}
+
+	if *statusCABundle != "" {
+		allowedURIs, err := wildcard.CompileList(*statusAllowURIs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URI pattern in --status-allow-uri flag (%s)", err)
+		}
+
+		statusACL := auth.ACL{
+			AllowAll:    len(*statusAllowCNs) == 0 && len(*statusAllowOUs) == 0 && len(*statusAllowDNSs) == 0 && len(allowedURIs) == 0,
+			AllowedCNs:  *statusAllowCNs,
+			AllowedOUs:  *statusAllowOUs,
+			AllowedDNSs: *statusAllowDNSs,
+			AllowedURIs: allowedURIs,
+			Logger:      logger,
+		}
+		chain, err := chainOptions(*statusCABundle, x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = auth.VerifyChain(*chain, statusACL.VerifyPeerCertificateServer)
+	}
+
+	return config, nil
+}
+
+// Read CA bundle into a cert pool. Without a CA bundle (or with --system-ca),
+// this returns nil: crypto/tls then verifies peers against the system trust
+// store, and servers don't send the (long) list of system CAs to clients.
 func caBundle(caBundlePath string) (*x509.CertPool, error) {
 	if caBundlePath == "" {
-		return x509.SystemCertPool()
+		return nil, nil
 	}
 
 	caBundleBytes, err := ioutil.ReadFile(caBundlePath)
@@ -98,6 +310,9 @@ func caBundle(caBundlePath string) (*x509.CertPool, error) {
 	}
 
 	bundle := x509.NewCertPool()
+	if *caIncludeSystem {
+		bundle = systemRoots()
+	}
 	ok := bundle.AppendCertsFromPEM(caBundleBytes)
 	if !ok {
 		return nil, errors.New("unable to read certificates from CA bundle")
@@ -106,6 +321,111 @@ func caBundle(caBundlePath string) (*x509.CertPool, error) {
 	return bundle, nil
 }
 
+// systemRoots returns a copy of the system trust store, for --ca-include-system.
+// Some platforms don't have one, in which case we warn and return an empty pool.
+func systemRoots() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		logger.Warnf("warning: unable to load system trust store, using only certificates from CA bundle: %v", err)
+		return x509.NewCertPool()
+	}
+	return pool
+}
+
+// readCABundle parses all certificates in a CA bundle file (PEM).
+func readCABundle(caBundlePath string) ([]*x509.Certificate, error) {
+	caBundleBytes, err := ioutil.ReadFile(caBundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, caBundleBytes = pem.Decode(caBundleBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("unable to read certificates from CA bundle")
+	}
+
+	return certs, nil
+}
+
+// chainOptions builds options to verify peer certificate chains against the
+// given CA bundle ourselves (see auth.VerifyChain), instead of in crypto/tls.
+// This lets us decide which certificates in the bundle are trust anchors
+// (--allow-partial-chain), and whether name constraints apply. Returns nil if
+// no CA bundle is set, in which case the system trust store is used. With
+// --ca-include-system, the system trust store is used in addition to the
+// anchors from the bundle.
+func chainOptions(caBundlePath string, keyUsage x509.ExtKeyUsage) (*auth.ChainOptions, error) {
+	if caBundlePath == "" {
+		return nil, nil
+	}
+
+	certs, err := readCABundle(caBundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	anchors, intermediates := auth.SplitBundle(certs, *allowPartialChain)
+	if len(anchors) == 0 && !*caIncludeSystem {
+		return nil, errors.New("CA bundle has no self-signed root certificates (use --allow-partial-chain to trust intermediates)")
+	}
+	if *ignoreConstraints {
+		anchors = auth.WithoutNameConstraints(anchors)
+	}
+
+	roots := x509.NewCertPool()
+	if *caIncludeSystem {
+		roots = systemRoots()
+	}
+	for _, cert := range anchors {
+		roots.AddCert(cert)
+	}
+
+	return &auth.ChainOptions{
+		Roots:                 roots,
+		Intermediates:         intermediates,
+		KeyUsage:              keyUsage,
+		IgnoreNameConstraints: *ignoreConstraints,
+		Logger:                logger,
+	}, nil
+}
+
+// applyClientHelloProfile changes the ClientHello a client config sends, for
+// --client-hello-profile. Go doesn't allow changing the order of cipher
+// suites or extensions, and never sends GREASE values, so profiles can only
+// change the offered versions, groups and ALPN protocols.
+func applyClientHelloProfile(config *tls.Config, profile string) {
+	switch profile {
+	case "browser":
+		// Offer TLS 1.2 and 1.3 only, the groups (and post-quantum hybrid
+		// key share) of current browsers, and ALPN unless already set.
+		config.MinVersion = tls.VersionTLS12
+		config.CurvePreferences = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = []string{"http/1.1"}
+		}
+	case "minimal":
+		// Offer TLS 1.2 and 1.3 only, and just two groups (with a single
+		// key share, without a post-quantum one).
+		config.MinVersion = tls.VersionTLS12
+		config.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256}
+	}
+}
+
 // buildConfig reads command-line options and builds a tls.Config
 func buildConfig(enabledCipherSuites string, caBundlePath string) (*tls.Config, error) {
 	ca, err := caBundle(caBundlePath)
@@ -117,22 +437,18 @@ func buildConfig(enabledCipherSuites string, caBundlePath string) (*tls.Config,
 	// * We list ECDSA ahead of RSA to prefer ECDSA for multi-cert setups.
 	// * We list AES-128 ahead of AES-256 for performance reasons.
 
-	suites := []uint16{}
-	for _, suite := range strings.Split(enabledCipherSuites, ",") {
-		ciphers, ok := cipherSuites[strings.TrimSpace(suite)]
-		if !ok {
-			return nil, fmt.Errorf("invalid cipher suite '%s' selected", suite)
-		}
-
-		suites = append(suites, ciphers...)
+	suites, err := resolveCipherSuites(enabledCipherSuites)
+	if err != nil {
+		return nil, err
 	}
 
-	return &tls.Config{
+	config := &tls.Config{
 		// Certificates
 		RootCAs:   ca,
 		ClientCAs: ca,
 
-		PreferServerCipherSuites: true,
+		// Ignored for TLS 1.3, where the client's preference always wins.
+		PreferServerCipherSuites: !*preferClientSuites,
 
 		ClientAuth:   tls.NoClientCert,
 		MinVersion:   tls.VersionTLS10,
@@ -144,5 +460,22 @@ func buildConfig(enabledCipherSuites string, caBundlePath string) (*tls.Config,
 			tls.CurveP384,
 			tls.CurveP521,
 		},
-	}, nil
+
+		KeyLogWriter: keyLogWriter,
+	}
+	applyFIPSOnly(config)
+	return config, nil
+}
+
+// Open the file for --keylog-file (or SSLKEYLOGFILE), appending to it if it
+// exists. Anyone who can read it can decrypt all traffic, so it's only
+// readable by us, and we warn about it.
+func openKeyLog(path string) (io.Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	logger.Warnf("warning: writing TLS session secrets for all connections to %s (--keylog-file or SSLKEYLOGFILE)", path)
+	logger.Warnf("warning: anyone with access to the key log file can decrypt all traffic, never use this in production")
+	return file, nil
 }
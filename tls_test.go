@@ -18,9 +18,14 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 
@@ -207,6 +212,165 @@ func TestCipherSuitePreference(t *testing.T) {
 	conf, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
 	assert.Nil(t, err, "should be able to build TLS config")
 	assert.True(t, conf.CipherSuites[0] == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, "expecting AES")
+	assert.True(t, conf.PreferServerCipherSuites, "should prefer our cipher suite order by default")
+
+	*preferClientSuites = true
+	defer func() { *preferClientSuites = false }()
+	conf, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.False(t, conf.PreferServerCipherSuites, "should respect client cipher suite order with --prefer-client-cipher-suites")
+}
+
+func TestCipherSuiteGroups(t *testing.T) {
+	tmpCaBundle, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+
+	tmpCaBundle.WriteString(testCertificate)
+	tmpCaBundle.WriteString("\n")
+
+	tmpCaBundle.Sync()
+	defer os.Remove(tmpCaBundle.Name())
+
+	*cipherSuiteGroups = []string{"ECDSA=TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305"}
+	defer func() { *cipherSuiteGroups = nil }()
+	conf, err := buildConfig("ECDSA,AES", tmpCaBundle.Name())
+	assert.Nil(t, err, "should be able to build TLS config with custom group")
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}, conf.CipherSuites[:2], "expecting custom group first")
+	assert.Equal(t, 6, len(conf.CipherSuites), "expecting custom group and AES")
+
+	for _, invalid := range [][]string{
+		{"ECDSA"},
+		{"=TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		{"ECDSA="},
+		{"ECDSA=TLS_NOT_A_CIPHER"},
+		{"ECDSA=TLS_AES_128_GCM_SHA256"},
+		{"ECDSA=TLS_ECDHE_RSA_WITH_RC4_128_SHA"},
+		{"AES=TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		{"ECDSA=TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "ECDSA=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+	} {
+		*cipherSuiteGroups = invalid
+		_, err = buildConfig("AES", tmpCaBundle.Name())
+		assert.NotNil(t, err, "should reject invalid cipher suite group %v", invalid)
+	}
+}
+
+func TestCipherSuiteNames(t *testing.T) {
+	tmpCaBundle, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+
+	tmpCaBundle.WriteString(testCertificate)
+	tmpCaBundle.WriteString("\n")
+
+	tmpCaBundle.Sync()
+	defer os.Remove(tmpCaBundle.Name())
+
+	*cipherSuiteNames = []string{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}
+	defer func() { *cipherSuiteNames = nil }()
+	conf, err := buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.Nil(t, err, "should be able to build TLS config with individual cipher suites")
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, conf.CipherSuites, "expecting exactly the given cipher suites, in order")
+
+	*cipherSuiteNames = []string{"TLS_NOT_A_CIPHER"}
+	_, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.NotNil(t, err, "should reject unknown cipher suite")
+
+	// Unsafe cipher suites that aren't in the built-in groups are gated.
+	*cipherSuiteNames = []string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"}
+	_, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.NotNil(t, err, "should reject unsafe cipher suite")
+
+	*cipherSuiteNames = []string{"TLS_RSA_WITH_3DES_EDE_CBC_SHA"}
+	_, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.Nil(t, err, "should accept insecure cipher suite from built-in groups")
+
+	*allowUnsafeSuites = true
+	defer func() { *allowUnsafeSuites = false }()
+	*cipherSuiteNames = []string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"}
+	conf, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.Nil(t, err, "should accept unsafe cipher suite with --allow-unsafe-cipher-suites")
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA}, conf.CipherSuites, "expecting unsafe cipher suite")
+
+	cipherSuitesSet = true
+	defer func() { cipherSuitesSet = false }()
+	_, err = buildConfig("AES,CHACHA", tmpCaBundle.Name())
+	assert.NotNil(t, err, "should reject --cipher-suite with --cipher-suites")
+}
+
+func TestKeyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.log")
+	ioutil.WriteFile(path, []byte("# existing\n"), 0600)
+	writer, err := openKeyLog(path)
+	assert.Nil(t, err, "should be able to open key log file")
+	defer writer.(io.Closer).Close()
+	writer.Write([]byte("CLIENT_RANDOM a b\n"))
+
+	contents, err := ioutil.ReadFile(path)
+	assert.Nil(t, err, "should be able to read key log file")
+	assert.Equal(t, "# existing\nCLIENT_RANDOM a b\n", string(contents), "should append to key log file")
+
+	keyLogWriter = writer
+	defer func() { keyLogWriter = nil }()
+	conf, err := buildConfig("AES", "")
+	assert.Nil(t, err, "should be able to build TLS config")
+	assert.Equal(t, writer, conf.KeyLogWriter, "should write session secrets to key log file")
+
+	_, err = openKeyLog(filepath.Join(dir, "missing", "keys.log"))
+	assert.NotNil(t, err, "should fail if key log file can't be created")
+}
+
+// Returns the ClientHello sent by a client with the given config.
+func captureClientHello(t *testing.T, config *tls.Config) *tls.ClientHelloInfo {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	server := tls.Server(c2, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, errors.New("done")
+		},
+	})
+	go server.Handshake()
+
+	config.InsecureSkipVerify = true
+	tls.Client(c1, config).Handshake()
+	return <-hellos
+}
+
+func TestClientHelloProfile(t *testing.T) {
+	config, err := buildConfig("AES,CHACHA", "")
+	panicOnError(err)
+	applyClientHelloProfile(config, "default")
+	hello := captureClientHello(t, config)
+	assert.Contains(t, hello.SupportedVersions, uint16(tls.VersionTLS10), "default profile should offer old versions")
+	assert.Empty(t, hello.SupportedProtos, "default profile should not offer ALPN")
+
+	config, err = buildConfig("AES,CHACHA", "")
+	panicOnError(err)
+	applyClientHelloProfile(config, "browser")
+	hello = captureClientHello(t, config)
+	assert.Equal(t, []uint16{tls.VersionTLS13, tls.VersionTLS12}, hello.SupportedVersions, "browser profile should offer TLS 1.2 and 1.3")
+	assert.Equal(t, []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}, hello.SupportedCurves)
+	assert.Equal(t, []string{"http/1.1"}, hello.SupportedProtos, "browser profile should offer ALPN")
+
+	config, err = buildConfig("AES,CHACHA", "")
+	panicOnError(err)
+	config.NextProtos = []string{multiplexProtocol}
+	applyClientHelloProfile(config, "browser")
+	assert.Equal(t, []string{multiplexProtocol}, config.NextProtos, "browser profile should keep protocols")
+
+	config, err = buildConfig("AES,CHACHA", "")
+	panicOnError(err)
+	applyClientHelloProfile(config, "minimal")
+	hello = captureClientHello(t, config)
+	assert.Equal(t, []uint16{tls.VersionTLS13, tls.VersionTLS12}, hello.SupportedVersions, "minimal profile should offer TLS 1.2 and 1.3")
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, hello.SupportedCurves)
+	assert.Empty(t, hello.SupportedProtos)
 }
 
 func TestReload(t *testing.T) {
@@ -232,7 +396,122 @@ func TestBuildConfigSystemRoots(t *testing.T) {
 	}
 	conf, err := buildConfig("AES", "")
 	assert.Nil(t, err, "should be able to build TLS config")
-	assert.NotNil(t, conf.RootCAs, "config must have CA certs")
-	assert.NotNil(t, conf.ClientCAs, "config must have CA certs")
+	assert.Nil(t, conf.RootCAs, "config should leave CA certs unset to use system roots")
+	assert.Nil(t, conf.ClientCAs, "config should leave CA certs unset to use system roots")
 	assert.True(t, conf.MinVersion == tls.VersionTLS12, "must have correct TLS min version")
 }
+
+func TestBuildStatusConfig(t *testing.T) {
+	tmpKeystore, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+	tmpCaBundle, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+
+	tmpKeystore.Write(testKeystore)
+	tmpCaBundle.WriteString(testCertificate)
+	tmpCaBundle.WriteString("\n")
+
+	tmpKeystore.Sync()
+	tmpCaBundle.Sync()
+
+	defer os.Remove(tmpKeystore.Name())
+	defer os.Remove(tmpCaBundle.Name())
+
+	*caBundlePath = tmpCaBundle.Name()
+	defer func() {
+		*caBundlePath = ""
+		*statusKeystore = ""
+		*statusStorePass = ""
+		*statusCABundle = ""
+		*statusAllowCNs = nil
+	}()
+
+	// Without status TLS flags, no client certificates are required
+	context := &Context{}
+	conf, err := context.buildStatusConfig()
+	assert.Nil(t, err, "should be able to build status TLS config")
+	assert.Equal(t, tls.NoClientCert, conf.ClientAuth, "should not require client certificates by default")
+	assert.Nil(t, context.statusCert, "should not load separate status certificate by default")
+
+	// With its own keystore and CA, client certificates are required
+	*statusKeystore = tmpKeystore.Name()
+	*statusStorePass = testKeystorePassword
+	*statusCABundle = tmpCaBundle.Name()
+	*statusAllowCNs = []string{"prometheus"}
+	conf, err = context.buildStatusConfig()
+	assert.Nil(t, err, "should be able to build status TLS config")
+	assert.Equal(t, tls.RequireAnyClientCert, conf.ClientAuth, "should require client certificates with --status-cacert (verified by us)")
+	assert.NotNil(t, conf.VerifyPeerCertificate, "should check status ACL")
+	assert.NotNil(t, context.statusCert, "should load separate status certificate")
+
+	cert, err := conf.GetCertificate(nil)
+	assert.Nil(t, err, "should be able to get status certificate")
+	assert.NotNil(t, cert, "should have status certificate")
+
+	*statusKeystore = "does-not-exist"
+	_, err = context.buildStatusConfig()
+	assert.NotNil(t, err, "should fail with invalid status keystore")
+}
+
+func TestChainOptions(t *testing.T) {
+	tmpCaBundle, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+	tmpCaBundle.WriteString(testCertificate)
+	tmpCaBundle.WriteString("\n")
+	tmpCaBundle.Sync()
+	defer os.Remove(tmpCaBundle.Name())
+
+	opts, err := chainOptions("", x509.ExtKeyUsageClientAuth)
+	assert.Nil(t, err, "should not fail without CA bundle")
+	assert.Nil(t, opts, "should use default verification without CA bundle")
+
+	opts, err = chainOptions(tmpCaBundle.Name(), x509.ExtKeyUsageClientAuth)
+	assert.Nil(t, err, "should build chain options from CA bundle")
+	assert.Empty(t, opts.Intermediates, "self-signed cert should be an anchor")
+	assert.Equal(t, x509.ExtKeyUsageClientAuth, opts.KeyUsage)
+
+	*allowPartialChain = true
+	*ignoreConstraints = true
+	defer func() {
+		*allowPartialChain = false
+		*ignoreConstraints = false
+	}()
+	opts, err = chainOptions(tmpCaBundle.Name(), x509.ExtKeyUsageServerAuth)
+	assert.Nil(t, err, "should build chain options with partial chains")
+	assert.True(t, opts.IgnoreNameConstraints, "should ignore name constraints if set")
+
+	_, err = chainOptions("does-not-exist", x509.ExtKeyUsageClientAuth)
+	assert.NotNil(t, err, "should fail with invalid CA bundle")
+}
+
+func TestCAIncludeSystem(t *testing.T) {
+	system, err := x509.SystemCertPool()
+	if err != nil || system.Equal(x509.NewCertPool()) {
+		t.Skip("system trust store not available")
+	}
+
+	tmpCaBundle, err := ioutil.TempFile("", "ghostunnel-test")
+	panicOnError(err)
+	tmpCaBundle.WriteString(testCertificate)
+	tmpCaBundle.WriteString("\n")
+	tmpCaBundle.Sync()
+	defer os.Remove(tmpCaBundle.Name())
+
+	bundle, err := caBundle(tmpCaBundle.Name())
+	assert.Nil(t, err)
+	opts, err := chainOptions(tmpCaBundle.Name(), x509.ExtKeyUsageServerAuth)
+	assert.Nil(t, err)
+
+	*caIncludeSystem = true
+	defer func() { *caIncludeSystem = false }()
+
+	withSystem, err := caBundle(tmpCaBundle.Name())
+	assert.Nil(t, err, "should read CA bundle with system roots")
+	assert.False(t, withSystem.Equal(bundle), "should include system roots")
+	assert.False(t, withSystem.Equal(system), "should include CA bundle")
+
+	optsWithSystem, err := chainOptions(tmpCaBundle.Name(), x509.ExtKeyUsageServerAuth)
+	assert.Nil(t, err, "should build chain options with system roots")
+	assert.False(t, optsWithSystem.Roots.Equal(opts.Roots), "should include system roots")
+	assert.False(t, optsWithSystem.Roots.Equal(system), "should include CA bundle")
+}
@@ -25,10 +25,6 @@ import (
 
 var (
 	shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
-	refreshSignals  = []os.Signal{syscall.SIGUSR1}
-	syslogFlag      = app.Flag("syslog", "Send logs to syslog instead of stderr.").Bool()
+	refreshSignals  = []os.Signal{syscall.SIGUSR1, syscall.SIGHUP}
+	upgradeSignals  = []os.Signal{syscall.SIGUSR2}
 )
-
-func useSyslog() bool {
-	return *syslogFlag
-}
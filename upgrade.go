@@ -0,0 +1,323 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	ctx "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/proxy"
+	"github.com/Elbandi/ghostunnel/sockopt"
+)
+
+// Environment variables for handing listening sockets over to a new process
+// on upgrade. The PID of the old process guards against picking them up in
+// processes that merely inherited the environment.
+const (
+	upgradePIDEnv     = "GHOSTUNNEL_UPGRADE_PID"
+	upgradeSocketsEnv = "GHOSTUNNEL_UPGRADE_SOCKETS"
+	upgradeReadyEnv   = "GHOSTUNNEL_UPGRADE_READY_FD"
+)
+
+// How long to wait for the new process to start listening on upgrade, before
+// giving up and killing it.
+const upgradeTimeout = 1 * time.Minute
+
+// First file descriptor passed to a child with exec.Cmd.ExtraFiles.
+const extraFilesFirstFd = 3
+
+// Sockets passed in by the process we're upgrading from (nil if none).
+var inherited *inheritedSockets
+
+// upgradeSocket describes a listening socket passed to a new process: the
+// listen address from flags it belongs to, and what it's bound to, so that the
+// new process can check it got the right socket.
+type upgradeSocket struct {
+	Address string `json:"address"`
+	Network string `json:"network"`
+	Bound   string `json:"bound"`
+	Fd      int    `json:"fd"`
+}
+
+// socketSet tracks our listening sockets by listen address, to pass them on
+// to a new process on upgrade.
+type socketSet struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func (s *socketSet) add(address string, listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = map[string]net.Listener{}
+	}
+	s.listeners[address] = listener
+}
+
+func (s *socketSet) remove(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, address)
+}
+
+// files returns duplicates of the listening sockets, in order of address, and
+// their descriptions for the new process.
+func (s *socketSet) files() ([]*os.File, []upgradeSocket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addresses := []string{}
+	for address := range s.listeners {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	files := []*os.File{}
+	sockets := []upgradeSocket{}
+	for _, address := range addresses {
+		listener := s.listeners[address]
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("can't pass socket for %s to new process", address)
+		}
+		file, err := filer.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("can't pass socket for %s to new process: %s", address, err)
+		}
+		sockets = append(sockets, upgradeSocket{
+			Address: flagAddress(address),
+			Network: listener.Addr().Network(),
+			Bound:   listener.Addr().String(),
+			Fd:      extraFilesFirstFd + len(files),
+		})
+		files = append(files, file)
+	}
+	return files, sockets, nil
+}
+
+// keepSocketFiles stops UNIX listeners from removing their socket file on
+// close, once the new process took them over.
+func (s *socketSet) keepSocketFiles() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, listener := range s.listeners {
+		if unix, ok := listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// upgrade starts a new process from our executable (which may have been
+// replaced with a new version) with the same flags, and passes our listening
+// sockets on to it. It returns once the new process is listening, and both
+// processes accept connections on the sockets until we stop. If the new
+// process fails to start or doesn't get ready in time, it's killed and we keep
+// running as before.
+func (context *Context) upgrade() error {
+	if context.child != nil {
+		return errors.New("upgrades are not supported with --exec")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %s", err)
+	}
+
+	files, sockets, err := context.sockets.files()
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	encoded, err := json.Marshal(sockets)
+	if err != nil {
+		return err
+	}
+
+	ready, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWrite)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", upgradePIDEnv, os.Getpid()),
+		fmt.Sprintf("%s=%s", upgradeSocketsEnv, encoded),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, extraFilesFirstFd+len(files)))
+
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return fmt.Errorf("unable to start new process: %s", err)
+	}
+	go cmd.Wait()
+
+	logger.Printf("started new process %d from %s, waiting up to %s for it to listen", cmd.Process.Pid, executable, upgradeTimeout)
+	ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	_, err = ready.Read(make([]byte, 1))
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d didn't get ready (%s)", cmd.Process.Pid, err)
+	}
+	logger.Printf("new process %d is listening, handing over", cmd.Process.Pid)
+	return nil
+}
+
+// handOff stops accepting connections after a successful upgrade, and waits
+// for existing ones to drain up to the shutdown timeout. Unlike on shutdown,
+// status isn't set to draining, as the new process serves on the same sockets.
+func (context *Context) handOff(p *proxy.Proxy) {
+	context.sockets.keepSocketFiles()
+	if context.statusHTTP != nil {
+		go context.statusHTTP.Shutdown(ctx.Background())
+	}
+	context.stop(p)
+}
+
+// inheritedSockets are listening sockets passed in by the process we're
+// upgrading from, by listen address.
+type inheritedSockets struct {
+	from    int
+	sockets map[string]upgradeSocket
+	ready   *os.File
+}
+
+// inheritedSocketsFromEnv reads the sockets passed in on upgrade, if any. The
+// variables are cleared afterwards, so that child processes (with --exec)
+// don't pick them up.
+func inheritedSocketsFromEnv() (*inheritedSockets, error) {
+	pid := os.Getenv(upgradePIDEnv)
+	if pid == "" {
+		return nil, nil
+	}
+	defer os.Unsetenv(upgradePIDEnv)
+	defer os.Unsetenv(upgradeSocketsEnv)
+	defer os.Unsetenv(upgradeReadyEnv)
+
+	from, err := strconv.Atoi(pid)
+	if err != nil || from != os.Getppid() {
+		return nil, fmt.Errorf("sockets for upgrade were passed by process %s, not by our parent (%d)", pid, os.Getppid())
+	}
+
+	var sockets []upgradeSocket
+	err = json.Unmarshal([]byte(os.Getenv(upgradeSocketsEnv)), &sockets)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value: %s", upgradeSocketsEnv, err)
+	}
+	readyFd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil || readyFd < 0 {
+		return nil, fmt.Errorf("invalid %s value '%s'", upgradeReadyEnv, os.Getenv(upgradeReadyEnv))
+	}
+
+	s := &inheritedSockets{
+		from:    from,
+		sockets: map[string]upgradeSocket{},
+		ready:   os.NewFile(uintptr(readyFd), "upgrade-ready"),
+	}
+	for _, socket := range sockets {
+		s.sockets[socket.Address] = socket
+	}
+	return s, nil
+}
+
+func (s *inheritedSockets) has(address string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.sockets[address]
+	return ok
+}
+
+// listen builds a listener from the socket passed in for the given address,
+// and checks it's bound to the same address as in the old process.
+func (s *inheritedSockets) listen(address string) (net.Listener, error) {
+	socket := s.sockets[address]
+	delete(s.sockets, address)
+
+	file := os.NewFile(uintptr(socket.Fd), address)
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on socket for %s passed in on upgrade: %s", address, err)
+	}
+	listening, err := sockopt.IsListening(listener)
+	if err == nil && !listening {
+		listener.Close()
+		return nil, fmt.Errorf("socket for %s passed in on upgrade is not a listening socket", address)
+	}
+	if listener.Addr().Network() != socket.Network || listener.Addr().String() != socket.Bound {
+		listener.Close()
+		return nil, fmt.Errorf("socket for %s passed in on upgrade (fd:%d) is bound to %s:%s, expected %s:%s", address, socket.Fd,
+			listener.Addr().Network(), listener.Addr(), socket.Network, socket.Bound)
+	}
+	if unix, ok := listener.(*net.UnixListener); ok && strings.HasPrefix(address, "unix:") {
+		// We own the socket file now, as if we created it.
+		unix.SetUnlinkOnClose(true)
+	}
+	logger.Printf("using socket for %s passed in by process %d", address, s.from)
+	return listener, nil
+}
+
+// checkUnused fails if some of the sockets passed in weren't used by any
+// listen address, which means our flags don't match the old process.
+func (s *inheritedSockets) checkUnused() error {
+	if s == nil || len(s.sockets) == 0 {
+		return nil
+	}
+	unused := []string{}
+	for address, socket := range s.sockets {
+		unused = append(unused, address)
+		os.NewFile(uintptr(socket.Fd), address).Close()
+	}
+	sort.Strings(unused)
+	return fmt.Errorf("sockets for %s passed in on upgrade don't match any listen address", strings.Join(unused, ", "))
+}
+
+// notifyReady tells the old process we're listening, so that it can stop.
+func (s *inheritedSockets) notifyReady() {
+	if s == nil || s.ready == nil {
+		return
+	}
+	s.ready.Write([]byte("ready\n"))
+	s.ready.Close()
+	s.ready = nil
+}
@@ -0,0 +1,173 @@
+// +build !windows
+
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Simulate an upgrade, as if our parent had passed in the given sockets (with
+// the descriptions from socketSet.files, but duplicated descriptors), and a
+// pipe to notify it once ready. Returns the read end of that pipe.
+func setUpgradeEnv(t *testing.T, files []*os.File, sockets []upgradeSocket) *os.File {
+	for i, file := range files {
+		fd, err := syscall.Dup(int(file.Fd()))
+		assert.Nil(t, err, "should be able to duplicate file descriptor")
+		sockets[i].Fd = fd
+	}
+	encoded, err := json.Marshal(sockets)
+	panicOnError(err)
+
+	ready, readyWrite, err := os.Pipe()
+	panicOnError(err)
+	t.Cleanup(func() { ready.Close() })
+	fd, err := syscall.Dup(int(readyWrite.Fd()))
+	panicOnError(err)
+	readyWrite.Close()
+
+	t.Setenv(upgradePIDEnv, strconv.Itoa(os.Getppid()))
+	t.Setenv(upgradeSocketsEnv, string(encoded))
+	t.Setenv(upgradeReadyEnv, strconv.Itoa(fd))
+	return ready
+}
+
+func TestUpgradeSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghostunnel-test")
+	panicOnError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socket")
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer tcp.Close()
+	unix, err := listenUnix(path, socketOptions{uid: -1, gid: -1})
+	panicOnError(err)
+
+	set := socketSet{}
+	set.add("localhost:0", tcp)
+	set.add("unix:"+path, unix)
+	files, sockets, err := set.files()
+	assert.Nil(t, err, "should be able to pass on sockets")
+	defer closeFiles(files)
+	assert.Equal(t, "localhost:0", sockets[0].Address)
+	assert.Equal(t, tcp.Addr().String(), sockets[0].Bound)
+	assert.Equal(t, "unix", sockets[1].Network)
+
+	// The old process stops, but the socket file stays
+	set.keepSocketFiles()
+	unix.Close()
+	_, err = os.Stat(path)
+	assert.Nil(t, err, "should keep socket file once handed over")
+
+	ready := setUpgradeEnv(t, files, sockets)
+	s, err := inheritedSocketsFromEnv()
+	assert.Nil(t, err, "should read sockets passed in on upgrade")
+	_, ok := os.LookupEnv(upgradePIDEnv)
+	assert.False(t, ok, "should clear environment for child processes")
+
+	assert.True(t, s.has("localhost:0"))
+	assert.False(t, s.has("localhost:8080"))
+
+	listener, err := s.listen("localhost:0")
+	assert.Nil(t, err, "should listen on socket passed in")
+	assert.Equal(t, tcp.Addr().String(), listener.Addr().String(), "should listen on same address")
+	listener.Close()
+
+	listener, err = s.listen("unix:" + path)
+	assert.Nil(t, err, "should listen on socket passed in")
+	assert.Nil(t, s.checkUnused(), "should not fail once all sockets were used")
+
+	go func() {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	assert.Nil(t, err, "should accept connections on socket passed in")
+	conn.Close()
+	listener.Close()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "should remove socket file on close in new process")
+
+	s.notifyReady()
+	buf := make([]byte, 16)
+	n, err := ready.Read(buf)
+	assert.Nil(t, err, "should notify old process")
+	assert.Equal(t, "ready\n", string(buf[:n]))
+}
+
+func TestUpgradeSocketsMismatch(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer tcp.Close()
+
+	set := socketSet{}
+	set.add("localhost:0", tcp)
+	files, sockets, err := set.files()
+	panicOnError(err)
+	defer closeFiles(files)
+
+	// As if the descriptors got mixed up on the way
+	sockets[0].Bound = "127.0.0.1:1"
+	setUpgradeEnv(t, files, sockets)
+	s, err := inheritedSocketsFromEnv()
+	panicOnError(err)
+	_, err = s.listen("localhost:0")
+	assert.NotNil(t, err, "should reject socket bound to different address")
+}
+
+func TestUpgradeSocketsUnused(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnError(err)
+	defer tcp.Close()
+
+	set := socketSet{}
+	set.add("localhost:0", tcp)
+	files, sockets, err := set.files()
+	panicOnError(err)
+	defer closeFiles(files)
+
+	setUpgradeEnv(t, files, sockets)
+	s, err := inheritedSocketsFromEnv()
+	panicOnError(err)
+	assert.NotNil(t, s.checkUnused(), "should fail if sockets weren't used")
+}
+
+func TestUpgradeSocketsWrongParent(t *testing.T) {
+	t.Setenv(upgradePIDEnv, strconv.Itoa(os.Getpid()))
+	_, err := inheritedSocketsFromEnv()
+	assert.NotNil(t, err, "should reject sockets not passed in by parent")
+
+	s, err := inheritedSocketsFromEnv()
+	assert.Nil(t, err, "should not upgrade without sockets passed in")
+	assert.Nil(t, s)
+	assert.False(t, s.has("localhost:8080"), "should handle no upgrade")
+	assert.Nil(t, s.checkUnused(), "should handle no upgrade")
+	s.notifyReady()
+}
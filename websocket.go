@@ -0,0 +1,51 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/Elbandi/ghostunnel/websocket"
+)
+
+// Server config for the TLS connections carrying WebSockets, with
+// --websocket-mtls=inner. These only authenticate the server, clients are
+// authenticated on the TLS connection within the WebSocket.
+func websocketOuterConfig(config *tls.Config) *tls.Config {
+	outer := config.Clone()
+	outer.ClientAuth = tls.NoClientCert
+	outer.VerifyPeerCertificate = nil
+	outer.VerifyConnection = withFIPSCheck(nil)
+	outer.GetConfigForClient = nil
+	outer.NextProtos = []string{"http/1.1"}
+	return outer
+}
+
+// Open a WebSocket on a connection to the target, for --transport=websocket
+// (with client certificates checked on the connection itself).
+func openWebSocket(conn net.Conn, address string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(*timeoutDuration))
+	ws, err := websocket.Client(conn, address, *websocketPath)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
@@ -0,0 +1,283 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Opcodes, see RFC 6455, section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Maximum payload of control frames.
+const maxControlPayload = 125
+
+// Conn is a byte stream carried over a WebSocket (see Client and Upgrade).
+// Writes are sent as binary messages, and data from text or binary messages
+// is returned by reads. Pings are answered automatically.
+//
+// There is no half-close in WebSocket, so CloseWrite sends a close frame, and
+// a close frame from the peer is reported as EOF: data can still flow in the
+// other direction until that side closes as well.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	// Whether we're the client (which masks frames it sends).
+	client bool
+
+	// Read state, only used by the reading goroutine: bytes left in the
+	// current (data) frame, and its masking key and offset.
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	readErr   error
+
+	// Mutex for writing frames, as control frames are sent while reading.
+	writeMu     sync.Mutex
+	writeClosed bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool) *Conn {
+	return &Conn{Conn: conn, reader: reader, client: client}
+}
+
+// NetConn returns the connection the WebSocket runs on.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Read reads data from messages sent by the peer.
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	c.remaining -= int64(n)
+	if c.masked {
+		c.unmask(b[:n])
+	}
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Read the header of the next frame. Control frames are handled right away,
+// data frames are read by Read.
+func (c *Conn) nextFrame() error {
+	// The underlying connection closing between frames is treated as EOF,
+	// like a close frame.
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if header[0]&0x70 != 0 {
+		return c.fail(1002, "reserved bits set in frame")
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&0x80 != 0
+	if c.masked == c.client {
+		if c.client {
+			return c.fail(1002, "server sent masked frame")
+		}
+		return c.fail(1002, "client sent unmasked frame")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+		if length < 0 {
+			return c.fail(1002, "invalid frame length")
+		}
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+		c.maskPos = 0
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+	default:
+		return c.fail(1002, fmt.Sprintf("unknown opcode 0x%x", opcode))
+	}
+
+	if length > maxControlPayload || header[0]&0x80 == 0 {
+		return c.fail(1002, "invalid control frame")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	if c.masked {
+		c.unmask(payload)
+	}
+	switch opcode {
+	case opClose:
+		return io.EOF
+	case opPing:
+		if err := c.writeFrame(opPong, payload); err != nil && err != errWriteClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) unmask(b []byte) {
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % 4
+	}
+}
+
+// Send a close frame for a protocol error, and return it as error.
+func (c *Conn) fail(code uint16, reason string) error {
+	c.sendClose(code)
+	return fmt.Errorf("websocket protocol error: %s", reason)
+}
+
+var errWriteClosed = errors.New("websocket: write after close")
+
+// Write sends data as a binary message.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Write a single (final) frame, masked if we're the client.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	if c.writeClosed {
+		return errWriteClosed
+	}
+	if opcode == opClose {
+		c.writeClosed = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Send a close frame with the given status code, if we haven't yet.
+func (c *Conn) sendClose(code uint16) error {
+	err := c.writeFrame(opClose, closePayload(code))
+	if err == errWriteClosed {
+		return nil
+	}
+	return err
+}
+
+func closePayload(code uint16) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	return payload
+}
+
+// CloseWrite sends a close frame. Nothing can be written afterwards, but data
+// from the peer can still be read until it closes as well.
+func (c *Conn) CloseWrite() error {
+	return c.sendClose(1000)
+}
+
+// How long Close waits for the close frame to be sent.
+const closeTimeout = time.Second
+
+// Close sends a close frame (unless CloseWrite was called), and closes the
+// underlying connection. The close frame is skipped if a write is blocked,
+// as Close is how blocked writes get unblocked.
+func (c *Conn) Close() error {
+	if c.writeMu.TryLock() {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		c.writeFrameLocked(opClose, closePayload(1000))
+		c.writeMu.Unlock()
+	}
+	return c.Conn.Close()
+}
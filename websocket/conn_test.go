@@ -0,0 +1,139 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the client and server ends of a WebSocket over an in-memory
+// connection, without going through the upgrade.
+func connPair(t *testing.T) (*Conn, *Conn) {
+	c1, c2 := net.Pipe()
+	client, server := newConn(c1, bufio.NewReader(c1), true), newConn(c2, bufio.NewReader(c2), false)
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return client, server
+}
+
+// Returns a server end of a WebSocket, and the raw connection to its peer.
+func rawPair(t *testing.T) (*Conn, net.Conn) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return newConn(c2, bufio.NewReader(c2), false), c1
+}
+
+// A masked frame, as sent by clients.
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestRoundTrip(t *testing.T) {
+	client, server := connPair(t)
+
+	// Sizes for each payload length encoding.
+	for _, size := range []int{1, 125, 126, 70000} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		go client.Write(data)
+		received := make([]byte, size)
+		_, err := io.ReadFull(server, received)
+		assert.Nil(t, err, "should read from client")
+		assert.True(t, bytes.Equal(data, received), "should receive what client sent (%d bytes)", size)
+
+		go server.Write(data)
+		_, err = io.ReadFull(client, received)
+		assert.Nil(t, err, "should read from server")
+		assert.True(t, bytes.Equal(data, received), "should receive what server sent (%d bytes)", size)
+	}
+}
+
+func TestPingAnswered(t *testing.T) {
+	server, raw := rawPair(t)
+
+	go func() {
+		raw.Write(maskedFrame(opPing, []byte("ping")))
+		raw.Write(maskedFrame(opBinary, []byte("data")))
+	}()
+	read := make(chan []byte)
+	go func() {
+		buf := make([]byte, 4)
+		io.ReadFull(server, buf)
+		read <- buf
+	}()
+
+	pong := make([]byte, 6)
+	_, err := io.ReadFull(raw, pong)
+	assert.Nil(t, err, "should get pong")
+	assert.Equal(t, []byte{0x80 | opPong, 4, 'p', 'i', 'n', 'g'}, pong)
+	assert.Equal(t, []byte("data"), <-read, "should read data after ping")
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server := connPair(t)
+
+	go client.CloseWrite()
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "close frame should be EOF")
+
+	_, err = client.Write([]byte("late"))
+	assert.Equal(t, errWriteClosed, err, "should not write after close frame")
+
+	// The other direction still works.
+	go server.Write([]byte("reply"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	assert.Nil(t, err, "should read after sending close frame")
+	assert.Equal(t, []byte("reply"), buf)
+}
+
+func TestUnmaskedFrameRejected(t *testing.T) {
+	server, raw := rawPair(t)
+
+	go raw.Write([]byte{0x80 | opBinary, 4, 'd', 'a', 't', 'a'})
+	failed := make(chan error)
+	go func() {
+		_, err := server.Read(make([]byte, 4))
+		failed <- err
+	}()
+
+	// Close frame with status 1002 (protocol error).
+	closeFrame := make([]byte, 4)
+	_, err := io.ReadFull(raw, closeFrame)
+	assert.Nil(t, err, "should get close frame")
+	assert.Equal(t, []byte{0x80 | opClose, 2, 0x03, 0xea}, closeFrame)
+	assert.NotNil(t, <-failed, "should fail on unmasked frame")
+}
@@ -0,0 +1,287 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GUID for computing Sec-WebSocket-Accept, see RFC 6455, section 1.3.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrNotWebSocket is returned by Upgrade for requests that aren't WebSocket
+// requests for the expected path, which get a 404 response.
+var ErrNotWebSocket = errors.New("not a WebSocket request")
+
+// Client opens a WebSocket on an established connection (e.g. a TLS
+// connection for wss://), by sending an upgrade request for path to host.
+func Client(conn net.Conn, host, path string) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: path},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+			"User-Agent":            {"ghostunnel"},
+		},
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WebSocket upgrade response: %s", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket upgrade for %s rejected with %s", path, response.Status)
+	}
+	if !headerContains(response.Header, "Upgrade", "websocket") || !headerContains(response.Header, "Connection", "upgrade") {
+		return nil, errors.New("invalid WebSocket upgrade response, missing Upgrade or Connection header")
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("invalid WebSocket upgrade response, wrong Sec-WebSocket-Accept")
+	}
+	return newConn(conn, reader, true), nil
+}
+
+// Upgrade reads an upgrade request from a client, and opens a WebSocket if
+// it's a valid WebSocket request for path. Other requests get an error
+// response (404 if they aren't WebSocket requests for path, see
+// ErrNotWebSocket), and an error is returned.
+func Upgrade(conn net.Conn, path string) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		writeResponse(conn, http.StatusBadRequest, nil)
+		return nil, fmt.Errorf("error reading WebSocket upgrade request: %s", err)
+	}
+
+	isWebSocket := request.Method == http.MethodGet &&
+		headerContains(request.Header, "Upgrade", "websocket") &&
+		headerContains(request.Header, "Connection", "upgrade")
+	if !isWebSocket || request.URL.Path != path {
+		writeResponse(conn, http.StatusNotFound, nil)
+		return nil, fmt.Errorf("%w (%s %s)", ErrNotWebSocket, request.Method, request.URL.Path)
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		writeResponse(conn, http.StatusUpgradeRequired, http.Header{"Sec-WebSocket-Version": {"13"}})
+		return nil, fmt.Errorf("unsupported WebSocket version '%s'", request.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		writeResponse(conn, http.StatusBadRequest, nil)
+		return nil, errors.New("invalid Sec-WebSocket-Key in WebSocket upgrade request")
+	}
+
+	err = writeResponse(conn, http.StatusSwitchingProtocols, http.Header{
+		"Upgrade":              {"websocket"},
+		"Connection":           {"Upgrade"},
+		"Sec-WebSocket-Accept": {acceptKey(key)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newConn(conn, reader, false), nil
+}
+
+func writeResponse(w io.Writer, status int, header http.Header) error {
+	response := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if status != http.StatusSwitchingProtocols {
+		// Not a WebSocket, we close the connection right after.
+		response.Close = true
+	}
+	return response.Write(w)
+}
+
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Check if a header has the given token (case-insensitive), in any of its
+// comma-separated values.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NetDialer connects to an address, like net.Dialer.
+type NetDialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// Dialer opens WebSockets to an address, returning connections once the
+// WebSocket is established.
+type Dialer struct {
+	// Dialer used to connect to the address.
+	Dialer NetDialer
+	// TLSConfig for connecting with TLS (wss://), nil for plain WebSockets.
+	TLSConfig *tls.Config
+	// Path to request.
+	Path string
+	// Timeout for the TLS handshake and the upgrade (zero for no timeout).
+	Timeout time.Duration
+}
+
+// Dial connects to the address, and opens a WebSocket on it.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	if d.TLSConfig != nil {
+		tlsConn := tls.Client(conn, d.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake for WebSocket with %s failed: %s", address, err)
+		}
+		conn = tlsConn
+	}
+	ws, err := Client(conn, address, d.Path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// NewListener returns a listener whose connections carry WebSockets for the
+// given path. The upgrade happens on first read or write (or handshake,
+// for TLS on top), so that Accept doesn't block on slow clients. Requests
+// that aren't WebSocket requests for path get an error response, and the
+// read or write fails.
+func NewListener(listener net.Listener, path string) net.Listener {
+	return &upgradeListener{Listener: listener, path: path}
+}
+
+type upgradeListener struct {
+	net.Listener
+	path string
+}
+
+func (l *upgradeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &upgradeConn{Conn: conn, path: l.path}, nil
+}
+
+// A connection that's upgraded to a WebSocket when first used.
+type upgradeConn struct {
+	net.Conn
+	path string
+
+	once sync.Once
+	mu   sync.Mutex
+	ws   *Conn
+	err  error
+}
+
+func (c *upgradeConn) upgrade() (*Conn, error) {
+	c.once.Do(func() {
+		ws, err := Upgrade(c.Conn, c.path)
+		c.mu.Lock()
+		c.ws, c.err = ws, err
+		c.mu.Unlock()
+	})
+	return c.ws, c.err
+}
+
+func (c *upgradeConn) Read(b []byte) (int, error) {
+	ws, err := c.upgrade()
+	if err != nil {
+		return 0, err
+	}
+	return ws.Read(b)
+}
+
+func (c *upgradeConn) Write(b []byte) (int, error) {
+	ws, err := c.upgrade()
+	if err != nil {
+		return 0, err
+	}
+	return ws.Write(b)
+}
+
+// NetConn returns the connection the WebSocket runs on.
+func (c *upgradeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite sends a close frame, if the WebSocket is open.
+func (c *upgradeConn) CloseWrite() error {
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+	if ws == nil {
+		return c.Conn.Close()
+	}
+	return ws.CloseWrite()
+}
+
+func (c *upgradeConn) Close() error {
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+	if ws == nil {
+		return c.Conn.Close()
+	}
+	return ws.Close()
+}
@@ -0,0 +1,136 @@
+/*-
+ * Copyright 2019 Square Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455, section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestClientUpgrade(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	upgraded := make(chan *Conn)
+	go func() {
+		server, err := Upgrade(c2, "/tunnel")
+		assert.Nil(t, err, "should upgrade")
+		upgraded <- server
+	}()
+
+	client, err := Client(c1, "example.com:443", "/tunnel")
+	assert.Nil(t, err, "should open WebSocket")
+	server := <-upgraded
+	if client == nil || server == nil {
+		t.FailNow()
+	}
+
+	go client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	assert.Nil(t, err, "should read from client")
+	assert.Equal(t, []byte("hello"), buf)
+}
+
+// Send a raw request to Upgrade, and return the response status and error.
+func upgradeRequest(t *testing.T, request string) (int, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := Upgrade(c2, "/tunnel")
+		failed <- err
+	}()
+
+	go io.WriteString(c1, request)
+	response, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	assert.Nil(t, err, "should get response")
+	return response.StatusCode, <-failed
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	websocketHeaders := "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+
+	status, err := upgradeRequest(t, "GET /other HTTP/1.1\r\nHost: example.com\r\n"+websocketHeaders+"Sec-WebSocket-Version: 13\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, status, "other paths should get 404")
+	assert.True(t, errors.Is(err, ErrNotWebSocket), "other paths should be rejected")
+
+	status, err = upgradeRequest(t, "GET /tunnel HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Equal(t, http.StatusNotFound, status, "non-WebSocket requests should get 404")
+	assert.True(t, errors.Is(err, ErrNotWebSocket), "non-WebSocket requests should be rejected")
+
+	status, err = upgradeRequest(t, "GET /tunnel HTTP/1.1\r\nHost: example.com\r\n"+websocketHeaders+"Sec-WebSocket-Version: 8\r\n\r\n")
+	assert.Equal(t, http.StatusUpgradeRequired, status, "other versions should get 426")
+	assert.NotNil(t, err, "other versions should be rejected")
+}
+
+func TestClientRejected(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		http.ReadRequest(bufio.NewReader(c2))
+		io.WriteString(c2, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	_, err := Client(c1, "example.com:443", "/tunnel")
+	assert.NotNil(t, err, "should fail if upgrade is rejected")
+	assert.True(t, strings.Contains(err.Error(), "404"), "error should have status")
+}
+
+func TestListenerAndDialer(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err, "should listen")
+	listener := NewListener(tcp, "/tunnel")
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	dialer := &Dialer{Dialer: &net.Dialer{}, Path: "/tunnel"}
+	conn, err := dialer.Dial("tcp", tcp.Addr().String())
+	assert.Nil(t, err, "should dial WebSocket")
+	defer conn.Close()
+
+	go conn.Write([]byte("echo"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err, "should read echo")
+	assert.Equal(t, []byte("echo"), buf)
+}
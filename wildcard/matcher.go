@@ -107,6 +107,8 @@ func CompileWithSeparator(pattern string, separator rune) (Matcher, error) {
 	}
 
 	segments := strings.Split(pattern, string(separator))
+	// Separator may be a regex meta char itself (e.g. '.' for host names)
+	quotedSeparator := regexp.QuoteMeta(string(separator))
 
 	var regex bytes.Buffer
 	regex.WriteString("^")
@@ -117,7 +119,7 @@ loop:
 		case "*":
 			// Segment with wildcard
 			regex.WriteString("[^")
-			regex.WriteRune(separator)
+			regex.WriteString(quotedSeparator)
 			regex.WriteString("]+")
 		case "**":
 			// Segment with double wildcard
@@ -126,7 +128,7 @@ loop:
 				return nil, errInvalidDoubleWildcard
 			}
 			regex.WriteString("?(|")
-			regex.WriteRune(separator)
+			regex.WriteString(quotedSeparator)
 			regex.WriteString(".*)$")
 			break loop
 		default:
@@ -138,7 +140,7 @@ loop:
 		}
 
 		// Separate this segment from next one
-		regex.WriteRune(separator)
+		regex.WriteString(quotedSeparator)
 
 		if i == len(segments)-1 {
 			// Final slash should be optional
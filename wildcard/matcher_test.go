@@ -256,6 +256,35 @@ func TestMatchingWithMetaChars(t *testing.T) {
 		})
 }
 
+func TestMatchingWithMetaCharSeparator(t *testing.T) {
+	// The '.' separator should not be interpreted as a regex char
+	for pattern, cases := range map[string][2][]string{
+		"api.internal": {
+			{"api.internal"},
+			{"apixinternal", "a.api.internal"},
+		},
+		"*.internal": {
+			{"a.internal", "api.internal"},
+			{"a.b.internal", "internal", "axinternal"},
+		},
+	} {
+		m, err := CompileWithSeparator(pattern, '.')
+		if err != nil {
+			t.Fatalf("unable to compile pattern '%s': %s", pattern, err)
+		}
+		for _, input := range cases[0] {
+			if !m.Matches(input) {
+				t.Errorf("pattern '%s' should match '%s'", pattern, input)
+			}
+		}
+		for _, input := range cases[1] {
+			if m.Matches(input) {
+				t.Errorf("pattern '%s' should not match '%s'", pattern, input)
+			}
+		}
+	}
+}
+
 func TestInvalidPatterns(t *testing.T) {
 	for _, pattern := range []string{
 		"",
@@ -25,8 +25,5 @@ import (
 var (
 	shutdownSignals = []os.Signal{os.Interrupt}
 	refreshSignals  = []os.Signal{ /* Not supported on Windows */ }
+	upgradeSignals  = []os.Signal{ /* Not supported on Windows */ }
 )
-
-func useSyslog() bool {
-	return false
-}